@@ -1,6 +1,7 @@
 package go_ciba
 
 import (
+	"context"
 	"log"
 
 	"github.com/adisazhar123/go-ciba/grant"
@@ -12,8 +13,9 @@ import (
 type AuthorizationServerInterface interface {
 	AddGrant(grant grant.GrantTypeInterface)
 	AddService(grantService service.GrantServiceInterface)
-	HandleCibaRequest(request *service.AuthenticationRequest) (*service.AuthenticationResponse, *util.OidcError)
-	HandleConsentRequest(request *service.ConsentRequest) *util.OidcError
+	HandleCibaRequest(ctx context.Context, request *service.AuthenticationRequest) (*service.AuthenticationResponse, *util.OidcError)
+	HandleConsentRequest(ctx context.Context, request *service.ConsentRequest) *util.OidcError
+	HandleCancellationRequest(ctx context.Context, request *service.CancellationRequest) *util.OidcError
 }
 
 type authorizationServer struct {
@@ -36,7 +38,7 @@ func (as *authorizationServer) AddService(gs service.GrantServiceInterface) {
 	}
 }
 
-func (as *authorizationServer) HandleCibaRequest(request *service.AuthenticationRequest) (*service.AuthenticationResponse, *util.OidcError) {
+func (as *authorizationServer) HandleCibaRequest(ctx context.Context, request *service.AuthenticationRequest) (*service.AuthenticationResponse, *util.OidcError) {
 	if _, exist := as.grantServices[grant.IdentifierCiba]; !exist {
 		return nil, util.ErrGeneral
 	}
@@ -44,10 +46,10 @@ func (as *authorizationServer) HandleCibaRequest(request *service.Authentication
 	if !ok {
 		return nil, util.ErrGeneral
 	}
-	return cs.HandleAuthenticationRequest(request)
+	return cs.HandleAuthenticationRequest(ctx, request)
 }
 
-func (as *authorizationServer) HandleConsentRequest(request *service.ConsentRequest) *util.OidcError {
+func (as *authorizationServer) HandleConsentRequest(ctx context.Context, request *service.ConsentRequest) *util.OidcError {
 	if _, exist := as.grantServices[grant.IdentifierCiba]; !exist {
 		return util.ErrGeneral
 	}
@@ -55,5 +57,16 @@ func (as *authorizationServer) HandleConsentRequest(request *service.ConsentRequ
 	if !ok {
 		return util.ErrGeneral
 	}
-	return cs.HandleConsentRequest(request)
+	return cs.HandleConsentRequest(ctx, request)
+}
+
+func (as *authorizationServer) HandleCancellationRequest(ctx context.Context, request *service.CancellationRequest) *util.OidcError {
+	if _, exist := as.grantServices[grant.IdentifierCiba]; !exist {
+		return util.ErrGeneral
+	}
+	cs, ok := as.grantServices[grant.IdentifierCiba].(service.CibaServiceInterface)
+	if !ok {
+		return util.ErrGeneral
+	}
+	return cs.HandleCancellationRequest(ctx, request)
 }
@@ -0,0 +1,132 @@
+package go_ciba
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+const defaultConsentLinkConfirmTemplate = `<!DOCTYPE html>
+<html>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<p>{{if .Consented}}Approve{{else}}Deny{{end}} the sign-in request?</p>
+<button type="submit">{{if .Consented}}Approve{{else}}Deny{{end}}</button>
+</form>
+</body>
+</html>
+`
+
+const defaultConsentLinkResultTemplate = `<!DOCTYPE html>
+<html>
+<body>
+{{if .Error}}<p>This link can no longer be used, the sign-in request was already answered or has expired.</p>
+{{else if .Consented}}<p>The sign-in request was approved, you can close this page.</p>
+{{else}}<p>The sign-in request was denied, you can close this page.</p>
+{{end}}</body>
+</html>
+`
+
+type ConsentLinkHandlerConfig struct {
+	// Shown when a link is opened, submitting its form gives the consent.
+	ConfirmTemplate *template.Template
+	// Shown once the consent was given, or when it couldn't be.
+	ResultTemplate *template.Template
+}
+
+func NewConsentLinkHandlerConfig() *ConsentLinkHandlerConfig {
+	return &ConsentLinkHandlerConfig{
+		ConfirmTemplate: template.Must(template.New("confirm").Parse(defaultConsentLinkConfirmTemplate)),
+		ResultTemplate:  template.Must(template.New("result").Parse(defaultConsentLinkResultTemplate)),
+	}
+}
+
+// What the confirm template is executed with.
+type ConsentLinkConfirmPage struct {
+	Token     string
+	Consented bool
+}
+
+// What the result template is executed with, Error is nil when the consent was given.
+type ConsentLinkResultPage struct {
+	Consented bool
+	Error     *util.OidcError
+}
+
+// Serves the approve and deny links of consent prompts sent by email. Opening a link only shows a
+// confirmation page, the consent is given when it's submitted, so mail scanners fetching the
+// links don't give it.
+type consentLinkHandler struct {
+	consentService service.TrustedConsentServiceInterface
+	links          *transport.ConsentLinkSigner
+	config         *ConsentLinkHandlerConfig
+}
+
+func NewConsentLinkHandler(consentService service.TrustedConsentServiceInterface, links *transport.ConsentLinkSigner) *consentLinkHandler {
+	return NewCustomConsentLinkHandler(consentService, links, NewConsentLinkHandlerConfig())
+}
+
+func NewCustomConsentLinkHandler(consentService service.TrustedConsentServiceInterface, links *transport.ConsentLinkSigner, config *ConsentLinkHandlerConfig) *consentLinkHandler {
+	return &consentLinkHandler{
+		consentService: consentService,
+		links:          links,
+		config:         config,
+	}
+}
+
+func (h *consentLinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	token := r.FormValue("token")
+	link, err := h.links.Verify(token)
+	if err != nil {
+		h.render(w, http.StatusBadRequest, h.config.ResultTemplate, &ConsentLinkResultPage{
+			Error: util.ErrInvalidToken,
+		})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		h.render(w, http.StatusOK, h.config.ConfirmTemplate, &ConsentLinkConfirmPage{
+			Token:     token,
+			Consented: link.Consented,
+		})
+		return
+	}
+
+	consented := link.Consented
+	if oidcErr := h.consentService.HandleTrustedConsentRequest(r.Context(), service.NewConsentRequest(link.AuthReqId, &consented)); oidcErr != nil {
+		// The token endpoint status codes don't mean anything to a browser.
+		status := http.StatusBadRequest
+		if oidcErr.Code >= http.StatusInternalServerError {
+			status = oidcErr.Code
+		}
+		h.render(w, status, h.config.ResultTemplate, &ConsentLinkResultPage{
+			Consented: consented,
+			Error:     oidcErr,
+		})
+		return
+	}
+	h.render(w, http.StatusOK, h.config.ResultTemplate, &ConsentLinkResultPage{
+		Consented: consented,
+	})
+}
+
+func (h *consentLinkHandler) render(w http.ResponseWriter, status int, tmpl *template.Template, data interface{}) {
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("[go-ciba][consentlinkhandler] failed rendering %s. %s\n", tmpl.Name(), err.Error())
+	}
+}
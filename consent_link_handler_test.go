@@ -0,0 +1,107 @@
+package go_ciba
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+)
+
+type silentUserNotifier struct{}
+
+func (s silentUserNotifier) NotifyUser(ctx context.Context, prompt *transport.UserConsentPrompt) error {
+	return nil
+}
+
+func newTestConsentLinkHandler(t *testing.T) (*consentLinkHandler, *memory.DataStore, *transport.ConsentLinkSigner, *domain.CibaSession) {
+	ds := memory.NewDataStore()
+	ds.AddUserAccount(&test_data.User1)
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPoll)
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "W4SCT", "", "openid", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+	links, err := transport.NewConsentLinkSigner([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := service.NewCibaService(ds, &silentUserNotifier{}, grant.NewCibaGrant(), func(token string) bool { return true })
+	return NewConsentLinkHandler(cs, links), ds, links, cibaSession
+}
+
+func submitConsentLink(h http.Handler, token string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	form.Set("token", token)
+	req := httptest.NewRequest(http.MethodPost, "/consent", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func TestConsentLinkHandler_Get_ShouldOnlyShowConfirmation(t *testing.T) {
+	h, ds, links, cibaSession := newTestConsentLinkHandler(t)
+	token, _ := links.Sign(cibaSession.AuthReqId, true, time.Minute)
+	res := httptest.NewRecorder()
+
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/consent?token="+token, nil))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `<form method="post">`)
+	assert.Contains(t, res.Body.String(), token)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+	assert.True(t, stored.IsAuthorizationPending())
+}
+
+func TestConsentLinkHandler_Post_ShouldApproveOnce(t *testing.T) {
+	h, ds, links, cibaSession := newTestConsentLinkHandler(t)
+	approve, _ := links.Sign(cibaSession.AuthReqId, true, time.Minute)
+	deny, _ := links.Sign(cibaSession.AuthReqId, false, time.Minute)
+
+	approveRes := submitConsentLink(h, approve)
+	denyRes := submitConsentLink(h, deny)
+	replayRes := submitConsentLink(h, approve)
+
+	assert.Equal(t, http.StatusOK, approveRes.Code)
+	assert.Contains(t, approveRes.Body.String(), "approved")
+	assert.Equal(t, http.StatusBadRequest, denyRes.Code)
+	assert.Equal(t, http.StatusBadRequest, replayRes.Code)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+	assert.Equal(t, domain.StatusApproved, stored.GetStatus())
+}
+
+func TestConsentLinkHandler_Post_ShouldDeny(t *testing.T) {
+	h, ds, links, cibaSession := newTestConsentLinkHandler(t)
+	deny, _ := links.Sign(cibaSession.AuthReqId, false, time.Minute)
+
+	res := submitConsentLink(h, deny)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "denied")
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+	assert.Equal(t, domain.StatusDenied, stored.GetStatus())
+}
+
+func TestConsentLinkHandler_ShouldRejectInvalidLinks(t *testing.T) {
+	h, ds, _, cibaSession := newTestConsentLinkHandler(t)
+	other, _ := transport.NewConsentLinkSigner([]byte(strings.Repeat("x", 32)))
+	forged, _ := other.Sign(cibaSession.AuthReqId, true, time.Minute)
+
+	res := submitConsentLink(h, forged)
+	putRes := httptest.NewRecorder()
+	h.ServeHTTP(putRes, httptest.NewRequest(http.MethodPut, "/consent", nil))
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, putRes.Code)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+	assert.True(t, stored.IsAuthorizationPending())
+}
@@ -0,0 +1,235 @@
+package go_ciba
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"golang.org/x/net/websocket"
+)
+
+// Identifies the user of an authentication device session, e.g. from its session cookie or bearer token.
+type UserSessionAuthenticator interface {
+	// Returns the ID of the user, or an error when the request isn't authenticated.
+	AuthenticateUser(r *http.Request) (string, error)
+}
+
+type ConsentStreamConfig struct {
+	// How often a heartbeat is sent to keep proxies from closing idle connections.
+	HeartbeatInterval time.Duration
+	// Reports whether a WebSocket handshake comes from an allowed origin, only same origin
+	// handshakes are allowed when nil. Browsers send cookies with cross origin handshakes.
+	CheckOrigin func(r *http.Request) bool
+}
+
+func NewConsentStreamConfig() *ConsentStreamConfig {
+	return &ConsentStreamConfig{
+		HeartbeatInterval: 15 * time.Second,
+	}
+}
+
+const (
+	consentPromptEventType    = "consent_prompt"
+	consentWithdrawnEventType = "consent_withdrawn"
+)
+
+// What is sent for every consent prompt, and for withdrawals without the scope and binding message.
+type consentPromptEvent struct {
+	AuthReqId      string `json:"auth_req_id"`
+	ClientId       string `json:"client_id"`
+	Scope          string `json:"scope,omitempty"`
+	BindingMessage string `json:"binding_message,omitempty"`
+}
+
+func newConsentPromptEvent(prompt *transport.UserConsentPrompt) *consentPromptEvent {
+	return &consentPromptEvent{
+		AuthReqId:      prompt.AuthReqId,
+		ClientId:       prompt.ClientId,
+		Scope:          prompt.Scope,
+		BindingMessage: prompt.BindingMessage,
+	}
+}
+
+func newConsentWithdrawnEvent(withdrawal *transport.UserConsentWithdrawal) *consentPromptEvent {
+	return &consentPromptEvent{
+		AuthReqId: withdrawal.AuthReqId,
+		ClientId:  withdrawal.ClientId,
+	}
+}
+
+type webSocketMessage struct {
+	Type string              `json:"type"`
+	Data *consentPromptEvent `json:"data,omitempty"`
+}
+
+// Streams the consent prompts of the authenticated user over Server-Sent Events, or over a WebSocket
+// when the request is a WebSocket handshake. The pending requests are sent first, so a session that
+// reconnects gets the prompts it missed. Withdrawn prompts are sent as consent_withdrawn events.
+type consentStreamHandler struct {
+	hub             transport.PromptSubscriber
+	authenticator   UserSessionAuthenticator
+	cibaSessionRepo repository.CibaSessionRepositoryInterface
+	config          *ConsentStreamConfig
+	now             func() time.Time
+}
+
+func NewConsentStreamHandler(hub transport.PromptSubscriber, authenticator UserSessionAuthenticator, dataStore repository.DataStoreInterface) *consentStreamHandler {
+	return NewCustomConsentStreamHandler(hub, authenticator, dataStore, NewConsentStreamConfig())
+}
+
+func NewCustomConsentStreamHandler(hub transport.PromptSubscriber, authenticator UserSessionAuthenticator, dataStore repository.DataStoreInterface, config *ConsentStreamConfig) *consentStreamHandler {
+	return &consentStreamHandler{
+		hub:             hub,
+		authenticator:   authenticator,
+		cibaSessionRepo: dataStore.GetCibaSessionRepository(),
+		config:          config,
+		now: func() time.Time {
+			return time.Now().UTC()
+		},
+	}
+}
+
+func (h *consentStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userId, err := h.authenticator.AuthenticateUser(r)
+	if err != nil || userId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		h.serveWebSocket(w, r, userId)
+		return
+	}
+	h.serveEventStream(w, r, userId)
+}
+
+func (h *consentStreamHandler) serveEventStream(w http.ResponseWriter, r *http.Request, userId string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	// Keeps nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	h.stream(r.Context(), userId, func(eventType string, event *consentPromptEvent) error {
+		data, _ := json.Marshal(event)
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.AuthReqId, eventType, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}, func() error {
+		if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+}
+
+func (h *consentStreamHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, userId string) {
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if !h.checkOrigin(r) {
+				return errors.New("websocket origin not allowed")
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ctx, cancel := context.WithCancel(ws.Request().Context())
+			defer cancel()
+			// Reading is the only way to notice the other side went away, nothing is expected from it.
+			go func() {
+				var discard string
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+				cancel()
+			}()
+			h.stream(ctx, userId, func(eventType string, event *consentPromptEvent) error {
+				return websocket.JSON.Send(ws, &webSocketMessage{Type: eventType, Data: event})
+			}, func() error {
+				return websocket.JSON.Send(ws, &webSocketMessage{Type: "heartbeat"})
+			})
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+func (h *consentStreamHandler) checkOrigin(r *http.Request) bool {
+	if h.config.CheckOrigin != nil {
+		return h.config.CheckOrigin(r)
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(origin.Host, r.Host)
+}
+
+// Sends the pending requests and then the prompts of the user and their withdrawals as they come,
+// until ctx is done or sending fails.
+func (h *consentStreamHandler) stream(ctx context.Context, userId string, send func(eventType string, event *consentPromptEvent) error, heartbeat func() error) {
+	// Subscribing first means no prompt is missed between the replay and the subscription,
+	// the subscription skips the prompts replayed already.
+	subscription := h.hub.Subscribe(userId)
+	defer subscription.Close()
+
+	pending, err := h.cibaSessionRepo.FindPendingByUserId(ctx, userId, h.now())
+	if err != nil {
+		log.Printf("[go-ciba][consentstreamhandler] failed finding pending requests of user %s. %s\n", userId, err.Error())
+		return
+	}
+	for _, cibaSession := range pending {
+		if !subscription.Claim(cibaSession.AuthReqId) {
+			continue
+		}
+		if err := send(consentPromptEventType, newConsentPromptEvent(transport.NewUserConsentPrompt(cibaSession, nil))); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(h.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-subscription.C:
+			if !ok {
+				return
+			}
+			var err error
+			if event.Withdrawal != nil {
+				err = send(consentWithdrawnEventType, newConsentWithdrawnEvent(event.Withdrawal))
+			} else {
+				err = send(consentPromptEventType, newConsentPromptEvent(event.Prompt))
+			}
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := heartbeat(); err != nil {
+				return
+			}
+		}
+	}
+}
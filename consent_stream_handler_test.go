@@ -0,0 +1,165 @@
+package go_ciba
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// Authenticates the user named in the X-User header.
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) AuthenticateUser(r *http.Request) (string, error) {
+	if userId := r.Header.Get("X-User"); userId != "" {
+		return userId, nil
+	}
+	if userId := r.URL.Query().Get("user"); userId != "" {
+		return userId, nil
+	}
+	return "", errors.New("not authenticated")
+}
+
+func newTestConsentStream(t *testing.T) (*httptest.Server, *memory.DataStore, transport.UserNotifier, *ConsentStreamConfig) {
+	ds := memory.NewDataStore()
+	hub := transport.NewPromptHub()
+	config := NewConsentStreamConfig()
+	server := httptest.NewServer(NewCustomConsentStreamHandler(hub, &headerAuthenticator{}, ds, config))
+	t.Cleanup(server.Close)
+	return server, ds, hub, config
+}
+
+// Reads the next event of the stream, returning its name and data.
+func readEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	var event, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && (event != "" || data != ""):
+			return event, data
+		case strings.HasPrefix(line, ": "):
+			return "heartbeat", ""
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func openEventStream(t *testing.T, server *httptest.Server, userId string) *bufio.Reader {
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("X-User", userId)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	return bufio.NewReader(res.Body)
+}
+
+func TestConsentStreamHandler_EventStream_ShouldReplayPendingThenStreamPrompts(t *testing.T) {
+	server, ds, hub, _ := newTestConsentStream(t)
+	pending := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "W4SCT", "", "openid", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), pending)
+	answered := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "", "", "openid", 3600, nil)
+	_ = answered.Deny(domain.ActorUser)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), answered)
+	reader := openEventStream(t, server, test_data.User1.Id)
+
+	replayedEvent, replayed := readEvent(t, reader)
+	live := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "", "", "openid email", 3600, nil)
+	_ = hub.NotifyUser(context.Background(), transport.NewUserConsentPrompt(live, nil))
+	_ = hub.NotifyUser(context.Background(), transport.NewUserConsentPrompt(pending, nil))
+	liveEvent, streamed := readEvent(t, reader)
+
+	assert.Equal(t, "consent_prompt", replayedEvent)
+	assert.JSONEq(t, `{"auth_req_id":"`+pending.AuthReqId+`","client_id":"`+test_data.ClientAppPoll.Id+`","scope":"openid","binding_message":"W4SCT"}`, replayed)
+	assert.Equal(t, "consent_prompt", liveEvent)
+	assert.Contains(t, streamed, live.AuthReqId)
+}
+
+func TestConsentStreamHandler_EventStream_ShouldStreamWithdrawals(t *testing.T) {
+	server, ds, hub, _ := newTestConsentStream(t)
+	pending := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "W4SCT", "", "openid", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), pending)
+	reader := openEventStream(t, server, test_data.User1.Id)
+
+	_, _ = readEvent(t, reader)
+	_ = hub.(transport.WithdrawalNotifier).NotifyWithdrawal(context.Background(), transport.NewUserConsentWithdrawal(pending, nil))
+	event, data := readEvent(t, reader)
+
+	assert.Equal(t, "consent_withdrawn", event)
+	assert.JSONEq(t, `{"auth_req_id":"`+pending.AuthReqId+`","client_id":"`+test_data.ClientAppPoll.Id+`"}`, data)
+}
+
+func TestConsentStreamHandler_EventStream_ShouldSendHeartbeats(t *testing.T) {
+	server, _, _, config := newTestConsentStream(t)
+	config.HeartbeatInterval = 10 * time.Millisecond
+	reader := openEventStream(t, server, test_data.User1.Id)
+
+	event, _ := readEvent(t, reader)
+
+	assert.Equal(t, "heartbeat", event)
+}
+
+func TestConsentStreamHandler_ShouldRejectUnauthenticatedRequests(t *testing.T) {
+	server, _, _, _ := newTestConsentStream(t)
+
+	res, err := http.Get(server.URL)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestConsentStreamHandler_WebSocket_ShouldStreamPrompts(t *testing.T) {
+	server, _, hub, _ := newTestConsentStream(t)
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "?user=" + test_data.User1.Id
+	ws, err := websocket.Dial(wsUrl, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	live := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "", "", "openid", 3600, nil)
+
+	// The subscription is made once the handshake is done, retry until the handler got it.
+	var raw string
+	for i := 0; i < 50 && raw == ""; i++ {
+		_ = hub.NotifyUser(context.Background(), transport.NewUserConsentPrompt(live, nil))
+		_ = ws.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		_ = websocket.Message.Receive(ws, &raw)
+	}
+	message := &webSocketMessage{}
+	_ = json.Unmarshal([]byte(raw), message)
+
+	assert.Equal(t, "consent_prompt", message.Type)
+	if assert.NotNil(t, message.Data) {
+		assert.Equal(t, live.AuthReqId, message.Data.AuthReqId)
+	}
+}
+
+func TestConsentStreamHandler_WebSocket_ShouldRejectCrossOriginHandshakes(t *testing.T) {
+	server, _, _, _ := newTestConsentStream(t)
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "?user=" + test_data.User1.Id
+
+	_, err := websocket.Dial(wsUrl, "", "https://evil.example.com")
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package consentui
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+)
+
+// The cookie keeps a random nonce, the forms carry the HMAC of it and the user id. Other sites
+// can neither read the token nor, without the key, make one for a nonce they managed to set.
+func (h *handler) csrfNonce(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(h.config.CsrfCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.config.CsrfCookieName,
+		Value:    nonce,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nonce, nil
+}
+
+func (h *handler) csrfToken(nonce, userId string) string {
+	mac := hmac.New(sha256.New, h.csrfKey)
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (h *handler) isValidCsrfToken(token, nonce, userId string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(h.csrfToken(nonce, userId)))
+}
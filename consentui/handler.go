@@ -0,0 +1,274 @@
+// Package consentui is a reference consent web UI for authentication devices. It lists the
+// requests waiting for the consent of the signed in user and lets them approve or deny them.
+package consentui
+
+import (
+	"context"
+	"crypto/rand"
+	"embed"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+const (
+	DecisionApproved = "approved"
+	DecisionDenied   = "denied"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// The descriptions of the standard OpenID Connect scopes.
+var DefaultScopeDescriptions = map[string]string{
+	"openid":         "Sign you in",
+	"profile":        "See your name and basic profile",
+	"email":          "See your email address",
+	"address":        "See your postal address",
+	"phone":          "See your phone number",
+	"offline_access": "Keep access while you're away",
+}
+
+// Authenticates the users of the UI, e.g. with the session cookie of the server.
+type Authenticator interface {
+	// Returns the ID of the user, or an error when the request isn't authenticated.
+	AuthenticateUser(r *http.Request) (string, error)
+}
+
+type HandlerConfig struct {
+	// Must define the "consent" template, which is executed with a *Page. DefaultTemplates returns
+	// the default ones, their "title", "style", "request" and "empty" templates can be redefined.
+	Templates *template.Template
+	// What the scopes are shown as, the scopes without a description are shown as they are.
+	ScopeDescriptions map[string]string
+	// Where scope display names and descriptions are looked up first, in the languages the browser
+	// accepts. ScopeDescriptions is used for the scopes it has no description of. Optional.
+	ScopeRegistry repository.ScopeRepositoryInterface
+	// The key of at least 32 bytes CSRF tokens are signed with, shared by every server of the UI.
+	// A random one is generated when it's nil, the forms then only work on the server they came from.
+	CsrfKey []byte
+	// The cookie the CSRF nonce is kept in.
+	CsrfCookieName string
+}
+
+func NewHandlerConfig() *HandlerConfig {
+	descriptions := make(map[string]string, len(DefaultScopeDescriptions))
+	for scope, description := range DefaultScopeDescriptions {
+		descriptions[scope] = description
+	}
+	return &HandlerConfig{
+		Templates:         DefaultTemplates(),
+		ScopeDescriptions: descriptions,
+		CsrfCookieName:    "ciba_consent_csrf",
+	}
+}
+
+// Returns the default templates, a new set every time so they can be redefined.
+func DefaultTemplates() *template.Template {
+	return template.Must(template.New("templates").ParseFS(templates, "templates/*.html"))
+}
+
+// What the "consent" template is executed with.
+type Page struct {
+	Requests []*Request
+	// DecisionApproved or DecisionDenied once the user answered a request, empty otherwise.
+	Decision string
+	// Why the answer of the user was refused, nil when it wasn't.
+	Error *util.OidcError
+}
+
+// A request waiting for the consent of the user.
+type Request struct {
+	AuthReqId      string
+	ClientName     string
+	BindingMessage string
+	Scopes         []*Scope
+	ExpiresAt      time.Time
+	// Posted along with the decision, as the csrf_token field.
+	CsrfToken string
+}
+
+type Scope struct {
+	Name        string
+	DisplayName string
+	Description string
+}
+
+// Serves a page listing the requests waiting for the consent of the authenticated user, whose forms
+// post the decision back to it. Decisions go through HandleConsentRequest on behalf of the user, so
+// requests of other users can't be answered.
+type handler struct {
+	consentService service.UserConsentServiceInterface
+	authenticator  Authenticator
+	config         *HandlerConfig
+	csrfKey        []byte
+}
+
+func NewHandler(consentService service.UserConsentServiceInterface, authenticator Authenticator) (*handler, error) {
+	return NewCustomHandler(consentService, authenticator, NewHandlerConfig())
+}
+
+func NewCustomHandler(consentService service.UserConsentServiceInterface, authenticator Authenticator, config *HandlerConfig) (*handler, error) {
+	csrfKey := config.CsrfKey
+	if csrfKey == nil {
+		csrfKey = make([]byte, 32)
+		if _, err := rand.Read(csrfKey); err != nil {
+			return nil, err
+		}
+	}
+	if len(csrfKey) < 32 {
+		return nil, errors.New("csrf key must be at least 32 bytes")
+	}
+	return &handler{
+		consentService: consentService,
+		authenticator:  authenticator,
+		config:         config,
+		csrfKey:        csrfKey,
+	}, nil
+}
+
+// Serves the UI at prefix of mux, e.g. /consent.
+func (h *handler) Mount(mux *http.ServeMux, prefix string) {
+	mux.Handle(strings.TrimSuffix(prefix, "/")+"/", h)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	userId, err := h.authenticator.AuthenticateUser(r)
+	if err != nil || userId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	nonce, err := h.csrfNonce(w, r)
+	if err != nil {
+		log.Printf("[go-ciba][consentui] failed generating csrf nonce. %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		decision := r.URL.Query().Get("decision")
+		if decision != DecisionApproved && decision != DecisionDenied {
+			decision = ""
+		}
+		h.render(w, r, http.StatusOK, userId, nonce, &Page{Decision: decision})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := r.ParseForm(); err != nil || !h.isValidCsrfToken(r.PostFormValue("csrf_token"), nonce, userId) {
+		h.render(w, r, http.StatusForbidden, userId, nonce, &Page{Error: util.ErrInvalidRequest})
+		return
+	}
+	var consented bool
+	switch r.PostFormValue("decision") {
+	case "approve":
+		consented = true
+	case "deny":
+		consented = false
+	default:
+		h.render(w, r, http.StatusBadRequest, userId, nonce, &Page{Error: util.ErrInvalidRequest})
+		return
+	}
+	request := service.NewUserConsentRequest(userId, r.PostFormValue("auth_req_id"), &consented)
+	if oidcErr := h.consentService.HandleConsentRequest(r.Context(), request); oidcErr != nil {
+		// The token endpoint status codes don't mean anything to a browser.
+		status := http.StatusBadRequest
+		if oidcErr.Code >= http.StatusInternalServerError {
+			status = oidcErr.Code
+		}
+		h.render(w, r, status, userId, nonce, &Page{Error: oidcErr})
+		return
+	}
+
+	decision := DecisionDenied
+	if consented {
+		decision = DecisionApproved
+	}
+	// Redirected so that reloading the page doesn't post the decision again.
+	http.Redirect(w, r, requestPath(r)+"?decision="+decision, http.StatusSeeOther)
+}
+
+// The path the request was sent to, before any prefix was stripped from it.
+func requestPath(r *http.Request) string {
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return r.URL.Path
+}
+
+func (h *handler) render(w http.ResponseWriter, r *http.Request, status int, userId, nonce string, page *Page) {
+	pending, oidcErr := h.consentService.FindPendingConsentRequests(r.Context(), userId)
+	if oidcErr != nil {
+		w.WriteHeader(oidcErr.Code)
+		return
+	}
+	csrfToken := h.csrfToken(nonce, userId)
+	languages := acceptedLanguages(r.Header.Get("Accept-Language"))
+	for _, p := range pending {
+		request := &Request{
+			AuthReqId:      p.AuthReqId,
+			ClientName:     p.ClientName,
+			BindingMessage: p.BindingMessage,
+			ExpiresAt:      p.ExpiresAt,
+			CsrfToken:      csrfToken,
+		}
+		for _, scope := range p.Scopes {
+			request.Scopes = append(request.Scopes, h.describeScope(r.Context(), scope, languages))
+		}
+		page.Requests = append(page.Requests, request)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := h.config.Templates.ExecuteTemplate(w, "consent", page); err != nil {
+		log.Printf("[go-ciba][consentui] failed rendering consent page. %s\n", err.Error())
+	}
+}
+
+func (h *handler) describeScope(ctx context.Context, name string, languages []string) *Scope {
+	scope := &Scope{Name: name, DisplayName: name}
+	if h.config.ScopeRegistry != nil {
+		registered, err := h.config.ScopeRegistry.FindScopeByName(ctx, name)
+		if err != nil {
+			log.Printf("[go-ciba][consentui] failed finding scope %s. %s\n", name, err.Error())
+		} else if registered != nil {
+			scope.DisplayName, scope.Description = registered.Localize(languages...)
+		}
+	}
+	if scope.Description == "" {
+		scope.Description = name
+		if description, ok := h.config.ScopeDescriptions[name]; ok {
+			scope.Description = description
+		}
+	}
+	return scope
+}
+
+// Returns the language tags of an Accept-Language header in the order they're listed, without their weights.
+func acceptedLanguages(header string) []string {
+	var languages []string
+	for _, part := range strings.Split(header, ",") {
+		language := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if language != "" && language != "*" {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
@@ -0,0 +1,211 @@
+package consentui
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+)
+
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) AuthenticateUser(r *http.Request) (string, error) {
+	if userId := r.Header.Get("X-User"); userId != "" {
+		return userId, nil
+	}
+	return "", errors.New("not authenticated")
+}
+
+type silentUserNotifier struct{}
+
+func (silentUserNotifier) NotifyUser(ctx context.Context, prompt *transport.UserConsentPrompt) error {
+	return nil
+}
+
+func newTestHandler(t *testing.T, config *HandlerConfig) (*handler, *memory.DataStore, *domain.CibaSession) {
+	ds := memory.NewDataStore()
+	ds.AddUserAccount(&test_data.User1)
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPoll)
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "W4SCT", "", "openid email chat:write", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+	cs := service.NewCibaService(ds, &silentUserNotifier{}, grant.NewCibaGrant(), func(token string) bool { return true })
+	config.CsrfKey = []byte("0123456789abcdef0123456789abcdef")
+	h, err := NewCustomHandler(cs, &headerAuthenticator{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, ds, cibaSession
+}
+
+func getPage(h http.Handler, userId string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/consent/", nil)
+	req.Header.Set("X-User", userId)
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func postDecision(h http.Handler, userId, nonce string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/consent/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-User", userId)
+	req.AddCookie(&http.Cookie{Name: "ciba_consent_csrf", Value: nonce})
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func TestHandler_Get_ShouldShowPendingRequestsOfUser(t *testing.T) {
+	h, _, cibaSession := newTestHandler(t, NewHandlerConfig())
+
+	res := getPage(h, test_data.User1.Id)
+	otherRes := getPage(h, test_data.User2.Id)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	body := res.Body.String()
+	assert.Contains(t, body, cibaSession.AuthReqId)
+	assert.Contains(t, body, test_data.ClientAppPoll.Name)
+	assert.Contains(t, body, "W4SCT")
+	assert.Contains(t, body, DefaultScopeDescriptions["email"])
+	assert.Contains(t, body, "chat:write")
+	assert.Contains(t, body, `name="csrf_token"`)
+	if assert.Len(t, res.Result().Cookies(), 1) {
+		cookie := res.Result().Cookies()[0]
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+	}
+	assert.Equal(t, "DENY", res.Header().Get("X-Frame-Options"))
+	assert.NotContains(t, otherRes.Body.String(), cibaSession.AuthReqId)
+	assert.Contains(t, otherRes.Body.String(), "There are no requests waiting for your approval.")
+}
+
+func TestHandler_Get_ShouldDescribeScopesFromRegistry(t *testing.T) {
+	config := NewHandlerConfig()
+	h, ds, _ := newTestHandler(t, config)
+	_ = ds.GetScopeRepository().CreateScope(context.Background(), &domain.Scope{
+		Name:        "chat:write",
+		Description: "Send messages for you",
+		Localizations: map[string]*domain.ScopeLocalization{
+			"fr": {Description: "Envoyer des messages pour vous"},
+		},
+	})
+	config.ScopeRegistry = ds.GetScopeRepository()
+	req := httptest.NewRequest(http.MethodGet, "/consent/", nil)
+	req.Header.Set("X-User", test_data.User1.Id)
+	req.Header.Set("Accept-Language", "fr-CA, fr;q=0.9, en;q=0.8")
+	res := httptest.NewRecorder()
+
+	h.ServeHTTP(res, req)
+	defaultRes := getPage(h, test_data.User1.Id)
+
+	assert.Contains(t, res.Body.String(), "Envoyer des messages pour vous")
+	assert.Contains(t, res.Body.String(), DefaultScopeDescriptions["email"])
+	assert.Contains(t, defaultRes.Body.String(), "Send messages for you")
+}
+
+func TestHandler_Post_ShouldTakeDecisionOfUser(t *testing.T) {
+	h, ds, cibaSession := newTestHandler(t, NewHandlerConfig())
+	form := url.Values{}
+	form.Set("csrf_token", h.csrfToken("nonce", test_data.User1.Id))
+	form.Set("auth_req_id", cibaSession.AuthReqId)
+	form.Set("decision", "approve")
+
+	res := postDecision(h, test_data.User1.Id, "nonce", form)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+
+	assert.Equal(t, http.StatusSeeOther, res.Code)
+	assert.Equal(t, "/consent/?decision=approved", res.Header().Get("Location"))
+	assert.Equal(t, domain.StatusApproved, stored.GetStatus())
+	assert.Equal(t, domain.ActorUser, stored.History[len(stored.History)-1].Actor)
+}
+
+func TestHandler_Post_ShouldRefuseDecision_WhenCsrfTokenIsInvalid(t *testing.T) {
+	h, ds, cibaSession := newTestHandler(t, NewHandlerConfig())
+	tests := []struct {
+		name   string
+		userId string
+		nonce  string
+		token  string
+	}{
+		{name: "missing token", userId: test_data.User1.Id, nonce: "nonce"},
+		{name: "token of another nonce", userId: test_data.User1.Id, nonce: "nonce", token: h.csrfToken("other", test_data.User1.Id)},
+		{name: "token of another user", userId: test_data.User1.Id, nonce: "nonce", token: h.csrfToken("nonce", test_data.User2.Id)},
+	}
+	for _, test := range tests {
+		form := url.Values{}
+		form.Set("csrf_token", test.token)
+		form.Set("auth_req_id", cibaSession.AuthReqId)
+		form.Set("decision", "approve")
+
+		res := postDecision(h, test.userId, test.nonce, form)
+
+		assert.Equal(t, http.StatusForbidden, res.Code, test.name)
+	}
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+	assert.Equal(t, domain.StatusPending, stored.GetStatus())
+}
+
+func TestHandler_Post_ShouldShowError_WhenRequestIsOfAnotherUser(t *testing.T) {
+	h, ds, cibaSession := newTestHandler(t, NewHandlerConfig())
+	form := url.Values{}
+	form.Set("csrf_token", h.csrfToken("nonce", test_data.User2.Id))
+	form.Set("auth_req_id", cibaSession.AuthReqId)
+	form.Set("decision", "deny")
+
+	res := postDecision(h, test_data.User2.Id, "nonce", form)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), `class="error"`)
+	assert.Equal(t, domain.StatusPending, stored.GetStatus())
+}
+
+func TestHandler_ShouldRejectUnauthenticatedRequests(t *testing.T) {
+	h, _, _ := newTestHandler(t, NewHandlerConfig())
+
+	res := getPage(h, "")
+
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestHandler_ShouldRenderRedefinedTemplates(t *testing.T) {
+	config := NewHandlerConfig()
+	config.Templates = template.Must(DefaultTemplates().Parse(`{{define "title"}}Approve sign-in{{end}}{{define "request"}}<p class="custom">{{.ClientName}}</p>{{end}}`))
+	h, _, _ := newTestHandler(t, config)
+
+	res := getPage(h, test_data.User1.Id)
+
+	assert.Contains(t, res.Body.String(), "<title>Approve sign-in</title>")
+	assert.Contains(t, res.Body.String(), `<p class="custom">`+test_data.ClientAppPoll.Name+`</p>`)
+}
+
+func TestHandler_Mount(t *testing.T) {
+	h, _, _ := newTestHandler(t, NewHandlerConfig())
+	mux := http.NewServeMux()
+	h.Mount(mux, "/consent")
+
+	res := getPage(mux, test_data.User1.Id)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestNewCustomHandler_ShouldFail_WhenCsrfKeyIsShort(t *testing.T) {
+	config := NewHandlerConfig()
+	config.CsrfKey = []byte("short")
+
+	_, err := NewCustomHandler(nil, &headerAuthenticator{}, config)
+
+	assert.Error(t, err)
+}
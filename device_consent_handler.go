@@ -0,0 +1,92 @@
+package go_ciba
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+// What the decisions of the user are posted as.
+type deviceConsentDecision struct {
+	AuthReqId string `json:"auth_req_id"`
+	Consented *bool  `json:"consented"`
+	// The decision signed by a registered device of the user, see service.ConsentSignatureClaims.
+	Signature string `json:"signature,omitempty"`
+	// The requested scopes the user approved, absent when they approved all of them.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+type pendingConsentRequestsResponse struct {
+	Requests []*service.PendingConsentRequest `json:"requests"`
+}
+
+// The API of authentication devices. GET lists the requests waiting for the consent of the
+// authenticated user, and POST takes their decision on one of them. Decisions are only taken for
+// requests of the authenticated user.
+type deviceConsentHandler struct {
+	consentService service.UserConsentServiceInterface
+	authenticator  UserSessionAuthenticator
+}
+
+func NewDeviceConsentHandler(consentService service.UserConsentServiceInterface, authenticator UserSessionAuthenticator) *deviceConsentHandler {
+	return &deviceConsentHandler{
+		consentService: consentService,
+		authenticator:  authenticator,
+	}
+}
+
+func (h *deviceConsentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	userId, err := h.authenticator.AuthenticateUser(r)
+	if err != nil || userId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		requests, oidcErr := h.consentService.FindPendingConsentRequests(r.Context(), userId)
+		if oidcErr != nil {
+			h.writeJson(w, oidcErr.Code, oidcErr)
+			return
+		}
+		h.writeJson(w, http.StatusOK, &pendingConsentRequestsResponse{Requests: requests})
+		return
+	}
+
+	// Browsers can't post JSON across origins without a preflight, so session cookies can't be
+	// used by other sites to give consent.
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	decision := &deviceConsentDecision{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(decision); err != nil || decision.AuthReqId == "" {
+		h.writeJson(w, util.ErrInvalidRequest.Code, util.ErrInvalidRequest)
+		return
+	}
+	request := service.NewUserConsentRequest(userId, decision.AuthReqId, decision.Consented)
+	request.Signature = decision.Signature
+	request.ApprovedScopes = decision.Scopes
+	if oidcErr := h.consentService.HandleConsentRequest(r.Context(), request); oidcErr != nil {
+		h.writeJson(w, oidcErr.Code, oidcErr)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *deviceConsentHandler) writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[go-ciba][deviceconsenthandler] failed writing response. %s\n", err.Error())
+	}
+}
@@ -0,0 +1,116 @@
+package go_ciba
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDeviceConsentHandler() (*deviceConsentHandler, *memory.DataStore, *domain.CibaSession) {
+	ds := memory.NewDataStore()
+	ds.AddUserAccount(&test_data.User1)
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPoll)
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "W4SCT", "", "openid", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+	cs := service.NewCibaService(ds, &silentUserNotifier{}, grant.NewCibaGrant(), func(token string) bool { return true })
+	return NewDeviceConsentHandler(cs, &headerAuthenticator{}), ds, cibaSession
+}
+
+func postDecision(h http.Handler, userId, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/device/consent", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User", userId)
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func TestDeviceConsentHandler_Get_ShouldListPendingRequestsOfUser(t *testing.T) {
+	h, _, cibaSession := newTestDeviceConsentHandler()
+	req := httptest.NewRequest(http.MethodGet, "/device/consent", nil)
+	req.Header.Set("X-User", test_data.User1.Id)
+	res := httptest.NewRecorder()
+
+	h.ServeHTTP(res, req)
+	body := &pendingConsentRequestsResponse{}
+	_ = json.NewDecoder(res.Body).Decode(body)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	if assert.Len(t, body.Requests, 1) {
+		assert.Equal(t, cibaSession.AuthReqId, body.Requests[0].AuthReqId)
+		assert.Equal(t, test_data.ClientAppPoll.Name, body.Requests[0].ClientName)
+	}
+}
+
+func TestDeviceConsentHandler_ShouldRejectUnauthenticatedRequests(t *testing.T) {
+	h, _, _ := newTestDeviceConsentHandler()
+	res := httptest.NewRecorder()
+
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/device/consent", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestDeviceConsentHandler_Post_ShouldTakeDecisionOfUser(t *testing.T) {
+	h, ds, cibaSession := newTestDeviceConsentHandler()
+
+	res := postDecision(h, test_data.User1.Id, `{"auth_req_id":"`+cibaSession.AuthReqId+`","consented":true}`)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, domain.StatusApproved, stored.GetStatus())
+}
+
+func TestDeviceConsentHandler_Post_ShouldRefuseDecision_WhenRequestIsOfAnotherUser(t *testing.T) {
+	h, ds, cibaSession := newTestDeviceConsentHandler()
+
+	res := postDecision(h, test_data.User2.Id, `{"auth_req_id":"`+cibaSession.AuthReqId+`","consented":true}`)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), "transaction_failed")
+	assert.Equal(t, domain.StatusPending, stored.GetStatus())
+}
+
+func TestDeviceConsentHandler_Post_ShouldRejectFormBodies(t *testing.T) {
+	h, _, cibaSession := newTestDeviceConsentHandler()
+	req := httptest.NewRequest(http.MethodPost, "/device/consent", strings.NewReader("auth_req_id="+cibaSession.AuthReqId+"&consented=true"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-User", test_data.User1.Id)
+	res := httptest.NewRecorder()
+
+	h.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, res.Code)
+}
+
+func TestDeviceConsentHandler_Post_ShouldReturnInvalidRequest_WhenDecisionIsMissing(t *testing.T) {
+	h, _, cibaSession := newTestDeviceConsentHandler()
+
+	res := postDecision(h, test_data.User1.Id, `{"auth_req_id":"`+cibaSession.AuthReqId+`"}`)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), "invalid_request")
+}
+
+func TestDeviceConsentHandler_Post_ShouldGrantApprovedScopesOnly(t *testing.T) {
+	h, ds, cibaSession := newTestDeviceConsentHandler()
+	cibaSession.Scope = "openid email"
+	_ = ds.GetCibaSessionRepository().Update(context.Background(), cibaSession)
+
+	res := postDecision(h, test_data.User1.Id, `{"auth_req_id":"`+cibaSession.AuthReqId+`","consented":true,"scopes":[]}`)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, "openid", stored.GetGrantedScope())
+}
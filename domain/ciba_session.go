@@ -31,43 +31,87 @@ type CibaSession struct {
 	// The minimum interval rate for poll token requests. Only for token mode poll.
 	Interval *int64 `db:"interval" json:"interval,omitempty"`
 	// The validity of the Ciba session.
+	// Deprecated: kept in sync with Status for sessions stored before it existed, use GetStatus instead.
 	Valid bool `db:"valid" json:"valid"`
 	// The id token for this Ciba session.
 	IdToken string `db:"id_token" json:"id_token"`
 	// The consent status of this Ciba session (consented/ not consented).
 	// User at the authentication device is in charge of the consent.
+	// Deprecated: kept in sync with Status for sessions stored before it existed, use GetStatus instead.
 	Consented *bool `db:"consented" json:"consented,omitempty"`
+	// The status of this Ciba session e.g. pending, approved, denied etc.
+	// It can only be changed through Transition.
+	Status string `db:"status" json:"status"`
+	// Every status change this Ciba session went through, oldest first.
+	History []CibaSessionTransition `db:"-" json:"history,omitempty"`
 	// The scope requested for this Ciba session.
 	Scope string `db:"scope" json:"scope"`
+	// The part of the requested scope the user consented to, nil for sessions consented to before it was kept.
+	GrantedScope *string `db:"granted_scope" json:"granted_scope,omitempty"`
 	// The latest time a token was requested using this Ciba session.
 	// in unix timestamp. Default Value is null, which means it hasn't
 	// requested a token yet. This is used for POLL mode only.
 	LatestTokenRequestedAt *int64 `db:"latest_token_requested_at" json:"latest_token_requested_at"`
 	// The time when this Ciba session was created.
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	// The time when this Ciba session expires, CreatedAt + ExpiresIn.
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+	// The registered device that signed the consent, empty when it wasn't signed.
+	ConsentDeviceId string `db:"consent_device_id" json:"consent_device_id,omitempty"`
+	// The compact JWS the device signed the consent with, kept as evidence of who gave it.
+	ConsentSignature string `db:"consent_signature" json:"consent_signature,omitempty"`
+	// When the device signed the consent.
+	ConsentSignedAt *time.Time `db:"consent_signed_at" json:"consent_signed_at,omitempty"`
 }
 
-func (cs *CibaSession) Expire() {
-	cs.Valid = false
+// Keeps the consent signed by the device as evidence, it's attached before the consent is given.
+func (cs *CibaSession) AttachConsentSignature(deviceId, signature string, signedAt time.Time) {
+	cs.ConsentDeviceId = deviceId
+	cs.ConsentSignature = signature
+	cs.ConsentSignedAt = &signedAt
+}
+
+// Returns the scope the tokens of this Ciba session are issued for.
+func (cs *CibaSession) GetGrantedScope() string {
+	if cs.GrantedScope != nil {
+		return *cs.GrantedScope
+	}
+	return cs.Scope
+}
+
+func (cs *CibaSession) SetGrantedScope(scope string) {
+	cs.GrantedScope = &scope
+}
+
+func (cs *CibaSession) IsConsentSigned() bool {
+	return cs.ConsentSignature != ""
+}
+
+// GetExpiresAt returns the time when this Ciba session expires. Sessions stored
+// before ExpiresAt existed have it calculated from CreatedAt and ExpiresIn.
+func (cs *CibaSession) GetExpiresAt() time.Time {
+	if !cs.ExpiresAt.IsZero() {
+		return cs.ExpiresAt
+	}
+	seconds, _ := time.ParseDuration(fmt.Sprintf("%ds", cs.ExpiresIn))
+	return cs.CreatedAt.Add(seconds)
 }
 
 func (cs *CibaSession) IsTimeExpired() bool {
 	now := time.Now().UTC()
-	seconds, _ := time.ParseDuration(fmt.Sprintf("%ds", cs.ExpiresIn))
-	t := cs.CreatedAt.Add(seconds)
-	return now.After(t)
+	return now.After(cs.GetExpiresAt())
 }
 
 func (cs *CibaSession) IsConsented() bool {
-	return *cs.Consented == true
+	return cs.GetStatus() == StatusApproved
 }
 
 func (cs *CibaSession) IsAuthorizationPending() bool {
-	return cs.Consented == nil
+	return cs.GetStatus() == StatusPending
 }
 
 func (cs *CibaSession) IsValid() bool {
-	return cs.Valid == true
+	return !cs.IsFinal()
 }
 
 func generateAuthReqId() string {
@@ -78,7 +122,8 @@ func NewCibaSession(clientApp *ClientApplication, hint, bindingMessage, clientNo
 	if clientApp.TokenMode != ModePoll {
 		interval = nil
 	}
-	return &CibaSession{
+	now := time.Now().UTC()
+	cs := &CibaSession{
 		Hint:                    hint,
 		UserId:                  hint,
 		ClientNotificationToken: clientNotificationToken,
@@ -89,8 +134,11 @@ func NewCibaSession(clientApp *ClientApplication, hint, bindingMessage, clientNo
 		Interval:                interval,
 		ClientId:                clientApp.Id,
 		Valid:                   true,
-		CreatedAt:               time.Now().UTC(),
+		CreatedAt:               now,
+		ExpiresAt:               now.Add(time.Duration(expiresIn) * time.Second),
 	}
+	cs.record("", StatusPending, ActorClient)
+	return cs
 }
 
 func (cs *CibaSession) MarshalBinary() ([]byte, error) {
@@ -0,0 +1,164 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// The user hasn't responded to the authentication request yet.
+	StatusPending = "pending"
+	// The user has given consent, tokens can be issued.
+	StatusApproved = "approved"
+	// The user has refused to give consent.
+	StatusDenied = "denied"
+	// The authentication request has passed its lifetime.
+	StatusExpired = "expired"
+	// The authentication request was withdrawn before the user responded.
+	StatusCancelled = "cancelled"
+	// Tokens have been issued for this Ciba session.
+	StatusRedeemed = "redeemed"
+	// The user revoked the grant of the client before tokens were issued.
+	StatusRevoked = "revoked"
+)
+
+const (
+	ActorClient = "client"
+	ActorUser   = "user"
+	ActorSystem = "system"
+)
+
+var ErrInvalidStatusTransition = errors.New("invalid ciba session status transition")
+
+// The statuses a Ciba session can move to from a given status.
+// Statuses without an entry are final.
+var allowedStatusTransitions = map[string][]string{
+	StatusPending:  {StatusApproved, StatusDenied, StatusExpired, StatusCancelled, StatusRevoked},
+	StatusApproved: {StatusRedeemed, StatusExpired, StatusRevoked},
+}
+
+// A single change of status of a Ciba session.
+type CibaSessionTransition struct {
+	// The Ciba session this transition belongs to.
+	AuthReqId string `db:"auth_req_id" json:"-"`
+	// The position of this transition in the history, starting from 1.
+	Seq int `db:"seq" json:"seq"`
+	// The status before the transition, empty for the first transition.
+	From string `db:"from_status" json:"from"`
+	// The status after the transition.
+	To string `db:"to_status" json:"to"`
+	// Who caused the transition e.g. client, user or system.
+	Actor string `db:"actor" json:"actor"`
+	// The time when the transition happened.
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+func isStatusTransitionAllowed(from, to string) bool {
+	for _, s := range allowedStatusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStatus returns the status of the Ciba session. Sessions stored before
+// the status was introduced have their status derived from the legacy fields.
+func (cs *CibaSession) GetStatus() string {
+	if cs.Status != "" {
+		return cs.Status
+	}
+	if !cs.Valid {
+		if cs.IdToken != "" {
+			return StatusRedeemed
+		}
+		return StatusExpired
+	}
+	if cs.Consented == nil {
+		return StatusPending
+	}
+	if *cs.Consented {
+		return StatusApproved
+	}
+	return StatusDenied
+}
+
+// Transition moves the Ciba session to the given status and records it in the history.
+// It returns ErrInvalidStatusTransition if the move isn't allowed from the current status.
+func (cs *CibaSession) Transition(to, actor string) error {
+	from := cs.GetStatus()
+	if !isStatusTransitionAllowed(from, to) {
+		return fmt.Errorf("%w: %q to %q", ErrInvalidStatusTransition, from, to)
+	}
+	cs.record(from, to, actor)
+	return nil
+}
+
+func (cs *CibaSession) record(from, to, actor string) {
+	cs.Status = to
+	cs.History = append(cs.History, CibaSessionTransition{
+		AuthReqId: cs.AuthReqId,
+		Seq:       len(cs.History) + 1,
+		From:      from,
+		To:        to,
+		Actor:     actor,
+		CreatedAt: time.Now().UTC(),
+	})
+	cs.syncLegacyFields()
+}
+
+// Keeps valid and consented in line with the status for readers of the old fields.
+func (cs *CibaSession) syncLegacyFields() {
+	consented := true
+	notConsented := false
+
+	switch cs.Status {
+	case StatusPending:
+		cs.Valid = true
+		cs.Consented = nil
+	case StatusApproved:
+		cs.Valid = true
+		cs.Consented = &consented
+	case StatusDenied:
+		cs.Valid = true
+		cs.Consented = &notConsented
+	case StatusExpired, StatusCancelled, StatusRedeemed, StatusRevoked:
+		cs.Valid = false
+	}
+}
+
+func (cs *CibaSession) Approve(actor string) error {
+	return cs.Transition(StatusApproved, actor)
+}
+
+func (cs *CibaSession) Deny(actor string) error {
+	return cs.Transition(StatusDenied, actor)
+}
+
+func (cs *CibaSession) Cancel(actor string) error {
+	return cs.Transition(StatusCancelled, actor)
+}
+
+func (cs *CibaSession) Redeem(actor string) error {
+	return cs.Transition(StatusRedeemed, actor)
+}
+
+func (cs *CibaSession) Revoke(actor string) error {
+	return cs.Transition(StatusRevoked, actor)
+}
+
+// ExpireIfElapsed moves a pending or approved Ciba session to expired once its lifetime has passed.
+// It returns true if the status has changed and the session needs to be persisted.
+func (cs *CibaSession) ExpireIfElapsed() bool {
+	if !cs.IsTimeExpired() {
+		return false
+	}
+	return cs.Transition(StatusExpired, ActorSystem) == nil
+}
+
+// IsFinal returns true if the Ciba session can no longer change status.
+func (cs *CibaSession) IsFinal() bool {
+	_, ok := allowedStatusTransitions[cs.GetStatus()]
+	return !ok
+}
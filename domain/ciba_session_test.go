@@ -1,8 +1,11 @@
 package domain
 
 import (
-	"github.com/stretchr/testify/assert"
+	"errors"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewCibaSession(t *testing.T) {
@@ -37,3 +40,106 @@ func TestNewCibaSession(t *testing.T) {
 	assert.Equal(t, interval, *cs.Interval)
 	assert.NotEmpty(t, cs.AuthReqId)
 }
+
+func newPendingCibaSession() *CibaSession {
+	ca := ClientApplication{
+		Id:        "420d637b-ff22-4e48-88fb-237aa2131e72",
+		TokenMode: ModePing,
+	}
+	return NewCibaSession(&ca, "some-hint-user-Id", "bind-123", "token", "openid", 120, nil)
+}
+
+func TestNewCibaSession_ShouldBePendingWithHistory(t *testing.T) {
+	cs := newPendingCibaSession()
+
+	assert.Equal(t, StatusPending, cs.GetStatus())
+	assert.Len(t, cs.History, 1)
+	assert.Equal(t, "", cs.History[0].From)
+	assert.Equal(t, StatusPending, cs.History[0].To)
+	assert.Equal(t, ActorClient, cs.History[0].Actor)
+	assert.True(t, cs.IsAuthorizationPending())
+}
+
+func TestCibaSession_Transition_ShouldRecordHistory(t *testing.T) {
+	cs := newPendingCibaSession()
+
+	assert.NoError(t, cs.Approve(ActorUser))
+	assert.NoError(t, cs.Redeem(ActorSystem))
+
+	assert.Equal(t, StatusRedeemed, cs.GetStatus())
+	assert.Len(t, cs.History, 3)
+	assert.Equal(t, StatusApproved, cs.History[1].To)
+	assert.Equal(t, ActorUser, cs.History[1].Actor)
+	assert.Equal(t, StatusApproved, cs.History[2].From)
+	assert.Equal(t, 3, cs.History[2].Seq)
+	assert.False(t, cs.Valid)
+	assert.True(t, cs.IsFinal())
+}
+
+func TestCibaSession_Transition_ShouldRejectNotAllowedTransition(t *testing.T) {
+	cs := newPendingCibaSession()
+
+	assert.NoError(t, cs.Deny(ActorUser))
+	err := cs.Approve(ActorUser)
+
+	assert.True(t, errors.Is(err, ErrInvalidStatusTransition))
+	assert.Equal(t, StatusDenied, cs.GetStatus())
+	assert.Len(t, cs.History, 2)
+	assert.False(t, cs.IsConsented())
+}
+
+func TestCibaSession_Revoke_ShouldEndPendingAndApprovedSessions(t *testing.T) {
+	pending := newPendingCibaSession()
+	approved := newPendingCibaSession()
+	_ = approved.Approve(ActorUser)
+	redeemed := newPendingCibaSession()
+	_ = redeemed.Approve(ActorUser)
+	_ = redeemed.Redeem(ActorSystem)
+
+	assert.NoError(t, pending.Revoke(ActorUser))
+	assert.NoError(t, approved.Revoke(ActorUser))
+	assert.True(t, errors.Is(redeemed.Revoke(ActorUser), ErrInvalidStatusTransition))
+
+	assert.Equal(t, StatusRevoked, pending.GetStatus())
+	assert.Equal(t, StatusRevoked, approved.GetStatus())
+	assert.True(t, approved.IsFinal())
+	assert.False(t, approved.Valid)
+}
+
+func TestCibaSession_ExpireIfElapsed(t *testing.T) {
+	cs := newPendingCibaSession()
+	cs.ExpiresAt = time.Now().UTC().Add(-1 * time.Minute)
+
+	assert.True(t, cs.ExpireIfElapsed())
+	assert.Equal(t, StatusExpired, cs.GetStatus())
+	assert.False(t, cs.ExpireIfElapsed())
+}
+
+func TestCibaSession_GetExpiresAt_ShouldFallBackToCreatedAt(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-1 * time.Hour)
+	cs := &CibaSession{CreatedAt: createdAt, ExpiresIn: 120}
+
+	assert.Equal(t, createdAt.Add(120*time.Second), cs.GetExpiresAt())
+	assert.True(t, cs.IsTimeExpired())
+}
+
+func TestCibaSession_GetStatus_ShouldDeriveStatusFromLegacyFields(t *testing.T) {
+	consented := true
+	notConsented := false
+
+	assert.Equal(t, StatusPending, (&CibaSession{Valid: true}).GetStatus())
+	assert.Equal(t, StatusApproved, (&CibaSession{Valid: true, Consented: &consented}).GetStatus())
+	assert.Equal(t, StatusDenied, (&CibaSession{Valid: true, Consented: &notConsented}).GetStatus())
+	assert.Equal(t, StatusRedeemed, (&CibaSession{Valid: false, IdToken: "id.token"}).GetStatus())
+	assert.Equal(t, StatusExpired, (&CibaSession{Valid: false}).GetStatus())
+	// Doesn't dereference a nil consent
+	assert.False(t, (&CibaSession{Valid: true}).IsConsented())
+}
+
+func TestCibaSession_GetGrantedScope_ShouldOnlyFallBackToScope_WhenNotSet(t *testing.T) {
+	cs := &CibaSession{Scope: "openid email"}
+	assert.Equal(t, "openid email", cs.GetGrantedScope())
+
+	cs.SetGrantedScope("")
+	assert.Equal(t, "", cs.GetGrantedScope())
+}
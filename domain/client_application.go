@@ -75,6 +75,26 @@ func (ca *ClientApplication) GetSecret() string {
 	return ca.Secret
 }
 
+// Reports whether secret is the secret of the client application.
+func (ca *ClientApplication) VerifySecret(secret string) bool {
+	return util.CompareSecret(ca.Secret, secret)
+}
+
+// Returns a copy of the client application with its secret hashed, the form it's stored in.
+// The secret of client_secret_jwt clients is kept as is, since it's the key their assertions are signed with.
+func (ca *ClientApplication) WithHashedSecret() (*ClientApplication, error) {
+	c := *ca
+	if c.TokenEndpointAuthMethod == "client_secret_jwt" || c.Secret == "" || util.IsHashedSecret(c.Secret) {
+		return &c, nil
+	}
+	hashed, err := util.HashSecret(c.Secret)
+	if err != nil {
+		return nil, err
+	}
+	c.Secret = hashed
+	return &c, nil
+}
+
 func (ca *ClientApplication) GetName() string {
 	return ca.Name
 }
@@ -15,3 +15,24 @@ func TestNewClientApplication(t *testing.T) {
 	assert.Equal(t, "RS256", ca.AuthenticationRequestSigningAlg)
 	assert.Equal(t, false, ca.UserCodeParameterSupported)
 }
+
+func TestClientApplication_WithHashedSecret_ShouldHashSecret(t *testing.T) {
+	ca := NewClientApplication("ca-demo", "openid", "poll", "", "RS256", false)
+
+	hashed, err := ca.WithHashedSecret()
+
+	assert.NoError(t, err)
+	assert.NotEqual(t, ca.Secret, hashed.Secret)
+	assert.True(t, hashed.VerifySecret(ca.Secret))
+	assert.False(t, hashed.VerifySecret("wrong-secret"))
+}
+
+func TestClientApplication_WithHashedSecret_ShouldKeepSecret_WhenClientSignsAssertionsWithIt(t *testing.T) {
+	ca := NewClientApplication("ca-demo", "openid", "poll", "", "RS256", false)
+	ca.TokenEndpointAuthMethod = "client_secret_jwt"
+
+	hashed, err := ca.WithHashedSecret()
+
+	assert.NoError(t, err)
+	assert.Equal(t, ca.Secret, hashed.Secret)
+}
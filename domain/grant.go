@@ -0,0 +1,79 @@
+package domain
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+// The scopes a user granted to a client application, there's one per user and client.
+// It's recorded when the user gives their consent and kept once revoked, as a record.
+type Grant struct {
+	UserId   string `db:"user_id" json:"user_id"`
+	ClientId string `db:"client_id" json:"client_id"`
+	// Every scope the user granted to the client since the grant was created or last revoked.
+	Scope     string    `db:"scope" json:"scope"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	// When the user last gave their consent, requests approved with the grant don't change it.
+	ConsentedAt time.Time  `db:"consented_at" json:"consented_at"`
+	RevokedAt   *time.Time `db:"revoked_at" json:"revoked_at"`
+}
+
+func NewGrant(userId, clientId, scope string, now time.Time) *Grant {
+	return &Grant{
+		UserId:      userId,
+		ClientId:    clientId,
+		Scope:       scope,
+		CreatedAt:   now,
+		ConsentedAt: now,
+	}
+}
+
+func (g *Grant) MarshalBinary() ([]byte, error) {
+	return json.Marshal(g)
+}
+
+func (g *Grant) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, g)
+}
+
+func (g *Grant) IsActive() bool {
+	return g.RevokedAt == nil
+}
+
+// Records the consent of the user to scope. The scopes add up, unless the grant was revoked
+// in which case it's granted anew.
+func (g *Grant) AddConsent(scope string, now time.Time) {
+	if !g.IsActive() {
+		g.Scope = ""
+		g.RevokedAt = nil
+	}
+	scopes := strings.Fields(g.Scope)
+	for _, s := range strings.Fields(scope) {
+		if !util.SliceStringContains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	g.Scope = strings.Join(scopes, " ")
+	g.ConsentedAt = now
+}
+
+// Reports whether every scope of scope was granted, a revoked grant covers none.
+func (g *Grant) Covers(scope string) bool {
+	if !g.IsActive() {
+		return false
+	}
+	granted := strings.Fields(g.Scope)
+	for _, s := range strings.Fields(scope) {
+		if !util.SliceStringContains(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Grant) Revoke(now time.Time) {
+	g.RevokedAt = &now
+}
@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrant_AddConsent_ShouldAddUpScopes(t *testing.T) {
+	now := time.Now().UTC()
+	grant := NewGrant("user", "client", "openid email", now.Add(-time.Hour))
+
+	grant.AddConsent("openid profile", now)
+
+	assert.Equal(t, "openid email profile", grant.Scope)
+	assert.Equal(t, now, grant.ConsentedAt)
+	assert.True(t, grant.Covers("profile email"))
+	assert.False(t, grant.Covers("openid address"))
+}
+
+func TestGrant_AddConsent_ShouldGrantAnew_WhenGrantWasRevoked(t *testing.T) {
+	now := time.Now().UTC()
+	grant := NewGrant("user", "client", "openid email", now.Add(-time.Hour))
+	grant.Revoke(now.Add(-time.Minute))
+	revokedCovers := grant.Covers("openid")
+
+	grant.AddConsent("openid profile", now)
+
+	assert.False(t, revokedCovers)
+	assert.True(t, grant.IsActive())
+	assert.Equal(t, "openid profile", grant.Scope)
+}
@@ -1,14 +1,74 @@
 package domain
 
+import (
+	"encoding/json"
+	"strings"
+)
+
+// The scope of OpenID Connect requests, it needs no registration.
+const ScopeOpenId = "openid"
+
+// A scope clients can request, along with how it's shown on consent screens.
 type Scope struct {
 	Name string `db:"name" json:"name"`
+	// What the scope is called on consent screens, the name is shown when it's empty.
+	DisplayName string `db:"display_name" json:"display_name"`
+	Description string `db:"description" json:"description"`
+	// The display name and description in other languages, keyed by language tag e.g. fr or pt-BR.
+	Localizations map[string]*ScopeLocalization `json:"localizations,omitempty"`
+	// Authentication requests for the scope must carry the user code of the user.
+	RequiresUserCode bool `db:"requires_user_code" json:"requires_user_code"`
+	// The names of the claims the scope grants, which are user account fields by their JSON name.
+	Claims []string `json:"claims"`
+}
+
+type ScopeLocalization struct {
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+}
+
+func (s *Scope) MarshalBinary() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (s *Scope) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, s)
+}
+
+// Returns the display name and description in the first of the languages the scope has them in,
+// matching a language tag or its base language. The untranslated ones are returned otherwise.
+func (s *Scope) Localize(languages ...string) (string, string) {
+	displayName, description := s.DisplayName, s.Description
+	for _, language := range languages {
+		localization, ok := s.Localizations[language]
+		if !ok {
+			localization, ok = s.Localizations[strings.SplitN(language, "-", 2)[0]]
+		}
+		if ok {
+			displayName, description = localization.DisplayName, localization.Description
+			break
+		}
+	}
+	if displayName == "" {
+		displayName = s.Name
+	}
+	return displayName, description
 }
 
 type Claim struct {
-	Name      string `db:"name" json:"name"`
-	ScopeName string
+	Name        string `db:"name" json:"name"`
+	Description string `db:"description" json:"description"`
+	ScopeName   string
 }
 
 func (c *Claim) Str() string {
 	return c.Name
 }
+
+func (c *Claim) MarshalBinary() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func (c *Claim) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, c)
+}
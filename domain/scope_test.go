@@ -0,0 +1,31 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScope_Localize(t *testing.T) {
+	scope := &Scope{
+		Name:        "payments",
+		DisplayName: "Payments",
+		Description: "Make payments on your behalf",
+		Localizations: map[string]*ScopeLocalization{
+			"fr":    {DisplayName: "Paiements", Description: "Effectuer des paiements en votre nom"},
+			"pt-BR": {DisplayName: "Pagamentos", Description: "Fazer pagamentos em seu nome"},
+		},
+	}
+
+	frName, frDescription := scope.Localize("fr-CA", "en")
+	ptName, _ := scope.Localize("de", "pt-BR")
+	defaultName, defaultDescription := scope.Localize("de")
+	bareName, _ := (&Scope{Name: "payments"}).Localize()
+
+	assert.Equal(t, "Paiements", frName)
+	assert.Equal(t, "Effectuer des paiements en votre nom", frDescription)
+	assert.Equal(t, "Pagamentos", ptName)
+	assert.Equal(t, "Payments", defaultName)
+	assert.Equal(t, "Make payments on your behalf", defaultDescription)
+	assert.Equal(t, "payments", bareName)
+}
@@ -0,0 +1,56 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// Published in the JWKS ahead of being used, so that relying parties have it cached once it's active.
+	SigningKeyStateNext = "next"
+	// Signs the tokens of client applications without a key of their own.
+	SigningKeyStateActive = "active"
+	// No longer signs tokens, but stays published until the tokens it signed have expired.
+	SigningKeyStateRetired = "retired"
+)
+
+// A server wide key pair, in PEM, used by client applications that have no key of their own.
+type SigningKey struct {
+	Id          string     `db:"id" json:"id"`
+	Alg         string     `db:"alg" json:"alg"`
+	Public      string     `db:"public" json:"public"`
+	Private     string     `db:"private" json:"private"`
+	State       string     `db:"state" json:"state"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	ActivatedAt *time.Time `db:"activated_at" json:"activated_at"`
+	RetiredAt   *time.Time `db:"retired_at" json:"retired_at"`
+}
+
+func (k *SigningKey) MarshalBinary() ([]byte, error) {
+	return json.Marshal(k)
+}
+
+func (k *SigningKey) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, k)
+}
+
+func (k *SigningKey) Activate(now time.Time) {
+	k.State = SigningKeyStateActive
+	k.ActivatedAt = &now
+}
+
+func (k *SigningKey) Retire(now time.Time) {
+	k.State = SigningKeyStateRetired
+	k.RetiredAt = &now
+}
+
+// Returns the key signing tokens on behalf of the given client application.
+func (k *SigningKey) ToKey(clientId string) *Key {
+	return &Key{
+		Id:       k.Id,
+		ClientId: clientId,
+		Alg:      k.Alg,
+		Public:   k.Public,
+		Private:  k.Private,
+	}
+}
@@ -90,6 +90,8 @@ type AccessTokenInternal struct {
 	Value     string
 	TokenType string
 	ExpiresIn int64
+	// The scope the access token is granted for.
+	Scope string
 }
 
 type DecodedIdToken struct {
@@ -0,0 +1,67 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+const (
+	DevicePlatformAndroid = "android"
+	DevicePlatformIos     = "ios"
+	DevicePlatformWeb     = "web"
+)
+
+// An authentication device of a user, consent prompts are sent to every active device of the user.
+type UserDevice struct {
+	Id       string `db:"id" json:"id"`
+	UserId   string `db:"user_id" json:"user_id"`
+	Platform string `db:"platform" json:"platform"`
+	// Where the device is reached, e.g. its FCM registration token.
+	PushToken   string `db:"push_token" json:"push_token"`
+	DisplayName string `db:"display_name" json:"display_name"`
+	// The PEM encoded public key of the device, if it signs what it sends.
+	PublicKey      string     `db:"public_key" json:"public_key"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+	LastSeenAt     time.Time  `db:"last_seen_at" json:"last_seen_at"`
+	DeregisteredAt *time.Time `db:"deregistered_at" json:"deregistered_at"`
+}
+
+func NewUserDevice(userId, platform, pushToken, displayName, publicKey string) *UserDevice {
+	now := time.Now().UTC()
+	return &UserDevice{
+		Id:          util.GenerateUuid(),
+		UserId:      userId,
+		Platform:    platform,
+		PushToken:   pushToken,
+		DisplayName: displayName,
+		PublicKey:   publicKey,
+		CreatedAt:   now,
+		LastSeenAt:  now,
+	}
+}
+
+func IsValidDevicePlatform(platform string) bool {
+	return platform == DevicePlatformAndroid || platform == DevicePlatformIos || platform == DevicePlatformWeb
+}
+
+func (d *UserDevice) MarshalBinary() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+func (d *UserDevice) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, d)
+}
+
+func (d *UserDevice) IsActive() bool {
+	return d.DeregisteredAt == nil
+}
+
+func (d *UserDevice) Touch(now time.Time) {
+	d.LastSeenAt = now
+}
+
+func (d *UserDevice) Deregister(now time.Time) {
+	d.DeregisteredAt = &now
+}
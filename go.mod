@@ -1,6 +1,6 @@
 module github.com/adisazhar123/go-ciba
 
-go 1.14
+go 1.16
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0
@@ -10,10 +10,13 @@ require (
 	github.com/gomodule/redigo v1.8.2 // indirect
 	github.com/google/uuid v1.1.1
 	github.com/jmoiron/sqlx v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/onsi/ginkgo v1.13.0 // indirect
 	github.com/stretchr/testify v1.6.1
 	github.com/yuin/gopher-lua v0.0.0-20200603152657-dc2b0ca8b37e // indirect
-	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
+	golang.org/x/net v0.0.0-20200520004742-59133d7f0dd7
 	gopkg.in/h2non/gock.v1 v1.0.16
 	gopkg.in/square/go-jose.v2 v2.5.1
 )
@@ -9,10 +9,11 @@ const (
 )
 
 var (
-	DefaultPollIntervalInSeconds        int64 = 5
-	DefaultIdTokenLifeTimeInSeconds     int64 = 3600
-	DefaultAccessTokenLifeTimeInSeconds int64 = 3600
-	DefaultAuthReqIdLifetimeInSeconds   int64 = 120
+	DefaultPollIntervalInSeconds           int64 = 5
+	DefaultIdTokenLifeTimeInSeconds        int64 = 3600
+	DefaultAccessTokenLifeTimeInSeconds    int64 = 3600
+	DefaultAuthReqIdLifetimeInSeconds      int64 = 120
+	DefaultConsentSignatureMaxAgeInSeconds int64 = 300
 )
 
 type CibaGrantTypeInterface interface {
@@ -31,12 +32,13 @@ type CibaGrant struct {
 func NewCibaGrant() *CibaGrant {
 	return &CibaGrant{
 		Config: &GrantConfig{
-			IdTokenLifetimeInSeconds:     DefaultIdTokenLifeTimeInSeconds,
-			AccessTokenLifetimeInSeconds: DefaultAccessTokenLifeTimeInSeconds,
-			AuthReqIdLifetimeInSeconds:   DefaultAuthReqIdLifetimeInSeconds,
-			PollingIntervalInSeconds:     &DefaultPollIntervalInSeconds,
-			Issuer:                       "issuer-ciba.example.com",
-			TokenEndpointUrl:             "issuer-ciba.example.com/token",
+			IdTokenLifetimeInSeconds:        DefaultIdTokenLifeTimeInSeconds,
+			AccessTokenLifetimeInSeconds:    DefaultAccessTokenLifeTimeInSeconds,
+			AuthReqIdLifetimeInSeconds:      DefaultAuthReqIdLifetimeInSeconds,
+			PollingIntervalInSeconds:        &DefaultPollIntervalInSeconds,
+			Issuer:                          "issuer-ciba.example.com",
+			TokenEndpointUrl:                "issuer-ciba.example.com/token",
+			ConsentSignatureMaxAgeInSeconds: DefaultConsentSignatureMaxAgeInSeconds,
 		},
 		TokenManager: domain.NewTokenManager(),
 	}
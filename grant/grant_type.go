@@ -11,4 +11,21 @@ type GrantConfig struct {
 	PollingIntervalInSeconds     *int64
 	AuthReqIdLifetimeInSeconds   int64
 	TokenEndpointUrl             string
+	// Refuses consent that isn't signed by a registered device of the user, for high-assurance flows.
+	RequireSignedConsent bool
+	// How long after being signed a consent signature is accepted, DefaultConsentSignatureMaxAgeInSeconds when zero.
+	ConsentSignatureMaxAgeInSeconds int64
+	// The acr of ID tokens issued for signed consent, none is set when empty.
+	SignedConsentAcr string
+	// The clients whose repeat requests are approved without prompting the user, by client id.
+	// Nothing is remembered for the clients that have no policy, nor when RequireSignedConsent is set.
+	RememberConsent map[string]*RememberConsentPolicy
+}
+
+// When a request can be approved with the consent the user already gave to the client.
+type RememberConsentPolicy struct {
+	// How long after the user last gave their consent it's remembered, forever when zero.
+	MaxAgeInSeconds int64
+	// The scopes the user is always asked for, even when they were granted already.
+	AlwaysAskScopes []string
 }
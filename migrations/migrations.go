@@ -0,0 +1,280 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// The migrations of every supported dialect, named <version>_<name>.<up|down>.sql.
+// Table names are written as {{prefix}}table_name so the prefix given to NewSQLDataStore can be applied.
+//
+//go:embed postgres mysql sqlite
+var files embed.FS
+
+var ErrUnsupportedDriver = errors.New("unsupported driver")
+
+type migrationScript struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied bool
+	// Zero when the migration isn't applied.
+	AppliedAt time.Time
+}
+
+// Applies every migration that hasn't been applied yet, in order.
+// Each migration runs in its own transaction where the database supports transactional DDL.
+func Migrate(ctx context.Context, db *sql.DB, driver, prefix string) error {
+	m, err := newMigrator(db, driver, prefix)
+	if err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := m.run(ctx, migration.up, func(tx *sql.Tx) error {
+			cmd := m.db.Rebind(fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES (?, ?, ?)", m.tableName))
+			_, err := tx.ExecContext(ctx, cmd, migration.Version, migration.Name, time.Now().UTC().Unix())
+			return err
+		}); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// Reverts the latest applied migration. It does nothing when no migration is applied.
+func Rollback(ctx context.Context, db *sql.DB, driver, prefix string) error {
+	m, err := newMigrator(db, driver, prefix)
+	if err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if err := m.run(ctx, migration.down, func(tx *sql.Tx) error {
+			cmd := m.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE version = ?", m.tableName))
+			_, err := tx.ExecContext(ctx, cmd, migration.Version)
+			return err
+		}); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Returns every known migration and whether it has been applied.
+func Status(ctx context.Context, db *sql.DB, driver, prefix string) ([]MigrationStatus, error) {
+	m, err := newMigrator(db, driver, prefix)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses[i] = MigrationStatus{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		}
+	}
+	return statuses, nil
+}
+
+// Returns true if every known migration has been applied.
+func IsUpToDate(ctx context.Context, db *sql.DB, driver, prefix string) (bool, error) {
+	statuses, err := Status(ctx, db, driver, prefix)
+	if err != nil {
+		return false, err
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+type migrator struct {
+	db         *sqlx.DB
+	prefix     string
+	tableName  string
+	migrations []migrationScript
+}
+
+func newMigrator(db *sql.DB, driver, prefix string) (*migrator, error) {
+	dialect, err := dialectOf(driver)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{
+		db:         sqlx.NewDb(db, driver),
+		prefix:     tablePrefix(prefix),
+		tableName:  tablePrefix(prefix) + "schema_migrations",
+		migrations: migrations,
+	}, nil
+}
+
+// Returns the applied migration versions along with the time they were applied,
+// creating the table that tracks them if it doesn't exist yet.
+func (m *migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	cmd := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at BIGINT NOT NULL)", m.tableName)
+	if _, err := m.db.ExecContext(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf("SELECT version, applied_at FROM %s", m.tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(appliedAt, 0).UTC()
+	}
+	return applied, rows.Err()
+}
+
+// Runs every statement of the migration script, then record, in a single transaction.
+func (m *migrator) run(ctx context.Context, script string, record func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements(strings.ReplaceAll(script, "{{prefix}}", m.prefix)) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := record(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func dialectOf(driver string) (string, error) {
+	switch driver {
+	case "postgres", "pgx":
+		return "postgres", nil
+	case "mysql":
+		return "mysql", nil
+	case "sqlite3", "sqlite":
+		return "sqlite", nil
+	}
+	return "", fmt.Errorf("%w %s", ErrUnsupportedDriver, driver)
+}
+
+// Mirrors how the SQL repositories build their table names.
+func tablePrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "_"
+}
+
+// Loads the migrations of the given dialect sorted by version.
+func load(dialect string) ([]migrationScript, error) {
+	entries, err := fs.ReadDir(files, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migrationScript)
+	for _, entry := range entries {
+		// e.g. 0001_initial.up.sql
+		parts := strings.SplitN(strings.TrimSuffix(entry.Name(), ".sql"), "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed migration file name %s", entry.Name())
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed migration file name %s", entry.Name())
+		}
+		content, err := files.ReadFile(path.Join(dialect, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &migrationScript{Version: version}
+			byVersion[version] = migration
+		}
+		switch {
+		case strings.HasSuffix(parts[1], ".up"):
+			migration.Name = strings.TrimSuffix(parts[1], ".up")
+			migration.up = string(content)
+		case strings.HasSuffix(parts[1], ".down"):
+			migration.Name = strings.TrimSuffix(parts[1], ".down")
+			migration.down = string(content)
+		default:
+			return nil, fmt.Errorf("malformed migration file name %s", entry.Name())
+		}
+	}
+
+	migrations := make([]migrationScript, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Splits a script into its statements. Migration scripts must not contain semicolons other than statement terminators.
+func statements(script string) []string {
+	var result []string
+	for _, statement := range strings.Split(script, ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			result = append(result, statement)
+		}
+	}
+	return result
+}
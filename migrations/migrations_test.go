@@ -0,0 +1,158 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/test_data"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a different database.
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func tableExists(db *sql.DB, name string) bool {
+	var count int
+	_ = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count)
+	return count == 1
+}
+
+func TestMigrate_ShouldApplyEveryMigration(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	err := Migrate(ctx, db, "sqlite3", "")
+	statuses, statusErr := Status(ctx, db, "sqlite3", "")
+	upToDate, _ := IsUpToDate(ctx, db, "sqlite3", "")
+
+	assert.NoError(t, err)
+	assert.NoError(t, statusErr)
+	assert.True(t, upToDate)
+	assert.Len(t, statuses, 11)
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+		assert.False(t, status.AppliedAt.IsZero())
+	}
+	for _, table := range []string{"ciba_sessions", "ciba_session_transitions", "client_applications", "keys", "access_tokens", "user_accounts", "scopes", "claims", "scope_claims", "locks", "signing_keys", "user_devices"} {
+		assert.True(t, tableExists(db, table), table)
+	}
+}
+
+func TestMigrate_ShouldBeIdempotent(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	assert.NoError(t, Migrate(ctx, db, "sqlite3", ""))
+	assert.NoError(t, Migrate(ctx, db, "sqlite3", ""))
+}
+
+func TestMigrate_ShouldHonourPrefix(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+
+	err := Migrate(context.Background(), db, "sqlite3", "my_app")
+
+	assert.NoError(t, err)
+	assert.True(t, tableExists(db, "my_app_schema_migrations"))
+	assert.True(t, tableExists(db, "my_app_ciba_sessions"))
+	assert.True(t, tableExists(db, "my_app_keys"))
+	assert.False(t, tableExists(db, "ciba_sessions"))
+}
+
+func TestMigrate_ShouldReturnError_WhenDriverIsUnsupported(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+
+	err := Migrate(context.Background(), db, "oracle", "")
+
+	assert.True(t, errors.Is(err, ErrUnsupportedDriver))
+}
+
+func TestMigrate_ShouldAllowManyClaimsPerScope(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+	assert.NoError(t, Migrate(context.Background(), db, "sqlite3", ""))
+
+	_, err := db.Exec("INSERT INTO scope_claims (scope_id, claim_id) VALUES ('profile', 'name'), ('profile', 'email')")
+
+	assert.NoError(t, err)
+}
+
+func TestMigrate_ShouldBackfillLegacyCibaSessions(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+	ctx := context.Background()
+	assert.NoError(t, Migrate(ctx, db, "sqlite3", ""))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, Rollback(ctx, db, "sqlite3", ""))
+	}
+	_, err := db.Exec("INSERT INTO ciba_sessions (auth_req_id, client_id, user_id, hint, binding_message, client_notification_token, expires_in, valid, id_token, consented, scope, created_at) VALUES ('1', 'client', 'user', '', '', '', 60, TRUE, '', TRUE, 'openid', '2020-01-01T10:00:00Z')")
+	assert.NoError(t, err)
+
+	err = Migrate(ctx, db, "sqlite3", "")
+	cs, findErr := repository.NewSQLDataStore(db, "sqlite3", "").GetCibaSessionRepository().FindById(context.Background(), "1")
+
+	assert.NoError(t, err)
+	assert.NoError(t, findErr)
+	assert.NotNil(t, cs)
+	assert.Equal(t, domain.StatusApproved, cs.Status)
+	assert.Equal(t, time.Date(2020, 1, 1, 10, 1, 0, 0, time.UTC), cs.ExpiresAt.UTC())
+	assert.Nil(t, cs.GrantedScope)
+	assert.Equal(t, "openid", cs.GetGrantedScope())
+}
+
+func TestRollback_ShouldRevertEveryMigration(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+	ctx := context.Background()
+	assert.NoError(t, Migrate(ctx, db, "sqlite3", ""))
+
+	for i := 0; i < 11; i++ {
+		assert.NoError(t, Rollback(ctx, db, "sqlite3", ""))
+	}
+	statuses, err := Status(ctx, db, "sqlite3", "")
+
+	assert.NoError(t, err)
+	for _, status := range statuses {
+		assert.False(t, status.Applied)
+	}
+	assert.False(t, tableExists(db, "ciba_sessions"))
+	assert.False(t, tableExists(db, "locks"))
+	assert.NoError(t, Rollback(ctx, db, "sqlite3", ""))
+}
+
+func TestMigrate_ShouldCreateSchemaUsableBySQLDataStore(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+	assert.NoError(t, Migrate(context.Background(), db, "sqlite3", "my_app"))
+	repo := repository.NewSQLDataStore(db, "sqlite3", "my_app").GetCibaSessionRepository()
+	interval := int64(5)
+	cs := domain.NewCibaSession(&test_data.ClientAppPoll, "hint", "binding", "token", "openid", 60, &interval)
+	cs.UserId = test_data.User1.Id
+
+	createErr := repo.Create(context.Background(), cs)
+	_ = cs.Approve(domain.ActorUser)
+	updateErr := repo.Update(context.Background(), cs)
+	found, findErr := repo.FindById(context.Background(), cs.AuthReqId)
+
+	assert.NoError(t, createErr)
+	assert.NoError(t, updateErr)
+	assert.NoError(t, findErr)
+	assert.Equal(t, domain.StatusApproved, found.GetStatus())
+	assert.Len(t, found.History, 2)
+}
@@ -0,0 +1,74 @@
+CREATE TABLE {{prefix}}ciba_sessions (
+    auth_req_id VARCHAR(255) PRIMARY KEY,
+    client_id VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    hint VARCHAR(255),
+    binding_message VARCHAR(10),
+    client_notification_token VARCHAR(255),
+    expires_in INT NOT NULL,
+    `interval` INT,
+    valid BOOLEAN,
+    id_token VARCHAR(2000),
+    consented BOOLEAN,
+    scope VARCHAR(4000),
+    latest_token_requested_at INT,
+    created_at DATETIME
+);
+
+CREATE TABLE {{prefix}}client_applications (
+    id VARCHAR(255) PRIMARY KEY,
+    secret VARCHAR(255),
+    name VARCHAR(255),
+    scope VARCHAR(4000),
+    token_mode VARCHAR(255),
+    client_notification_endpoint VARCHAR(2000),
+    authentication_request_signing_alg VARCHAR(10),
+    user_code_parameter_supported BOOLEAN,
+    redirect_uri VARCHAR(2000),
+    token_endpoint_auth_method VARCHAR(20),
+    token_endpoint_auth_signing_alg VARCHAR(10),
+    grant_types VARCHAR(255),
+    public_key_uri VARCHAR(2000)
+);
+
+CREATE TABLE `{{prefix}}keys` (
+    id VARCHAR(255) PRIMARY KEY,
+    client_id VARCHAR(255),
+    alg VARCHAR(10),
+    public TEXT,
+    private TEXT
+);
+
+CREATE TABLE {{prefix}}access_tokens (
+    access_token VARCHAR(255) PRIMARY KEY,
+    client_id VARCHAR(255),
+    expires DATETIME,
+    user_id VARCHAR(255),
+    scope VARCHAR(4000)
+);
+
+CREATE TABLE {{prefix}}user_accounts (
+    id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255),
+    email VARCHAR(255),
+    password VARCHAR(255),
+    user_code VARCHAR(255),
+    created_at DATETIME,
+    updated_at DATETIME
+);
+
+CREATE TABLE {{prefix}}scopes (
+    id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255)
+);
+
+CREATE TABLE {{prefix}}claims (
+    id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255)
+);
+
+CREATE TABLE {{prefix}}scope_claims (
+    scope_id VARCHAR(255) NOT NULL,
+    claim_id VARCHAR(255) NOT NULL,
+    PRIMARY KEY (scope_id, claim_id)
+);
@@ -0,0 +1,2 @@
+DROP TABLE {{prefix}}ciba_session_transitions;
+ALTER TABLE {{prefix}}ciba_sessions DROP COLUMN status;
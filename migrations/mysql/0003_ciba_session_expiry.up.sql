@@ -0,0 +1,13 @@
+ALTER TABLE {{prefix}}ciba_sessions ADD COLUMN expires_at DATETIME;
+
+UPDATE {{prefix}}ciba_sessions SET expires_at = DATE_ADD(created_at, INTERVAL expires_in SECOND);
+
+CREATE INDEX {{prefix}}ciba_sessions_status_expires_at_idx ON {{prefix}}ciba_sessions (status, expires_at);
+
+CREATE INDEX {{prefix}}access_tokens_expires_idx ON {{prefix}}access_tokens (expires);
+
+CREATE TABLE {{prefix}}locks (
+    name VARCHAR(255) PRIMARY KEY,
+    owner VARCHAR(255),
+    expires_at DATETIME
+);
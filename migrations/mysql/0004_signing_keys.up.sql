@@ -0,0 +1,10 @@
+CREATE TABLE {{prefix}}signing_keys (
+    id VARCHAR(255) PRIMARY KEY,
+    alg VARCHAR(10) NOT NULL,
+    public TEXT NOT NULL,
+    private TEXT NOT NULL,
+    state VARCHAR(20) NOT NULL,
+    created_at DATETIME NOT NULL,
+    activated_at DATETIME NULL,
+    retired_at DATETIME NULL
+);
@@ -0,0 +1,13 @@
+CREATE TABLE {{prefix}}user_devices (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    platform VARCHAR(20) NOT NULL,
+    push_token VARCHAR(4000) NOT NULL,
+    display_name VARCHAR(255) NOT NULL,
+    public_key TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    deregistered_at DATETIME NULL
+);
+
+CREATE INDEX {{prefix}}user_devices_user_id_idx ON {{prefix}}user_devices (user_id);
@@ -0,0 +1,3 @@
+ALTER TABLE {{prefix}}ciba_sessions DROP COLUMN consent_signed_at;
+ALTER TABLE {{prefix}}ciba_sessions DROP COLUMN consent_signature;
+ALTER TABLE {{prefix}}ciba_sessions DROP COLUMN consent_device_id;
@@ -0,0 +1,5 @@
+ALTER TABLE {{prefix}}ciba_sessions ADD COLUMN consent_device_id VARCHAR(255);
+ALTER TABLE {{prefix}}ciba_sessions ADD COLUMN consent_signature TEXT;
+ALTER TABLE {{prefix}}ciba_sessions ADD COLUMN consent_signed_at DATETIME;
+
+UPDATE {{prefix}}ciba_sessions SET consent_device_id = '', consent_signature = '';
@@ -0,0 +1 @@
+ALTER TABLE {{prefix}}ciba_sessions DROP COLUMN granted_scope;
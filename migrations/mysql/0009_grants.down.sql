@@ -0,0 +1,2 @@
+DROP INDEX {{prefix}}access_tokens_user_id_client_id_idx ON {{prefix}}access_tokens;
+DROP TABLE {{prefix}}grants;
@@ -0,0 +1,11 @@
+CREATE TABLE {{prefix}}grants (
+    user_id VARCHAR(255) NOT NULL,
+    client_id VARCHAR(255) NOT NULL,
+    scope VARCHAR(4000) NOT NULL,
+    created_at DATETIME NOT NULL,
+    consented_at DATETIME NOT NULL,
+    revoked_at DATETIME NULL,
+    PRIMARY KEY (user_id, client_id)
+);
+
+CREATE INDEX {{prefix}}access_tokens_user_id_client_id_idx ON {{prefix}}access_tokens (user_id, client_id);
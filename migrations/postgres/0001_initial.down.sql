@@ -0,0 +1,8 @@
+DROP TABLE {{prefix}}scope_claims;
+DROP TABLE {{prefix}}claims;
+DROP TABLE {{prefix}}scopes;
+DROP TABLE {{prefix}}user_accounts;
+DROP TABLE {{prefix}}access_tokens;
+DROP TABLE {{prefix}}keys;
+DROP TABLE {{prefix}}client_applications;
+DROP TABLE {{prefix}}ciba_sessions;
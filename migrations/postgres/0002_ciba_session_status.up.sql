@@ -0,0 +1,19 @@
+ALTER TABLE {{prefix}}ciba_sessions ADD COLUMN status VARCHAR(20);
+
+UPDATE {{prefix}}ciba_sessions SET status = CASE
+    WHEN valid = FALSE AND id_token IS NOT NULL AND id_token <> '' THEN 'redeemed'
+    WHEN valid = FALSE THEN 'expired'
+    WHEN consented IS NULL THEN 'pending'
+    WHEN consented = TRUE THEN 'approved'
+    ELSE 'denied'
+END;
+
+CREATE TABLE {{prefix}}ciba_session_transitions (
+    auth_req_id VARCHAR(255) NOT NULL,
+    seq INT NOT NULL,
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    actor VARCHAR(255),
+    created_at TIMESTAMP,
+    PRIMARY KEY (auth_req_id, seq)
+);
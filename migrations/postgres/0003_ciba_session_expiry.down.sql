@@ -0,0 +1,4 @@
+DROP TABLE {{prefix}}locks;
+DROP INDEX {{prefix}}access_tokens_expires_idx;
+DROP INDEX {{prefix}}ciba_sessions_status_expires_at_idx;
+ALTER TABLE {{prefix}}ciba_sessions DROP COLUMN expires_at;
@@ -0,0 +1,3 @@
+ALTER TABLE {{prefix}}ciba_sessions ADD COLUMN granted_scope VARCHAR(4000);
+
+UPDATE {{prefix}}ciba_sessions SET granted_scope = '';
@@ -0,0 +1,8 @@
+ALTER TABLE {{prefix}}scopes ADD COLUMN display_name VARCHAR(255);
+ALTER TABLE {{prefix}}scopes ADD COLUMN description VARCHAR(4000);
+ALTER TABLE {{prefix}}scopes ADD COLUMN localizations VARCHAR(4000);
+ALTER TABLE {{prefix}}scopes ADD COLUMN requires_user_code BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE {{prefix}}claims ADD COLUMN description VARCHAR(4000);
+
+CREATE UNIQUE INDEX {{prefix}}scopes_name_idx ON {{prefix}}scopes (name);
+CREATE UNIQUE INDEX {{prefix}}claims_name_idx ON {{prefix}}claims (name);
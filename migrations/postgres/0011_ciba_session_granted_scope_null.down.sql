@@ -0,0 +1 @@
+UPDATE {{prefix}}ciba_sessions SET granted_scope = '' WHERE granted_scope IS NULL;
@@ -0,0 +1 @@
+UPDATE {{prefix}}ciba_sessions SET granted_scope = NULL WHERE granted_scope = '';
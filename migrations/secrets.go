@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/jmoiron/sqlx"
+)
+
+// Hashes the client secrets stored in plaintext, except those of client_secret_jwt clients which sign
+// their assertions with it. Returns the number of secrets hashed. Secrets are checked against plaintext
+// as well as hashes, so it can be run while the server is up.
+func HashClientSecrets(ctx context.Context, db *sql.DB, driver, prefix string) (int, error) {
+	dialect, err := dialectOf(driver)
+	if err != nil {
+		return 0, err
+	}
+	x := sqlx.NewDb(db, driver)
+	tableName := quoteIdentifier(dialect, tablePrefix(prefix)+"client_applications")
+	var clients []struct {
+		Id     string         `db:"id"`
+		Secret sql.NullString `db:"secret"`
+	}
+	cmd := x.Rebind(fmt.Sprintf("SELECT id, secret FROM %s WHERE token_endpoint_auth_method IS NULL OR token_endpoint_auth_method <> ?", tableName))
+	if err := x.SelectContext(ctx, &clients, cmd, "client_secret_jwt"); err != nil {
+		return 0, err
+	}
+
+	hashed := 0
+	updateCmd := x.Rebind(fmt.Sprintf("UPDATE %s SET secret = ? WHERE id = ? AND secret = ?", tableName))
+	for _, client := range clients {
+		if client.Secret.String == "" || util.IsHashedSecret(client.Secret.String) {
+			continue
+		}
+		secret, err := util.HashSecret(client.Secret.String)
+		if err != nil {
+			return hashed, err
+		}
+		if _, err := x.ExecContext(ctx, updateCmd, secret, client.Id, client.Secret.String); err != nil {
+			return hashed, err
+		}
+		hashed++
+	}
+	return hashed, nil
+}
+
+// Encrypts the private keys stored in plaintext in the keys and signing_keys tables with provider.
+// Returns the number of private keys encrypted.
+func EncryptPrivateKeys(ctx context.Context, db *sql.DB, driver, prefix string, provider util.KeyEncryptionProvider) (int, error) {
+	dialect, err := dialectOf(driver)
+	if err != nil {
+		return 0, err
+	}
+	x := sqlx.NewDb(db, driver)
+	encrypted := 0
+	for _, table := range []string{"keys", "signing_keys"} {
+		tableName := quoteIdentifier(dialect, tablePrefix(prefix)+table)
+		var keys []struct {
+			Id      string         `db:"id"`
+			Private sql.NullString `db:"private"`
+		}
+		if err := x.SelectContext(ctx, &keys, fmt.Sprintf("SELECT id, private FROM %s", tableName)); err != nil {
+			return encrypted, err
+		}
+		updateCmd := x.Rebind(fmt.Sprintf("UPDATE %s SET private = ? WHERE id = ? AND private = ?", tableName))
+		for _, key := range keys {
+			if key.Private.String == "" || util.IsSealedPrivateKey(key.Private.String) {
+				continue
+			}
+			private, err := util.SealPrivateKey(provider, key.Id, key.Private.String)
+			if err != nil {
+				return encrypted, err
+			}
+			if _, err := x.ExecContext(ctx, updateCmd, private, key.Id, key.Private.String); err != nil {
+				return encrypted, err
+			}
+			encrypted++
+		}
+	}
+	return encrypted, nil
+}
+
+// Quotes a table name, some of them such as keys are reserved words in MySQL.
+func quoteIdentifier(dialect, name string) string {
+	if dialect == "mysql" {
+		return "`" + name + "`"
+	}
+	return `"` + name + `"`
+}
@@ -0,0 +1,78 @@
+package migrations
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashClientSecrets_ShouldHashPlaintextSecrets(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+	ctx := context.Background()
+	_ = Migrate(ctx, db, "sqlite3", "")
+	hashed, _ := util.HashSecret("already-hashed")
+	_, _ = db.Exec("INSERT INTO client_applications (id, secret, token_endpoint_auth_method) VALUES ('basic', 'secret', 'client_secret_basic'), ('jwt', 'hmac-key', 'client_secret_jwt'), ('hashed', ?, 'client_secret_post')", hashed)
+
+	count, err := HashClientSecrets(ctx, db, "sqlite3", "")
+	secrets := make(map[string]string)
+	rows, _ := db.Query("SELECT id, secret FROM client_applications")
+	for rows.Next() {
+		var id, secret string
+		_ = rows.Scan(&id, &secret)
+		secrets[id] = secret
+	}
+	_ = rows.Close()
+	again, _ := HashClientSecrets(ctx, db, "sqlite3", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.True(t, util.IsHashedSecret(secrets["basic"]))
+	assert.True(t, util.CompareSecret(secrets["basic"], "secret"))
+	assert.Equal(t, "hmac-key", secrets["jwt"])
+	assert.Equal(t, hashed, secrets["hashed"])
+	assert.Equal(t, 0, again)
+}
+
+func TestEncryptPrivateKeys_ShouldEncryptPlaintextKeys(t *testing.T) {
+	db := newTestSQLite(t)
+	defer db.Close()
+	ctx := context.Background()
+	_ = Migrate(ctx, db, "sqlite3", "")
+	provider, _ := util.NewLocalKeyEncryptionProvider([]byte("0123456789abcdef0123456789abcdef"))
+	_, _ = db.Exec("INSERT INTO keys (id, client_id, alg, public, private) VALUES ('key', 'client', 'RS256', 'public', 'private')")
+	_, _ = db.Exec("INSERT INTO signing_keys (id, alg, public, private, state, created_at) VALUES ('signing-key', 'RS256', 'public', 'signing-private', 'active', CURRENT_TIMESTAMP)")
+
+	count, err := EncryptPrivateKeys(ctx, db, "sqlite3", "", provider)
+	var private, signingPrivate string
+	_ = db.QueryRow("SELECT private FROM keys WHERE id = 'key'").Scan(&private)
+	_ = db.QueryRow("SELECT private FROM signing_keys WHERE id = 'signing-key'").Scan(&signingPrivate)
+	opened, _ := util.OpenPrivateKey(provider, "key", private)
+	signingOpened, _ := util.OpenPrivateKey(provider, "signing-key", signingPrivate)
+	again, _ := EncryptPrivateKeys(ctx, db, "sqlite3", "", provider)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, "private", opened)
+	assert.Equal(t, "signing-private", signingOpened)
+	assert.Equal(t, 0, again)
+}
+
+func TestEncryptPrivateKeys_ShouldQuoteTableNames_WhenDriverIsMysql(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	provider, _ := util.NewLocalKeyEncryptionProvider([]byte("0123456789abcdef0123456789abcdef"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, private FROM `go_ciba_keys`")).WillReturnRows(sqlmock.NewRows([]string{"id", "private"}).AddRow("key", "private"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `go_ciba_keys` SET private = ? WHERE id = ? AND private = ?")).WithArgs(sqlmock.AnyArg(), "key", "private").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, private FROM `go_ciba_signing_keys`")).WillReturnRows(sqlmock.NewRows([]string{"id", "private"}))
+
+	count, err := EncryptPrivateKeys(context.Background(), db, "mysql", "go_ciba", provider)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
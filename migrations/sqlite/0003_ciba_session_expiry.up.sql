@@ -0,0 +1,13 @@
+ALTER TABLE {{prefix}}ciba_sessions ADD COLUMN expires_at TIMESTAMP;
+
+UPDATE {{prefix}}ciba_sessions SET expires_at = datetime(created_at, '+' || expires_in || ' seconds');
+
+CREATE INDEX {{prefix}}ciba_sessions_status_expires_at_idx ON {{prefix}}ciba_sessions (status, expires_at);
+
+CREATE INDEX {{prefix}}access_tokens_expires_idx ON {{prefix}}access_tokens (expires);
+
+CREATE TABLE {{prefix}}locks (
+    name VARCHAR(255) PRIMARY KEY,
+    owner VARCHAR(255),
+    expires_at TIMESTAMP
+);
@@ -0,0 +1 @@
+DROP TABLE {{prefix}}signing_keys;
@@ -0,0 +1,10 @@
+CREATE TABLE {{prefix}}signing_keys (
+    id VARCHAR(255) PRIMARY KEY,
+    alg VARCHAR(10) NOT NULL,
+    public TEXT NOT NULL,
+    private TEXT NOT NULL,
+    state VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    activated_at TIMESTAMP NULL,
+    retired_at TIMESTAMP NULL
+);
@@ -0,0 +1 @@
+DROP INDEX {{prefix}}ciba_sessions_user_id_status_idx;
@@ -0,0 +1,11 @@
+CREATE TABLE {{prefix}}grants (
+    user_id VARCHAR(255) NOT NULL,
+    client_id VARCHAR(255) NOT NULL,
+    scope VARCHAR(4000) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    consented_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL,
+    PRIMARY KEY (user_id, client_id)
+);
+
+CREATE INDEX {{prefix}}access_tokens_user_id_client_id_idx ON {{prefix}}access_tokens (user_id, client_id);
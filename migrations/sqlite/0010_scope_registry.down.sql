@@ -0,0 +1,8 @@
+DROP INDEX {{prefix}}claims_name_idx;
+DROP INDEX {{prefix}}scopes_name_idx;
+
+ALTER TABLE {{prefix}}claims DROP COLUMN description;
+ALTER TABLE {{prefix}}scopes DROP COLUMN requires_user_code;
+ALTER TABLE {{prefix}}scopes DROP COLUMN localizations;
+ALTER TABLE {{prefix}}scopes DROP COLUMN description;
+ALTER TABLE {{prefix}}scopes DROP COLUMN display_name;
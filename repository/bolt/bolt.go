@@ -0,0 +1,1034 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// How long Ciba sessions and access tokens are kept after they expire,
+// so that late requests still get an expired error instead of an unknown one.
+const DefaultGracePeriod = 1 * time.Hour
+
+// How often expired Ciba sessions and access tokens are evicted, at most.
+const DefaultEvictionInterval = 1 * time.Minute
+
+var (
+	bucketClientApplications = []byte("client_applications")
+	bucketCibaSessions       = []byte("ciba_sessions")
+	// Every stored Ciba session keyed by its expiry time followed by its id.
+	bucketCibaSessionsExpiry = []byte("ciba_sessions_expiry")
+	bucketAccessTokens       = []byte("access_tokens")
+	// Every stored access token keyed by its expiry time followed by its value.
+	bucketAccessTokensExpiry = []byte("access_tokens_expiry")
+	// Keyed by client id.
+	bucketKeys         = []byte("keys")
+	bucketSigningKeys  = []byte("signing_keys")
+	bucketUserAccounts = []byte("user_accounts")
+	// The claims of every scope, as a JSON array, keyed by scope name.
+	bucketScopeClaims = []byte("scope_claims")
+	// The scopes without their claims, keyed by name.
+	bucketScopes      = []byte("scopes")
+	bucketClaims      = []byte("claims")
+	bucketUserDevices = []byte("user_devices")
+	// Keyed by user id and client id, separated by a zero byte.
+	bucketGrants = []byte("grants")
+)
+
+type DataStoreConfig struct {
+	// How long Ciba sessions and access tokens are kept after they expire.
+	GracePeriod time.Duration
+	// How often expired Ciba sessions and access tokens are evicted, at most.
+	// Eviction happens after writes, reads never return evicted entries.
+	EvictionInterval time.Duration
+}
+
+// The database shared by a data store and every transaction started from it.
+type store struct {
+	db     *bbolt.DB
+	config *DataStoreConfig
+
+	mu           sync.Mutex
+	lastEviction time.Time
+}
+
+// Runs fn in tx when it's not nil, or in a read only transaction of its own otherwise.
+func (s *store) view(ctx context.Context, tx *bbolt.Tx, fn func(tx *bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tx != nil {
+		return fn(tx)
+	}
+	return s.db.View(fn)
+}
+
+// Runs fn in tx when it's not nil, or in a read write transaction of its own otherwise.
+func (s *store) update(ctx context.Context, tx *bbolt.Tx, fn func(tx *bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tx != nil {
+		return fn(tx)
+	}
+	if err := s.db.Update(fn); err != nil {
+		return err
+	}
+	return s.evictIfDue()
+}
+
+func (s *store) isEvictable(expiresAt time.Time) bool {
+	return time.Now().After(expiresAt.Add(s.config.GracePeriod))
+}
+
+// Deletes the Ciba sessions and access tokens past their grace period.
+func (s *store) evictIfDue() error {
+	s.mu.Lock()
+	if time.Since(s.lastEviction) < s.config.EvictionInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastEviction = time.Now()
+	s.mu.Unlock()
+
+	before := time.Now().Add(-s.config.GracePeriod)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := deleteExpired(tx, bucketCibaSessions, bucketCibaSessionsExpiry, before, -1); err != nil {
+			return err
+		}
+		_, err := deleteExpired(tx, bucketAccessTokens, bucketAccessTokensExpiry, before, -1)
+		return err
+	})
+}
+
+// Returns the key of an expiry index entry, which sorts by expiry time then id.
+func expiryKey(expiresAt time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(expiresAt.UnixNano()))
+	return append(key, id...)
+}
+
+// Calls fn with the id of every entry of the expiry index that expired before the given time, oldest first,
+// until fn returns false.
+func forEachExpired(tx *bbolt.Tx, indexBucket []byte, before time.Time, fn func(id []byte) bool) {
+	limit := expiryKey(before, "")
+	c := tx.Bucket(indexBucket).Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.Next() {
+		if !fn(k[8:]) {
+			return
+		}
+	}
+}
+
+// Deletes at most limit entries, or every one of them if limit is negative, that expired before the given time
+// along with their expiry index entries. Returns the number of deleted entries.
+func deleteExpired(tx *bbolt.Tx, bucket, indexBucket []byte, before time.Time, limit int) (int, error) {
+	var indexKeys [][]byte
+	limitKey := expiryKey(before, "")
+	c := tx.Bucket(indexBucket).Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limitKey) < 0 && (limit < 0 || len(indexKeys) < limit); k, _ = c.Next() {
+		// Keys are only valid for the life of the transaction and can't be kept while deleting.
+		indexKeys = append(indexKeys, append([]byte{}, k...))
+	}
+	for _, k := range indexKeys {
+		if err := tx.Bucket(bucket).Delete(k[8:]); err != nil {
+			return 0, err
+		}
+		if err := tx.Bucket(indexBucket).Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(indexKeys), nil
+}
+
+type clientApplicationRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func (c *clientApplicationRepository) Register(ctx context.Context, clientApp *domain.ClientApplication) error {
+	hashed, err := clientApp.WithHashedSecret()
+	if err != nil {
+		return err
+	}
+	value, err := hashed.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.store.update(ctx, c.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketClientApplications).Put([]byte(clientApp.Id), value)
+	})
+}
+
+func (c *clientApplicationRepository) FindById(ctx context.Context, id string) (*domain.ClientApplication, error) {
+	var clientApp *domain.ClientApplication
+	err := c.store.view(ctx, c.tx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(bucketClientApplications).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+		clientApp = &domain.ClientApplication{}
+		return clientApp.UnmarshalBinary(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clientApp, nil
+}
+
+type cibaSessionRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func getCibaSession(tx *bbolt.Tx, id []byte) (*domain.CibaSession, error) {
+	value := tx.Bucket(bucketCibaSessions).Get(id)
+	if value == nil {
+		return nil, nil
+	}
+	cs := &domain.CibaSession{}
+	if err := cs.UnmarshalBinary(value); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Stores the Ciba session and moves its expiry index entry if its expiry time has changed.
+func putCibaSession(tx *bbolt.Tx, previous, cs *domain.CibaSession) error {
+	value, err := cs.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketCibaSessions).Put([]byte(cs.AuthReqId), value); err != nil {
+		return err
+	}
+	if previous != nil {
+		if err := tx.Bucket(bucketCibaSessionsExpiry).Delete(expiryKey(previous.GetExpiresAt(), previous.AuthReqId)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketCibaSessionsExpiry).Put(expiryKey(cs.GetExpiresAt(), cs.AuthReqId), nil)
+}
+
+func (c *cibaSessionRepository) Create(ctx context.Context, cibaSession *domain.CibaSession) error {
+	return c.store.update(ctx, c.tx, func(tx *bbolt.Tx) error {
+		previous, err := getCibaSession(tx, []byte(cibaSession.AuthReqId))
+		if err != nil {
+			return err
+		}
+		return putCibaSession(tx, previous, cibaSession)
+	})
+}
+
+func (c *cibaSessionRepository) FindById(ctx context.Context, id string) (*domain.CibaSession, error) {
+	var cibaSession *domain.CibaSession
+	err := c.store.view(ctx, c.tx, func(tx *bbolt.Tx) error {
+		cs, err := getCibaSession(tx, []byte(id))
+		if err != nil || cs == nil || c.store.isEvictable(cs.GetExpiresAt()) {
+			return err
+		}
+		cibaSession = cs
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cibaSession, nil
+}
+
+// Stores the Ciba session only if its history contains every transition of the stored one,
+// that is nobody else has changed its status since it was read. Returns repository.ErrConcurrentUpdate otherwise.
+func (c *cibaSessionRepository) Update(ctx context.Context, cibaSession *domain.CibaSession) error {
+	return c.store.update(ctx, c.tx, func(tx *bbolt.Tx) error {
+		previous, err := getCibaSession(tx, []byte(cibaSession.AuthReqId))
+		if err != nil {
+			return err
+		}
+		if previous != nil && !isHistoryPrefix(previous.History, cibaSession.History) {
+			return repository.ErrConcurrentUpdate
+		}
+		return putCibaSession(tx, previous, cibaSession)
+	})
+}
+
+func isHistoryPrefix(prefix, history []domain.CibaSessionTransition) bool {
+	if len(prefix) > len(history) {
+		return false
+	}
+	for i, t := range prefix {
+		if t.Seq != history[i].Seq || t.To != history[i].To || !t.CreatedAt.Equal(history[i].CreatedAt) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *cibaSessionRepository) FindExpired(ctx context.Context, before time.Time, limit int) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	err := c.store.view(ctx, c.tx, func(tx *bbolt.Tx) error {
+		var err error
+		forEachExpired(tx, bucketCibaSessionsExpiry, before, func(id []byte) bool {
+			var cs *domain.CibaSession
+			if cs, err = getCibaSession(tx, id); err != nil {
+				return false
+			}
+			if cs != nil && !cs.IsFinal() {
+				cibaSessions = append(cibaSessions, cs)
+			}
+			return len(cibaSessions) < limit
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cibaSessions, nil
+}
+
+// Scans every Ciba session, there is no index by user.
+func (c *cibaSessionRepository) FindPendingByUserId(ctx context.Context, userId string, after time.Time) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	err := c.store.view(ctx, c.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketCibaSessions).ForEach(func(k, v []byte) error {
+			cs := &domain.CibaSession{}
+			if err := cs.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			if cs.UserId == userId && cs.IsAuthorizationPending() && cs.GetExpiresAt().After(after) {
+				cibaSessions = append(cibaSessions, cs)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].CreatedAt.Before(cibaSessions[j].CreatedAt)
+	})
+	return cibaSessions, nil
+}
+
+// Scans every Ciba session, there is no index by user and client.
+func (c *cibaSessionRepository) FindActiveByUserIdAndClientId(ctx context.Context, userId, clientId string) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	err := c.store.view(ctx, c.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketCibaSessions).ForEach(func(k, v []byte) error {
+			cs := &domain.CibaSession{}
+			if err := cs.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			if cs.UserId == userId && cs.ClientId == clientId && !cs.IsFinal() {
+				cibaSessions = append(cibaSessions, cs)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].CreatedAt.Before(cibaSessions[j].CreatedAt)
+	})
+	return cibaSessions, nil
+}
+
+func (c *cibaSessionRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	deleted := 0
+	err := c.store.update(ctx, c.tx, func(tx *bbolt.Tx) error {
+		var err error
+		deleted, err = deleteExpired(tx, bucketCibaSessions, bucketCibaSessionsExpiry, before, limit)
+		return err
+	})
+	return deleted, err
+}
+
+type accessTokenRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func (a *accessTokenRepository) Create(ctx context.Context, accessToken *domain.AccessToken) error {
+	value, err := accessToken.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return a.store.update(ctx, a.tx, func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketAccessTokens).Put([]byte(accessToken.Value), value); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketAccessTokensExpiry).Put(expiryKey(accessToken.Expires, accessToken.Value), nil)
+	})
+}
+
+func (a *accessTokenRepository) Find(ctx context.Context, accessToken string) (*domain.AccessToken, error) {
+	var at *domain.AccessToken
+	err := a.store.view(ctx, a.tx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(bucketAccessTokens).Get([]byte(accessToken))
+		if value == nil {
+			return nil
+		}
+		token := &domain.AccessToken{}
+		if err := token.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if !a.store.isEvictable(token.Expires) {
+			at = token
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return at, nil
+}
+
+func (a *accessTokenRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	deleted := 0
+	err := a.store.update(ctx, a.tx, func(tx *bbolt.Tx) error {
+		var err error
+		deleted, err = deleteExpired(tx, bucketAccessTokens, bucketAccessTokensExpiry, before, limit)
+		return err
+	})
+	return deleted, err
+}
+
+// Access tokens are found by going through every access token, revocations are rare.
+func (a *accessTokenRepository) DeleteByUserIdAndClientId(ctx context.Context, userId, clientId string) (int, error) {
+	deleted := 0
+	err := a.store.update(ctx, a.tx, func(tx *bbolt.Tx) error {
+		var tokens []*domain.AccessToken
+		err := tx.Bucket(bucketAccessTokens).ForEach(func(_, value []byte) error {
+			token := &domain.AccessToken{}
+			if err := token.UnmarshalBinary(value); err != nil {
+				return err
+			}
+			if token.UserId == userId && token.ClientId == clientId {
+				tokens = append(tokens, token)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if err := tx.Bucket(bucketAccessTokens).Delete([]byte(token.Value)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketAccessTokensExpiry).Delete(expiryKey(token.Expires, token.Value)); err != nil {
+				return err
+			}
+		}
+		deleted = len(tokens)
+		return nil
+	})
+	return deleted, err
+}
+
+type keyRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func (k *keyRepository) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
+	var key *domain.Key
+	err := k.store.view(ctx, k.tx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(bucketKeys).Get([]byte(clientId))
+		if value == nil {
+			return nil
+		}
+		key = &domain.Key{}
+		return key.UnmarshalBinary(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type signingKeyRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func (k *signingKeyRepository) Create(ctx context.Context, key *domain.SigningKey) error {
+	return k.put(ctx, key)
+}
+
+func (k *signingKeyRepository) Update(ctx context.Context, key *domain.SigningKey) error {
+	return k.put(ctx, key)
+}
+
+func (k *signingKeyRepository) put(ctx context.Context, key *domain.SigningKey) error {
+	value, err := key.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return k.store.update(ctx, k.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketSigningKeys).Put([]byte(key.Id), value)
+	})
+}
+
+func (k *signingKeyRepository) FindAll(ctx context.Context) ([]*domain.SigningKey, error) {
+	var keys []*domain.SigningKey
+	err := k.store.view(ctx, k.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketSigningKeys).ForEach(func(_, value []byte) error {
+			key := &domain.SigningKey{}
+			if err := key.UnmarshalBinary(value); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (k *signingKeyRepository) Delete(ctx context.Context, id string) error {
+	return k.store.update(ctx, k.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketSigningKeys).Delete([]byte(id))
+	})
+}
+
+type userAccountRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func (u *userAccountRepository) FindById(ctx context.Context, id string) (*domain.UserAccount, error) {
+	var user *domain.UserAccount
+	err := u.store.view(ctx, u.tx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(bucketUserAccounts).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+		user = &domain.UserAccount{}
+		return user.UnmarshalBinary(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+type userClaimRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+// Returns the values of the user account fields, by their JSON name, that are claims of the given scopes.
+func (u *userClaimRepository) GetUserClaims(ctx context.Context, userId, scopes string) (map[string]interface{}, error) {
+	claimsValues := make(map[string]interface{})
+	err := u.store.view(ctx, u.tx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(bucketUserAccounts).Get([]byte(userId))
+		if value == nil {
+			return nil
+		}
+		var userAccount map[string]interface{}
+		if err := json.Unmarshal(value, &userAccount); err != nil {
+			return err
+		}
+
+		for _, scope := range strings.Split(scopes, " ") {
+			value := tx.Bucket(bucketScopeClaims).Get([]byte(scope))
+			if value == nil {
+				continue
+			}
+			var claims []string
+			if err := json.Unmarshal(value, &claims); err != nil {
+				return err
+			}
+			for _, claim := range claims {
+				if val, ok := userAccount[claim]; ok {
+					claimsValues[claim] = val
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimsValues, nil
+}
+
+type userDeviceRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func (u *userDeviceRepository) Create(ctx context.Context, device *domain.UserDevice) error {
+	return u.put(ctx, device)
+}
+
+func (u *userDeviceRepository) Update(ctx context.Context, device *domain.UserDevice) error {
+	return u.put(ctx, device)
+}
+
+func (u *userDeviceRepository) put(ctx context.Context, device *domain.UserDevice) error {
+	value, err := device.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return u.store.update(ctx, u.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketUserDevices).Put([]byte(device.Id), value)
+	})
+}
+
+func (u *userDeviceRepository) FindById(ctx context.Context, id string) (*domain.UserDevice, error) {
+	var device *domain.UserDevice
+	err := u.store.view(ctx, u.tx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(bucketUserDevices).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+		device = &domain.UserDevice{}
+		return device.UnmarshalBinary(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// Users have a few devices at most, so they're found by going through every device.
+func (u *userDeviceRepository) FindActiveByUserId(ctx context.Context, userId string) ([]*domain.UserDevice, error) {
+	var devices []*domain.UserDevice
+	err := u.store.view(ctx, u.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketUserDevices).ForEach(func(_, value []byte) error {
+			device := &domain.UserDevice{}
+			if err := device.UnmarshalBinary(value); err != nil {
+				return err
+			}
+			if device.UserId == userId && device.IsActive() {
+				devices = append(devices, device)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastSeenAt.After(devices[j].LastSeenAt)
+	})
+	return devices, nil
+}
+
+type grantRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func grantKey(userId, clientId string) []byte {
+	return []byte(userId + "\x00" + clientId)
+}
+
+func (g *grantRepository) Create(ctx context.Context, grant *domain.Grant) error {
+	return g.put(ctx, grant)
+}
+
+func (g *grantRepository) Update(ctx context.Context, grant *domain.Grant) error {
+	return g.put(ctx, grant)
+}
+
+func (g *grantRepository) put(ctx context.Context, grant *domain.Grant) error {
+	value, err := grant.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return g.store.update(ctx, g.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketGrants).Put(grantKey(grant.UserId, grant.ClientId), value)
+	})
+}
+
+func (g *grantRepository) FindByUserIdAndClientId(ctx context.Context, userId, clientId string) (*domain.Grant, error) {
+	var grant *domain.Grant
+	err := g.store.view(ctx, g.tx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(bucketGrants).Get(grantKey(userId, clientId))
+		if value == nil {
+			return nil
+		}
+		grant = &domain.Grant{}
+		return grant.UnmarshalBinary(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+func (g *grantRepository) FindActiveByUserId(ctx context.Context, userId string) ([]*domain.Grant, error) {
+	var grants []*domain.Grant
+	prefix := grantKey(userId, "")
+	err := g.store.view(ctx, g.tx, func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketGrants).Cursor()
+		for k, value := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, value = c.Next() {
+			grant := &domain.Grant{}
+			if err := grant.UnmarshalBinary(value); err != nil {
+				return err
+			}
+			if grant.IsActive() {
+				grants = append(grants, grant)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].ConsentedAt.After(grants[j].ConsentedAt)
+	})
+	return grants, nil
+}
+
+type scopeRepository struct {
+	store *store
+	tx    *bbolt.Tx
+}
+
+func (r *scopeRepository) CreateScope(ctx context.Context, scope *domain.Scope) error {
+	return r.UpdateScope(ctx, scope)
+}
+
+func (r *scopeRepository) UpdateScope(ctx context.Context, scope *domain.Scope) error {
+	value, err := scope.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	claims := scope.Claims
+	if claims == nil {
+		claims = []string{}
+	}
+	claimsValue, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	return r.store.update(ctx, r.tx, func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketScopes).Put([]byte(scope.Name), value); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketScopeClaims).Put([]byte(scope.Name), claimsValue); err != nil {
+			return err
+		}
+		for _, claim := range claims {
+			if tx.Bucket(bucketClaims).Get([]byte(claim)) != nil {
+				continue
+			}
+			value, err := (&domain.Claim{Name: claim}).MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketClaims).Put([]byte(claim), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *scopeRepository) DeleteScope(ctx context.Context, name string) error {
+	return r.store.update(ctx, r.tx, func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketScopes).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketScopeClaims).Delete([]byte(name))
+	})
+}
+
+// Returns the scope with its claims, scopes added before the registry only have their claims.
+func findScope(tx *bbolt.Tx, name []byte, claimsValue []byte) (*domain.Scope, error) {
+	scope := &domain.Scope{Name: string(name)}
+	if value := tx.Bucket(bucketScopes).Get(name); value != nil {
+		if err := scope.UnmarshalBinary(value); err != nil {
+			return nil, err
+		}
+	}
+	scope.Claims = nil
+	if err := json.Unmarshal(claimsValue, &scope.Claims); err != nil {
+		return nil, err
+	}
+	return scope, nil
+}
+
+func (r *scopeRepository) FindScopeByName(ctx context.Context, name string) (*domain.Scope, error) {
+	var scope *domain.Scope
+	err := r.store.view(ctx, r.tx, func(tx *bbolt.Tx) error {
+		claimsValue := tx.Bucket(bucketScopeClaims).Get([]byte(name))
+		if claimsValue == nil {
+			return nil
+		}
+		var err error
+		scope, err = findScope(tx, []byte(name), claimsValue)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scope, nil
+}
+
+func (r *scopeRepository) FindAllScopes(ctx context.Context) ([]*domain.Scope, error) {
+	var scopes []*domain.Scope
+	err := r.store.view(ctx, r.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketScopeClaims).ForEach(func(name, claimsValue []byte) error {
+			scope, err := findScope(tx, name, claimsValue)
+			if err != nil {
+				return err
+			}
+			scopes = append(scopes, scope)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scopes, nil
+}
+
+func (r *scopeRepository) CreateClaim(ctx context.Context, claim *domain.Claim) error {
+	return r.UpdateClaim(ctx, claim)
+}
+
+func (r *scopeRepository) UpdateClaim(ctx context.Context, claim *domain.Claim) error {
+	value, err := claim.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return r.store.update(ctx, r.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketClaims).Put([]byte(claim.Name), value)
+	})
+}
+
+func (r *scopeRepository) DeleteClaim(ctx context.Context, name string) error {
+	return r.store.update(ctx, r.tx, func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketClaims).Delete([]byte(name)); err != nil {
+			return err
+		}
+		updated := make(map[string][]byte)
+		err := tx.Bucket(bucketScopeClaims).ForEach(func(scope, value []byte) error {
+			var claims []string
+			if err := json.Unmarshal(value, &claims); err != nil {
+				return err
+			}
+			remaining := []string{}
+			for _, claim := range claims {
+				if claim != name {
+					remaining = append(remaining, claim)
+				}
+			}
+			if len(remaining) == len(claims) {
+				return nil
+			}
+			value, err := json.Marshal(remaining)
+			if err != nil {
+				return err
+			}
+			updated[string(scope)] = value
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Buckets can't be changed while they're iterated.
+		for scope, value := range updated {
+			if err := tx.Bucket(bucketScopeClaims).Put([]byte(scope), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *scopeRepository) FindAllClaims(ctx context.Context) ([]*domain.Claim, error) {
+	var claims []*domain.Claim
+	err := r.store.view(ctx, r.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketClaims).ForEach(func(_, value []byte) error {
+			claim := &domain.Claim{}
+			if err := claim.UnmarshalBinary(value); err != nil {
+				return err
+			}
+			claims = append(claims, claim)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// DataStore keeps everything in a bbolt database file, for single node deployments
+// that can't run an external database.
+type DataStore struct {
+	store *store
+	// Nil when the data store isn't bound to a transaction.
+	tx *bbolt.Tx
+
+	accessTokenRepo       *accessTokenRepository
+	cibaSessionRepo       *cibaSessionRepository
+	clientApplicationRepo *clientApplicationRepository
+	keyRepositoryRepo     *keyRepository
+	signingKeyRepo        *signingKeyRepository
+	userAccountRepo       *userAccountRepository
+	userClaimRepo         *userClaimRepository
+	userDeviceRepo        *userDeviceRepository
+	grantRepo             *grantRepository
+	scopeRepo             *scopeRepository
+}
+
+// NewDataStore creates the buckets in db if they don't exist yet.
+func NewDataStore(db *bbolt.DB) (*DataStore, error) {
+	return NewCustomDataStore(db, &DataStoreConfig{
+		GracePeriod:      DefaultGracePeriod,
+		EvictionInterval: DefaultEvictionInterval,
+	})
+}
+
+func NewCustomDataStore(db *bbolt.DB, config *DataStoreConfig) (*DataStore, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{bucketClientApplications, bucketCibaSessions, bucketCibaSessionsExpiry, bucketAccessTokens, bucketAccessTokensExpiry, bucketKeys, bucketSigningKeys, bucketUserAccounts, bucketScopeClaims, bucketScopes, bucketClaims, bucketUserDevices, bucketGrants} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newDataStore(&store{
+		db:           db,
+		config:       config,
+		lastEviction: time.Now(),
+	}, nil), nil
+}
+
+// Creates the repositories, running them in tx if it's not nil.
+func newDataStore(s *store, tx *bbolt.Tx) *DataStore {
+	return &DataStore{
+		store:                 s,
+		tx:                    tx,
+		accessTokenRepo:       &accessTokenRepository{store: s, tx: tx},
+		cibaSessionRepo:       &cibaSessionRepository{store: s, tx: tx},
+		clientApplicationRepo: &clientApplicationRepository{store: s, tx: tx},
+		keyRepositoryRepo:     &keyRepository{store: s, tx: tx},
+		signingKeyRepo:        &signingKeyRepository{store: s, tx: tx},
+		userAccountRepo:       &userAccountRepository{store: s, tx: tx},
+		userClaimRepo:         &userClaimRepository{store: s, tx: tx},
+		userDeviceRepo:        &userDeviceRepository{store: s, tx: tx},
+		grantRepo:             &grantRepository{store: s, tx: tx},
+		scopeRepo:             &scopeRepository{store: s, tx: tx},
+	}
+}
+
+func (d *DataStore) put(bucket []byte, key string, value []byte) error {
+	return d.store.update(context.Background(), d.tx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), value)
+	})
+}
+
+// Adds or replaces the key of the client application it belongs to.
+func (d *DataStore) AddKey(key *domain.Key) error {
+	value, err := key.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return d.put(bucketKeys, key.ClientId, value)
+}
+
+// Adds or replaces a user account.
+func (d *DataStore) AddUserAccount(user *domain.UserAccount) error {
+	value, err := user.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return d.put(bucketUserAccounts, user.Id, value)
+}
+
+// Adds or replaces a scope along with the claims it grants, which are user account fields by their JSON name.
+func (d *DataStore) AddScope(scope string, claims ...string) error {
+	return d.scopeRepo.UpdateScope(context.Background(), &domain.Scope{Name: scope, Claims: claims})
+}
+
+func (d *DataStore) HaveTransactionSupport() bool {
+	return true
+}
+
+// Runs fn with a data store bound to a read write bbolt transaction, which is committed if fn returns
+// no error and rolled back otherwise. Reads within fn see its writes. bbolt allows a single writer at
+// a time, fn must not write through a data store that isn't bound to the transaction.
+// Calling it on a data store that is already bound to a transaction runs fn within that transaction.
+func (d *DataStore) WithinTransaction(ctx context.Context, fn func(tx repository.DataStoreInterface) error) error {
+	if d.tx != nil {
+		return fn(d)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := d.store.db.Update(func(tx *bbolt.Tx) error {
+		if err := fn(newDataStore(d.store, tx)); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}); err != nil {
+		return err
+	}
+	return d.store.evictIfDue()
+}
+
+func (d *DataStore) GetAccessTokenRepository() repository.AccessTokenRepositoryInterface {
+	return d.accessTokenRepo
+}
+
+func (d *DataStore) GetCibaSessionRepository() repository.CibaSessionRepositoryInterface {
+	return d.cibaSessionRepo
+}
+
+func (d *DataStore) GetClientApplicationRepository() repository.ClientApplicationRepositoryInterface {
+	return d.clientApplicationRepo
+}
+
+func (d *DataStore) GetKeyRepository() repository.KeyRepositoryInterface {
+	return d.keyRepositoryRepo
+}
+
+func (d *DataStore) GetSigningKeyRepository() repository.SigningKeyRepositoryInterface {
+	return d.signingKeyRepo
+}
+
+func (d *DataStore) GetUserAccountRepository() repository.UserAccountRepositoryInterface {
+	return d.userAccountRepo
+}
+
+func (d *DataStore) GetUserClaimRepository() repository.UserClaimRepositoryInterface {
+	return d.userClaimRepo
+}
+
+func (d *DataStore) GetUserDeviceRepository() repository.UserDeviceRepositoryInterface {
+	return d.userDeviceRepo
+}
+
+func (d *DataStore) GetGrantRepository() repository.GrantRepositoryInterface {
+	return d.grantRepo
+}
+
+func (d *DataStore) GetScopeRepository() repository.ScopeRepositoryInterface {
+	return d.scopeRepo
+}
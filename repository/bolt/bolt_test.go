@@ -0,0 +1,259 @@
+package bolt
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/repositorytest"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func newTestBolt(t *testing.T) *bbolt.DB {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "go-ciba.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func newTestDataStore(t *testing.T, config *DataStoreConfig) *DataStore {
+	if config == nil {
+		config = &DataStoreConfig{GracePeriod: DefaultGracePeriod, EvictionInterval: DefaultEvictionInterval}
+	}
+	ds, err := NewCustomDataStore(newTestBolt(t), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func newCibaSession(age time.Duration) *domain.CibaSession {
+	interval := int64(5)
+	cs := domain.NewCibaSession(&test_data.ClientAppPoll, "hint", "binding", "token", "openid", 60, &interval)
+	cs.CreatedAt = cs.CreatedAt.Add(-age)
+	cs.ExpiresAt = cs.ExpiresAt.Add(-age)
+	return cs
+}
+
+func TestDataStore_ShouldKeepData_WhenReopened(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go-ciba.db")
+	db, _ := bbolt.Open(path, 0600, nil)
+	ds, _ := NewDataStore(db)
+	clientApp := test_data.ClientAppPing
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &clientApp)
+	_ = db.Close()
+
+	db, _ = bbolt.Open(path, 0600, nil)
+	defer db.Close()
+	ds, err := NewDataStore(db)
+	found, findErr := ds.GetClientApplicationRepository().FindById(context.Background(), clientApp.Id)
+
+	assert.NoError(t, err)
+	assert.NoError(t, findErr)
+	assert.True(t, found.VerifySecret(clientApp.Secret))
+	assert.Equal(t, clientApp.Name, found.Name)
+}
+
+func TestCibaSessionRepository_Update_ShouldStoreChanges(t *testing.T) {
+	repo := newTestDataStore(t, nil).GetCibaSessionRepository()
+	cs := newCibaSession(0)
+	_ = repo.Create(context.Background(), cs)
+	_ = cs.Approve(domain.ActorUser)
+
+	err := repo.Update(context.Background(), cs)
+	updated, _ := repo.FindById(context.Background(), cs.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.Equal(t, domain.StatusApproved, updated.GetStatus())
+	assert.Len(t, updated.History, 2)
+}
+
+func TestCibaSessionRepository_Update_ShouldReturnErrConcurrentUpdate_WhenSessionChangedSinceRead(t *testing.T) {
+	repo := newTestDataStore(t, nil).GetCibaSessionRepository()
+	cs := newCibaSession(0)
+	_ = repo.Create(context.Background(), cs)
+	first, _ := repo.FindById(context.Background(), cs.AuthReqId)
+	second, _ := repo.FindById(context.Background(), cs.AuthReqId)
+	_ = first.Approve(domain.ActorUser)
+	_ = second.Deny(domain.ActorUser)
+
+	firstErr := repo.Update(context.Background(), first)
+	secondErr := repo.Update(context.Background(), second)
+	stored, _ := repo.FindById(context.Background(), cs.AuthReqId)
+
+	assert.NoError(t, firstErr)
+	assert.True(t, errors.Is(secondErr, repository.ErrConcurrentUpdate))
+	assert.Equal(t, domain.StatusApproved, stored.GetStatus())
+}
+
+func TestCibaSessionRepository_FindExpired_ShouldReturnActiveSessionsOldestFirst(t *testing.T) {
+	repo := newTestDataStore(t, nil).GetCibaSessionRepository()
+	older := newCibaSession(10 * time.Minute)
+	old := newCibaSession(5 * time.Minute)
+	denied := newCibaSession(5 * time.Minute)
+	_ = denied.Deny(domain.ActorUser)
+	active := newCibaSession(0)
+	for _, cs := range []*domain.CibaSession{old, older, denied, active} {
+		_ = repo.Create(context.Background(), cs)
+	}
+
+	cibaSessions, err := repo.FindExpired(context.Background(), time.Now().UTC(), 10)
+	limited, _ := repo.FindExpired(context.Background(), time.Now().UTC(), 1)
+
+	assert.NoError(t, err)
+	assert.Len(t, cibaSessions, 2)
+	assert.Equal(t, older.AuthReqId, cibaSessions[0].AuthReqId)
+	assert.Equal(t, old.AuthReqId, cibaSessions[1].AuthReqId)
+	assert.Len(t, limited, 1)
+}
+
+func TestCibaSessionRepository_DeleteExpiredBefore(t *testing.T) {
+	ds := newTestDataStore(t, nil)
+	repo := ds.GetCibaSessionRepository()
+	stale := newCibaSession(48 * time.Hour)
+	recent := newCibaSession(5 * time.Minute)
+	_ = repo.Create(context.Background(), stale)
+	_ = repo.Create(context.Background(), recent)
+
+	deleted, err := repo.DeleteExpiredBefore(context.Background(), time.Now().UTC().Add(-24*time.Hour), 10)
+	foundRecent, _ := repo.FindById(context.Background(), recent.AuthReqId)
+	expired, _ := repo.FindExpired(context.Background(), time.Now().UTC(), 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NotNil(t, foundRecent)
+	assert.Len(t, expired, 1)
+}
+
+func TestAccessTokenRepository_DeleteExpiredBefore(t *testing.T) {
+	repo := newTestDataStore(t, nil).GetAccessTokenRepository()
+	expired := domain.NewAccessToken("expired", "client", "user", "openid", time.Now().UTC().Add(-1*time.Minute))
+	valid := domain.NewAccessToken("valid", "client", "user", "openid", time.Now().UTC().Add(1*time.Hour))
+	_ = repo.Create(context.Background(), expired)
+	_ = repo.Create(context.Background(), valid)
+
+	deleted, err := repo.DeleteExpiredBefore(context.Background(), time.Now().UTC(), 10)
+	foundExpired, _ := repo.Find(context.Background(), expired.Value)
+	foundValid, _ := repo.Find(context.Background(), valid.Value)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Nil(t, foundExpired)
+	assert.NotNil(t, foundValid)
+}
+
+func TestDataStore_ShouldEvictExpiredEntries_OnWrite(t *testing.T) {
+	ds := newTestDataStore(t, &DataStoreConfig{GracePeriod: time.Minute, EvictionInterval: 0})
+	withinGrace := newCibaSession(30 * time.Second)
+	pastGrace := newCibaSession(5 * time.Minute)
+	staleToken := domain.NewAccessToken("stale", "client", "user", "openid", time.Now().Add(-5*time.Minute))
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), withinGrace)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), pastGrace)
+	_ = ds.GetAccessTokenRepository().Create(context.Background(), staleToken)
+
+	var sessions, tokens int
+	_ = ds.store.db.View(func(tx *bbolt.Tx) error {
+		sessions = tx.Bucket(bucketCibaSessions).Stats().KeyN
+		tokens = tx.Bucket(bucketAccessTokens).Stats().KeyN
+		return nil
+	})
+
+	assert.Equal(t, 1, sessions)
+	assert.Equal(t, 0, tokens)
+}
+
+func TestUserClaimRepository_GetUserClaims(t *testing.T) {
+	ds := newTestDataStore(t, nil)
+	_ = ds.AddUserAccount(&test_data.User1)
+	_ = ds.AddScope("profile", "name")
+	_ = ds.AddScope("email", "email")
+
+	claims, err := ds.GetUserClaimRepository().GetUserClaims(context.Background(), test_data.User1.Id, "openid profile email")
+	unknownUserClaims, unknownErr := ds.GetUserClaimRepository().GetUserClaims(context.Background(), "unknown", "profile")
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": test_data.User1.Name, "email": test_data.User1.Email}, claims)
+	assert.NoError(t, unknownErr)
+	assert.Empty(t, unknownUserClaims)
+}
+
+func TestKeyRepository_FindPrivateKeyByClientId(t *testing.T) {
+	ds := newTestDataStore(t, nil)
+	_ = ds.AddKey(&test_data.Key1)
+
+	key, err := ds.GetKeyRepository().FindPrivateKeyByClientId(context.Background(), test_data.Key1.ClientId)
+	unknown, _ := ds.GetKeyRepository().FindPrivateKeyByClientId(context.Background(), "missing-client")
+
+	assert.NoError(t, err)
+	assert.Equal(t, test_data.Key1, *key)
+	assert.Nil(t, unknown)
+}
+
+func TestDataStore_WithinTransaction_ShouldApplyWrites(t *testing.T) {
+	ds := newTestDataStore(t, nil)
+	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+	cs := newCibaSession(0)
+
+	err := ds.WithinTransaction(context.Background(), func(tx repository.DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(context.Background(), accessToken); err != nil {
+			return err
+		}
+		// Reads within the transaction see its writes.
+		if found, _ := tx.GetAccessTokenRepository().Find(context.Background(), accessToken.Value); found == nil {
+			return errors.New("write not visible within transaction")
+		}
+		return tx.GetCibaSessionRepository().Create(context.Background(), cs)
+	})
+	foundToken, _ := ds.GetAccessTokenRepository().Find(context.Background(), accessToken.Value)
+	foundSession, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cs.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, foundToken)
+	assert.NotNil(t, foundSession)
+}
+
+func TestDataStore_WithinTransaction_ShouldDiscardWrites_WhenFnFails(t *testing.T) {
+	ds := newTestDataStore(t, nil)
+	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+	fnErr := errors.New("failed")
+
+	err := ds.WithinTransaction(context.Background(), func(tx repository.DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(context.Background(), accessToken); err != nil {
+			return err
+		}
+		return fnErr
+	})
+	found, _ := ds.GetAccessTokenRepository().Find(context.Background(), accessToken.Value)
+
+	assert.Equal(t, fnErr, err)
+	assert.Nil(t, found)
+}
+
+func TestDataStore_ShouldReturnError_WhenContextIsCancelled(t *testing.T) {
+	ds := newTestDataStore(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	createErr := ds.GetCibaSessionRepository().Create(ctx, newCibaSession(0))
+	_, findErr := ds.GetAccessTokenRepository().Find(ctx, "token")
+
+	assert.True(t, errors.Is(createErr, context.Canceled))
+	assert.True(t, errors.Is(findErr, context.Canceled))
+}
+
+func TestDataStore_Conformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (repository.DataStoreInterface, repositorytest.Seeder) {
+		ds := newTestDataStore(t, nil)
+		return ds, ds
+	})
+}
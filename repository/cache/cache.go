@@ -0,0 +1,283 @@
+// Package cache provides read-through caching decorators for the repositories read on every request,
+// client applications, keys and user accounts.
+package cache
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+)
+
+const (
+	DefaultSize = 1000
+	DefaultTTL  = 5 * time.Minute
+)
+
+type Config struct {
+	// The maximum number of entries kept by each cache, the least recently used ones are dropped first.
+	Size int
+	// How long an entry is kept before being read again from the decorated repository.
+	TTL time.Duration
+	// Propagates invalidations to the other server instances, nil if there are none.
+	Invalidator Invalidator
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Size: DefaultSize,
+		TTL:  DefaultTTL,
+	}
+}
+
+type cache struct {
+	kind        string
+	entries     *lru
+	invalidator Invalidator
+}
+
+func newCache(kind string, config *Config) *cache {
+	c := &cache{
+		kind:        kind,
+		entries:     newLRU(config.Size, config.TTL),
+		invalidator: config.Invalidator,
+	}
+	if c.invalidator != nil {
+		c.invalidator.Subscribe(kind, c.entries.remove)
+	}
+	return c
+}
+
+func (c *cache) invalidate(ctx context.Context, key string) error {
+	c.entries.remove(key)
+	if c.invalidator == nil {
+		return nil
+	}
+	return c.invalidator.Publish(ctx, c.kind, key)
+}
+
+// Invalidates after a write that already succeeded, so a failure is only logged.
+func (c *cache) invalidateAfterWrite(ctx context.Context, key string) {
+	if err := c.invalidate(ctx, key); err != nil {
+		log.Printf("[go-ciba][cache] failed publishing invalidation of %s %s %s\n", c.kind, key, err.Error())
+	}
+}
+
+type clientApplicationRepository struct {
+	repo  repository.ClientApplicationRepositoryInterface
+	cache *cache
+}
+
+// Creates a repository caching the client applications found by repo.
+func NewClientApplicationRepository(repo repository.ClientApplicationRepositoryInterface) *clientApplicationRepository {
+	return NewCustomClientApplicationRepository(repo, NewConfig())
+}
+
+func NewCustomClientApplicationRepository(repo repository.ClientApplicationRepositoryInterface, config *Config) *clientApplicationRepository {
+	return &clientApplicationRepository{
+		repo:  repo,
+		cache: newCache(KindClientApplication, config),
+	}
+}
+
+func (c *clientApplicationRepository) Register(ctx context.Context, clientApp *domain.ClientApplication) error {
+	if err := c.repo.Register(ctx, clientApp); err != nil {
+		return err
+	}
+	c.cache.invalidateAfterWrite(ctx, clientApp.Id)
+	return nil
+}
+
+func (c *clientApplicationRepository) FindById(ctx context.Context, id string) (*domain.ClientApplication, error) {
+	if value, ok := c.cache.entries.get(id); ok {
+		clientApp := value.(domain.ClientApplication)
+		return &clientApp, nil
+	}
+	clientApp, err := c.repo.FindById(ctx, id)
+	if err != nil || clientApp == nil {
+		return clientApp, err
+	}
+	c.cache.entries.add(id, *clientApp)
+	return clientApp, nil
+}
+
+// Drops the client application with the given id, to be called when it's updated or deleted
+// other than through this repository.
+func (c *clientApplicationRepository) Invalidate(ctx context.Context, id string) error {
+	return c.cache.invalidate(ctx, id)
+}
+
+func (c *clientApplicationRepository) Stats() Stats {
+	return c.cache.entries.getStats()
+}
+
+type keyRepository struct {
+	repo  repository.KeyRepositoryInterface
+	cache *cache
+}
+
+// Creates a repository caching the keys found by repo.
+func NewKeyRepository(repo repository.KeyRepositoryInterface) *keyRepository {
+	return NewCustomKeyRepository(repo, NewConfig())
+}
+
+func NewCustomKeyRepository(repo repository.KeyRepositoryInterface, config *Config) *keyRepository {
+	return &keyRepository{
+		repo:  repo,
+		cache: newCache(KindKey, config),
+	}
+}
+
+func (k *keyRepository) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
+	if value, ok := k.cache.entries.get(clientId); ok {
+		key := value.(domain.Key)
+		return &key, nil
+	}
+	key, err := k.repo.FindPrivateKeyByClientId(ctx, clientId)
+	if err != nil || key == nil {
+		return key, err
+	}
+	k.cache.entries.add(clientId, *key)
+	return key, nil
+}
+
+// Drops the key of the client application with the given id, to be called when it's rotated or deleted.
+func (k *keyRepository) Invalidate(ctx context.Context, clientId string) error {
+	return k.cache.invalidate(ctx, clientId)
+}
+
+func (k *keyRepository) Stats() Stats {
+	return k.cache.entries.getStats()
+}
+
+type userAccountRepository struct {
+	repo  repository.UserAccountRepositoryInterface
+	cache *cache
+}
+
+// Creates a repository caching the user accounts found by repo.
+func NewUserAccountRepository(repo repository.UserAccountRepositoryInterface) *userAccountRepository {
+	return NewCustomUserAccountRepository(repo, NewConfig())
+}
+
+func NewCustomUserAccountRepository(repo repository.UserAccountRepositoryInterface, config *Config) *userAccountRepository {
+	return &userAccountRepository{
+		repo:  repo,
+		cache: newCache(KindUserAccount, config),
+	}
+}
+
+func (u *userAccountRepository) FindById(ctx context.Context, id string) (*domain.UserAccount, error) {
+	if value, ok := u.cache.entries.get(id); ok {
+		user := value.(domain.UserAccount)
+		return &user, nil
+	}
+	user, err := u.repo.FindById(ctx, id)
+	if err != nil || user == nil {
+		return user, err
+	}
+	u.cache.entries.add(id, *user)
+	return user, nil
+}
+
+// Drops the user account with the given id, to be called when it's updated or deleted.
+func (u *userAccountRepository) Invalidate(ctx context.Context, id string) error {
+	return u.cache.invalidate(ctx, id)
+}
+
+func (u *userAccountRepository) Stats() Stats {
+	return u.cache.entries.getStats()
+}
+
+// Decorates a data store so that its client application, key and user account repositories are cached.
+// The other repositories are the ones of the decorated data store.
+type DataStore struct {
+	repository.DataStoreInterface
+	clientApplicationRepo *clientApplicationRepository
+	keyRepo               *keyRepository
+	userAccountRepo       *userAccountRepository
+}
+
+func NewDataStore(ds repository.DataStoreInterface) *DataStore {
+	return NewCustomDataStore(ds, NewConfig())
+}
+
+func NewCustomDataStore(ds repository.DataStoreInterface, config *Config) *DataStore {
+	return &DataStore{
+		DataStoreInterface:    ds,
+		clientApplicationRepo: NewCustomClientApplicationRepository(ds.GetClientApplicationRepository(), config),
+		keyRepo:               NewCustomKeyRepository(ds.GetKeyRepository(), config),
+		userAccountRepo:       NewCustomUserAccountRepository(ds.GetUserAccountRepository(), config),
+	}
+}
+
+// Runs fn within a transaction of the decorated data store. Reads within fn aren't cached, since they may
+// see uncommitted writes, and the client applications registered by fn are invalidated once it's committed.
+func (d *DataStore) WithinTransaction(ctx context.Context, fn func(tx repository.DataStoreInterface) error) error {
+	var registered []string
+	err := d.DataStoreInterface.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		return fn(&txDataStore{DataStoreInterface: tx, registered: &registered})
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range registered {
+		d.clientApplicationRepo.cache.invalidateAfterWrite(ctx, id)
+	}
+	return nil
+}
+
+func (d *DataStore) GetClientApplicationRepository() repository.ClientApplicationRepositoryInterface {
+	return d.clientApplicationRepo
+}
+
+func (d *DataStore) GetKeyRepository() repository.KeyRepositoryInterface {
+	return d.keyRepo
+}
+
+func (d *DataStore) GetUserAccountRepository() repository.UserAccountRepositoryInterface {
+	return d.userAccountRepo
+}
+
+// Returns the hit and miss counts of the client application, key and user account caches, by kind.
+func (d *DataStore) Stats() map[string]Stats {
+	return map[string]Stats{
+		KindClientApplication: d.clientApplicationRepo.Stats(),
+		KindKey:               d.keyRepo.Stats(),
+		KindUserAccount:       d.userAccountRepo.Stats(),
+	}
+}
+
+// A data store bound to a transaction, recording the client applications registered within it.
+type txDataStore struct {
+	repository.DataStoreInterface
+	registered *[]string
+}
+
+func (t *txDataStore) WithinTransaction(ctx context.Context, fn func(tx repository.DataStoreInterface) error) error {
+	return t.DataStoreInterface.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		return fn(&txDataStore{DataStoreInterface: tx, registered: t.registered})
+	})
+}
+
+func (t *txDataStore) GetClientApplicationRepository() repository.ClientApplicationRepositoryInterface {
+	return &txClientApplicationRepository{
+		ClientApplicationRepositoryInterface: t.DataStoreInterface.GetClientApplicationRepository(),
+		registered:                           t.registered,
+	}
+}
+
+type txClientApplicationRepository struct {
+	repository.ClientApplicationRepositoryInterface
+	registered *[]string
+}
+
+func (t *txClientApplicationRepository) Register(ctx context.Context, clientApp *domain.ClientApplication) error {
+	if err := t.ClientApplicationRepositoryInterface.Register(ctx, clientApp); err != nil {
+		return err
+	}
+	*t.registered = append(*t.registered, clientApp.Id)
+	return nil
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/repository/repositorytest"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingClientApplicationRepository struct {
+	repository.ClientApplicationRepositoryInterface
+	finds int
+}
+
+func (c *countingClientApplicationRepository) FindById(ctx context.Context, id string) (*domain.ClientApplication, error) {
+	c.finds++
+	return c.ClientApplicationRepositoryInterface.FindById(ctx, id)
+}
+
+// Delivers invalidations synchronously to every subscriber, like instances sharing a Redis channel.
+type localInvalidator struct {
+	mu        sync.Mutex
+	handlers  map[string][]func(key string)
+	published int
+}
+
+func newLocalInvalidator() *localInvalidator {
+	return &localInvalidator{handlers: make(map[string][]func(key string))}
+}
+
+func (l *localInvalidator) Publish(ctx context.Context, kind, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.published++
+	for _, invalidate := range l.handlers[kind] {
+		invalidate(key)
+	}
+	return nil
+}
+
+func (l *localInvalidator) Subscribe(kind string, invalidate func(key string)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[kind] = append(l.handlers[kind], invalidate)
+}
+
+func TestClientApplicationRepository_FindById_ShouldReadThrough(t *testing.T) {
+	ds := memory.NewDataStore()
+	clientApp := test_data.ClientAppPoll
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &clientApp)
+	counting := &countingClientApplicationRepository{ClientApplicationRepositoryInterface: ds.GetClientApplicationRepository()}
+	repo := NewClientApplicationRepository(counting)
+
+	first, err := repo.FindById(context.Background(), clientApp.Id)
+	expected := *first
+	first.Name = "changed"
+	second, secondErr := repo.FindById(context.Background(), clientApp.Id)
+
+	assert.NoError(t, err)
+	assert.NoError(t, secondErr)
+	assert.Equal(t, expected, *second)
+	assert.Equal(t, 1, counting.finds)
+	assert.Equal(t, Stats{Hits: 1, Misses: 1}, repo.Stats())
+}
+
+func TestClientApplicationRepository_FindById_ShouldNotCacheMissingClientApplication(t *testing.T) {
+	ds := memory.NewDataStore()
+	repo := NewClientApplicationRepository(ds.GetClientApplicationRepository())
+	clientApp := test_data.ClientAppPoll
+
+	missing, _ := repo.FindById(context.Background(), clientApp.Id)
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &clientApp)
+	found, err := repo.FindById(context.Background(), clientApp.Id)
+
+	assert.Nil(t, missing)
+	assert.NoError(t, err)
+	assert.NotNil(t, found)
+}
+
+func TestClientApplicationRepository_Register_ShouldInvalidateEveryInstance(t *testing.T) {
+	ds := memory.NewDataStore()
+	clientApp := test_data.ClientAppPoll
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &clientApp)
+	invalidator := newLocalInvalidator()
+	config := &Config{Size: 10, TTL: DefaultTTL, Invalidator: invalidator}
+	instance1 := NewCustomClientApplicationRepository(ds.GetClientApplicationRepository(), config)
+	instance2 := NewCustomClientApplicationRepository(ds.GetClientApplicationRepository(), config)
+	_, _ = instance2.FindById(context.Background(), clientApp.Id)
+
+	clientApp.Name = "renamed"
+	err := instance1.Register(context.Background(), &clientApp)
+	found, _ := instance2.FindById(context.Background(), clientApp.Id)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, invalidator.published)
+	assert.Equal(t, "renamed", found.Name)
+	assert.Equal(t, Stats{Misses: 2}, instance2.Stats())
+}
+
+func TestKeyRepository_Invalidate_ShouldDropKey(t *testing.T) {
+	ds := memory.NewDataStore()
+	key := test_data.Key1
+	ds.AddKey(&key)
+	repo := NewKeyRepository(ds.GetKeyRepository())
+	_, _ = repo.FindPrivateKeyByClientId(context.Background(), key.ClientId)
+
+	rotated := key
+	rotated.Id = "rotated"
+	ds.AddKey(&rotated)
+	stale, _ := repo.FindPrivateKeyByClientId(context.Background(), key.ClientId)
+	err := repo.Invalidate(context.Background(), key.ClientId)
+	fresh, _ := repo.FindPrivateKeyByClientId(context.Background(), key.ClientId)
+
+	assert.NoError(t, err)
+	assert.Equal(t, key.Id, stale.Id)
+	assert.Equal(t, rotated.Id, fresh.Id)
+}
+
+func TestUserAccountRepository_FindById_ShouldReturnError_WhenRepositoryFails(t *testing.T) {
+	ds := memory.NewDataStore()
+	repo := NewUserAccountRepository(ds.GetUserAccountRepository())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	user, err := repo.FindById(ctx, test_data.User1.Id)
+
+	assert.Nil(t, user)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestDataStore_WithinTransaction_ShouldInvalidateRegisteredClientApplications_OnceCommitted(t *testing.T) {
+	ds := NewDataStore(memory.NewDataStore())
+	clientApp := test_data.ClientAppPoll
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &clientApp)
+	_, _ = ds.GetClientApplicationRepository().FindById(context.Background(), clientApp.Id)
+
+	failedErr := ds.WithinTransaction(context.Background(), func(tx repository.DataStoreInterface) error {
+		renamed := clientApp
+		renamed.Name = "discarded"
+		if err := tx.GetClientApplicationRepository().Register(context.Background(), &renamed); err != nil {
+			return err
+		}
+		return errors.New("failed")
+	})
+	afterFailure, _ := ds.GetClientApplicationRepository().FindById(context.Background(), clientApp.Id)
+	err := ds.WithinTransaction(context.Background(), func(tx repository.DataStoreInterface) error {
+		renamed := clientApp
+		renamed.Name = "renamed"
+		return tx.GetClientApplicationRepository().Register(context.Background(), &renamed)
+	})
+	afterCommit, _ := ds.GetClientApplicationRepository().FindById(context.Background(), clientApp.Id)
+
+	assert.Error(t, failedErr)
+	assert.Equal(t, clientApp.Name, afterFailure.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, "renamed", afterCommit.Name)
+	assert.Equal(t, Stats{Hits: 1, Misses: 2}, ds.Stats()[KindClientApplication])
+}
+
+func TestDataStore_Conformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (repository.DataStoreInterface, repositorytest.Seeder) {
+		ds := memory.NewDataStore()
+		return NewDataStore(ds), seeder{ds: ds}
+	})
+}
+
+type seeder struct {
+	ds *memory.DataStore
+}
+
+func (s seeder) AddKey(key *domain.Key) error {
+	s.ds.AddKey(key)
+	return nil
+}
+
+func (s seeder) AddUserAccount(user *domain.UserAccount) error {
+	s.ds.AddUserAccount(user)
+	return nil
+}
+
+func (s seeder) AddScope(scope string, claims ...string) error {
+	s.ds.AddScope(scope, claims...)
+	return nil
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const DefaultInvalidationChannel = "go-ciba:cache:invalidate"
+
+// Kinds of cached entries, telling caches apart in invalidation messages.
+const (
+	KindClientApplication = "client_application"
+	KindKey               = "key"
+	KindUserAccount       = "user_account"
+)
+
+// Propagates cache invalidations between server instances.
+type Invalidator interface {
+	// Tells every instance to drop the entry with the given key from its caches of the given kind.
+	Publish(ctx context.Context, kind, key string) error
+	// Registers a function dropping entries from a cache of the given kind, called for every published invalidation.
+	Subscribe(kind string, invalidate func(key string))
+}
+
+type redisInvalidator struct {
+	client  *redis.Client
+	channel string
+
+	mu       sync.RWMutex
+	handlers map[string][]func(key string)
+
+	pubSub *redis.PubSub
+	wg     sync.WaitGroup
+}
+
+// Creates an invalidator propagating invalidations through Redis pub/sub on DefaultInvalidationChannel.
+// Start must be called to receive the invalidations published by other instances.
+func NewRedisInvalidator(client *redis.Client) *redisInvalidator {
+	return NewCustomRedisInvalidator(client, DefaultInvalidationChannel)
+}
+
+func NewCustomRedisInvalidator(client *redis.Client, channel string) *redisInvalidator {
+	return &redisInvalidator{
+		client:   client,
+		channel:  channel,
+		handlers: make(map[string][]func(key string)),
+	}
+}
+
+func (r *redisInvalidator) Publish(ctx context.Context, kind, key string) error {
+	return r.client.Publish(ctx, r.channel, fmt.Sprintf("%s:%s", kind, key)).Err()
+}
+
+func (r *redisInvalidator) Subscribe(kind string, invalidate func(key string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[kind] = append(r.handlers[kind], invalidate)
+}
+
+// Subscribes to the channel and dispatches the invalidations received until Stop is called.
+func (r *redisInvalidator) Start(ctx context.Context) error {
+	r.pubSub = r.client.Subscribe(ctx, r.channel)
+	// Wait for the subscription to be confirmed so that no invalidation published afterwards is missed.
+	if _, err := r.pubSub.Receive(ctx); err != nil {
+		_ = r.pubSub.Close()
+		return err
+	}
+	messages := r.pubSub.Channel()
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for message := range messages {
+			r.handle(message.Payload)
+		}
+	}()
+	return nil
+}
+
+// Unsubscribes from the channel and waits for the invalidations being dispatched to finish.
+func (r *redisInvalidator) Stop() error {
+	err := r.pubSub.Close()
+	r.wg.Wait()
+	return err
+}
+
+func (r *redisInvalidator) handle(payload string) {
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 {
+		log.Printf("[go-ciba][cache] ignoring malformed invalidation %s\n", payload)
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, invalidate := range r.handlers[parts[0]] {
+		invalidate(parts[1])
+	}
+}
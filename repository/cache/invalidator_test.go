@@ -0,0 +1,21 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisInvalidator_Handle_ShouldDispatchToSubscribersOfKind(t *testing.T) {
+	invalidator := NewRedisInvalidator(nil)
+	var clientApps, keys []string
+	invalidator.Subscribe(KindClientApplication, func(key string) { clientApps = append(clientApps, key) })
+	invalidator.Subscribe(KindKey, func(key string) { keys = append(keys, key) })
+
+	invalidator.handle("client_application:1:2")
+	invalidator.handle("key:3")
+	invalidator.handle("malformed")
+
+	assert.Equal(t, []string{"1:2"}, clientApps)
+	assert.Equal(t, []string{"3"}, keys)
+}
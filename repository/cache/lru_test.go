@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU_ShouldDropLeastRecentlyUsedEntry_WhenFull(t *testing.T) {
+	c := newLRU(2, time.Minute)
+	c.add("a", 1)
+	c.add("b", 2)
+	_, _ = c.get("a")
+	c.add("c", 3)
+
+	_, foundA := c.get("a")
+	_, foundB := c.get("b")
+	_, foundC := c.get("c")
+
+	assert.True(t, foundA)
+	assert.False(t, foundB)
+	assert.True(t, foundC)
+	assert.Equal(t, 2, c.len())
+}
+
+func TestLRU_ShouldMissExpiredEntry(t *testing.T) {
+	now := time.Now()
+	c := newLRU(2, time.Minute)
+	c.now = func() time.Time { return now }
+	c.add("a", 1)
+
+	_, foundBeforeExpiry := c.get("a")
+	now = now.Add(2 * time.Minute)
+	_, foundAfterExpiry := c.get("a")
+
+	assert.True(t, foundBeforeExpiry)
+	assert.False(t, foundAfterExpiry)
+	assert.Equal(t, 0, c.len())
+	assert.Equal(t, Stats{Hits: 1, Misses: 1}, c.getStats())
+}
+
+func TestLRU_Add_ShouldReplaceValueAndRefreshExpiry(t *testing.T) {
+	now := time.Now()
+	c := newLRU(2, time.Minute)
+	c.now = func() time.Time { return now }
+	c.add("a", 1)
+	now = now.Add(50 * time.Second)
+	c.add("a", 2)
+	now = now.Add(50 * time.Second)
+
+	value, found := c.get("a")
+
+	assert.True(t, found)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, 1, c.len())
+}
@@ -0,0 +1,99 @@
+package repository_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/migrations"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/repositorytest"
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis/v8"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type sqliteSeeder struct {
+	db *sql.DB
+}
+
+func (s *sqliteSeeder) AddKey(key *domain.Key) error {
+	_, err := s.db.Exec("INSERT INTO keys (id, client_id, alg, public, private) VALUES (?, ?, ?, ?, ?)",
+		key.Id, key.ClientId, key.Alg, key.Public, key.Private)
+	return err
+}
+
+func (s *sqliteSeeder) AddUserAccount(user *domain.UserAccount) error {
+	now := time.Now().UTC()
+	_, err := s.db.Exec("INSERT INTO user_accounts (id, name, email, password, user_code, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		user.Id, user.Name, user.Email, user.Password, user.UserCode, now, now)
+	return err
+}
+
+func (s *sqliteSeeder) AddScope(scope string, claims ...string) error {
+	if _, err := s.db.Exec("INSERT INTO scopes (id, name) VALUES (?, ?)", scope, scope); err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		if _, err := s.db.Exec("INSERT OR IGNORE INTO claims (id, name) VALUES (?, ?)", claim, claim); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec("INSERT INTO scope_claims (scope_id, claim_id) VALUES (?, ?)", scope, claim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type redisSeeder struct {
+	client *redis.Client
+}
+
+func (s *redisSeeder) AddKey(key *domain.Key) error {
+	return s.client.Set(context.Background(), fmt.Sprintf("oauth_key:%s", key.ClientId), key, 0).Err()
+}
+
+func (s *redisSeeder) AddUserAccount(user *domain.UserAccount) error {
+	return s.client.Set(context.Background(), fmt.Sprintf("user_account:%s", user.Id), user, 0).Err()
+}
+
+func (s *redisSeeder) AddScope(scope string, claims ...string) error {
+	values := make([]interface{}, len(claims))
+	for i, claim := range claims {
+		values[i] = claim
+	}
+	return s.client.RPush(context.Background(), "scope:"+scope, values...).Err()
+}
+
+func TestSQLDataStore_Conformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (repository.DataStoreInterface, repositorytest.Seeder) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every connection to :memory: is a different database.
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		if err := migrations.Migrate(context.Background(), db, "sqlite3", ""); err != nil {
+			t.Fatal(err)
+		}
+		return repository.NewSQLDataStore(db, "sqlite3", ""), &sqliteSeeder{db: db}
+	})
+}
+
+func TestRedisDataStore_Conformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (repository.DataStoreInterface, repositorytest.Seeder) {
+		miniRedis, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(miniRedis.Close)
+		client := redis.NewClient(&redis.Options{Addr: miniRedis.Addr()})
+		return repository.NewRedisDataStore(client), &redisSeeder{client: client}
+	})
+}
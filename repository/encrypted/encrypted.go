@@ -0,0 +1,153 @@
+// Package encrypted provides a data store decorator keeping private keys encrypted at rest.
+package encrypted
+
+import (
+	"context"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+type keyRepository struct {
+	repo     repository.KeyRepositoryInterface
+	provider util.KeyEncryptionProvider
+}
+
+// Creates a repository decrypting the private keys found by repo.
+func NewKeyRepository(repo repository.KeyRepositoryInterface, provider util.KeyEncryptionProvider) *keyRepository {
+	return &keyRepository{
+		repo:     repo,
+		provider: provider,
+	}
+}
+
+func (k *keyRepository) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
+	key, err := k.repo.FindPrivateKeyByClientId(ctx, clientId)
+	if err != nil || key == nil {
+		return key, err
+	}
+	private, err := util.OpenPrivateKey(k.provider, key.Id, key.Private)
+	if err != nil {
+		return nil, err
+	}
+	key.Private = private
+	return key, nil
+}
+
+type signingKeyRepository struct {
+	repo     repository.SigningKeyRepositoryInterface
+	provider util.KeyEncryptionProvider
+}
+
+// Creates a repository encrypting the private keys stored by repo, and decrypting the ones it finds.
+func NewSigningKeyRepository(repo repository.SigningKeyRepositoryInterface, provider util.KeyEncryptionProvider) *signingKeyRepository {
+	return &signingKeyRepository{
+		repo:     repo,
+		provider: provider,
+	}
+}
+
+func (s *signingKeyRepository) Create(ctx context.Context, key *domain.SigningKey) error {
+	sealed, err := s.seal(key)
+	if err != nil {
+		return err
+	}
+	return s.repo.Create(ctx, sealed)
+}
+
+func (s *signingKeyRepository) Update(ctx context.Context, key *domain.SigningKey) error {
+	sealed, err := s.seal(key)
+	if err != nil {
+		return err
+	}
+	return s.repo.Update(ctx, sealed)
+}
+
+func (s *signingKeyRepository) FindAll(ctx context.Context) ([]*domain.SigningKey, error) {
+	keys, err := s.repo.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Private, err = util.OpenPrivateKey(s.provider, key.Id, key.Private); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (s *signingKeyRepository) Delete(ctx context.Context, id string) error {
+	return s.repo.Delete(ctx, id)
+}
+
+// Returns a copy of the key with its private key encrypted.
+func (s *signingKeyRepository) seal(key *domain.SigningKey) (*domain.SigningKey, error) {
+	sealed := *key
+	if util.IsSealedPrivateKey(sealed.Private) {
+		return &sealed, nil
+	}
+	private, err := util.SealPrivateKey(s.provider, key.Id, key.Private)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Private = private
+	return &sealed, nil
+}
+
+// Decorates a data store so that the private keys of its key and signing key repositories are
+// encrypted at rest. Private keys stored in plaintext beforehand are still read.
+type DataStore struct {
+	repository.DataStoreInterface
+	provider       util.KeyEncryptionProvider
+	keyRepo        *keyRepository
+	signingKeyRepo *signingKeyRepository
+}
+
+func NewDataStore(ds repository.DataStoreInterface, provider util.KeyEncryptionProvider) *DataStore {
+	return &DataStore{
+		DataStoreInterface: ds,
+		provider:           provider,
+		keyRepo:            NewKeyRepository(ds.GetKeyRepository(), provider),
+		signingKeyRepo:     NewSigningKeyRepository(ds.GetSigningKeyRepository(), provider),
+	}
+}
+
+func (d *DataStore) WithinTransaction(ctx context.Context, fn func(tx repository.DataStoreInterface) error) error {
+	return d.DataStoreInterface.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		return fn(NewDataStore(tx, d.provider))
+	})
+}
+
+func (d *DataStore) GetKeyRepository() repository.KeyRepositoryInterface {
+	return d.keyRepo
+}
+
+func (d *DataStore) GetSigningKeyRepository() repository.SigningKeyRepositoryInterface {
+	return d.signingKeyRepo
+}
+
+// Encrypts the private keys of the signing keys stored in plaintext. Returns the number of keys encrypted.
+func (d *DataStore) EncryptSigningKeys(ctx context.Context) (int, error) {
+	keys, err := d.DataStoreInterface.GetSigningKeyRepository().FindAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+	encrypted := 0
+	err = d.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		for _, key := range keys {
+			if util.IsSealedPrivateKey(key.Private) {
+				continue
+			}
+			if err := tx.GetSigningKeyRepository().Update(ctx, key); err != nil {
+				return err
+			}
+			encrypted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return encrypted, nil
+}
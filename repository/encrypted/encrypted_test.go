@@ -0,0 +1,182 @@
+package encrypted
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/repository/repositorytest"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProvider(t *testing.T) util.KeyEncryptionProvider {
+	provider, err := util.NewLocalKeyEncryptionProvider([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func newSigningKey(id string) *domain.SigningKey {
+	return &domain.SigningKey{
+		Id:        id,
+		Alg:       "RS256",
+		Public:    "public",
+		Private:   "private",
+		State:     domain.SigningKeyStateNext,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func TestKeyRepository_FindPrivateKeyByClientId_ShouldDecryptPrivateKey(t *testing.T) {
+	provider := newTestProvider(t)
+	ds := memory.NewDataStore()
+	key := test_data.Key1
+	key.Private, _ = util.SealPrivateKey(provider, key.Id, test_data.Key1.Private)
+	ds.AddKey(&key)
+
+	found, err := NewDataStore(ds, provider).GetKeyRepository().FindPrivateKeyByClientId(context.Background(), key.ClientId)
+
+	assert.NoError(t, err)
+	assert.Equal(t, test_data.Key1.Private, found.Private)
+}
+
+func TestKeyRepository_FindPrivateKeyByClientId_ShouldReadPlaintextPrivateKey(t *testing.T) {
+	ds := memory.NewDataStore()
+	ds.AddKey(&test_data.Key1)
+
+	found, err := NewDataStore(ds, newTestProvider(t)).GetKeyRepository().FindPrivateKeyByClientId(context.Background(), test_data.Key1.ClientId)
+
+	assert.NoError(t, err)
+	assert.Equal(t, test_data.Key1.Private, found.Private)
+}
+
+func TestSigningKeyRepository_ShouldStoreEncryptedPrivateKey(t *testing.T) {
+	ds := memory.NewDataStore()
+	repo := NewDataStore(ds, newTestProvider(t)).GetSigningKeyRepository()
+	key := newSigningKey("key-1")
+
+	err := repo.Create(context.Background(), key)
+	stored, _ := ds.GetSigningKeyRepository().FindAll(context.Background())
+	found, findErr := repo.FindAll(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "private", key.Private)
+	assert.True(t, util.IsSealedPrivateKey(stored[0].Private))
+	assert.NoError(t, findErr)
+	assert.Equal(t, "private", found[0].Private)
+}
+
+func TestDataStore_WithinTransaction_ShouldEncryptPrivateKeys(t *testing.T) {
+	ds := memory.NewDataStore()
+	encrypted := NewDataStore(ds, newTestProvider(t))
+
+	err := encrypted.WithinTransaction(context.Background(), func(tx repository.DataStoreInterface) error {
+		return tx.GetSigningKeyRepository().Create(context.Background(), newSigningKey("key-1"))
+	})
+	stored, _ := ds.GetSigningKeyRepository().FindAll(context.Background())
+
+	assert.NoError(t, err)
+	assert.True(t, util.IsSealedPrivateKey(stored[0].Private))
+}
+
+func TestDataStore_EncryptSigningKeys_ShouldEncryptPlaintextPrivateKeys(t *testing.T) {
+	ds := memory.NewDataStore()
+	provider := newTestProvider(t)
+	_ = ds.GetSigningKeyRepository().Create(context.Background(), newSigningKey("key-1"))
+	_ = NewDataStore(ds, provider).GetSigningKeyRepository().Create(context.Background(), newSigningKey("key-2"))
+
+	count, err := NewDataStore(ds, provider).EncryptSigningKeys(context.Background())
+	stored, _ := ds.GetSigningKeyRepository().FindAll(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	for _, key := range stored {
+		assert.True(t, util.IsSealedPrivateKey(key.Private), key.Id)
+	}
+}
+
+func TestDataStore_ShouldFail_WhenPrivateKeyWasEncryptedWithAnotherMasterKey(t *testing.T) {
+	ds := memory.NewDataStore()
+	_ = NewDataStore(ds, newTestProvider(t)).GetSigningKeyRepository().Create(context.Background(), newSigningKey("key-1"))
+	other, _ := util.NewLocalKeyEncryptionProvider([]byte("abcdef0123456789abcdef0123456789"))
+
+	keys, err := NewDataStore(ds, other).GetSigningKeyRepository().FindAll(context.Background())
+
+	assert.Error(t, err)
+	assert.Nil(t, keys)
+}
+
+func TestDataStore_ShouldFail_WhenPrivateKeyWasCopiedFromAnotherKey(t *testing.T) {
+	ds := memory.NewDataStore()
+	provider := newTestProvider(t)
+	_ = NewDataStore(ds, provider).GetSigningKeyRepository().Create(context.Background(), newSigningKey("key-1"))
+	stored, _ := ds.GetSigningKeyRepository().FindAll(context.Background())
+	copied := newSigningKey("key-2")
+	copied.Private = stored[0].Private
+	_ = ds.GetSigningKeyRepository().Create(context.Background(), copied)
+
+	keys, err := NewDataStore(ds, provider).GetSigningKeyRepository().FindAll(context.Background())
+
+	assert.Error(t, err)
+	assert.Nil(t, keys)
+}
+
+type failingProvider struct{}
+
+func (failingProvider) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	return nil, errors.New("provider is unavailable")
+}
+
+func (failingProvider) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	return nil, errors.New("provider is unavailable")
+}
+
+func TestSigningKeyRepository_Create_ShouldFail_WhenEncryptionFails(t *testing.T) {
+	ds := memory.NewDataStore()
+
+	err := NewDataStore(ds, failingProvider{}).GetSigningKeyRepository().Create(context.Background(), newSigningKey("key-1"))
+	stored, _ := ds.GetSigningKeyRepository().FindAll(context.Background())
+
+	assert.EqualError(t, err, "provider is unavailable")
+	assert.Len(t, stored, 0)
+}
+
+type seeder struct {
+	ds       *memory.DataStore
+	provider util.KeyEncryptionProvider
+}
+
+func (s seeder) AddKey(key *domain.Key) error {
+	sealed := *key
+	var err error
+	if sealed.Private, err = util.SealPrivateKey(s.provider, key.Id, key.Private); err != nil {
+		return err
+	}
+	s.ds.AddKey(&sealed)
+	return nil
+}
+
+func (s seeder) AddUserAccount(user *domain.UserAccount) error {
+	s.ds.AddUserAccount(user)
+	return nil
+}
+
+func (s seeder) AddScope(scope string, claims ...string) error {
+	s.ds.AddScope(scope, claims...)
+	return nil
+}
+
+func TestDataStore_Conformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (repository.DataStoreInterface, repositorytest.Seeder) {
+		ds := memory.NewDataStore()
+		provider := newTestProvider(t)
+		return NewDataStore(ds, provider), seeder{ds: ds, provider: provider}
+	})
+}
@@ -0,0 +1,978 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+)
+
+// How long Ciba sessions and access tokens are kept after they expire,
+// so that late requests still get an expired error instead of an unknown one.
+const DefaultGracePeriod = 1 * time.Hour
+
+// How often expired Ciba sessions and access tokens are evicted, at most.
+const DefaultEvictionInterval = 1 * time.Minute
+
+type DataStoreConfig struct {
+	// How long Ciba sessions and access tokens are kept after they expire.
+	GracePeriod time.Duration
+	// How often expired Ciba sessions and access tokens are evicted, at most.
+	// Eviction happens on writes, reads never return evicted entries.
+	EvictionInterval time.Duration
+}
+
+// The maps shared by a data store and every transaction started from it.
+type store struct {
+	mu     sync.RWMutex
+	config *DataStoreConfig
+
+	clientApps   map[string]*domain.ClientApplication
+	cibaSessions map[string]*domain.CibaSession
+	accessTokens map[string]*domain.AccessToken
+	// Keyed by client id.
+	keys         map[string]*domain.Key
+	signingKeys  map[string]*domain.SigningKey
+	userAccounts map[string]*domain.UserAccount
+	scopes       map[string]*domain.Scope
+	claims       map[string]*domain.Claim
+	userDevices  map[string]*domain.UserDevice
+	// Keyed by user id then client id.
+	grants map[string]map[string]*domain.Grant
+
+	lastEviction time.Time
+}
+
+// A write that is applied with the store lock held. It returns a function reverting it.
+type operation func(s *store) (undo func(), err error)
+
+// The writes of a transaction, applied all together on commit.
+type transaction struct {
+	operations []operation
+}
+
+// Applies op right away, or queues it when tx isn't nil.
+func (s *store) write(ctx context.Context, tx *transaction, op operation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tx != nil {
+		tx.operations = append(tx.operations, op)
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := op(s)
+	s.evictIfDue()
+	return err
+}
+
+// Applies every operation of tx, or none of them if one fails.
+func (s *store) commit(tx *transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	undos := make([]func(), 0, len(tx.operations))
+	for _, op := range tx.operations {
+		undo, err := op(s)
+		if err != nil {
+			for i := len(undos) - 1; i >= 0; i-- {
+				undos[i]()
+			}
+			return err
+		}
+		undos = append(undos, undo)
+	}
+	s.evictIfDue()
+	return nil
+}
+
+func (s *store) isEvictable(expiresAt time.Time) bool {
+	return time.Now().After(expiresAt.Add(s.config.GracePeriod))
+}
+
+// Deletes the Ciba sessions and access tokens past their grace period. Must be called with the lock held.
+func (s *store) evictIfDue() {
+	if time.Since(s.lastEviction) < s.config.EvictionInterval {
+		return
+	}
+	s.lastEviction = time.Now()
+	for id, cs := range s.cibaSessions {
+		if s.isEvictable(cs.GetExpiresAt()) {
+			delete(s.cibaSessions, id)
+		}
+	}
+	for value, at := range s.accessTokens {
+		if s.isEvictable(at.Expires) {
+			delete(s.accessTokens, value)
+		}
+	}
+}
+
+// Returns a copy of the Ciba session that shares nothing with the original.
+func copyCibaSession(cs *domain.CibaSession) *domain.CibaSession {
+	c := *cs
+	if cs.Interval != nil {
+		interval := *cs.Interval
+		c.Interval = &interval
+	}
+	if cs.Consented != nil {
+		consented := *cs.Consented
+		c.Consented = &consented
+	}
+	if cs.LatestTokenRequestedAt != nil {
+		latestTokenRequestedAt := *cs.LatestTokenRequestedAt
+		c.LatestTokenRequestedAt = &latestTokenRequestedAt
+	}
+	if cs.History != nil {
+		c.History = make([]domain.CibaSessionTransition, len(cs.History))
+		copy(c.History, cs.History)
+	}
+	return &c
+}
+
+type clientApplicationRepository struct {
+	store *store
+	tx    *transaction
+}
+
+func (c *clientApplicationRepository) Register(ctx context.Context, clientApp *domain.ClientApplication) error {
+	ca, err := clientApp.WithHashedSecret()
+	if err != nil {
+		return err
+	}
+	return c.store.write(ctx, c.tx, func(s *store) (func(), error) {
+		previous, existed := s.clientApps[ca.Id]
+		s.clientApps[ca.Id] = ca
+		return func() {
+			if existed {
+				s.clientApps[ca.Id] = previous
+			} else {
+				delete(s.clientApps, ca.Id)
+			}
+		}, nil
+	})
+}
+
+func (c *clientApplicationRepository) FindById(ctx context.Context, id string) (*domain.ClientApplication, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	clientApp, ok := c.store.clientApps[id]
+	if !ok {
+		return nil, nil
+	}
+	ca := *clientApp
+	return &ca, nil
+}
+
+type cibaSessionRepository struct {
+	store *store
+	tx    *transaction
+}
+
+func (c *cibaSessionRepository) Create(ctx context.Context, cibaSession *domain.CibaSession) error {
+	cs := copyCibaSession(cibaSession)
+	return c.store.write(ctx, c.tx, func(s *store) (func(), error) {
+		previous, existed := s.cibaSessions[cs.AuthReqId]
+		s.cibaSessions[cs.AuthReqId] = cs
+		return func() {
+			if existed {
+				s.cibaSessions[cs.AuthReqId] = previous
+			} else {
+				delete(s.cibaSessions, cs.AuthReqId)
+			}
+		}, nil
+	})
+}
+
+func (c *cibaSessionRepository) FindById(ctx context.Context, id string) (*domain.CibaSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	cs, ok := c.store.cibaSessions[id]
+	if !ok || c.store.isEvictable(cs.GetExpiresAt()) {
+		return nil, nil
+	}
+	return copyCibaSession(cs), nil
+}
+
+// Stores the Ciba session only if its history contains every transition of the stored one,
+// that is nobody else has changed its status since it was read. Returns repository.ErrConcurrentUpdate otherwise.
+func (c *cibaSessionRepository) Update(ctx context.Context, cibaSession *domain.CibaSession) error {
+	cs := copyCibaSession(cibaSession)
+	return c.store.write(ctx, c.tx, func(s *store) (func(), error) {
+		previous, existed := s.cibaSessions[cs.AuthReqId]
+		if existed && !isHistoryPrefix(previous.History, cs.History) {
+			return nil, repository.ErrConcurrentUpdate
+		}
+		s.cibaSessions[cs.AuthReqId] = cs
+		return func() {
+			if existed {
+				s.cibaSessions[cs.AuthReqId] = previous
+			} else {
+				delete(s.cibaSessions, cs.AuthReqId)
+			}
+		}, nil
+	})
+}
+
+func isHistoryPrefix(prefix, history []domain.CibaSessionTransition) bool {
+	if len(prefix) > len(history) {
+		return false
+	}
+	for i, t := range prefix {
+		if t.Seq != history[i].Seq || t.To != history[i].To || !t.CreatedAt.Equal(history[i].CreatedAt) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the Ciba sessions matching fn sorted by expiry time. Must be called with the lock held.
+func (c *cibaSessionRepository) expiredBefore(before time.Time, fn func(cs *domain.CibaSession) bool) []*domain.CibaSession {
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range c.store.cibaSessions {
+		if cs.GetExpiresAt().Before(before) && fn(cs) {
+			cibaSessions = append(cibaSessions, cs)
+		}
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].GetExpiresAt().Before(cibaSessions[j].GetExpiresAt())
+	})
+	return cibaSessions
+}
+
+func (c *cibaSessionRepository) FindExpired(ctx context.Context, before time.Time, limit int) ([]*domain.CibaSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	expired := c.expiredBefore(before, func(cs *domain.CibaSession) bool {
+		return !cs.IsFinal()
+	})
+	var cibaSessions []*domain.CibaSession
+	for i := 0; i < len(expired) && i < limit; i++ {
+		cibaSessions = append(cibaSessions, copyCibaSession(expired[i]))
+	}
+	return cibaSessions, nil
+}
+
+func (c *cibaSessionRepository) FindPendingByUserId(ctx context.Context, userId string, after time.Time) ([]*domain.CibaSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range c.store.cibaSessions {
+		if cs.UserId == userId && cs.IsAuthorizationPending() && cs.GetExpiresAt().After(after) {
+			cibaSessions = append(cibaSessions, copyCibaSession(cs))
+		}
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].CreatedAt.Before(cibaSessions[j].CreatedAt)
+	})
+	return cibaSessions, nil
+}
+
+func (c *cibaSessionRepository) FindActiveByUserIdAndClientId(ctx context.Context, userId, clientId string) ([]*domain.CibaSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range c.store.cibaSessions {
+		if cs.UserId == userId && cs.ClientId == clientId && !cs.IsFinal() {
+			cibaSessions = append(cibaSessions, copyCibaSession(cs))
+		}
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].CreatedAt.Before(cibaSessions[j].CreatedAt)
+	})
+	return cibaSessions, nil
+}
+
+func (c *cibaSessionRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	expired := c.expiredBefore(before, func(cs *domain.CibaSession) bool {
+		return true
+	})
+	deleted := 0
+	for ; deleted < len(expired) && deleted < limit; deleted++ {
+		delete(c.store.cibaSessions, expired[deleted].AuthReqId)
+	}
+	return deleted, nil
+}
+
+type accessTokenRepository struct {
+	store *store
+	tx    *transaction
+}
+
+func (a *accessTokenRepository) Create(ctx context.Context, accessToken *domain.AccessToken) error {
+	at := *accessToken
+	return a.store.write(ctx, a.tx, func(s *store) (func(), error) {
+		previous, existed := s.accessTokens[at.Value]
+		s.accessTokens[at.Value] = &at
+		return func() {
+			if existed {
+				s.accessTokens[at.Value] = previous
+			} else {
+				delete(s.accessTokens, at.Value)
+			}
+		}, nil
+	})
+}
+
+func (a *accessTokenRepository) Find(ctx context.Context, accessToken string) (*domain.AccessToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	a.store.mu.RLock()
+	defer a.store.mu.RUnlock()
+	token, ok := a.store.accessTokens[accessToken]
+	if !ok || a.store.isEvictable(token.Expires) {
+		return nil, nil
+	}
+	at := *token
+	return &at, nil
+}
+
+func (a *accessTokenRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	a.store.mu.Lock()
+	defer a.store.mu.Unlock()
+	var expired []*domain.AccessToken
+	for _, at := range a.store.accessTokens {
+		if at.Expires.Before(before) {
+			expired = append(expired, at)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Expires.Before(expired[j].Expires)
+	})
+	deleted := 0
+	for ; deleted < len(expired) && deleted < limit; deleted++ {
+		delete(a.store.accessTokens, expired[deleted].Value)
+	}
+	return deleted, nil
+}
+
+func (a *accessTokenRepository) DeleteByUserIdAndClientId(ctx context.Context, userId, clientId string) (int, error) {
+	deleted := 0
+	err := a.store.write(ctx, a.tx, func(s *store) (func(), error) {
+		removed := make(map[string]*domain.AccessToken)
+		for value, at := range s.accessTokens {
+			if at.UserId == userId && at.ClientId == clientId {
+				removed[value] = at
+				delete(s.accessTokens, value)
+			}
+		}
+		deleted = len(removed)
+		return func() {
+			for value, at := range removed {
+				s.accessTokens[value] = at
+			}
+		}, nil
+	})
+	return deleted, err
+}
+
+type keyRepository struct {
+	store *store
+}
+
+func (k *keyRepository) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k.store.mu.RLock()
+	defer k.store.mu.RUnlock()
+	key, ok := k.store.keys[clientId]
+	if !ok {
+		return nil, nil
+	}
+	copied := *key
+	return &copied, nil
+}
+
+// Returns a copy of the signing key that shares nothing with the original.
+func copySigningKey(key *domain.SigningKey) *domain.SigningKey {
+	c := *key
+	if key.ActivatedAt != nil {
+		activatedAt := *key.ActivatedAt
+		c.ActivatedAt = &activatedAt
+	}
+	if key.RetiredAt != nil {
+		retiredAt := *key.RetiredAt
+		c.RetiredAt = &retiredAt
+	}
+	return &c
+}
+
+type signingKeyRepository struct {
+	store *store
+	tx    *transaction
+}
+
+func (k *signingKeyRepository) Create(ctx context.Context, key *domain.SigningKey) error {
+	return k.put(ctx, copySigningKey(key))
+}
+
+func (k *signingKeyRepository) Update(ctx context.Context, key *domain.SigningKey) error {
+	return k.put(ctx, copySigningKey(key))
+}
+
+func (k *signingKeyRepository) put(ctx context.Context, key *domain.SigningKey) error {
+	return k.store.write(ctx, k.tx, func(s *store) (func(), error) {
+		previous, existed := s.signingKeys[key.Id]
+		s.signingKeys[key.Id] = key
+		return func() {
+			if existed {
+				s.signingKeys[key.Id] = previous
+			} else {
+				delete(s.signingKeys, key.Id)
+			}
+		}, nil
+	})
+}
+
+func (k *signingKeyRepository) FindAll(ctx context.Context) ([]*domain.SigningKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k.store.mu.RLock()
+	defer k.store.mu.RUnlock()
+	keys := make([]*domain.SigningKey, 0, len(k.store.signingKeys))
+	for _, key := range k.store.signingKeys {
+		keys = append(keys, copySigningKey(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (k *signingKeyRepository) Delete(ctx context.Context, id string) error {
+	return k.store.write(ctx, k.tx, func(s *store) (func(), error) {
+		previous, existed := s.signingKeys[id]
+		delete(s.signingKeys, id)
+		return func() {
+			if existed {
+				s.signingKeys[id] = previous
+			}
+		}, nil
+	})
+}
+
+type userAccountRepository struct {
+	store *store
+}
+
+func (u *userAccountRepository) FindById(ctx context.Context, id string) (*domain.UserAccount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u.store.mu.RLock()
+	defer u.store.mu.RUnlock()
+	user, ok := u.store.userAccounts[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *user
+	return &copied, nil
+}
+
+type userClaimRepository struct {
+	store *store
+}
+
+// Returns the values of the user account fields, by their JSON name, that are claims of the given scopes.
+func (u *userClaimRepository) GetUserClaims(ctx context.Context, userId, scopes string) (map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u.store.mu.RLock()
+	defer u.store.mu.RUnlock()
+	user, ok := u.store.userAccounts[userId]
+	if !ok {
+		return map[string]interface{}{}, nil
+	}
+
+	marshalled, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	var userAccount map[string]interface{}
+	if err := json.Unmarshal(marshalled, &userAccount); err != nil {
+		return nil, err
+	}
+
+	claimsValues := make(map[string]interface{})
+	for _, scope := range strings.Split(scopes, " ") {
+		sc, ok := u.store.scopes[scope]
+		if !ok {
+			continue
+		}
+		for _, claim := range sc.Claims {
+			if val, ok := userAccount[claim]; ok {
+				claimsValues[claim] = val
+			}
+		}
+	}
+	return claimsValues, nil
+}
+
+// Returns a copy of the device that shares nothing with the original.
+func copyUserDevice(device *domain.UserDevice) *domain.UserDevice {
+	c := *device
+	if device.DeregisteredAt != nil {
+		deregisteredAt := *device.DeregisteredAt
+		c.DeregisteredAt = &deregisteredAt
+	}
+	return &c
+}
+
+type userDeviceRepository struct {
+	store *store
+	tx    *transaction
+}
+
+func (u *userDeviceRepository) Create(ctx context.Context, device *domain.UserDevice) error {
+	return u.put(ctx, copyUserDevice(device))
+}
+
+func (u *userDeviceRepository) Update(ctx context.Context, device *domain.UserDevice) error {
+	return u.put(ctx, copyUserDevice(device))
+}
+
+func (u *userDeviceRepository) put(ctx context.Context, device *domain.UserDevice) error {
+	return u.store.write(ctx, u.tx, func(s *store) (func(), error) {
+		previous, existed := s.userDevices[device.Id]
+		s.userDevices[device.Id] = device
+		return func() {
+			if existed {
+				s.userDevices[device.Id] = previous
+			} else {
+				delete(s.userDevices, device.Id)
+			}
+		}, nil
+	})
+}
+
+func (u *userDeviceRepository) FindById(ctx context.Context, id string) (*domain.UserDevice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u.store.mu.RLock()
+	defer u.store.mu.RUnlock()
+	device, ok := u.store.userDevices[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyUserDevice(device), nil
+}
+
+func (u *userDeviceRepository) FindActiveByUserId(ctx context.Context, userId string) ([]*domain.UserDevice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u.store.mu.RLock()
+	defer u.store.mu.RUnlock()
+	var devices []*domain.UserDevice
+	for _, device := range u.store.userDevices {
+		if device.UserId == userId && device.IsActive() {
+			devices = append(devices, copyUserDevice(device))
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastSeenAt.After(devices[j].LastSeenAt)
+	})
+	return devices, nil
+}
+
+// Returns a copy of the grant that shares nothing with the original.
+func copyGrant(grant *domain.Grant) *domain.Grant {
+	c := *grant
+	if grant.RevokedAt != nil {
+		revokedAt := *grant.RevokedAt
+		c.RevokedAt = &revokedAt
+	}
+	return &c
+}
+
+type grantRepository struct {
+	store *store
+	tx    *transaction
+}
+
+func (g *grantRepository) Create(ctx context.Context, grant *domain.Grant) error {
+	return g.put(ctx, copyGrant(grant))
+}
+
+func (g *grantRepository) Update(ctx context.Context, grant *domain.Grant) error {
+	return g.put(ctx, copyGrant(grant))
+}
+
+func (g *grantRepository) put(ctx context.Context, grant *domain.Grant) error {
+	return g.store.write(ctx, g.tx, func(s *store) (func(), error) {
+		grants, ok := s.grants[grant.UserId]
+		if !ok {
+			grants = make(map[string]*domain.Grant)
+			s.grants[grant.UserId] = grants
+		}
+		previous, existed := grants[grant.ClientId]
+		grants[grant.ClientId] = grant
+		return func() {
+			if existed {
+				grants[grant.ClientId] = previous
+			} else {
+				delete(grants, grant.ClientId)
+			}
+		}, nil
+	})
+}
+
+func (g *grantRepository) FindByUserIdAndClientId(ctx context.Context, userId, clientId string) (*domain.Grant, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g.store.mu.RLock()
+	defer g.store.mu.RUnlock()
+	grant, ok := g.store.grants[userId][clientId]
+	if !ok {
+		return nil, nil
+	}
+	return copyGrant(grant), nil
+}
+
+func (g *grantRepository) FindActiveByUserId(ctx context.Context, userId string) ([]*domain.Grant, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g.store.mu.RLock()
+	defer g.store.mu.RUnlock()
+	var grants []*domain.Grant
+	for _, grant := range g.store.grants[userId] {
+		if grant.IsActive() {
+			grants = append(grants, copyGrant(grant))
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].ConsentedAt.After(grants[j].ConsentedAt)
+	})
+	return grants, nil
+}
+
+// Returns a copy of the scope that shares nothing with the original.
+func copyScope(scope *domain.Scope) *domain.Scope {
+	c := *scope
+	if scope.Localizations != nil {
+		c.Localizations = make(map[string]*domain.ScopeLocalization, len(scope.Localizations))
+		for language, localization := range scope.Localizations {
+			l := *localization
+			c.Localizations[language] = &l
+		}
+	}
+	if scope.Claims != nil {
+		c.Claims = make([]string, len(scope.Claims))
+		copy(c.Claims, scope.Claims)
+	}
+	return &c
+}
+
+// Stores the scope and creates the claims it grants that don't exist yet. Must be called with the lock held.
+// Stored scopes and claims are replaced and never changed in place, so the returned function restores them
+// by restoring the maps.
+func (s *store) putScope(scope *domain.Scope) (undo func()) {
+	undo = s.snapshotScopes()
+	s.scopes[scope.Name] = scope
+	for _, claim := range scope.Claims {
+		if _, ok := s.claims[claim]; !ok {
+			s.claims[claim] = &domain.Claim{Name: claim}
+		}
+	}
+	return undo
+}
+
+// Returns a function restoring the scopes and claims as they are now. Must be called with the lock held.
+func (s *store) snapshotScopes() func() {
+	scopes := make(map[string]*domain.Scope, len(s.scopes))
+	for name, scope := range s.scopes {
+		scopes[name] = scope
+	}
+	claims := make(map[string]*domain.Claim, len(s.claims))
+	for name, claim := range s.claims {
+		claims[name] = claim
+	}
+	return func() {
+		s.scopes = scopes
+		s.claims = claims
+	}
+}
+
+type scopeRepository struct {
+	store *store
+	tx    *transaction
+}
+
+func (r *scopeRepository) CreateScope(ctx context.Context, scope *domain.Scope) error {
+	return r.UpdateScope(ctx, scope)
+}
+
+func (r *scopeRepository) UpdateScope(ctx context.Context, scope *domain.Scope) error {
+	sc := copyScope(scope)
+	return r.store.write(ctx, r.tx, func(s *store) (func(), error) {
+		return s.putScope(sc), nil
+	})
+}
+
+func (r *scopeRepository) DeleteScope(ctx context.Context, name string) error {
+	return r.store.write(ctx, r.tx, func(s *store) (func(), error) {
+		undo := s.snapshotScopes()
+		delete(s.scopes, name)
+		return undo, nil
+	})
+}
+
+func (r *scopeRepository) FindScopeByName(ctx context.Context, name string) (*domain.Scope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+	scope, ok := r.store.scopes[name]
+	if !ok {
+		return nil, nil
+	}
+	return copyScope(scope), nil
+}
+
+func (r *scopeRepository) FindAllScopes(ctx context.Context) ([]*domain.Scope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+	var scopes []*domain.Scope
+	for _, scope := range r.store.scopes {
+		scopes = append(scopes, copyScope(scope))
+	}
+	sort.Slice(scopes, func(i, j int) bool {
+		return scopes[i].Name < scopes[j].Name
+	})
+	return scopes, nil
+}
+
+func (r *scopeRepository) CreateClaim(ctx context.Context, claim *domain.Claim) error {
+	return r.UpdateClaim(ctx, claim)
+}
+
+func (r *scopeRepository) UpdateClaim(ctx context.Context, claim *domain.Claim) error {
+	c := *claim
+	return r.store.write(ctx, r.tx, func(s *store) (func(), error) {
+		undo := s.snapshotScopes()
+		s.claims[c.Name] = &c
+		return undo, nil
+	})
+}
+
+func (r *scopeRepository) DeleteClaim(ctx context.Context, name string) error {
+	return r.store.write(ctx, r.tx, func(s *store) (func(), error) {
+		undo := s.snapshotScopes()
+		delete(s.claims, name)
+		for scopeName, scope := range s.scopes {
+			var claims []string
+			for _, claim := range scope.Claims {
+				if claim != name {
+					claims = append(claims, claim)
+				}
+			}
+			if len(claims) != len(scope.Claims) {
+				sc := copyScope(scope)
+				sc.Claims = claims
+				s.scopes[scopeName] = sc
+			}
+		}
+		return undo, nil
+	})
+}
+
+func (r *scopeRepository) FindAllClaims(ctx context.Context) ([]*domain.Claim, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+	var claims []*domain.Claim
+	for _, claim := range r.store.claims {
+		c := *claim
+		claims = append(claims, &c)
+	}
+	sort.Slice(claims, func(i, j int) bool {
+		return claims[i].Name < claims[j].Name
+	})
+	return claims, nil
+}
+
+// DataStore keeps everything in memory, guarded by a mutex. It needs no external
+// dependency, which makes it suited to development and integration tests. Nothing survives a restart.
+type DataStore struct {
+	store *store
+	// Nil when the data store isn't bound to a transaction.
+	tx *transaction
+
+	accessTokenRepo       *accessTokenRepository
+	cibaSessionRepo       *cibaSessionRepository
+	clientApplicationRepo *clientApplicationRepository
+	keyRepositoryRepo     *keyRepository
+	signingKeyRepo        *signingKeyRepository
+	userAccountRepo       *userAccountRepository
+	userClaimRepo         *userClaimRepository
+	userDeviceRepo        *userDeviceRepository
+	grantRepo             *grantRepository
+	scopeRepo             *scopeRepository
+}
+
+func NewDataStore() *DataStore {
+	return NewCustomDataStore(&DataStoreConfig{
+		GracePeriod:      DefaultGracePeriod,
+		EvictionInterval: DefaultEvictionInterval,
+	})
+}
+
+func NewCustomDataStore(config *DataStoreConfig) *DataStore {
+	return newDataStore(&store{
+		config:       config,
+		clientApps:   make(map[string]*domain.ClientApplication),
+		cibaSessions: make(map[string]*domain.CibaSession),
+		accessTokens: make(map[string]*domain.AccessToken),
+		keys:         make(map[string]*domain.Key),
+		signingKeys:  make(map[string]*domain.SigningKey),
+		userAccounts: make(map[string]*domain.UserAccount),
+		scopes:       make(map[string]*domain.Scope),
+		claims:       make(map[string]*domain.Claim),
+		userDevices:  make(map[string]*domain.UserDevice),
+		grants:       make(map[string]map[string]*domain.Grant),
+		lastEviction: time.Now(),
+	}, nil)
+}
+
+// Creates the repositories, queueing their writes in tx if it's not nil.
+func newDataStore(s *store, tx *transaction) *DataStore {
+	return &DataStore{
+		store:                 s,
+		tx:                    tx,
+		accessTokenRepo:       &accessTokenRepository{store: s, tx: tx},
+		cibaSessionRepo:       &cibaSessionRepository{store: s, tx: tx},
+		clientApplicationRepo: &clientApplicationRepository{store: s, tx: tx},
+		keyRepositoryRepo:     &keyRepository{store: s},
+		signingKeyRepo:        &signingKeyRepository{store: s, tx: tx},
+		userAccountRepo:       &userAccountRepository{store: s},
+		userClaimRepo:         &userClaimRepository{store: s},
+		userDeviceRepo:        &userDeviceRepository{store: s, tx: tx},
+		grantRepo:             &grantRepository{store: s, tx: tx},
+		scopeRepo:             &scopeRepository{store: s, tx: tx},
+	}
+}
+
+// Adds or replaces the key of the client application it belongs to.
+func (d *DataStore) AddKey(key *domain.Key) {
+	copied := *key
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+	d.store.keys[key.ClientId] = &copied
+}
+
+// Adds or replaces a user account.
+func (d *DataStore) AddUserAccount(user *domain.UserAccount) {
+	copied := *user
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+	d.store.userAccounts[user.Id] = &copied
+}
+
+// Adds or replaces a scope along with the claims it grants, which are user account fields by their JSON name.
+func (d *DataStore) AddScope(scope string, claims ...string) {
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+	d.store.putScope(copyScope(&domain.Scope{Name: scope, Claims: claims}))
+}
+
+func (d *DataStore) HaveTransactionSupport() bool {
+	return true
+}
+
+// Runs fn with a data store whose writes are queued, then applied all together under the lock
+// if fn returns no error and discarded otherwise. Reads within fn don't see the queued writes.
+// Calling it on a data store that is already bound to a transaction runs fn within that transaction.
+func (d *DataStore) WithinTransaction(ctx context.Context, fn func(tx repository.DataStoreInterface) error) error {
+	if d.tx != nil {
+		return fn(d)
+	}
+	tx := &transaction{}
+	if err := fn(newDataStore(d.store, tx)); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.store.commit(tx)
+}
+
+func (d *DataStore) GetAccessTokenRepository() repository.AccessTokenRepositoryInterface {
+	return d.accessTokenRepo
+}
+
+func (d *DataStore) GetCibaSessionRepository() repository.CibaSessionRepositoryInterface {
+	return d.cibaSessionRepo
+}
+
+func (d *DataStore) GetClientApplicationRepository() repository.ClientApplicationRepositoryInterface {
+	return d.clientApplicationRepo
+}
+
+func (d *DataStore) GetKeyRepository() repository.KeyRepositoryInterface {
+	return d.keyRepositoryRepo
+}
+
+func (d *DataStore) GetSigningKeyRepository() repository.SigningKeyRepositoryInterface {
+	return d.signingKeyRepo
+}
+
+func (d *DataStore) GetUserAccountRepository() repository.UserAccountRepositoryInterface {
+	return d.userAccountRepo
+}
+
+func (d *DataStore) GetUserClaimRepository() repository.UserClaimRepositoryInterface {
+	return d.userClaimRepo
+}
+
+func (d *DataStore) GetUserDeviceRepository() repository.UserDeviceRepositoryInterface {
+	return d.userDeviceRepo
+}
+
+func (d *DataStore) GetGrantRepository() repository.GrantRepositoryInterface {
+	return d.grantRepo
+}
+
+func (d *DataStore) GetScopeRepository() repository.ScopeRepositoryInterface {
+	return d.scopeRepo
+}
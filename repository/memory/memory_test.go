@@ -0,0 +1,350 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/repositorytest"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCibaSession(age time.Duration) *domain.CibaSession {
+	interval := int64(5)
+	cs := domain.NewCibaSession(&test_data.ClientAppPoll, "hint", "binding", "token", "openid", 60, &interval)
+	cs.CreatedAt = cs.CreatedAt.Add(-age)
+	cs.ExpiresAt = cs.ExpiresAt.Add(-age)
+	return cs
+}
+
+func TestClientApplicationRepository_FindById_ShouldReturnCopy(t *testing.T) {
+	ds := NewDataStore()
+	repo := ds.GetClientApplicationRepository()
+	clientApp := test_data.ClientAppPing
+	_ = repo.Register(context.Background(), &clientApp)
+
+	found, err := repo.FindById(context.Background(), clientApp.Id)
+	found.Name = "changed"
+	foundAgain, _ := repo.FindById(context.Background(), clientApp.Id)
+
+	assert.NoError(t, err)
+	assert.Equal(t, clientApp.Name, foundAgain.Name)
+}
+
+func TestClientApplicationRepository_FindById_ShouldReturnNil_WhenNotFound(t *testing.T) {
+	ds := NewDataStore()
+
+	clientApp, err := ds.GetClientApplicationRepository().FindById(context.Background(), "unknown")
+
+	assert.NoError(t, err)
+	assert.Nil(t, clientApp)
+}
+
+func TestCibaSessionRepository_Update_ShouldStoreChanges(t *testing.T) {
+	repo := NewDataStore().GetCibaSessionRepository()
+	cs := newCibaSession(0)
+	_ = repo.Create(context.Background(), cs)
+	found, _ := repo.FindById(context.Background(), cs.AuthReqId)
+	_ = found.Approve(domain.ActorUser)
+
+	err := repo.Update(context.Background(), found)
+	updated, _ := repo.FindById(context.Background(), cs.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.Equal(t, domain.StatusApproved, updated.GetStatus())
+	assert.Len(t, updated.History, 2)
+	assert.Equal(t, domain.StatusPending, cs.GetStatus())
+}
+
+func TestCibaSessionRepository_Update_ShouldReturnErrConcurrentUpdate_WhenSessionChangedSinceRead(t *testing.T) {
+	repo := NewDataStore().GetCibaSessionRepository()
+	cs := newCibaSession(0)
+	_ = repo.Create(context.Background(), cs)
+	first, _ := repo.FindById(context.Background(), cs.AuthReqId)
+	second, _ := repo.FindById(context.Background(), cs.AuthReqId)
+	_ = first.Approve(domain.ActorUser)
+	_ = second.Deny(domain.ActorUser)
+
+	firstErr := repo.Update(context.Background(), first)
+	secondErr := repo.Update(context.Background(), second)
+	stored, _ := repo.FindById(context.Background(), cs.AuthReqId)
+
+	assert.NoError(t, firstErr)
+	assert.True(t, errors.Is(secondErr, repository.ErrConcurrentUpdate))
+	assert.Equal(t, domain.StatusApproved, stored.GetStatus())
+}
+
+func TestCibaSessionRepository_Update_ShouldReturnErrConcurrentUpdate_WhenStaleSessionIsWritten(t *testing.T) {
+	repo := NewDataStore().GetCibaSessionRepository()
+	cs := newCibaSession(0)
+	_ = repo.Create(context.Background(), cs)
+	stale, _ := repo.FindById(context.Background(), cs.AuthReqId)
+	approved, _ := repo.FindById(context.Background(), cs.AuthReqId)
+	_ = approved.Approve(domain.ActorUser)
+	_ = repo.Update(context.Background(), approved)
+	now := time.Now().Unix()
+	stale.LatestTokenRequestedAt = &now
+
+	err := repo.Update(context.Background(), stale)
+
+	assert.True(t, errors.Is(err, repository.ErrConcurrentUpdate))
+}
+
+func TestCibaSessionRepository_FindById_ShouldReturnNil_WhenPastGracePeriod(t *testing.T) {
+	repo := NewCustomDataStore(&DataStoreConfig{GracePeriod: time.Minute, EvictionInterval: time.Hour}).GetCibaSessionRepository()
+	withinGrace := newCibaSession(90 * time.Second)
+	pastGrace := newCibaSession(5 * time.Minute)
+	_ = repo.Create(context.Background(), withinGrace)
+	_ = repo.Create(context.Background(), pastGrace)
+
+	foundWithinGrace, _ := repo.FindById(context.Background(), withinGrace.AuthReqId)
+	foundPastGrace, err := repo.FindById(context.Background(), pastGrace.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, foundWithinGrace)
+	assert.Nil(t, foundPastGrace)
+}
+
+func TestDataStore_ShouldEvictExpiredEntries_OnWrite(t *testing.T) {
+	ds := NewCustomDataStore(&DataStoreConfig{GracePeriod: time.Minute, EvictionInterval: 0})
+	stale := newCibaSession(5 * time.Minute)
+	staleToken := domain.NewAccessToken("stale", "client", "user", "openid", time.Now().Add(-5*time.Minute))
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), stale)
+	_ = ds.GetAccessTokenRepository().Create(context.Background(), staleToken)
+
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), newCibaSession(0))
+
+	assert.NotContains(t, ds.store.cibaSessions, stale.AuthReqId)
+	assert.NotContains(t, ds.store.accessTokens, staleToken.Value)
+	assert.Len(t, ds.store.cibaSessions, 1)
+}
+
+func TestCibaSessionRepository_FindExpired_ShouldReturnActiveSessionsOldestFirst(t *testing.T) {
+	repo := NewDataStore().GetCibaSessionRepository()
+	older := newCibaSession(10 * time.Minute)
+	old := newCibaSession(5 * time.Minute)
+	denied := newCibaSession(5 * time.Minute)
+	_ = denied.Deny(domain.ActorUser)
+	active := newCibaSession(0)
+	for _, cs := range []*domain.CibaSession{old, older, denied, active} {
+		_ = repo.Create(context.Background(), cs)
+	}
+
+	cibaSessions, err := repo.FindExpired(context.Background(), time.Now().UTC(), 10)
+	limited, _ := repo.FindExpired(context.Background(), time.Now().UTC(), 1)
+
+	assert.NoError(t, err)
+	assert.Len(t, cibaSessions, 2)
+	assert.Equal(t, older.AuthReqId, cibaSessions[0].AuthReqId)
+	assert.Equal(t, old.AuthReqId, cibaSessions[1].AuthReqId)
+	assert.Len(t, limited, 1)
+}
+
+func TestCibaSessionRepository_DeleteExpiredBefore(t *testing.T) {
+	repo := NewDataStore().GetCibaSessionRepository()
+	stale := newCibaSession(48 * time.Hour)
+	recent := newCibaSession(5 * time.Minute)
+	_ = repo.Create(context.Background(), stale)
+	_ = repo.Create(context.Background(), recent)
+
+	deleted, err := repo.DeleteExpiredBefore(context.Background(), time.Now().UTC().Add(-24*time.Hour), 10)
+	foundRecent, _ := repo.FindById(context.Background(), recent.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NotNil(t, foundRecent)
+}
+
+func TestAccessTokenRepository_DeleteExpiredBefore(t *testing.T) {
+	repo := NewDataStore().GetAccessTokenRepository()
+	expired := domain.NewAccessToken("expired", "client", "user", "openid", time.Now().UTC().Add(-1*time.Minute))
+	valid := domain.NewAccessToken("valid", "client", "user", "openid", time.Now().UTC().Add(1*time.Hour))
+	_ = repo.Create(context.Background(), expired)
+	_ = repo.Create(context.Background(), valid)
+
+	deleted, err := repo.DeleteExpiredBefore(context.Background(), time.Now().UTC(), 10)
+	foundExpired, _ := repo.Find(context.Background(), expired.Value)
+	foundValid, _ := repo.Find(context.Background(), valid.Value)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Nil(t, foundExpired)
+	assert.NotNil(t, foundValid)
+}
+
+func TestUserClaimRepository_GetUserClaims(t *testing.T) {
+	ds := NewDataStore()
+	ds.AddUserAccount(&test_data.User1)
+	ds.AddScope("profile", "name")
+	ds.AddScope("email", "email")
+
+	claims, err := ds.GetUserClaimRepository().GetUserClaims(context.Background(), test_data.User1.Id, "openid profile email")
+	unknownUserClaims, unknownErr := ds.GetUserClaimRepository().GetUserClaims(context.Background(), "unknown", "profile")
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": test_data.User1.Name, "email": test_data.User1.Email}, claims)
+	assert.NoError(t, unknownErr)
+	assert.Empty(t, unknownUserClaims)
+}
+
+func TestKeyRepository_FindPrivateKeyByClientId(t *testing.T) {
+	ds := NewDataStore()
+	ds.AddKey(&test_data.Key1)
+
+	key, err := ds.GetKeyRepository().FindPrivateKeyByClientId(context.Background(), test_data.Key1.ClientId)
+	unknown, _ := ds.GetKeyRepository().FindPrivateKeyByClientId(context.Background(), "missing-client")
+
+	assert.NoError(t, err)
+	assert.Equal(t, test_data.Key1.Id, key.Id)
+	assert.Nil(t, unknown)
+}
+
+func TestDataStore_WithinTransaction_ShouldApplyWrites(t *testing.T) {
+	ds := NewDataStore()
+	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+	cs := newCibaSession(0)
+
+	err := ds.WithinTransaction(context.Background(), func(tx repository.DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(context.Background(), accessToken); err != nil {
+			return err
+		}
+		// Queued writes aren't visible until the transaction is committed.
+		if found, _ := ds.GetAccessTokenRepository().Find(context.Background(), accessToken.Value); found != nil {
+			return errors.New("write visible before commit")
+		}
+		return tx.GetCibaSessionRepository().Create(context.Background(), cs)
+	})
+	foundToken, _ := ds.GetAccessTokenRepository().Find(context.Background(), accessToken.Value)
+	foundSession, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cs.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, foundToken)
+	assert.NotNil(t, foundSession)
+}
+
+func TestDataStore_WithinTransaction_ShouldDiscardWrites_WhenFnFails(t *testing.T) {
+	ds := NewDataStore()
+	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+	fnErr := errors.New("failed")
+
+	err := ds.WithinTransaction(context.Background(), func(tx repository.DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(context.Background(), accessToken); err != nil {
+			return err
+		}
+		return fnErr
+	})
+	found, _ := ds.GetAccessTokenRepository().Find(context.Background(), accessToken.Value)
+
+	assert.Equal(t, fnErr, err)
+	assert.Nil(t, found)
+}
+
+func TestDataStore_WithinTransaction_ShouldRevertWrites_WhenCommitConflicts(t *testing.T) {
+	ds := NewDataStore()
+	cs := newCibaSession(0)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cs)
+	stale, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cs.AuthReqId)
+	approved, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cs.AuthReqId)
+	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+
+	err := ds.WithinTransaction(context.Background(), func(tx repository.DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(context.Background(), accessToken); err != nil {
+			return err
+		}
+		_ = stale.Deny(domain.ActorUser)
+		if err := tx.GetCibaSessionRepository().Update(context.Background(), stale); err != nil {
+			return err
+		}
+		// Someone else approves the session before the transaction is committed.
+		_ = approved.Approve(domain.ActorUser)
+		return ds.GetCibaSessionRepository().Update(context.Background(), approved)
+	})
+	found, _ := ds.GetAccessTokenRepository().Find(context.Background(), accessToken.Value)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cs.AuthReqId)
+
+	assert.True(t, errors.Is(err, repository.ErrConcurrentUpdate))
+	assert.Nil(t, found)
+	assert.Equal(t, domain.StatusApproved, stored.GetStatus())
+}
+
+func TestDataStore_ShouldReturnError_WhenContextIsCancelled(t *testing.T) {
+	ds := NewDataStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	createErr := ds.GetCibaSessionRepository().Create(ctx, newCibaSession(0))
+	_, findErr := ds.GetAccessTokenRepository().Find(ctx, "token")
+
+	assert.True(t, errors.Is(createErr, context.Canceled))
+	assert.True(t, errors.Is(findErr, context.Canceled))
+}
+
+func TestCibaSessionRepository_Update_ShouldAllowOnlyOneConcurrentTransition(t *testing.T) {
+	repo := NewDataStore().GetCibaSessionRepository()
+	cs := newCibaSession(0)
+	_ = repo.Create(context.Background(), cs)
+
+	// Every writer reads the pending session before any of them writes.
+	var read []*domain.CibaSession
+	for i := 0; i < 20; i++ {
+		found, _ := repo.FindById(context.Background(), cs.AuthReqId)
+		if i%2 == 0 {
+			_ = found.Approve(domain.ActorUser)
+		} else {
+			_ = found.Deny(domain.ActorUser)
+		}
+		read = append(read, found)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for _, found := range read {
+		wg.Add(1)
+		go func(found *domain.CibaSession) {
+			defer wg.Done()
+			if err := repo.Update(context.Background(), found); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}(found)
+	}
+	wg.Wait()
+	stored, _ := repo.FindById(context.Background(), cs.AuthReqId)
+
+	assert.Equal(t, 1, succeeded)
+	assert.Len(t, stored.History, 2)
+}
+
+// Adapts the seeders of DataStore, which cannot fail, to repositorytest.Seeder.
+type seeder struct {
+	ds *DataStore
+}
+
+func (s seeder) AddKey(key *domain.Key) error {
+	s.ds.AddKey(key)
+	return nil
+}
+
+func (s seeder) AddUserAccount(user *domain.UserAccount) error {
+	s.ds.AddUserAccount(user)
+	return nil
+}
+
+func (s seeder) AddScope(scope string, claims ...string) error {
+	s.ds.AddScope(scope, claims...)
+	return nil
+}
+
+func TestDataStore_Conformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (repository.DataStoreInterface, repositorytest.Seeder) {
+		ds := NewDataStore()
+		return ds, seeder{ds: ds}
+	})
+}
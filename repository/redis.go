@@ -4,27 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/util"
 	"github.com/go-redis/redis/v8"
 )
 
 func NewClientApplicationRedisRepository(client *redis.Client) *clientApplicationRedisRepository {
 	return &clientApplicationRedisRepository{
 		client: client,
-		ctx:    context.Background(),
+		writer: client,
 	}
 }
 
 type clientApplicationRedisRepository struct {
 	client *redis.Client
-	ctx    context.Context
+	// Where writes go, the transaction pipeline when the repository is bound to a transaction.
+	writer redis.Cmdable
 }
 
-func (ca *clientApplicationRedisRepository) FindById(id string) (*domain.ClientApplication, error) {
+func (ca *clientApplicationRedisRepository) FindById(ctx context.Context, id string) (*domain.ClientApplication, error) {
 	key := fmt.Sprintf("client_application:%s", id)
-	val, err := ca.client.Get(ca.ctx, key).Result()
+	val, err := ca.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, nil
 	} else if err != nil {
@@ -37,26 +41,28 @@ func (ca *clientApplicationRedisRepository) FindById(id string) (*domain.ClientA
 	return clientApp, nil
 }
 
-func (ca *clientApplicationRedisRepository) Register(clientApp *domain.ClientApplication) error {
+func (ca *clientApplicationRedisRepository) Register(ctx context.Context, clientApp *domain.ClientApplication) error {
+	hashed, err := clientApp.WithHashedSecret()
+	if err != nil {
+		return err
+	}
 	key := fmt.Sprintf("client_application:%s", clientApp.GetId())
-	return ca.client.Set(ca.ctx, key, clientApp, 0).Err()
+	return ca.writer.Set(ctx, key, hashed, 0).Err()
 }
 
 type userAccountRedisRepository struct {
 	client redis.Cmdable
-	ctx    context.Context
 }
 
 func NewUserAccountRedisRepository(client *redis.Client) *userAccountRedisRepository {
 	return &userAccountRedisRepository{
 		client: client,
-		ctx:    context.Background(),
 	}
 }
 
-func (ua *userAccountRedisRepository) FindById(id string) (*domain.UserAccount, error) {
+func (ua *userAccountRedisRepository) FindById(ctx context.Context, id string) (*domain.UserAccount, error) {
 	key := fmt.Sprintf("user_account:%s", id)
-	val, err := ua.client.Get(ua.ctx, key).Result()
+	val, err := ua.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, nil
 	} else if err != nil {
@@ -71,26 +77,137 @@ func (ua *userAccountRedisRepository) FindById(id string) (*domain.UserAccount,
 	return user, nil
 }
 
+// Sessions are stored with a TTL and are removed from the expiry indexes once Redis has dropped them,
+// running a sweeper only marks expired sessions and deletes them sooner.
 func NewCibaSessionRedisRepository(client *redis.Client) *CibaSessionRedisRepository {
 	return &CibaSessionRedisRepository{
-		client: client,
-		ctx:    context.Background(),
+		client:      client,
+		writer:      client,
+		gracePeriod: DefaultRedisGracePeriod,
 	}
 }
 
 type CibaSessionRedisRepository struct {
 	client *redis.Client
-	ctx    context.Context
+	// Where writes go, the transaction pipeline when the repository is bound to a transaction.
+	writer      redis.Cmdable
+	gracePeriod time.Duration
+}
+
+const (
+	// Sorted set of every stored Ciba session scored by its expiry time.
+	cibaSessionExpiryKey = "ciba_sessions:expiry"
+	// Sorted set of the pending and approved Ciba sessions scored by their expiry time.
+	cibaSessionActiveKey = "ciba_sessions:active"
+	// Sorted set of every stored access token scored by its expiry time.
+	accessTokenExpiryKey = "access_tokens:expiry"
+	// Sorted set of the pending Ciba sessions of a user scored by their expiry time.
+	cibaSessionPendingKeyFormat = "ciba_sessions:pending:%s"
+	// Set of the access tokens issued to a client for a user, it lives as long as the latest expiring one.
+	accessTokenGrantKeyFormat = "access_tokens:%s:%s"
+)
+
+// How long Ciba sessions and access tokens are kept in Redis after they expire,
+// so that late requests still get an expired error instead of an unknown one.
+const DefaultRedisGracePeriod = 1 * time.Hour
+
+// Overwrites the Ciba session in KEYS[1] while keeping its remaining TTL, like SET KEEPTTL but available
+// before Redis 6. A missing key is created with a TTL of ARGV[2] milliseconds. Fails with the error ARGV[4]
+// unless the history of the stored session is a prefix of the new one, whose statuses are the JSON array ARGV[3].
+const redisUpdateCibaSessionScript = `local current = redis.call("get", KEYS[1])
+if current then
+  local stored = cjson.decode(current)
+  local n = 0
+  if type(stored.history) == "table" then n = #stored.history end
+  local statuses = cjson.decode(ARGV[3])
+  if n > #statuses or (n > 0 and statuses[n] ~= stored.history[n].to) then
+    return redis.error_reply(ARGV[4])
+  end
+end
+local ttl = redis.call("pttl", KEYS[1])
+if ttl > 0 then return redis.call("set", KEYS[1], ARGV[1], "px", tostring(ttl)) end
+if ttl == -1 then return redis.call("set", KEYS[1], ARGV[1]) end
+return redis.call("set", KEYS[1], ARGV[1], "px", ARGV[2])`
+
+// Maps the error reply of redisUpdateCibaSessionScript back to ErrConcurrentUpdate.
+func redisConcurrentUpdateError(err error) error {
+	if err != nil && err.Error() == ErrConcurrentUpdate.Error() {
+		return ErrConcurrentUpdate
+	}
+	return err
 }
 
-func (c *CibaSessionRedisRepository) Create(cibaSession *domain.CibaSession) error {
+// Removes from the given indexes scored by expiry time the members whose keys Redis has already dropped,
+// so that the indexes don't keep growing when nothing deletes expired keys.
+func trimRedisIndexes(ctx context.Context, writer redis.Cmdable, gracePeriod time.Duration, indexes ...string) error {
+	// Scores are in seconds, the extra second keeps members whose key may still be alive.
+	max := fmt.Sprintf("(%d", time.Now().Add(-gracePeriod-time.Second).Unix())
+	for _, index := range indexes {
+		if err := writer.ZRemRangeByScore(ctx, index, "-inf", max).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extends the TTL of KEYS[1] to ARGV[1] milliseconds unless it already lives longer.
+const redisExtendTtlScript = `local ttl = redis.call("pttl", KEYS[1])
+if ttl >= 0 and ttl < tonumber(ARGV[1]) then return redis.call("pexpire", KEYS[1], ARGV[1]) end
+return 0`
+
+// Returns the TTL of a key holding something that expires at the given time.
+func redisTtl(expiresAt time.Time, gracePeriod time.Duration) time.Duration {
+	ttl := time.Until(expiresAt) + gracePeriod
+	// A zero or negative expiration would store the key without any TTL.
+	if ttl < time.Second {
+		return time.Second
+	}
+	return ttl
+}
+
+func (c *CibaSessionRedisRepository) Create(ctx context.Context, cibaSession *domain.CibaSession) error {
 	key := fmt.Sprintf("ciba_session:%s", cibaSession.AuthReqId)
-	return c.client.Set(c.ctx, key, cibaSession, 0).Err()
+	ttl := redisTtl(cibaSession.GetExpiresAt(), c.gracePeriod)
+	if err := c.writer.Set(ctx, key, cibaSession, ttl).Err(); err != nil {
+		return err
+	}
+	if err := trimRedisIndexes(ctx, c.writer, c.gracePeriod, cibaSessionExpiryKey, cibaSessionActiveKey); err != nil {
+		return err
+	}
+	return c.index(ctx, cibaSession)
 }
 
-func (c *CibaSessionRedisRepository) FindById(id string) (*domain.CibaSession, error) {
+// Keeps the expiry indexes used to find and delete expired sessions up to date.
+func (c *CibaSessionRedisRepository) index(ctx context.Context, cibaSession *domain.CibaSession) error {
+	member := &redis.Z{
+		Score:  float64(cibaSession.GetExpiresAt().Unix()),
+		Member: cibaSession.AuthReqId,
+	}
+	if err := c.writer.ZAdd(ctx, cibaSessionExpiryKey, member).Err(); err != nil {
+		return err
+	}
+	// The pending index of the user lives as long as its latest expiring session.
+	pendingKey := fmt.Sprintf(cibaSessionPendingKeyFormat, cibaSession.UserId)
+	if cibaSession.IsAuthorizationPending() {
+		if err := c.writer.ZAdd(ctx, pendingKey, member).Err(); err != nil {
+			return err
+		}
+		ttl := redisTtl(cibaSession.GetExpiresAt(), c.gracePeriod)
+		if err := c.writer.Eval(ctx, redisExtendTtlScript, []string{pendingKey}, ttl.Milliseconds()).Err(); err != nil {
+			return err
+		}
+	} else if err := c.writer.ZRem(ctx, pendingKey, cibaSession.AuthReqId).Err(); err != nil {
+		return err
+	}
+	if cibaSession.IsFinal() {
+		return c.writer.ZRem(ctx, cibaSessionActiveKey, cibaSession.AuthReqId).Err()
+	}
+	return c.writer.ZAdd(ctx, cibaSessionActiveKey, member).Err()
+}
+
+func (c *CibaSessionRedisRepository) FindById(ctx context.Context, id string) (*domain.CibaSession, error) {
 	key := fmt.Sprintf("ciba_session:%s", id)
-	val, err := c.client.Get(c.ctx, key).Result()
+	val, err := c.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, nil
 	} else if err != nil {
@@ -103,25 +220,123 @@ func (c *CibaSessionRedisRepository) FindById(id string) (*domain.CibaSession, e
 	return cibaSession, nil
 }
 
-func (c *CibaSessionRedisRepository) Update(cibaSession *domain.CibaSession) error {
-	return c.Create(cibaSession)
+// Stores the Ciba session only if its history contains every transition of the stored one,
+// that is nobody else has changed its status since it was read. Returns ErrConcurrentUpdate otherwise.
+// Within a transaction the error is only known once the transaction is executed.
+func (c *CibaSessionRedisRepository) Update(ctx context.Context, cibaSession *domain.CibaSession) error {
+	key := fmt.Sprintf("ciba_session:%s", cibaSession.AuthReqId)
+	ttl := redisTtl(cibaSession.GetExpiresAt(), c.gracePeriod)
+	statuses := make([]string, len(cibaSession.History))
+	for i, t := range cibaSession.History {
+		statuses[i] = t.To
+	}
+	encodedStatuses, err := json.Marshal(statuses)
+	if err != nil {
+		return err
+	}
+	err = c.writer.Eval(ctx, redisUpdateCibaSessionScript, []string{key}, cibaSession, ttl.Milliseconds(), encodedStatuses, ErrConcurrentUpdate.Error()).Err()
+	if err != nil {
+		return redisConcurrentUpdateError(err)
+	}
+	return c.index(ctx, cibaSession)
+}
+
+func (c *CibaSessionRedisRepository) FindExpired(ctx context.Context, before time.Time, limit int) ([]*domain.CibaSession, error) {
+	ids, err := c.client.ZRangeByScore(ctx, cibaSessionActiveKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("(%d", before.Unix()),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var cibaSessions []*domain.CibaSession
+	for _, id := range ids {
+		cibaSession, err := c.FindById(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if cibaSession == nil || cibaSession.IsFinal() {
+			// The index is stale, the session is either gone or no longer active.
+			if err := c.writer.ZRem(ctx, cibaSessionActiveKey, id).Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		cibaSessions = append(cibaSessions, cibaSession)
+	}
+	return cibaSessions, nil
+}
+
+func (c *CibaSessionRedisRepository) FindPendingByUserId(ctx context.Context, userId string, after time.Time) ([]*domain.CibaSession, error) {
+	ids, err := c.client.ZRangeByScore(ctx, fmt.Sprintf(cibaSessionPendingKeyFormat, userId), &redis.ZRangeBy{
+		Min: fmt.Sprintf("%d", after.Unix()),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var cibaSessions []*domain.CibaSession
+	for _, id := range ids {
+		cibaSession, err := c.FindById(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		// Sessions are indexed by their expiry in seconds, the exact time is checked here.
+		if cibaSession == nil || !cibaSession.IsAuthorizationPending() || !cibaSession.GetExpiresAt().After(after) {
+			continue
+		}
+		cibaSessions = append(cibaSessions, cibaSession)
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].CreatedAt.Before(cibaSessions[j].CreatedAt)
+	})
+	return cibaSessions, nil
+}
+
+// Scans the index of every pending and approved Ciba session, there is none by user and client.
+func (c *CibaSessionRedisRepository) FindActiveByUserIdAndClientId(ctx context.Context, userId, clientId string) ([]*domain.CibaSession, error) {
+	ids, err := c.client.ZRange(ctx, cibaSessionActiveKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var cibaSessions []*domain.CibaSession
+	for _, id := range ids {
+		cibaSession, err := c.FindById(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if cibaSession == nil || cibaSession.IsFinal() || cibaSession.UserId != userId || cibaSession.ClientId != clientId {
+			continue
+		}
+		cibaSessions = append(cibaSessions, cibaSession)
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].CreatedAt.Before(cibaSessions[j].CreatedAt)
+	})
+	return cibaSessions, nil
+}
+
+func (c *CibaSessionRedisRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	return deleteExpiredRedisKeys(ctx, c.client, cibaSessionExpiryKey, "ciba_session:%s", before, limit, cibaSessionActiveKey)
 }
 
 type keyRedisRepository struct {
 	client *redis.Client
-	ctx    context.Context
 }
 
 func NewKeyRedisRepository(client *redis.Client) *keyRedisRepository {
 	return &keyRedisRepository{
 		client: client,
-		ctx:    context.Background(),
 	}
 }
 
-func (k *keyRedisRepository) FindPrivateKeyByClientId(clientId string) (*domain.Key, error) {
+func (k *keyRedisRepository) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
 	key := fmt.Sprintf("oauth_key:%s", clientId)
-	val, err := k.client.Get(k.ctx, key).Result()
+	val, err := k.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -135,26 +350,122 @@ func (k *keyRedisRepository) FindPrivateKeyByClientId(clientId string) (*domain.
 	return oauthKey, nil
 }
 
+// Signing keys are kept in a single hash, there are only a few of them and they're always read together.
+const signingKeysRedisKey = "signing_keys"
+
+type signingKeyRedisRepository struct {
+	client *redis.Client
+	// Where writes go, the transaction pipeline when the repository is bound to a transaction.
+	writer redis.Cmdable
+}
+
+func NewSigningKeyRedisRepository(client *redis.Client) *signingKeyRedisRepository {
+	return &signingKeyRedisRepository{
+		client: client,
+		writer: client,
+	}
+}
+
+func (s *signingKeyRedisRepository) Create(ctx context.Context, key *domain.SigningKey) error {
+	return s.writer.HSet(ctx, signingKeysRedisKey, key.Id, key).Err()
+}
+
+func (s *signingKeyRedisRepository) Update(ctx context.Context, key *domain.SigningKey) error {
+	return s.writer.HSet(ctx, signingKeysRedisKey, key.Id, key).Err()
+}
+
+func (s *signingKeyRedisRepository) FindAll(ctx context.Context) ([]*domain.SigningKey, error) {
+	values, err := s.client.HGetAll(ctx, signingKeysRedisKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*domain.SigningKey, 0, len(values))
+	for _, value := range values {
+		key := &domain.SigningKey{}
+		if err := key.UnmarshalBinary([]byte(value)); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (s *signingKeyRedisRepository) Delete(ctx context.Context, id string) error {
+	return s.writer.HDel(ctx, signingKeysRedisKey, id).Err()
+}
+
 type accessTokenRedisRepository struct {
 	client *redis.Client
-	ctx    context.Context
+	// Where writes go, the transaction pipeline when the repository is bound to a transaction.
+	writer      redis.Cmdable
+	gracePeriod time.Duration
 }
 
+// Access tokens are stored with a TTL and are removed from the expiry index once Redis has dropped them.
 func NewAccessTokenRedisRepository(client *redis.Client) *accessTokenRedisRepository {
 	return &accessTokenRedisRepository{
-		client: client,
-		ctx:    context.Background(),
+		client:      client,
+		writer:      client,
+		gracePeriod: DefaultRedisGracePeriod,
 	}
 }
 
-func (a *accessTokenRedisRepository) Create(accessToken *domain.AccessToken) error {
+func (a *accessTokenRedisRepository) Create(ctx context.Context, accessToken *domain.AccessToken) error {
 	key := fmt.Sprintf("access_token:%s", accessToken.Value)
-	return a.client.Set(a.ctx, key, accessToken, 0).Err()
+	ttl := redisTtl(accessToken.Expires, a.gracePeriod)
+	if err := a.writer.Set(ctx, key, accessToken, ttl).Err(); err != nil {
+		return err
+	}
+	if err := trimRedisIndexes(ctx, a.writer, a.gracePeriod, accessTokenExpiryKey); err != nil {
+		return err
+	}
+	if err := a.writer.ZAdd(ctx, accessTokenExpiryKey, &redis.Z{
+		Score:  float64(accessToken.Expires.Unix()),
+		Member: accessToken.Value,
+	}).Err(); err != nil {
+		return err
+	}
+	grantKey := fmt.Sprintf(accessTokenGrantKeyFormat, accessToken.UserId, accessToken.ClientId)
+	if err := a.writer.SAdd(ctx, grantKey, accessToken.Value).Err(); err != nil {
+		return err
+	}
+	return a.writer.Eval(ctx, redisExtendTtlScript, []string{grantKey}, ttl.Milliseconds()).Err()
+}
+
+func (a *accessTokenRedisRepository) DeleteByUserIdAndClientId(ctx context.Context, userId, clientId string) (int, error) {
+	grantKey := fmt.Sprintf(accessTokenGrantKeyFormat, userId, clientId)
+	values, err := a.client.SMembers(ctx, grantKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, len(values))
+	members := make([]interface{}, len(values))
+	for i, value := range values {
+		keys[i] = fmt.Sprintf("access_token:%s", value)
+		members[i] = value
+	}
+	if err := a.writer.Del(ctx, append(keys, grantKey)...).Err(); err != nil {
+		return 0, err
+	}
+	if err := a.writer.ZRem(ctx, accessTokenExpiryKey, members...).Err(); err != nil {
+		return 0, err
+	}
+	return len(values), nil
+}
+
+func (a *accessTokenRedisRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	return deleteExpiredRedisKeys(ctx, a.client, accessTokenExpiryKey, "access_token:%s", before, limit)
 }
 
-func (a *accessTokenRedisRepository) Find(accessToken string) (*domain.AccessToken, error) {
+func (a *accessTokenRedisRepository) Find(ctx context.Context, accessToken string) (*domain.AccessToken, error) {
 	key := fmt.Sprintf("access_token:%s", accessToken)
-	val, err := a.client.Get(a.ctx, key).Result()
+	val, err := a.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -170,19 +481,17 @@ func (a *accessTokenRedisRepository) Find(accessToken string) (*domain.AccessTok
 
 type userClaimRedisRepository struct {
 	client *redis.Client
-	ctx    context.Context
 }
 
 func NewUserClaimRedisRepository(client *redis.Client) *userClaimRedisRepository {
 	return &userClaimRedisRepository{
 		client: client,
-		ctx:    context.Background(),
 	}
 }
 
-func (u *userClaimRedisRepository) GetUserClaims(userId, scopes string) (map[string]interface{}, error) {
+func (u *userClaimRedisRepository) GetUserClaims(ctx context.Context, userId, scopes string) (map[string]interface{}, error) {
 	userKey := fmt.Sprintf("user_account:%s", userId)
-	val, err := u.client.Get(u.ctx, userKey).Result()
+	val, err := u.client.Get(ctx, userKey).Result()
 	if err == redis.Nil {
 		return map[string]interface{}{}, nil
 	} else if err != nil {
@@ -197,7 +506,7 @@ func (u *userClaimRedisRepository) GetUserClaims(userId, scopes string) (map[str
 	scopesArr := strings.Split(scopes, " ")
 
 	for _, scope := range scopesArr {
-		claimsInScope, err := u.client.LRange(u.ctx, "scope:"+scope, 0, -1).Result()
+		claimsInScope, err := u.client.LRange(ctx, "scope:"+scope, 0, -1).Result()
 		if err == redis.Nil {
 			continue
 		} else if err != nil {
@@ -215,24 +524,441 @@ func (u *userClaimRedisRepository) GetUserClaims(userId, scopes string) (map[str
 	return claimsValues, nil
 }
 
+// Deletes at most limit keys whose score in the expiry index is before the given time,
+// along with their members in the expiry index and in every other given index.
+func deleteExpiredRedisKeys(ctx context.Context, client *redis.Client, expiryKey, keyFormat string, before time.Time, limit int, otherIndexes ...string) (int, error) {
+	members, err := client.ZRangeByScore(ctx, expiryKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("(%d", before.Unix()),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(members) == 0 {
+		return 0, nil
+	}
+
+	keys := make([]string, len(members))
+	indexMembers := make([]interface{}, len(members))
+	for i, member := range members {
+		keys[i] = fmt.Sprintf(keyFormat, member)
+		indexMembers[i] = member
+	}
+
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		for _, index := range append([]string{expiryKey}, otherIndexes...) {
+			pipe.ZRem(ctx, index, indexMembers...)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(members), nil
+}
+
+type userDeviceRedisRepository struct {
+	client *redis.Client
+	// Where writes go, the transaction pipeline when the repository is bound to a transaction.
+	writer redis.Cmdable
+}
+
+func NewUserDeviceRedisRepository(client *redis.Client) *userDeviceRedisRepository {
+	return &userDeviceRedisRepository{
+		client: client,
+		writer: client,
+	}
+}
+
+// The ids of the devices of a user are kept in a set, so that they're found without scanning.
+func userDevicesRedisKey(userId string) string {
+	return fmt.Sprintf("user_devices:%s", userId)
+}
+
+func (u *userDeviceRedisRepository) Create(ctx context.Context, device *domain.UserDevice) error {
+	if err := u.writer.Set(ctx, fmt.Sprintf("user_device:%s", device.Id), device, 0).Err(); err != nil {
+		return err
+	}
+	return u.writer.SAdd(ctx, userDevicesRedisKey(device.UserId), device.Id).Err()
+}
+
+func (u *userDeviceRedisRepository) Update(ctx context.Context, device *domain.UserDevice) error {
+	return u.writer.Set(ctx, fmt.Sprintf("user_device:%s", device.Id), device, 0).Err()
+}
+
+func (u *userDeviceRedisRepository) FindById(ctx context.Context, id string) (*domain.UserDevice, error) {
+	val, err := u.client.Get(ctx, fmt.Sprintf("user_device:%s", id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	device := &domain.UserDevice{}
+	if err := device.UnmarshalBinary([]byte(val)); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (u *userDeviceRedisRepository) FindActiveByUserId(ctx context.Context, userId string) ([]*domain.UserDevice, error) {
+	ids, err := u.client.SMembers(ctx, userDevicesRedisKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var devices []*domain.UserDevice
+	for _, id := range ids {
+		device, err := u.FindById(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if device != nil && device.IsActive() {
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastSeenAt.After(devices[j].LastSeenAt)
+	})
+	return devices, nil
+}
+
+type grantRedisRepository struct {
+	client *redis.Client
+	// Where writes go, the transaction pipeline when the repository is bound to a transaction.
+	writer redis.Cmdable
+}
+
+func NewGrantRedisRepository(client *redis.Client) *grantRedisRepository {
+	return &grantRedisRepository{
+		client: client,
+		writer: client,
+	}
+}
+
+func grantRedisKey(userId, clientId string) string {
+	return fmt.Sprintf("grant:%s:%s", userId, clientId)
+}
+
+// The client ids of the grants of a user are kept in a set, so that they're found without scanning.
+func userGrantsRedisKey(userId string) string {
+	return fmt.Sprintf("grants:%s", userId)
+}
+
+func (g *grantRedisRepository) Create(ctx context.Context, grant *domain.Grant) error {
+	if err := g.writer.Set(ctx, grantRedisKey(grant.UserId, grant.ClientId), grant, 0).Err(); err != nil {
+		return err
+	}
+	return g.writer.SAdd(ctx, userGrantsRedisKey(grant.UserId), grant.ClientId).Err()
+}
+
+func (g *grantRedisRepository) Update(ctx context.Context, grant *domain.Grant) error {
+	return g.writer.Set(ctx, grantRedisKey(grant.UserId, grant.ClientId), grant, 0).Err()
+}
+
+func (g *grantRedisRepository) FindByUserIdAndClientId(ctx context.Context, userId, clientId string) (*domain.Grant, error) {
+	val, err := g.client.Get(ctx, grantRedisKey(userId, clientId)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	grant := &domain.Grant{}
+	if err := grant.UnmarshalBinary([]byte(val)); err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+func (g *grantRedisRepository) FindActiveByUserId(ctx context.Context, userId string) ([]*domain.Grant, error) {
+	clientIds, err := g.client.SMembers(ctx, userGrantsRedisKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var grants []*domain.Grant
+	for _, clientId := range clientIds {
+		grant, err := g.FindByUserIdAndClientId(ctx, userId, clientId)
+		if err != nil {
+			return nil, err
+		}
+		if grant != nil && grant.IsActive() {
+			grants = append(grants, grant)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].ConsentedAt.After(grants[j].ConsentedAt)
+	})
+	return grants, nil
+}
+
+// Releases the lock only if it's still held by the given owner.
+const redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+type redisLocker struct {
+	client *redis.Client
+	owner  string
+}
+
+// NewRedisLocker creates a locker backed by Redis keys prefixed with lock:.
+func NewRedisLocker(client *redis.Client) *redisLocker {
+	return &redisLocker{
+		client: client,
+		owner:  util.GenerateUuid(),
+	}
+}
+
+func (l *redisLocker) TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return l.client.SetNX(ctx, fmt.Sprintf("lock:%s", name), l.owner, ttl).Result()
+}
+
+func (l *redisLocker) Unlock(ctx context.Context, name string) error {
+	return l.client.Eval(ctx, redisUnlockScript, []string{fmt.Sprintf("lock:%s", name)}, l.owner).Err()
+}
+
+type scopeRedisRepository struct {
+	client *redis.Client
+	// Where writes go, the transaction pipeline when the repository is bound to a transaction.
+	writer redis.Cmdable
+}
+
+func NewScopeRedisRepository(client *redis.Client) *scopeRedisRepository {
+	return &scopeRedisRepository{
+		client: client,
+		writer: client,
+	}
+}
+
+// The claims a scope grants are kept in the scope:<name> list read by GetUserClaims,
+// the rest of the scope is kept next to it.
+func scopeRedisKey(name string) string {
+	return fmt.Sprintf("scope_registry:%s", name)
+}
+
+func scopeClaimsRedisKey(name string) string {
+	return fmt.Sprintf("scope:%s", name)
+}
+
+func claimRedisKey(name string) string {
+	return fmt.Sprintf("claim:%s", name)
+}
+
+const (
+	scopesRedisKey = "scopes"
+	claimsRedisKey = "claims"
+)
+
+func (s *scopeRedisRepository) CreateScope(ctx context.Context, scope *domain.Scope) error {
+	return s.UpdateScope(ctx, scope)
+}
+
+func (s *scopeRedisRepository) UpdateScope(ctx context.Context, scope *domain.Scope) error {
+	if err := s.writer.Set(ctx, scopeRedisKey(scope.Name), scope, 0).Err(); err != nil {
+		return err
+	}
+	if err := s.writer.SAdd(ctx, scopesRedisKey, scope.Name).Err(); err != nil {
+		return err
+	}
+	if err := s.writer.Del(ctx, scopeClaimsRedisKey(scope.Name)).Err(); err != nil {
+		return err
+	}
+	for _, claim := range scope.Claims {
+		if err := s.writer.RPush(ctx, scopeClaimsRedisKey(scope.Name), claim).Err(); err != nil {
+			return err
+		}
+		if err := s.writer.SetNX(ctx, claimRedisKey(claim), &domain.Claim{Name: claim}, 0).Err(); err != nil {
+			return err
+		}
+		if err := s.writer.SAdd(ctx, claimsRedisKey, claim).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scopeRedisRepository) DeleteScope(ctx context.Context, name string) error {
+	if err := s.writer.Del(ctx, scopeRedisKey(name), scopeClaimsRedisKey(name)).Err(); err != nil {
+		return err
+	}
+	return s.writer.SRem(ctx, scopesRedisKey, name).Err()
+}
+
+func (s *scopeRedisRepository) FindScopeByName(ctx context.Context, name string) (*domain.Scope, error) {
+	claims, err := s.client.LRange(ctx, scopeClaimsRedisKey(name), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	val, err := s.client.Get(ctx, scopeRedisKey(name)).Result()
+	if err == redis.Nil {
+		// Scopes stored before the registry only have their claims list.
+		if len(claims) == 0 {
+			return nil, nil
+		}
+		return &domain.Scope{Name: name, Claims: claims}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scope := &domain.Scope{}
+	if err := scope.UnmarshalBinary([]byte(val)); err != nil {
+		return nil, err
+	}
+	scope.Claims = claims
+	return scope, nil
+}
+
+func (s *scopeRedisRepository) FindAllScopes(ctx context.Context) ([]*domain.Scope, error) {
+	names, err := s.client.SMembers(ctx, scopesRedisKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var scopes []*domain.Scope
+	for _, name := range names {
+		scope, err := s.FindScopeByName(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if scope != nil {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+func (s *scopeRedisRepository) CreateClaim(ctx context.Context, claim *domain.Claim) error {
+	return s.UpdateClaim(ctx, claim)
+}
+
+func (s *scopeRedisRepository) UpdateClaim(ctx context.Context, claim *domain.Claim) error {
+	if err := s.writer.Set(ctx, claimRedisKey(claim.Name), claim, 0).Err(); err != nil {
+		return err
+	}
+	return s.writer.SAdd(ctx, claimsRedisKey, claim.Name).Err()
+}
+
+func (s *scopeRedisRepository) DeleteClaim(ctx context.Context, name string) error {
+	scopes, err := s.client.SMembers(ctx, scopesRedisKey).Result()
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		if err := s.writer.LRem(ctx, scopeClaimsRedisKey(scope), 0, name).Err(); err != nil {
+			return err
+		}
+	}
+	if err := s.writer.Del(ctx, claimRedisKey(name)).Err(); err != nil {
+		return err
+	}
+	return s.writer.SRem(ctx, claimsRedisKey, name).Err()
+}
+
+func (s *scopeRedisRepository) FindAllClaims(ctx context.Context) ([]*domain.Claim, error) {
+	names, err := s.client.SMembers(ctx, claimsRedisKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var claims []*domain.Claim
+	for _, name := range names {
+		val, err := s.client.Get(ctx, claimRedisKey(name)).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		claim := &domain.Claim{}
+		if err := claim.UnmarshalBinary([]byte(val)); err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+	return claims, nil
+}
+
 type RedisDataStore struct {
+	client *redis.Client
+	config *RedisDataStoreConfig
+	// Nil when the data store isn't bound to a transaction.
+	pipe redis.Pipeliner
+
 	accessTokenRepo       *accessTokenRedisRepository
 	cibaSessionRepo       *CibaSessionRedisRepository
 	clientApplicationRepo *clientApplicationRedisRepository
 	keyRepositoryRepo     *keyRedisRepository
+	signingKeyRepo        *signingKeyRedisRepository
 	userAccountRepo       *userAccountRedisRepository
 	userClaimRepo         *userClaimRedisRepository
+	userDeviceRepo        *userDeviceRedisRepository
+	grantRepo             *grantRedisRepository
+	scopeRepo             *scopeRedisRepository
+}
+
+type RedisDataStoreConfig struct {
+	// How long Ciba sessions and access tokens are kept after they expire.
+	GracePeriod time.Duration
 }
 
 func NewRedisDataStore(client *redis.Client) *RedisDataStore {
+	return NewCustomRedisDataStore(client, &RedisDataStoreConfig{
+		GracePeriod: DefaultRedisGracePeriod,
+	})
+}
+
+func NewCustomRedisDataStore(client *redis.Client, config *RedisDataStoreConfig) *RedisDataStore {
+	return newRedisDataStore(client, config, nil)
+}
+
+// Creates the repositories, writing through pipe instead of the client if it's not nil.
+func newRedisDataStore(client *redis.Client, config *RedisDataStoreConfig, pipe redis.Pipeliner) *RedisDataStore {
+	accessTokenRepo := NewAccessTokenRedisRepository(client)
+	accessTokenRepo.gracePeriod = config.GracePeriod
+	cibaSessionRepo := NewCibaSessionRedisRepository(client)
+	cibaSessionRepo.gracePeriod = config.GracePeriod
+	clientApplicationRepo := NewClientApplicationRedisRepository(client)
+	signingKeyRepo := NewSigningKeyRedisRepository(client)
+	userDeviceRepo := NewUserDeviceRedisRepository(client)
+	grantRepo := NewGrantRedisRepository(client)
+	scopeRepo := NewScopeRedisRepository(client)
+	if pipe != nil {
+		accessTokenRepo.writer = pipe
+		cibaSessionRepo.writer = pipe
+		clientApplicationRepo.writer = pipe
+		signingKeyRepo.writer = pipe
+		userDeviceRepo.writer = pipe
+		grantRepo.writer = pipe
+		scopeRepo.writer = pipe
+	}
 	return &RedisDataStore{
-		accessTokenRepo:       NewAccessTokenRedisRepository(client),
-		cibaSessionRepo:       NewCibaSessionRedisRepository(client),
-		clientApplicationRepo: NewClientApplicationRedisRepository(client),
+		client:                client,
+		config:                config,
+		pipe:                  pipe,
+		accessTokenRepo:       accessTokenRepo,
+		cibaSessionRepo:       cibaSessionRepo,
+		clientApplicationRepo: clientApplicationRepo,
 		keyRepositoryRepo:     NewKeyRedisRepository(client),
+		signingKeyRepo:        signingKeyRepo,
 		userAccountRepo:       NewUserAccountRedisRepository(client),
 		userClaimRepo:         NewUserClaimRedisRepository(client),
+		userDeviceRepo:        userDeviceRepo,
+		grantRepo:             grantRepo,
+		scopeRepo:             scopeRepo,
+	}
+}
+
+func (r *RedisDataStore) HaveTransactionSupport() bool {
+	return true
+}
+
+// Runs fn with a data store whose writes are queued in a MULTI/EXEC block, which is executed if fn
+// returns no error and discarded otherwise. Reads within fn don't see the queued writes.
+// Calling it on a data store that is already bound to a transaction runs fn within that transaction.
+func (r *RedisDataStore) WithinTransaction(ctx context.Context, fn func(tx DataStoreInterface) error) error {
+	if r.pipe != nil {
+		return fn(r)
 	}
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return fn(newRedisDataStore(r.client, r.config, pipe))
+	})
+	return redisConcurrentUpdateError(err)
 }
 
 func (r *RedisDataStore) GetAccessTokenRepository() AccessTokenRepositoryInterface {
@@ -251,6 +977,10 @@ func (r *RedisDataStore) GetKeyRepository() KeyRepositoryInterface {
 	return r.keyRepositoryRepo
 }
 
+func (r *RedisDataStore) GetSigningKeyRepository() SigningKeyRepositoryInterface {
+	return r.signingKeyRepo
+}
+
 func (r *RedisDataStore) GetUserAccountRepository() UserAccountRepositoryInterface {
 	return r.userAccountRepo
 }
@@ -258,3 +988,15 @@ func (r *RedisDataStore) GetUserAccountRepository() UserAccountRepositoryInterfa
 func (r *RedisDataStore) GetUserClaimRepository() UserClaimRepositoryInterface {
 	return r.userClaimRepo
 }
+
+func (r *RedisDataStore) GetUserDeviceRepository() UserDeviceRepositoryInterface {
+	return r.userDeviceRepo
+}
+
+func (r *RedisDataStore) GetGrantRepository() GrantRepositoryInterface {
+	return r.grantRepo
+}
+
+func (r *RedisDataStore) GetScopeRepository() ScopeRepositoryInterface {
+	return r.scopeRepo
+}
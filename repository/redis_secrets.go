@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/go-redis/redis/v8"
+)
+
+// Hashes the client secrets stored in plaintext, except those of client_secret_jwt clients which sign
+// their assertions with it. Returns the number of secrets hashed.
+func (r *RedisDataStore) HashClientSecrets(ctx context.Context) (int, error) {
+	hashed := 0
+	iter := r.client.Scan(ctx, 0, "client_application:*", 100).Iterator()
+	for iter.Next(ctx) {
+		val, err := r.client.Get(ctx, iter.Val()).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return hashed, err
+		}
+		clientApp := &domain.ClientApplication{}
+		if err := clientApp.UnmarshalBinary([]byte(val)); err != nil {
+			return hashed, err
+		}
+		withHashedSecret, err := clientApp.WithHashedSecret()
+		if err != nil {
+			return hashed, err
+		}
+		if withHashedSecret.Secret == clientApp.Secret {
+			continue
+		}
+		if err := r.client.Set(ctx, iter.Val(), withHashedSecret, 0).Err(); err != nil {
+			return hashed, err
+		}
+		hashed++
+	}
+	return hashed, iter.Err()
+}
+
+// Encrypts the private keys of the client keys and signing keys stored in plaintext with provider.
+// Returns the number of private keys encrypted.
+func (r *RedisDataStore) EncryptPrivateKeys(ctx context.Context, provider util.KeyEncryptionProvider) (int, error) {
+	encrypted := 0
+	iter := r.client.Scan(ctx, 0, "oauth_key:*", 100).Iterator()
+	for iter.Next(ctx) {
+		val, err := r.client.Get(ctx, iter.Val()).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return encrypted, err
+		}
+		key := &domain.Key{}
+		if err := key.UnmarshalBinary([]byte(val)); err != nil {
+			return encrypted, err
+		}
+		if key.Private == "" || util.IsSealedPrivateKey(key.Private) {
+			continue
+		}
+		if key.Private, err = util.SealPrivateKey(provider, key.Id, key.Private); err != nil {
+			return encrypted, err
+		}
+		if err := r.client.Set(ctx, iter.Val(), key, 0).Err(); err != nil {
+			return encrypted, err
+		}
+		encrypted++
+	}
+	if err := iter.Err(); err != nil {
+		return encrypted, err
+	}
+
+	signingKeys, err := r.signingKeyRepo.FindAll(ctx)
+	if err != nil {
+		return encrypted, err
+	}
+	for _, key := range signingKeys {
+		if key.Private == "" || util.IsSealedPrivateKey(key.Private) {
+			continue
+		}
+		if key.Private, err = util.SealPrivateKey(provider, key.Id, key.Private); err != nil {
+			return encrypted, err
+		}
+		if err := r.signingKeyRepo.Update(ctx, key); err != nil {
+			return encrypted, err
+		}
+		encrypted++
+	}
+	return encrypted, nil
+}
@@ -1,6 +1,8 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -8,6 +10,7 @@ import (
 	"github.com/adisazhar123/go-ciba/domain"
 	"github.com/adisazhar123/go-ciba/grant"
 	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/adisazhar123/go-ciba/util"
 	"github.com/alicebob/miniredis"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
@@ -36,12 +39,16 @@ func TestClientApplicationRedisRepository_Register(t *testing.T) {
 	userCode := false
 
 	newClientApp := domain.NewClientApplication(name, scope, tokenMode, endpoint, alg, userCode)
-	marshalled, _ := newClientApp.MarshalBinary()
 
-	err := repo.Register(newClientApp)
+	err := repo.Register(context.Background(), newClientApp)
+	stored, _ := miniRedis.Get("client_application:" + newClientApp.Id)
+	storedClientApp := &domain.ClientApplication{}
+	_ = storedClientApp.UnmarshalBinary([]byte(stored))
 
-	miniRedis.CheckGet(t, "client_application:"+newClientApp.Id, string(marshalled))
 	assert.NoError(t, err)
+	assert.NotEqual(t, newClientApp.Secret, storedClientApp.Secret)
+	assert.True(t, storedClientApp.VerifySecret(newClientApp.Secret))
+	assert.Equal(t, newClientApp.Name, storedClientApp.Name)
 }
 
 func TestClientApplicationRedisRepository_FindById(t *testing.T) {
@@ -57,7 +64,7 @@ func TestClientApplicationRedisRepository_FindById(t *testing.T) {
 	jsonString, _ := newClientApp.MarshalBinary()
 	miniRedis.Set("client_application:"+newClientApp.Id, string(jsonString))
 
-	clientApp, err := repo.FindById(newClientApp.Id)
+	clientApp, err := repo.FindById(context.Background(), newClientApp.Id)
 
 	assert.NotNil(t, clientApp)
 	assert.NoError(t, err)
@@ -88,7 +95,7 @@ func TestCibaSessionRedisRepository_Create(t *testing.T) {
 	newCibaSession := domain.NewCibaSession(&ca, hint, bindingMessage, token, scope, expiresIn, &interval)
 	marshalled, _ := newCibaSession.MarshalBinary()
 
-	err := repo.Create(newCibaSession)
+	err := repo.Create(context.Background(), newCibaSession)
 
 	miniRedis.CheckGet(t, "ciba_session:"+newCibaSession.AuthReqId, string(marshalled))
 	assert.NoError(t, err)
@@ -110,7 +117,7 @@ func TestUserAccountRedisRepository_FindById_ValidUser(t *testing.T) {
 	jsonString, _ := user.MarshalBinary()
 	miniRedis.Set("user_account:"+userId, string(jsonString))
 
-	foundUser, err := repo.FindById(userId)
+	foundUser, err := repo.FindById(context.Background(), userId)
 
 	assert.Empty(t, err)
 	assert.Equal(t, user.Id, foundUser.Id)
@@ -132,7 +139,7 @@ func TestUserAccountRedisRepository_FindById_InvalidUser(t *testing.T) {
 	jsonString, _ := user.MarshalBinary()
 	miniRedis.Set("user_account:"+user.Id, string(jsonString))
 
-	foundUser, err := repo.FindById(invalidUserId)
+	foundUser, err := repo.FindById(context.Background(), invalidUserId)
 
 	assert.Nil(t, foundUser)
 	assert.NoError(t, err)
@@ -145,7 +152,7 @@ func TestCibaSessionRedisRepository_FindById_ShouldReturnNil_WhenNotFound(t *tes
 	bytes, _ := test_data.CibaSession1.MarshalBinary()
 	miniRedis.Set("ciba_session:"+test_data.CibaSession1.AuthReqId, string(bytes))
 
-	ciba, err := repo.FindById(invalidSessionId)
+	ciba, err := repo.FindById(context.Background(), invalidSessionId)
 
 	assert.Nil(t, ciba)
 	assert.NoError(t, err)
@@ -157,7 +164,7 @@ func TestCibaSessionRedisRepository_FindById_ShouldReturnCibaSession(t *testing.
 	bytes, _ := test_data.CibaSession1.MarshalBinary()
 	miniRedis.Set("ciba_session:"+test_data.CibaSession1.AuthReqId, string(bytes))
 
-	cs, err := repo.FindById(test_data.CibaSession1.AuthReqId)
+	cs, err := repo.FindById(context.Background(), test_data.CibaSession1.AuthReqId)
 
 	assert.Nil(t, err)
 	assert.NotNil(t, cs)
@@ -169,7 +176,7 @@ func TestCibaSessionRedisRepository_Update(t *testing.T) {
 	cs := test_data.CibaSession1
 	bytes, _ := test_data.CibaSession1.MarshalBinary()
 
-	err := repo.Update(&cs)
+	err := repo.Update(context.Background(), &cs)
 
 	miniRedis.CheckGet(t, "ciba_session:"+test_data.CibaSession1.AuthReqId, string(bytes))
 	assert.Nil(t, err)
@@ -181,7 +188,7 @@ func TestKeyRedisRepository_FindPrivateKeyByClientId(t *testing.T) {
 	bytes, _ := test_data.Key1.MarshalBinary()
 	miniRedis.Set("oauth_key:"+test_data.Key1.ClientId, string(bytes))
 
-	key, err := repo.FindPrivateKeyByClientId(test_data.Key1.ClientId)
+	key, err := repo.FindPrivateKeyByClientId(context.Background(), test_data.Key1.ClientId)
 
 	assert.Nil(t, err)
 	assert.Equal(t, test_data.Key1, *key)
@@ -193,7 +200,7 @@ func TestAccessTokenRedisRepository_Create(t *testing.T) {
 	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid address", time.Now().UTC().Add(1 * time.Hour))
 	marshalled, _ := accessToken.MarshalBinary()
 
-	err := repo.Create(accessToken)
+	err := repo.Create(context.Background(), accessToken)
 
 	miniRedis.CheckGet(t, "access_token:"+accessToken.Value, string(marshalled))
 	assert.NoError(t, err)
@@ -206,7 +213,7 @@ func TestAccessTokenRedisRepository_Find(t *testing.T) {
 	marshalled, _ := accessToken.MarshalBinary()
 	miniRedis.Set("access_token:"+accessToken.Value, string(marshalled))
 
-	at, err := repo.Find(accessToken.Value)
+	at, err := repo.Find(context.Background(), accessToken.Value)
 
 	assert.NotNil(t, at)
 	assert.NoError(t, err)
@@ -221,11 +228,281 @@ func TestUserClaimRedisRepository_GetUserClaims(t *testing.T) {
 	miniRedis.Lpush("scope:openid", "id")
 
 
-	claims, err := repo.GetUserClaims(userAccount.Id, "openid address")
+	claims, err := repo.GetUserClaims(context.Background(), userAccount.Id, "openid address")
 
 	miniRedis.CheckList(t, "scope:openid", "id")
 	miniRedis.CheckGet(t, "user_account:"+userAccount.Id, string(marshalled))
 	assert.NotNil(t, claims)
 	assert.NoError(t, err)
 	assert.Contains(t, claims, "id")
-}
\ No newline at end of file
+}
+func newExpiredRedisCibaSession(age time.Duration) *domain.CibaSession {
+	interval := int64(5)
+	cs := domain.NewCibaSession(&test_data.ClientAppPoll, "hint", "binding", "token", "openid", 60, &interval)
+	cs.CreatedAt = cs.CreatedAt.Add(-age)
+	cs.ExpiresAt = cs.ExpiresAt.Add(-age)
+	return cs
+}
+
+func TestCibaSessionRedisRepository_FindExpired(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewCibaSessionRedisRepository(newRedisClient(miniRedis.Addr()))
+	expired := newExpiredRedisCibaSession(5 * time.Minute)
+	active := newExpiredRedisCibaSession(0)
+	denied := newExpiredRedisCibaSession(5 * time.Minute)
+	_ = denied.Deny(domain.ActorUser)
+	_ = repo.Create(context.Background(), expired)
+	_ = repo.Create(context.Background(), active)
+	_ = repo.Create(context.Background(), denied)
+
+	cibaSessions, err := repo.FindExpired(context.Background(), time.Now().UTC(), 10)
+
+	assert.NoError(t, err)
+	assert.Len(t, cibaSessions, 1)
+	assert.Equal(t, expired.AuthReqId, cibaSessions[0].AuthReqId)
+}
+
+func TestCibaSessionRedisRepository_Update_ShouldRemoveFinalSessionFromActiveIndex(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewCibaSessionRedisRepository(newRedisClient(miniRedis.Addr()))
+	cs := newExpiredRedisCibaSession(5 * time.Minute)
+	_ = repo.Create(context.Background(), cs)
+	cs.ExpireIfElapsed()
+
+	err := repo.Update(context.Background(), cs)
+	members, _ := miniRedis.ZMembers(cibaSessionActiveKey)
+
+	assert.NoError(t, err)
+	assert.NotContains(t, members, cs.AuthReqId)
+}
+
+func TestCibaSessionRedisRepository_DeleteExpiredBefore(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewCibaSessionRedisRepository(newRedisClient(miniRedis.Addr()))
+	stale := newExpiredRedisCibaSession(48 * time.Hour)
+	recent := newExpiredRedisCibaSession(5 * time.Minute)
+	// Creating a session trims the index of sessions Redis already dropped, the stale one goes last to be kept.
+	_ = repo.Create(context.Background(), recent)
+	_ = repo.Create(context.Background(), stale)
+
+	deleted, err := repo.DeleteExpiredBefore(context.Background(), time.Now().UTC().Add(-24*time.Hour), 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.False(t, miniRedis.Exists("ciba_session:"+stale.AuthReqId))
+	assert.True(t, miniRedis.Exists("ciba_session:"+recent.AuthReqId))
+}
+
+func TestCibaSessionRedisRepository_Create_ShouldTrimIndexesOfDroppedSessions(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewCibaSessionRedisRepository(newRedisClient(miniRedis.Addr()))
+	dropped := newExpiredRedisCibaSession(2 * time.Hour)
+	graced := newExpiredRedisCibaSession(5 * time.Minute)
+	_ = repo.Create(context.Background(), dropped)
+	_ = repo.Create(context.Background(), graced)
+
+	err := repo.Create(context.Background(), newExpiredRedisCibaSession(0))
+	expiryMembers, _ := miniRedis.ZMembers(cibaSessionExpiryKey)
+	activeMembers, _ := miniRedis.ZMembers(cibaSessionActiveKey)
+
+	assert.NoError(t, err)
+	assert.Len(t, expiryMembers, 2)
+	assert.NotContains(t, expiryMembers, dropped.AuthReqId)
+	assert.Contains(t, expiryMembers, graced.AuthReqId)
+	assert.NotContains(t, activeMembers, dropped.AuthReqId)
+}
+
+func TestAccessTokenRedisRepository_Create_ShouldTrimIndexOfDroppedTokens(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewAccessTokenRedisRepository(newRedisClient(miniRedis.Addr()))
+	dropped := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(-2*time.Hour))
+	_ = repo.Create(context.Background(), dropped)
+
+	err := repo.Create(context.Background(), domain.NewAccessToken("4-4-4-4", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour)))
+	members, _ := miniRedis.ZMembers(accessTokenExpiryKey)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"4-4-4-4"}, members)
+}
+
+func TestAccessTokenRedisRepository_DeleteExpiredBefore(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewAccessTokenRedisRepository(newRedisClient(miniRedis.Addr()))
+	expired := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(-1*time.Hour))
+	valid := domain.NewAccessToken("4-4-4-4", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+	_ = repo.Create(context.Background(), expired)
+	_ = repo.Create(context.Background(), valid)
+
+	deleted, err := repo.DeleteExpiredBefore(context.Background(), time.Now().UTC(), 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.False(t, miniRedis.Exists("access_token:"+expired.Value))
+	assert.True(t, miniRedis.Exists("access_token:"+valid.Value))
+}
+
+func TestRedisLocker_TryLock(t *testing.T) {
+	miniRedis := newTestRedis()
+	client := newRedisClient(miniRedis.Addr())
+	locker := NewRedisLocker(client)
+	other := NewRedisLocker(client)
+
+	acquired, err := locker.TryLock(context.Background(), "sweeper", time.Minute)
+	acquiredByOther, otherErr := other.TryLock(context.Background(), "sweeper", time.Minute)
+
+	assert.NoError(t, err)
+	assert.NoError(t, otherErr)
+	assert.True(t, acquired)
+	assert.False(t, acquiredByOther)
+}
+
+func TestRedisLocker_Unlock_ShouldOnlyReleaseOwnLock(t *testing.T) {
+	miniRedis := newTestRedis()
+	client := newRedisClient(miniRedis.Addr())
+	locker := NewRedisLocker(client)
+	other := NewRedisLocker(client)
+	_, _ = locker.TryLock(context.Background(), "sweeper", time.Minute)
+
+	otherErr := other.Unlock(context.Background(), "sweeper")
+	stillHeld := miniRedis.Exists("lock:sweeper")
+	err := locker.Unlock(context.Background(), "sweeper")
+
+	assert.NoError(t, otherErr)
+	assert.NoError(t, err)
+	assert.True(t, stillHeld)
+	assert.False(t, miniRedis.Exists("lock:sweeper"))
+}
+
+func TestCibaSessionRedisRepository_Create_ShouldSetTtl(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewCibaSessionRedisRepository(newRedisClient(miniRedis.Addr()))
+	cs := newExpiredRedisCibaSession(0)
+
+	err := repo.Create(context.Background(), cs)
+	ttl := miniRedis.TTL("ciba_session:" + cs.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.InDelta(t, (60*time.Second + DefaultRedisGracePeriod).Seconds(), ttl.Seconds(), 2)
+}
+
+func TestCibaSessionRedisRepository_Update_ShouldKeepTtl(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewCibaSessionRedisRepository(newRedisClient(miniRedis.Addr()))
+	cs := newExpiredRedisCibaSession(0)
+	_ = repo.Create(context.Background(), cs)
+	miniRedis.SetTTL("ciba_session:"+cs.AuthReqId, 30*time.Second)
+	_ = cs.Approve(domain.ActorUser)
+
+	err := repo.Update(context.Background(), cs)
+	found, _ := repo.FindById(context.Background(), cs.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, miniRedis.TTL("ciba_session:"+cs.AuthReqId))
+	assert.Equal(t, domain.StatusApproved, found.GetStatus())
+}
+
+func TestCibaSessionRedisRepository_Update_ShouldSetTtl_WhenKeyIsMissing(t *testing.T) {
+	miniRedis := newTestRedis()
+	repo := NewCibaSessionRedisRepository(newRedisClient(miniRedis.Addr()))
+	cs := newExpiredRedisCibaSession(0)
+
+	err := repo.Update(context.Background(), cs)
+	ttl := miniRedis.TTL("ciba_session:" + cs.AuthReqId)
+
+	assert.NoError(t, err)
+	assert.InDelta(t, (60*time.Second + DefaultRedisGracePeriod).Seconds(), ttl.Seconds(), 2)
+}
+
+func TestAccessTokenRedisRepository_Create_ShouldSetTtl(t *testing.T) {
+	miniRedis := newTestRedis()
+	ds := NewCustomRedisDataStore(newRedisClient(miniRedis.Addr()), &RedisDataStoreConfig{GracePeriod: 10 * time.Minute})
+	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+
+	err := ds.GetAccessTokenRepository().Create(context.Background(), accessToken)
+	ttl := miniRedis.TTL("access_token:" + accessToken.Value)
+
+	assert.NoError(t, err)
+	assert.InDelta(t, (70 * time.Minute).Seconds(), ttl.Seconds(), 2)
+}
+
+func TestRedisDataStore_WithinTransaction_ShouldApplyWrites(t *testing.T) {
+	miniRedis := newTestRedis()
+	ds := NewRedisDataStore(newRedisClient(miniRedis.Addr()))
+	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+	cs := newExpiredRedisCibaSession(0)
+
+	err := ds.WithinTransaction(context.Background(), func(tx DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(context.Background(), accessToken); err != nil {
+			return err
+		}
+		return tx.GetCibaSessionRepository().Create(context.Background(), cs)
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, miniRedis.Exists("access_token:"+accessToken.Value))
+	assert.True(t, miniRedis.Exists("ciba_session:"+cs.AuthReqId))
+}
+
+func TestRedisDataStore_WithinTransaction_ShouldDiscardWrites_WhenFnFails(t *testing.T) {
+	miniRedis := newTestRedis()
+	ds := NewRedisDataStore(newRedisClient(miniRedis.Addr()))
+	accessToken := domain.NewAccessToken("1-1-1-1", "2-2-2-2", "3-3-3-3", "openid", time.Now().UTC().Add(1*time.Hour))
+	fnErr := errors.New("failed")
+
+	err := ds.WithinTransaction(context.Background(), func(tx DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(context.Background(), accessToken); err != nil {
+			return err
+		}
+		return fnErr
+	})
+
+	assert.Equal(t, fnErr, err)
+	assert.False(t, miniRedis.Exists("access_token:"+accessToken.Value))
+}
+
+func TestRedisDataStore_HashClientSecrets_ShouldHashPlaintextSecrets(t *testing.T) {
+	miniRedis := newTestRedis()
+	ds := NewRedisDataStore(newRedisClient(miniRedis.Addr()))
+	basic := test_data.ClientAppPing
+	jwt := test_data.ClientAppPoll
+	jwt.TokenEndpointAuthMethod = "client_secret_jwt"
+	for _, clientApp := range []domain.ClientApplication{basic, jwt} {
+		marshalled, _ := clientApp.MarshalBinary()
+		_ = miniRedis.Set("client_application:"+clientApp.Id, string(marshalled))
+	}
+
+	count, err := ds.HashClientSecrets(context.Background())
+	foundBasic, _ := ds.GetClientApplicationRepository().FindById(context.Background(), basic.Id)
+	foundJwt, _ := ds.GetClientApplicationRepository().FindById(context.Background(), jwt.Id)
+	again, _ := ds.HashClientSecrets(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.True(t, util.IsHashedSecret(foundBasic.Secret))
+	assert.True(t, foundBasic.VerifySecret(basic.Secret))
+	assert.Equal(t, jwt.Secret, foundJwt.Secret)
+	assert.Equal(t, 0, again)
+}
+
+func TestRedisDataStore_EncryptPrivateKeys_ShouldEncryptPlaintextKeys(t *testing.T) {
+	miniRedis := newTestRedis()
+	ds := NewRedisDataStore(newRedisClient(miniRedis.Addr()))
+	provider, _ := util.NewLocalKeyEncryptionProvider([]byte("0123456789abcdef0123456789abcdef"))
+	marshalled, _ := test_data.Key1.MarshalBinary()
+	_ = miniRedis.Set("oauth_key:"+test_data.Key1.ClientId, string(marshalled))
+	_ = ds.GetSigningKeyRepository().Create(context.Background(), &domain.SigningKey{Id: "signing-key", Private: "signing-private", State: domain.SigningKeyStateActive})
+
+	count, err := ds.EncryptPrivateKeys(context.Background(), provider)
+	key, _ := ds.GetKeyRepository().FindPrivateKeyByClientId(context.Background(), test_data.Key1.ClientId)
+	signingKeys, _ := ds.GetSigningKeyRepository().FindAll(context.Background())
+	opened, _ := util.OpenPrivateKey(provider, key.Id, key.Private)
+	signingOpened, _ := util.OpenPrivateKey(provider, signingKeys[0].Id, signingKeys[0].Private)
+	again, _ := ds.EncryptPrivateKeys(context.Background(), provider)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.True(t, util.IsSealedPrivateKey(key.Private))
+	assert.Equal(t, test_data.Key1.Private, opened)
+	assert.Equal(t, "signing-private", signingOpened)
+	assert.Equal(t, 0, again)
+}
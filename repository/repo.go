@@ -1,44 +1,126 @@
 package repository
 
-import "github.com/adisazhar123/go-ciba/domain"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+)
+
+// Returned by data stores that detect a Ciba session was updated by someone else since it was read.
+var ErrConcurrentUpdate = errors.New("ciba session was updated concurrently")
 
 type common interface {
 	HaveTransactionSupport() bool
 }
 
 type AccessTokenRepositoryInterface interface {
-	Create(accessToken *domain.AccessToken) error
-	Find(accessToken string) (*domain.AccessToken, error)
+	Create(ctx context.Context, accessToken *domain.AccessToken) error
+	Find(ctx context.Context, accessToken string) (*domain.AccessToken, error)
+	// Deletes at most limit access tokens that expired before the given time.
+	// Returns the number of deleted access tokens.
+	DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error)
+	// Deletes the access tokens issued to the client for the user, e.g. when the user revokes its grant.
+	// Returns the number of deleted access tokens.
+	DeleteByUserIdAndClientId(ctx context.Context, userId, clientId string) (int, error)
 }
 
 type CibaSessionRepositoryInterface interface {
-	Create(cibaSession *domain.CibaSession) error
-	FindById(id string) (*domain.CibaSession, error)
-	Update(cibaSession *domain.CibaSession) error
+	Create(ctx context.Context, cibaSession *domain.CibaSession) error
+	FindById(ctx context.Context, id string) (*domain.CibaSession, error)
+	Update(ctx context.Context, cibaSession *domain.CibaSession) error
+	// Finds at most limit pending or approved Ciba sessions that expired before the given time.
+	FindExpired(ctx context.Context, before time.Time, limit int) ([]*domain.CibaSession, error)
+	// Deletes at most limit Ciba sessions, whatever their status, that expired before the given time.
+	// Returns the number of deleted Ciba sessions.
+	DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error)
+	// Finds the pending Ciba sessions of the user that expire after the given time, oldest first.
+	FindPendingByUserId(ctx context.Context, userId string, after time.Time) ([]*domain.CibaSession, error)
+	// Finds the pending and approved Ciba sessions of the user for the client, expired or not.
+	FindActiveByUserIdAndClientId(ctx context.Context, userId, clientId string) ([]*domain.CibaSession, error)
 }
 
 type ClientApplicationRepositoryInterface interface {
-	Register(clientApp *domain.ClientApplication) error
-	FindById(id string) (*domain.ClientApplication, error)
+	Register(ctx context.Context, clientApp *domain.ClientApplication) error
+	FindById(ctx context.Context, id string) (*domain.ClientApplication, error)
 }
 
 type KeyRepositoryInterface interface {
-	FindPrivateKeyByClientId(clientId string) (*domain.Key, error)
+	FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error)
+}
+
+type SigningKeyRepositoryInterface interface {
+	Create(ctx context.Context, key *domain.SigningKey) error
+	Update(ctx context.Context, key *domain.SigningKey) error
+	// Finds every signing key, whatever its state, oldest first.
+	FindAll(ctx context.Context) ([]*domain.SigningKey, error)
+	Delete(ctx context.Context, id string) error
 }
 
 type UserAccountRepositoryInterface interface {
-	FindById(id string) (*domain.UserAccount, error)
+	FindById(ctx context.Context, id string) (*domain.UserAccount, error)
 }
 
 type UserClaimRepositoryInterface interface {
-	GetUserClaims(userId, scopes string) (map[string]interface{}, error)
+	GetUserClaims(ctx context.Context, userId, scopes string) (map[string]interface{}, error)
+}
+
+type UserDeviceRepositoryInterface interface {
+	Create(ctx context.Context, device *domain.UserDevice) error
+	Update(ctx context.Context, device *domain.UserDevice) error
+	FindById(ctx context.Context, id string) (*domain.UserDevice, error)
+	// Finds the devices of the user that aren't deregistered, most recently seen first.
+	FindActiveByUserId(ctx context.Context, userId string) ([]*domain.UserDevice, error)
+}
+
+type GrantRepositoryInterface interface {
+	Create(ctx context.Context, grant *domain.Grant) error
+	Update(ctx context.Context, grant *domain.Grant) error
+	FindByUserIdAndClientId(ctx context.Context, userId, clientId string) (*domain.Grant, error)
+	// Finds the grants of the user that aren't revoked, most recently consented first.
+	FindActiveByUserId(ctx context.Context, userId string) ([]*domain.Grant, error)
+}
+
+// The registry of the scopes clients can request and the claims they grant. Scopes are found
+// by name, and creating a scope creates the claims it grants that don't exist yet.
+type ScopeRepositoryInterface interface {
+	CreateScope(ctx context.Context, scope *domain.Scope) error
+	// Updates the scope along with the claims it grants.
+	UpdateScope(ctx context.Context, scope *domain.Scope) error
+	DeleteScope(ctx context.Context, name string) error
+	FindScopeByName(ctx context.Context, name string) (*domain.Scope, error)
+	// Finds every scope, ordered by name.
+	FindAllScopes(ctx context.Context) ([]*domain.Scope, error)
+	CreateClaim(ctx context.Context, claim *domain.Claim) error
+	UpdateClaim(ctx context.Context, claim *domain.Claim) error
+	// Deletes the claim, the scopes granting it no longer do.
+	DeleteClaim(ctx context.Context, name string) error
+	// Finds every claim, ordered by name.
+	FindAllClaims(ctx context.Context) ([]*domain.Claim, error)
+}
+
+// A lock shared between server instances so that only one of them runs a job at a time.
+type LockerInterface interface {
+	// Acquires the lock with the given name for ttl. Returns false if it's held by someone else.
+	TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error)
+	// Releases the lock with the given name if it's held by this locker.
+	Unlock(ctx context.Context, name string) error
 }
 
 type DataStoreInterface interface {
+	common
+	// Runs fn with a data store whose writes are applied all together if fn returns no error,
+	// and discarded otherwise. Data stores without transaction support run fn as is.
+	WithinTransaction(ctx context.Context, fn func(tx DataStoreInterface) error) error
 	GetAccessTokenRepository() AccessTokenRepositoryInterface
 	GetCibaSessionRepository() CibaSessionRepositoryInterface
 	GetClientApplicationRepository() ClientApplicationRepositoryInterface
 	GetKeyRepository() KeyRepositoryInterface
+	GetSigningKeyRepository() SigningKeyRepositoryInterface
 	GetUserAccountRepository() UserAccountRepositoryInterface
 	GetUserClaimRepository() UserClaimRepositoryInterface
+	GetUserDeviceRepository() UserDeviceRepositoryInterface
+	GetGrantRepository() GrantRepositoryInterface
+	GetScopeRepository() ScopeRepositoryInterface
 }
@@ -0,0 +1,752 @@
+// Package repositorytest provides a conformance test suite that every DataStoreInterface
+// implementation should pass, so that backends behave the same way.
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// Seeder adds the data that DataStoreInterface has no write methods for.
+type Seeder interface {
+	// Adds the key of the client application it belongs to.
+	AddKey(key *domain.Key) error
+	// Adds a user account.
+	AddUserAccount(user *domain.UserAccount) error
+	// Adds a scope along with the claims it grants, which are user account fields e.g. name or email.
+	AddScope(scope string, claims ...string) error
+}
+
+// Factory returns an empty data store along with the seeder adding data to it.
+// It's called once per test case.
+type Factory func(t *testing.T) (repository.DataStoreInterface, Seeder)
+
+var clientApp = domain.ClientApplication{
+	Id:                         "0f4b6b0e-4a05-4f5b-8d43-6b3c3f0c2a11",
+	Secret:                     "secret",
+	Name:                       "conformance-app",
+	Scope:                      "openid profile email",
+	TokenMode:                  domain.ModePoll,
+	ClientNotificationEndpoint: "https://client.example.com/notification",
+	TokenEndpointAuthMethod:    "client_secret_basic",
+	GrantTypes:                 "urn:openid:params:grant-type:ciba",
+}
+
+var userAccount = domain.UserAccount{
+	Id:       "7d1e2c55-3a4b-4c5d-9e6f-708192a3b4c5",
+	Name:     "conformance-user",
+	Email:    "conformance-user@example.com",
+	Password: "secret",
+	UserCode: "1234",
+}
+
+// Returns a Ciba session that expired age ago, or expires in its lifetime when age is zero.
+func newCibaSession(age time.Duration) *domain.CibaSession {
+	interval := int64(5)
+	cs := domain.NewCibaSession(&clientApp, userAccount.Id, "binding", "client-notification-token", "openid", 60, &interval)
+	cs.CreatedAt = cs.CreatedAt.Add(-age)
+	cs.ExpiresAt = cs.ExpiresAt.Add(-age)
+	if age > 0 {
+		cs.CreatedAt = cs.CreatedAt.Add(-60 * time.Second)
+		cs.ExpiresAt = cs.ExpiresAt.Add(-60 * time.Second)
+	}
+	return cs
+}
+
+func statuses(history []domain.CibaSessionTransition) []string {
+	var result []string
+	for _, t := range history {
+		result = append(result, t.To)
+	}
+	return result
+}
+
+// Run runs the conformance test suite against the data stores returned by factory.
+func Run(t *testing.T, factory Factory) {
+	ctx := context.Background()
+
+	t.Run("ClientApplication/RegisterThenFindById", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetClientApplicationRepository()
+		ca := clientApp
+
+		err := repo.Register(ctx, &ca)
+		found, findErr := repo.FindById(ctx, ca.Id)
+
+		assert.NoError(t, err)
+		assert.NoError(t, findErr)
+		if assert.NotNil(t, found) {
+			assert.NotEqual(t, ca.Secret, found.Secret)
+			assert.True(t, found.VerifySecret(ca.Secret))
+			expected := ca
+			expected.Secret = found.Secret
+			assert.Equal(t, expected, *found)
+		}
+	})
+
+	t.Run("ClientApplication/FindById_ShouldReturnNil_WhenNotFound", func(t *testing.T) {
+		ds, _ := factory(t)
+
+		found, err := ds.GetClientApplicationRepository().FindById(ctx, "unknown")
+
+		assert.NoError(t, err)
+		assert.Nil(t, found)
+	})
+
+	t.Run("CibaSession/CreateThenFindById", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		cs := newCibaSession(0)
+
+		err := repo.Create(ctx, cs)
+		found, findErr := repo.FindById(ctx, cs.AuthReqId)
+
+		assert.NoError(t, err)
+		assert.NoError(t, findErr)
+		if assert.NotNil(t, found) {
+			assert.Equal(t, cs.ClientId, found.ClientId)
+			assert.Equal(t, cs.UserId, found.UserId)
+			assert.Equal(t, cs.Scope, found.Scope)
+			assert.Equal(t, cs.ClientNotificationToken, found.ClientNotificationToken)
+			assert.Equal(t, cs.Interval, found.Interval)
+			assert.Equal(t, domain.StatusPending, found.GetStatus())
+			assert.Equal(t, []string{domain.StatusPending}, statuses(found.History))
+			assert.WithinDuration(t, cs.GetExpiresAt(), found.GetExpiresAt(), time.Second)
+			assert.Nil(t, found.LatestTokenRequestedAt)
+		}
+	})
+
+	t.Run("CibaSession/FindById_ShouldReturnNil_WhenNotFound", func(t *testing.T) {
+		ds, _ := factory(t)
+
+		found, err := ds.GetCibaSessionRepository().FindById(ctx, "unknown")
+
+		assert.NoError(t, err)
+		assert.Nil(t, found)
+	})
+
+	t.Run("CibaSession/Update_ShouldStoreStatusHistoryAndFields", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		cs := newCibaSession(0)
+		_ = repo.Create(ctx, cs)
+		stored, _ := repo.FindById(ctx, cs.AuthReqId)
+		_ = stored.Approve(domain.ActorUser)
+		now := time.Now().Unix()
+		stored.LatestTokenRequestedAt = &now
+		stored.SetGrantedScope("openid")
+
+		err := repo.Update(ctx, stored)
+		updated, findErr := repo.FindById(ctx, cs.AuthReqId)
+
+		assert.NoError(t, err)
+		assert.NoError(t, findErr)
+		if assert.NotNil(t, updated) {
+			assert.Equal(t, domain.StatusApproved, updated.GetStatus())
+			assert.True(t, updated.IsConsented())
+			assert.Equal(t, []string{domain.StatusPending, domain.StatusApproved}, statuses(updated.History))
+			assert.Equal(t, &now, updated.LatestTokenRequestedAt)
+			if assert.NotNil(t, updated.GrantedScope) {
+				assert.Equal(t, "openid", *updated.GrantedScope)
+			}
+		}
+	})
+
+	t.Run("CibaSession/Update_ShouldReturnErrConcurrentUpdate_WhenSessionChangedSinceRead", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		cs := newCibaSession(0)
+		_ = repo.Create(ctx, cs)
+		first, _ := repo.FindById(ctx, cs.AuthReqId)
+		second, _ := repo.FindById(ctx, cs.AuthReqId)
+		_ = first.Approve(domain.ActorUser)
+		_ = second.Deny(domain.ActorUser)
+
+		firstErr := repo.Update(ctx, first)
+		secondErr := repo.Update(ctx, second)
+		stale, _ := repo.FindById(ctx, cs.AuthReqId)
+		stored, _ := repo.FindById(ctx, cs.AuthReqId)
+		_ = stored.Redeem(domain.ActorClient)
+		_ = repo.Update(ctx, stored)
+		now := time.Now().Unix()
+		stale.LatestTokenRequestedAt = &now
+		staleErr := repo.Update(ctx, stale)
+		found, _ := repo.FindById(ctx, cs.AuthReqId)
+
+		assert.NoError(t, firstErr)
+		assert.True(t, errors.Is(secondErr, repository.ErrConcurrentUpdate))
+		assert.True(t, errors.Is(staleErr, repository.ErrConcurrentUpdate))
+		assert.Equal(t, domain.StatusRedeemed, found.GetStatus())
+	})
+
+	t.Run("CibaSession/Update_ShouldReturnErrConcurrentUpdate_WithinTransaction", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		cs := newCibaSession(0)
+		_ = repo.Create(ctx, cs)
+		stale, _ := repo.FindById(ctx, cs.AuthReqId)
+		approved, _ := repo.FindById(ctx, cs.AuthReqId)
+		_ = approved.Approve(domain.ActorUser)
+		_ = repo.Update(ctx, approved)
+		_ = stale.Deny(domain.ActorUser)
+
+		err := ds.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+			return tx.GetCibaSessionRepository().Update(ctx, stale)
+		})
+		found, _ := repo.FindById(ctx, cs.AuthReqId)
+
+		assert.True(t, errors.Is(err, repository.ErrConcurrentUpdate))
+		assert.Equal(t, domain.StatusApproved, found.GetStatus())
+	})
+
+	t.Run("CibaSession/Update_ShouldStoreConsentSignature", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		cs := newCibaSession(0)
+		_ = repo.Create(ctx, cs)
+		signedAt := time.Now().UTC().Truncate(time.Second)
+		cs.AttachConsentSignature("device-1", "header.payload.signature", signedAt)
+		_ = cs.Approve(domain.ActorUser)
+
+		err := repo.Update(ctx, cs)
+		updated, findErr := repo.FindById(ctx, cs.AuthReqId)
+
+		assert.NoError(t, err)
+		assert.NoError(t, findErr)
+		if assert.NotNil(t, updated) {
+			assert.True(t, updated.IsConsentSigned())
+			assert.Equal(t, "device-1", updated.ConsentDeviceId)
+			assert.Equal(t, "header.payload.signature", updated.ConsentSignature)
+			if assert.NotNil(t, updated.ConsentSignedAt) {
+				assert.True(t, signedAt.Equal(*updated.ConsentSignedAt))
+			}
+		}
+	})
+
+	t.Run("CibaSession/FindExpired_ShouldReturnOnlyPendingAndApprovedSessions", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		pending := newCibaSession(5 * time.Minute)
+		approved := newCibaSession(5 * time.Minute)
+		_ = approved.Approve(domain.ActorUser)
+		denied := newCibaSession(5 * time.Minute)
+		_ = denied.Deny(domain.ActorUser)
+		active := newCibaSession(0)
+		for _, cs := range []*domain.CibaSession{pending, approved, denied, active} {
+			_ = repo.Create(ctx, cs)
+		}
+
+		expired, err := repo.FindExpired(ctx, time.Now().UTC(), 10)
+		limited, limitedErr := repo.FindExpired(ctx, time.Now().UTC(), 1)
+
+		assert.NoError(t, err)
+		assert.NoError(t, limitedErr)
+		var ids []string
+		for _, cs := range expired {
+			ids = append(ids, cs.AuthReqId)
+		}
+		assert.ElementsMatch(t, []string{pending.AuthReqId, approved.AuthReqId}, ids)
+		assert.Len(t, limited, 1)
+	})
+
+	t.Run("CibaSession/FindPendingByUserId_ShouldReturnOnlyPendingSessionsOfUser", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		older := newCibaSession(0)
+		older.CreatedAt = older.CreatedAt.Add(-10 * time.Second)
+		newer := newCibaSession(0)
+		answered := newCibaSession(0)
+		expired := newCibaSession(5 * time.Minute)
+		otherUser := newCibaSession(0)
+		otherUser.UserId = "other-user"
+		for _, cs := range []*domain.CibaSession{newer, older, answered, expired, otherUser} {
+			_ = repo.Create(ctx, cs)
+		}
+		_ = answered.Approve(domain.ActorUser)
+		_ = repo.Update(ctx, answered)
+
+		pending, err := repo.FindPendingByUserId(ctx, userAccount.Id, time.Now().UTC())
+
+		assert.NoError(t, err)
+		var ids []string
+		for _, cs := range pending {
+			ids = append(ids, cs.AuthReqId)
+		}
+		assert.Equal(t, []string{older.AuthReqId, newer.AuthReqId}, ids)
+	})
+
+	t.Run("CibaSession/FindActiveByUserIdAndClientId_ShouldReturnOnlyActiveSessionsOfUserForClient", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		pending := newCibaSession(0)
+		pending.CreatedAt = pending.CreatedAt.Add(-10 * time.Second)
+		approved := newCibaSession(0)
+		_ = approved.Approve(domain.ActorUser)
+		expired := newCibaSession(5 * time.Minute)
+		denied := newCibaSession(0)
+		_ = denied.Deny(domain.ActorUser)
+		otherUser := newCibaSession(0)
+		otherUser.UserId = "other-user"
+		otherClient := newCibaSession(0)
+		otherClient.ClientId = "other-client"
+		for _, cs := range []*domain.CibaSession{approved, pending, expired, denied, otherUser, otherClient} {
+			_ = repo.Create(ctx, cs)
+		}
+
+		active, err := repo.FindActiveByUserIdAndClientId(ctx, userAccount.Id, pending.ClientId)
+
+		assert.NoError(t, err)
+		var ids []string
+		for _, cs := range active {
+			ids = append(ids, cs.AuthReqId)
+		}
+		assert.ElementsMatch(t, []string{pending.AuthReqId, approved.AuthReqId, expired.AuthReqId}, ids)
+	})
+
+	t.Run("CibaSession/DeleteExpiredBefore_ShouldDeleteOnlySessionsExpiredBefore", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetCibaSessionRepository()
+		stale := newCibaSession(10 * time.Minute)
+		_ = stale.Deny(domain.ActorUser)
+		otherStale := newCibaSession(10 * time.Minute)
+		recent := newCibaSession(1 * time.Minute)
+		for _, cs := range []*domain.CibaSession{stale, otherStale, recent} {
+			_ = repo.Create(ctx, cs)
+		}
+
+		deleted, err := repo.DeleteExpiredBefore(ctx, time.Now().UTC().Add(-5*time.Minute), 1)
+		deletedRest, restErr := repo.DeleteExpiredBefore(ctx, time.Now().UTC().Add(-5*time.Minute), 10)
+		foundStale, _ := repo.FindById(ctx, stale.AuthReqId)
+		foundRecent, _ := repo.FindById(ctx, recent.AuthReqId)
+
+		assert.NoError(t, err)
+		assert.NoError(t, restErr)
+		assert.Equal(t, 1, deleted)
+		assert.Equal(t, 1, deletedRest)
+		assert.Nil(t, foundStale)
+		assert.NotNil(t, foundRecent)
+	})
+
+	t.Run("AccessToken/CreateThenFind", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetAccessTokenRepository()
+		accessToken := domain.NewAccessToken("conformance-token", clientApp.Id, userAccount.Id, "openid email", time.Now().UTC().Add(time.Hour))
+
+		err := repo.Create(ctx, accessToken)
+		found, findErr := repo.Find(ctx, accessToken.Value)
+
+		assert.NoError(t, err)
+		assert.NoError(t, findErr)
+		if assert.NotNil(t, found) {
+			assert.Equal(t, accessToken.Value, found.Value)
+			assert.Equal(t, accessToken.ClientId, found.ClientId)
+			assert.Equal(t, accessToken.UserId, found.UserId)
+			assert.Equal(t, accessToken.Scope, found.Scope)
+			assert.WithinDuration(t, accessToken.Expires, found.Expires, time.Second)
+			assert.False(t, found.IsExpired())
+		}
+	})
+
+	t.Run("AccessToken/Find_ShouldReturnNil_WhenNotFound", func(t *testing.T) {
+		ds, _ := factory(t)
+
+		found, err := ds.GetAccessTokenRepository().Find(ctx, "unknown")
+
+		assert.NoError(t, err)
+		assert.Nil(t, found)
+	})
+
+	t.Run("AccessToken/Find_ShouldReturnExpiredToken_UntilItIsDeleted", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetAccessTokenRepository()
+		expired := domain.NewAccessToken("expired-token", clientApp.Id, userAccount.Id, "openid", time.Now().UTC().Add(-time.Minute))
+		valid := domain.NewAccessToken("valid-token", clientApp.Id, userAccount.Id, "openid", time.Now().UTC().Add(time.Hour))
+		_ = repo.Create(ctx, expired)
+		_ = repo.Create(ctx, valid)
+
+		found, findErr := repo.Find(ctx, expired.Value)
+		deleted, err := repo.DeleteExpiredBefore(ctx, time.Now().UTC(), 10)
+		foundAfterDelete, _ := repo.Find(ctx, expired.Value)
+		foundValid, _ := repo.Find(ctx, valid.Value)
+
+		assert.NoError(t, findErr)
+		if assert.NotNil(t, found) {
+			assert.True(t, found.IsExpired())
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		assert.Nil(t, foundAfterDelete)
+		assert.NotNil(t, foundValid)
+	})
+
+	t.Run("AccessToken/DeleteByUserIdAndClientId_ShouldDeleteOnlyTokensOfUserAndClient", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetAccessTokenRepository()
+		expires := time.Now().UTC().Add(time.Hour)
+		first := domain.NewAccessToken("first-token", clientApp.Id, userAccount.Id, "openid", expires)
+		second := domain.NewAccessToken("second-token", clientApp.Id, userAccount.Id, "openid email", expires)
+		otherClient := domain.NewAccessToken("other-client-token", "other-client", userAccount.Id, "openid", expires)
+		otherUser := domain.NewAccessToken("other-user-token", clientApp.Id, "other-user", "openid", expires)
+		for _, at := range []*domain.AccessToken{first, second, otherClient, otherUser} {
+			_ = repo.Create(ctx, at)
+		}
+
+		deleted, err := repo.DeleteByUserIdAndClientId(ctx, userAccount.Id, clientApp.Id)
+		foundFirst, _ := repo.Find(ctx, first.Value)
+		foundSecond, _ := repo.Find(ctx, second.Value)
+		foundOtherClient, _ := repo.Find(ctx, otherClient.Value)
+		foundOtherUser, _ := repo.Find(ctx, otherUser.Value)
+		deletedAgain, againErr := repo.DeleteByUserIdAndClientId(ctx, userAccount.Id, clientApp.Id)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, deleted)
+		assert.Nil(t, foundFirst)
+		assert.Nil(t, foundSecond)
+		assert.NotNil(t, foundOtherClient)
+		assert.NotNil(t, foundOtherUser)
+		assert.NoError(t, againErr)
+		assert.Equal(t, 0, deletedAgain)
+	})
+
+	t.Run("Grant/CreateUpdateThenFind", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetGrantRepository()
+		now := time.Now().UTC().Truncate(time.Second)
+		older := domain.NewGrant(userAccount.Id, clientApp.Id, "openid email", now.Add(-time.Hour))
+		newer := domain.NewGrant(userAccount.Id, "newer-client", "openid", now)
+		revoked := domain.NewGrant(userAccount.Id, "revoked-client", "openid", now)
+		other := domain.NewGrant("other-user", clientApp.Id, "openid", now)
+
+		createErr := repo.Create(ctx, older)
+		_ = repo.Create(ctx, newer)
+		_ = repo.Create(ctx, revoked)
+		_ = repo.Create(ctx, other)
+		revoked.Revoke(now)
+		updateErr := repo.Update(ctx, revoked)
+		found, findErr := repo.FindByUserIdAndClientId(ctx, userAccount.Id, revoked.ClientId)
+		active, activeErr := repo.FindActiveByUserId(ctx, userAccount.Id)
+		unknown, unknownErr := repo.FindByUserIdAndClientId(ctx, "other-user", "newer-client")
+
+		assert.NoError(t, createErr)
+		assert.NoError(t, updateErr)
+		assert.NoError(t, findErr)
+		assert.NoError(t, activeErr)
+		if assert.NotNil(t, found) {
+			assert.False(t, found.IsActive())
+			assert.Equal(t, revoked.Scope, found.Scope)
+		}
+		if assert.Len(t, active, 2) {
+			assert.Equal(t, newer.ClientId, active[0].ClientId)
+			assert.Equal(t, older.ClientId, active[1].ClientId)
+			assert.Equal(t, older.Scope, active[1].Scope)
+			assert.True(t, older.CreatedAt.Equal(active[1].CreatedAt))
+			assert.True(t, older.ConsentedAt.Equal(active[1].ConsentedAt))
+		}
+		assert.NoError(t, unknownErr)
+		assert.Nil(t, unknown)
+	})
+
+	t.Run("Scope/CreateUpdateThenFind", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetScopeRepository()
+		profile := &domain.Scope{
+			Name:        "profile",
+			DisplayName: "Profile",
+			Description: "Your name",
+			Localizations: map[string]*domain.ScopeLocalization{
+				"fr": {DisplayName: "Profil", Description: "Votre nom"},
+			},
+			Claims: []string{"name"},
+		}
+		payments := &domain.Scope{Name: "payments", RequiresUserCode: true}
+
+		createErr := repo.CreateScope(ctx, profile)
+		_ = repo.CreateScope(ctx, payments)
+		profile.Description = "Your name and email"
+		profile.Claims = []string{"email", "name"}
+		updateErr := repo.UpdateScope(ctx, profile)
+		found, findErr := repo.FindScopeByName(ctx, "profile")
+		all, allErr := repo.FindAllScopes(ctx)
+		claims, claimsErr := repo.FindAllClaims(ctx)
+		unknown, unknownErr := repo.FindScopeByName(ctx, "unknown")
+
+		assert.NoError(t, createErr)
+		assert.NoError(t, updateErr)
+		assert.NoError(t, findErr)
+		if assert.NotNil(t, found) {
+			assert.Equal(t, "Profile", found.DisplayName)
+			assert.Equal(t, "Your name and email", found.Description)
+			assert.Equal(t, "Profil", found.Localizations["fr"].DisplayName)
+			assert.ElementsMatch(t, []string{"email", "name"}, found.Claims)
+			assert.False(t, found.RequiresUserCode)
+		}
+		assert.NoError(t, allErr)
+		if assert.Len(t, all, 2) {
+			assert.Equal(t, "payments", all[0].Name)
+			assert.True(t, all[0].RequiresUserCode)
+			assert.Empty(t, all[0].Claims)
+			assert.Equal(t, "profile", all[1].Name)
+		}
+		assert.NoError(t, claimsErr)
+		if assert.Len(t, claims, 2) {
+			assert.Equal(t, "email", claims[0].Name)
+			assert.Equal(t, "name", claims[1].Name)
+		}
+		assert.NoError(t, unknownErr)
+		assert.Nil(t, unknown)
+	})
+
+	t.Run("Scope/DeleteScope", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetScopeRepository()
+		_ = repo.CreateScope(ctx, &domain.Scope{Name: "profile", Claims: []string{"name"}})
+
+		err := repo.DeleteScope(ctx, "profile")
+		found, findErr := repo.FindScopeByName(ctx, "profile")
+		all, _ := repo.FindAllScopes(ctx)
+		claims, _ := repo.FindAllClaims(ctx)
+
+		assert.NoError(t, err)
+		assert.NoError(t, findErr)
+		assert.Nil(t, found)
+		assert.Empty(t, all)
+		assert.Len(t, claims, 1)
+		assert.NoError(t, repo.DeleteScope(ctx, "unknown"))
+	})
+
+	t.Run("Scope/ClaimCreateUpdateDelete", func(t *testing.T) {
+		ds, seeder := factory(t)
+		repo := ds.GetScopeRepository()
+		if err := seeder.AddUserAccount(&userAccount); err != nil {
+			t.Fatal(err)
+		}
+		_ = repo.CreateScope(ctx, &domain.Scope{Name: "profile", Claims: []string{"name", "email"}})
+
+		createErr := repo.CreateClaim(ctx, &domain.Claim{Name: "phone_number", Description: "Phone"})
+		updateErr := repo.UpdateClaim(ctx, &domain.Claim{Name: "phone_number", Description: "Your phone number"})
+		deleteErr := repo.DeleteClaim(ctx, "email")
+		claims, claimsErr := repo.FindAllClaims(ctx)
+		profile, _ := repo.FindScopeByName(ctx, "profile")
+		userClaims, userClaimsErr := ds.GetUserClaimRepository().GetUserClaims(ctx, userAccount.Id, "profile")
+
+		assert.NoError(t, createErr)
+		assert.NoError(t, updateErr)
+		assert.NoError(t, deleteErr)
+		assert.NoError(t, claimsErr)
+		if assert.Len(t, claims, 2) {
+			assert.Equal(t, "name", claims[0].Name)
+			assert.Equal(t, "phone_number", claims[1].Name)
+			assert.Equal(t, "Your phone number", claims[1].Description)
+		}
+		if assert.NotNil(t, profile) {
+			assert.Equal(t, []string{"name"}, profile.Claims)
+		}
+		assert.NoError(t, userClaimsErr)
+		assert.Equal(t, map[string]interface{}{"name": userAccount.Name}, userClaims)
+	})
+
+	t.Run("Scope/FindScopeByName_ShouldFindSeededScope", func(t *testing.T) {
+		ds, seeder := factory(t)
+		if err := seeder.AddScope("profile", "name"); err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := ds.GetScopeRepository().FindScopeByName(ctx, "profile")
+
+		assert.NoError(t, err)
+		if assert.NotNil(t, found) {
+			assert.Equal(t, []string{"name"}, found.Claims)
+		}
+	})
+
+	t.Run("Key/FindPrivateKeyByClientId", func(t *testing.T) {
+		ds, seeder := factory(t)
+		key := domain.Key{Id: "conformance-key", ClientId: clientApp.Id, Alg: "RS256", Public: "public", Private: "private"}
+		if err := seeder.AddKey(&key); err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := ds.GetKeyRepository().FindPrivateKeyByClientId(ctx, clientApp.Id)
+		unknown, unknownErr := ds.GetKeyRepository().FindPrivateKeyByClientId(ctx, "unknown")
+
+		assert.NoError(t, err)
+		if assert.NotNil(t, found) {
+			assert.Equal(t, key, *found)
+		}
+		assert.NoError(t, unknownErr)
+		assert.Nil(t, unknown)
+	})
+
+	t.Run("SigningKey/CreateUpdateFindAllThenDelete", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetSigningKeyRepository()
+		now := time.Now().UTC()
+		older := &domain.SigningKey{Id: "older", Alg: "RS256", Public: "public", Private: "private", State: domain.SigningKeyStateActive, CreatedAt: now.Add(-time.Hour), ActivatedAt: &now}
+		newer := &domain.SigningKey{Id: "newer", Alg: "RS256", Public: "public", Private: "private", State: domain.SigningKeyStateNext, CreatedAt: now}
+
+		createErr := repo.Create(ctx, newer)
+		_ = repo.Create(ctx, older)
+		older.Retire(now)
+		updateErr := repo.Update(ctx, older)
+		keys, findErr := repo.FindAll(ctx)
+		deleteErr := repo.Delete(ctx, older.Id)
+		remaining, _ := repo.FindAll(ctx)
+
+		assert.NoError(t, createErr)
+		assert.NoError(t, updateErr)
+		assert.NoError(t, findErr)
+		assert.NoError(t, deleteErr)
+		if assert.Len(t, keys, 2) {
+			assert.Equal(t, older.Id, keys[0].Id)
+			assert.Equal(t, domain.SigningKeyStateRetired, keys[0].State)
+			if assert.NotNil(t, keys[0].RetiredAt) {
+				assert.WithinDuration(t, now, *keys[0].RetiredAt, time.Second)
+			}
+			assert.Equal(t, newer.Id, keys[1].Id)
+			assert.Equal(t, newer.Private, keys[1].Private)
+			assert.Nil(t, keys[1].ActivatedAt)
+		}
+		if assert.Len(t, remaining, 1) {
+			assert.Equal(t, newer.Id, remaining[0].Id)
+		}
+	})
+
+	t.Run("UserDevice/CreateUpdateThenFind", func(t *testing.T) {
+		ds, _ := factory(t)
+		repo := ds.GetUserDeviceRepository()
+		now := time.Now().UTC().Truncate(time.Second)
+		phone := &domain.UserDevice{Id: "phone", UserId: userAccount.Id, Platform: domain.DevicePlatformAndroid, PushToken: "phone-token", DisplayName: "Phone", PublicKey: "public", CreatedAt: now, LastSeenAt: now.Add(-time.Hour)}
+		tablet := &domain.UserDevice{Id: "tablet", UserId: userAccount.Id, Platform: domain.DevicePlatformIos, PushToken: "tablet-token", CreatedAt: now, LastSeenAt: now}
+		old := &domain.UserDevice{Id: "old", UserId: userAccount.Id, Platform: domain.DevicePlatformWeb, PushToken: "old-token", CreatedAt: now, LastSeenAt: now}
+		other := &domain.UserDevice{Id: "other", UserId: "other-user", Platform: domain.DevicePlatformWeb, PushToken: "other-token", CreatedAt: now, LastSeenAt: now}
+
+		createErr := repo.Create(ctx, phone)
+		_ = repo.Create(ctx, tablet)
+		_ = repo.Create(ctx, old)
+		_ = repo.Create(ctx, other)
+		old.Deregister(now)
+		updateErr := repo.Update(ctx, old)
+		found, findErr := repo.FindById(ctx, old.Id)
+		active, activeErr := repo.FindActiveByUserId(ctx, userAccount.Id)
+		unknown, _ := repo.FindById(ctx, "unknown")
+
+		assert.NoError(t, createErr)
+		assert.NoError(t, updateErr)
+		assert.NoError(t, findErr)
+		assert.NoError(t, activeErr)
+		if assert.NotNil(t, found) {
+			assert.False(t, found.IsActive())
+			assert.Equal(t, old.PushToken, found.PushToken)
+		}
+		if assert.Len(t, active, 2) {
+			assert.Equal(t, tablet.Id, active[0].Id)
+			assert.Equal(t, phone.Id, active[1].Id)
+			assert.Equal(t, phone.DisplayName, active[1].DisplayName)
+			assert.Equal(t, phone.PublicKey, active[1].PublicKey)
+			assert.True(t, phone.LastSeenAt.Equal(active[1].LastSeenAt))
+		}
+		assert.Nil(t, unknown)
+	})
+
+	t.Run("UserAccount/FindById", func(t *testing.T) {
+		ds, seeder := factory(t)
+		if err := seeder.AddUserAccount(&userAccount); err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := ds.GetUserAccountRepository().FindById(ctx, userAccount.Id)
+		unknown, unknownErr := ds.GetUserAccountRepository().FindById(ctx, "unknown")
+
+		assert.NoError(t, err)
+		if assert.NotNil(t, found) {
+			assert.Equal(t, userAccount.Id, found.Id)
+			assert.Equal(t, userAccount.Name, found.Name)
+			assert.Equal(t, userAccount.Email, found.Email)
+			assert.Equal(t, userAccount.UserCode, found.GetUseCode())
+		}
+		assert.NoError(t, unknownErr)
+		assert.Nil(t, unknown)
+	})
+
+	t.Run("UserClaim/GetUserClaims_ShouldResolveClaimsOfEveryScope", func(t *testing.T) {
+		ds, seeder := factory(t)
+		if err := seeder.AddUserAccount(&userAccount); err != nil {
+			t.Fatal(err)
+		}
+		if err := seeder.AddScope("profile", "name"); err != nil {
+			t.Fatal(err)
+		}
+		if err := seeder.AddScope("email", "email"); err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := ds.GetUserClaimRepository().GetUserClaims(ctx, userAccount.Id, "openid profile email unknown")
+		onlyProfile, profileErr := ds.GetUserClaimRepository().GetUserClaims(ctx, userAccount.Id, "profile")
+
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"name": userAccount.Name, "email": userAccount.Email}, claims)
+		assert.NoError(t, profileErr)
+		assert.Equal(t, map[string]interface{}{"name": userAccount.Name}, onlyProfile)
+	})
+
+	t.Run("UserClaim/GetUserClaims_ShouldReturnEmptyMap_WhenUserIsUnknown", func(t *testing.T) {
+		ds, seeder := factory(t)
+		if err := seeder.AddScope("profile", "name"); err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := ds.GetUserClaimRepository().GetUserClaims(ctx, "unknown", "profile")
+
+		assert.NoError(t, err)
+		assert.NotNil(t, claims)
+		assert.Empty(t, claims)
+	})
+
+	t.Run("WithinTransaction_ShouldApplyWrites", func(t *testing.T) {
+		ds, _ := factory(t)
+		accessToken := domain.NewAccessToken("transaction-token", clientApp.Id, userAccount.Id, "openid", time.Now().UTC().Add(time.Hour))
+		cs := newCibaSession(0)
+
+		err := ds.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+			if err := tx.GetAccessTokenRepository().Create(ctx, accessToken); err != nil {
+				return err
+			}
+			return tx.GetCibaSessionRepository().Create(ctx, cs)
+		})
+		foundToken, _ := ds.GetAccessTokenRepository().Find(ctx, accessToken.Value)
+		foundSession, _ := ds.GetCibaSessionRepository().FindById(ctx, cs.AuthReqId)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, foundToken)
+		assert.NotNil(t, foundSession)
+	})
+
+	t.Run("WithinTransaction_ShouldDiscardWrites_WhenFnFails", func(t *testing.T) {
+		ds, _ := factory(t)
+		accessToken := domain.NewAccessToken("transaction-token", clientApp.Id, userAccount.Id, "openid", time.Now().UTC().Add(time.Hour))
+		cs := newCibaSession(0)
+		fnErr := errors.New("failed")
+
+		err := ds.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+			if err := tx.GetAccessTokenRepository().Create(ctx, accessToken); err != nil {
+				return err
+			}
+			if err := tx.GetCibaSessionRepository().Create(ctx, cs); err != nil {
+				return err
+			}
+			return fnErr
+		})
+		foundToken, _ := ds.GetAccessTokenRepository().Find(ctx, accessToken.Value)
+		foundSession, _ := ds.GetCibaSessionRepository().FindById(ctx, cs.AuthReqId)
+
+		assert.Equal(t, fnErr, err)
+		assert.Nil(t, foundToken)
+		assert.Nil(t, foundSession)
+	})
+}
@@ -1,30 +1,38 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
 	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/util"
 	"github.com/jmoiron/sqlx"
 )
 
 type clientApplicationSQLRepository struct {
-	db        *sqlx.DB
+	db        sqlx.ExtContext
 	tableName string
 }
 
-func (c *clientApplicationSQLRepository) Register(ca *domain.ClientApplication) error {
+func (c *clientApplicationSQLRepository) Register(ctx context.Context, clientApp *domain.ClientApplication) error {
+	ca, err := clientApp.WithHashedSecret()
+	if err != nil {
+		return err
+	}
 	cmd := c.db.Rebind(fmt.Sprintf("INSERT INTO %s (id, secret, name, scope, token_mode, client_notification_endpoint, authentication_request_signing_alg, user_code_parameter_supported, redirect_uri, token_endpoint_auth_method, token_endpoint_auth_signing_alg, grant_types, public_key_uri) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", c.tableName))
-	_, err := c.db.Exec(cmd, ca.Id, ca.Secret, ca.Name, ca.Scope, ca.TokenMode, ca.ClientNotificationEndpoint, ca.AuthenticationRequestSigningAlg, ca.UserCodeParameterSupported, ca.RedirectUri, ca.TokenEndpointAuthMethod, ca.TokenEndpointAuthSigningAlg, ca.GrantTypes, ca.PublicKeyUri)
+	_, err = c.db.ExecContext(ctx, cmd, ca.Id, ca.Secret, ca.Name, ca.Scope, ca.TokenMode, ca.ClientNotificationEndpoint, ca.AuthenticationRequestSigningAlg, ca.UserCodeParameterSupported, ca.RedirectUri, ca.TokenEndpointAuthMethod, ca.TokenEndpointAuthSigningAlg, ca.GrantTypes, ca.PublicKeyUri)
 	return err
 }
 
-func (c *clientApplicationSQLRepository) FindById(id string) (*domain.ClientApplication, error) {
+func (c *clientApplicationSQLRepository) FindById(ctx context.Context, id string) (*domain.ClientApplication, error) {
 	var clientApp domain.ClientApplication
 	cmd := c.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE id = ? LIMIT 1", c.tableName))
-	err := c.db.Get(&clientApp, cmd, id)
+	err := sqlx.GetContext(ctx, c.db, &clientApp, cmd, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -35,20 +43,20 @@ func (c *clientApplicationSQLRepository) FindById(id string) (*domain.ClientAppl
 }
 
 type accessTokenSQLRepository struct {
-	db        *sqlx.DB
+	db        sqlx.ExtContext
 	tableName string
 }
 
-func (a *accessTokenSQLRepository) Create(at *domain.AccessToken) error {
+func (a *accessTokenSQLRepository) Create(ctx context.Context, at *domain.AccessToken) error {
 	cmd := a.db.Rebind(fmt.Sprintf("INSERT INTO %s (access_token, client_id, expires, user_id, scope) VALUES (?, ?, ?, ?, ?)", a.tableName))
-	_, err := a.db.Exec(cmd, at.Value, at.ClientId, at.Expires, at.UserId, at.Scope)
+	_, err := a.db.ExecContext(ctx, cmd, at.Value, at.ClientId, at.Expires, at.UserId, at.Scope)
 	return err
 }
 
-func (a *accessTokenSQLRepository) Find(at string) (*domain.AccessToken, error) {
+func (a *accessTokenSQLRepository) Find(ctx context.Context, at string) (*domain.AccessToken, error) {
 	var accessToken domain.AccessToken
 	cmd := a.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE access_token = ? LIMIT 1", a.tableName))
-	err := a.db.Get(&accessToken, cmd, at)
+	err := sqlx.GetContext(ctx, a.db, &accessToken, cmd, at)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -58,45 +66,215 @@ func (a *accessTokenSQLRepository) Find(at string) (*domain.AccessToken, error)
 	return &accessToken, nil
 }
 
+func (a *accessTokenSQLRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	var tokens []string
+	cmd := a.db.Rebind(fmt.Sprintf("SELECT access_token FROM %s WHERE expires < ? ORDER BY expires LIMIT ?", a.tableName))
+	if err := sqlx.SelectContext(ctx, a.db, &tokens, cmd, before, limit); err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+	query, args, err := sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE access_token IN (?)", a.tableName), tokens)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := a.db.ExecContext(ctx, a.db.Rebind(query), args...); err != nil {
+		return 0, err
+	}
+	return len(tokens), nil
+}
+
+func (a *accessTokenSQLRepository) DeleteByUserIdAndClientId(ctx context.Context, userId, clientId string) (int, error) {
+	cmd := a.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND client_id = ?", a.tableName))
+	res, err := a.db.ExecContext(ctx, cmd, userId, clientId)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
 type cibaSessionSQLRepository struct {
-	db        *sqlx.DB
-	tableName string
+	db                   sqlx.ExtContext
+	tableName            string
+	tableNameTransitions string
 }
 
-func (c *cibaSessionSQLRepository) Create(cs *domain.CibaSession) error {
-	cmd := c.db.Rebind(fmt.Sprintf("INSERT INTO %s (auth_req_id, client_id, user_id, hint, binding_message, client_notification_token, expires_in, interval, valid, id_token, consented, scope, latest_token_requested_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", c.tableName))
-	_, err := c.db.Exec(cmd, cs.AuthReqId, cs.ClientId, cs.UserId, cs.Hint, cs.BindingMessage, cs.ClientNotificationToken, cs.ExpiresIn, cs.Interval, cs.Valid, cs.IdToken, cs.Consented, cs.Scope, cs.LatestTokenRequestedAt, cs.CreatedAt.Format(time.RFC3339))
-	return err
+func (c *cibaSessionSQLRepository) Create(ctx context.Context, cs *domain.CibaSession) error {
+	cmd := c.db.Rebind(fmt.Sprintf("INSERT INTO %s (auth_req_id, client_id, user_id, hint, binding_message, client_notification_token, expires_in, interval, valid, id_token, consented, scope, latest_token_requested_at, created_at, status, expires_at, consent_device_id, consent_signature, consent_signed_at, granted_scope) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", c.tableName))
+	_, err := c.db.ExecContext(ctx, cmd, cs.AuthReqId, cs.ClientId, cs.UserId, cs.Hint, cs.BindingMessage, cs.ClientNotificationToken, cs.ExpiresIn, cs.Interval, cs.Valid, cs.IdToken, cs.Consented, cs.Scope, cs.LatestTokenRequestedAt, cs.CreatedAt.Format(time.RFC3339), cs.Status, cs.GetExpiresAt(), cs.ConsentDeviceId, cs.ConsentSignature, cs.ConsentSignedAt, cs.GrantedScope)
+	if err != nil {
+		return err
+	}
+	return c.createTransitions(ctx, cs.AuthReqId, cs.History)
 }
 
-func (c *cibaSessionSQLRepository) FindById(id string) (*domain.CibaSession, error) {
+func (c *cibaSessionSQLRepository) FindById(ctx context.Context, id string) (*domain.CibaSession, error) {
 	var cibaSession domain.CibaSession
 	cmd := c.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE auth_req_id = ? LIMIT 1", c.tableName))
-	err := c.db.Get(&cibaSession, cmd, id)
+	err := sqlx.GetContext(ctx, c.db, &cibaSession, cmd, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
+	if err := c.loadHistory(ctx, &cibaSession); err != nil {
+		return nil, err
+	}
 	return &cibaSession, nil
 }
 
-func (c *cibaSessionSQLRepository) Update(cs *domain.CibaSession) error {
-	cmd := c.db.Rebind(fmt.Sprintf("UPDATE %s SET client_id = ?, user_id = ?, hint = ?, binding_message = ?, client_notification_token = ?, expires_in = ?, interval = ?, valid = ?, id_token = ?, consented = ?, scope = ?, latest_token_requested_at = ? WHERE auth_req_id = ?", c.tableName))
-	_, err := c.db.Exec(cmd, cs.ClientId, cs.UserId, cs.Hint, cs.BindingMessage, cs.ClientNotificationToken, cs.ExpiresIn, cs.Interval, cs.Valid, cs.IdToken, cs.Consented, cs.Scope, cs.LatestTokenRequestedAt, cs.AuthReqId)
-	return err
+func (c *cibaSessionSQLRepository) loadHistory(ctx context.Context, cs *domain.CibaSession) error {
+	cmd := c.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE auth_req_id = ? ORDER BY seq", c.tableNameTransitions))
+	return sqlx.SelectContext(ctx, c.db, &cs.History, cmd, cs.AuthReqId)
+}
+
+func (c *cibaSessionSQLRepository) FindExpired(ctx context.Context, before time.Time, limit int) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	cmd := c.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE status IN (?, ?) AND expires_at < ? ORDER BY expires_at LIMIT ?", c.tableName))
+	if err := sqlx.SelectContext(ctx, c.db, &cibaSessions, cmd, domain.StatusPending, domain.StatusApproved, before, limit); err != nil {
+		return nil, err
+	}
+	for _, cs := range cibaSessions {
+		if err := c.loadHistory(ctx, cs); err != nil {
+			return nil, err
+		}
+	}
+	return cibaSessions, nil
+}
+
+func (c *cibaSessionSQLRepository) FindPendingByUserId(ctx context.Context, userId string, after time.Time) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	cmd := c.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE user_id = ? AND status = ? AND expires_at > ? ORDER BY created_at", c.tableName))
+	if err := sqlx.SelectContext(ctx, c.db, &cibaSessions, cmd, userId, domain.StatusPending, after); err != nil {
+		return nil, err
+	}
+	for _, cs := range cibaSessions {
+		if err := c.loadHistory(ctx, cs); err != nil {
+			return nil, err
+		}
+	}
+	return cibaSessions, nil
+}
+
+func (c *cibaSessionSQLRepository) FindActiveByUserIdAndClientId(ctx context.Context, userId, clientId string) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	cmd := c.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE user_id = ? AND client_id = ? AND status IN (?, ?) ORDER BY created_at", c.tableName))
+	if err := sqlx.SelectContext(ctx, c.db, &cibaSessions, cmd, userId, clientId, domain.StatusPending, domain.StatusApproved); err != nil {
+		return nil, err
+	}
+	for _, cs := range cibaSessions {
+		if err := c.loadHistory(ctx, cs); err != nil {
+			return nil, err
+		}
+	}
+	return cibaSessions, nil
+}
+
+func (c *cibaSessionSQLRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	var ids []string
+	cmd := c.db.Rebind(fmt.Sprintf("SELECT auth_req_id FROM %s WHERE expires_at < ? ORDER BY expires_at LIMIT ?", c.tableName))
+	if err := sqlx.SelectContext(ctx, c.db, &ids, cmd, before, limit); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	for _, tableName := range []string{c.tableNameTransitions, c.tableName} {
+		query, args, err := sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE auth_req_id IN (?)", tableName), ids)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.db.ExecContext(ctx, c.db.Rebind(query), args...); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// Stores the Ciba session only if its stored status is still the one it was read with, that is
+// nobody else has changed it since. Returns ErrConcurrentUpdate otherwise.
+func (c *cibaSessionSQLRepository) Update(ctx context.Context, cs *domain.CibaSession) error {
+	// Only the transitions that happened after the latest stored one are new.
+	var latestSeq int
+	seqCmd := c.db.Rebind(fmt.Sprintf("SELECT COALESCE(MAX(seq), 0) FROM %s WHERE auth_req_id = ?", c.tableNameTransitions))
+	if err := sqlx.GetContext(ctx, c.db, &latestSeq, seqCmd, cs.AuthReqId); err != nil {
+		return err
+	}
+	if latestSeq > len(cs.History) || (latestSeq > 0 && cs.History[latestSeq-1].Seq != latestSeq) {
+		return ErrConcurrentUpdate
+	}
+
+	cmd := fmt.Sprintf("UPDATE %s SET client_id = ?, user_id = ?, hint = ?, binding_message = ?, client_notification_token = ?, expires_in = ?, interval = ?, valid = ?, id_token = ?, consented = ?, scope = ?, latest_token_requested_at = ?, status = ?, expires_at = ?, consent_device_id = ?, consent_signature = ?, consent_signed_at = ?, granted_scope = ? WHERE auth_req_id = ?", c.tableName)
+	args := []interface{}{cs.ClientId, cs.UserId, cs.Hint, cs.BindingMessage, cs.ClientNotificationToken, cs.ExpiresIn, cs.Interval, cs.Valid, cs.IdToken, cs.Consented, cs.Scope, cs.LatestTokenRequestedAt, cs.Status, cs.GetExpiresAt(), cs.ConsentDeviceId, cs.ConsentSignature, cs.ConsentSignedAt, cs.GrantedScope, cs.AuthReqId}
+	// Sessions stored before their history was recorded can't be checked.
+	expectedStatus := ""
+	if latestSeq > 0 {
+		expectedStatus = cs.History[latestSeq-1].To
+		cmd += " AND status = ?"
+		args = append(args, expectedStatus)
+	}
+	res, err := c.db.ExecContext(ctx, c.db.Rebind(cmd), args...)
+	if err != nil {
+		return err
+	}
+	if expectedStatus != "" {
+		if err := c.checkStatus(ctx, res, cs.AuthReqId, expectedStatus); err != nil {
+			return err
+		}
+	}
+
+	var transitions []domain.CibaSessionTransition
+	for _, t := range cs.History {
+		if t.Seq > latestSeq {
+			transitions = append(transitions, t)
+		}
+	}
+	return c.createTransitions(ctx, cs.AuthReqId, transitions)
+}
+
+// Returns ErrConcurrentUpdate when a status-conditioned update matched no row because the status changed.
+// MySQL doesn't count rows whose values are unchanged, so the status is read again to tell both apart.
+func (c *cibaSessionSQLRepository) checkStatus(ctx context.Context, res sql.Result, authReqId, expectedStatus string) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+	var status string
+	cmd := c.db.Rebind(fmt.Sprintf("SELECT status FROM %s WHERE auth_req_id = ?", c.tableName))
+	if err := sqlx.GetContext(ctx, c.db, &status, cmd, authReqId); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if status != expectedStatus {
+		return ErrConcurrentUpdate
+	}
+	return nil
+}
+
+func (c *cibaSessionSQLRepository) createTransitions(ctx context.Context, authReqId string, transitions []domain.CibaSessionTransition) error {
+	cmd := c.db.Rebind(fmt.Sprintf("INSERT INTO %s (auth_req_id, seq, from_status, to_status, actor, created_at) VALUES (?, ?, ?, ?, ?, ?)", c.tableNameTransitions))
+	for _, t := range transitions {
+		if _, err := c.db.ExecContext(ctx, cmd, authReqId, t.Seq, t.From, t.To, t.Actor, t.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type keySQLRepository struct {
-	db        *sqlx.DB
+	db        sqlx.ExtContext
 	tableName string
 }
 
-func (k *keySQLRepository) FindPrivateKeyByClientId(clientId string) (*domain.Key, error) {
+func (k *keySQLRepository) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
 	var key domain.Key
 	cmd := k.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE client_id = ? LIMIT 1", k.tableName))
-	err := k.db.Get(&key, cmd, clientId)
+	err := sqlx.GetContext(ctx, k.db, &key, cmd, clientId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -106,15 +284,47 @@ func (k *keySQLRepository) FindPrivateKeyByClientId(clientId string) (*domain.Ke
 	return &key, nil
 }
 
+type signingKeySQLRepository struct {
+	db        sqlx.ExtContext
+	tableName string
+}
+
+func (k *signingKeySQLRepository) Create(ctx context.Context, key *domain.SigningKey) error {
+	cmd := k.db.Rebind(fmt.Sprintf("INSERT INTO %s (id, alg, public, private, state, created_at, activated_at, retired_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", k.tableName))
+	_, err := k.db.ExecContext(ctx, cmd, key.Id, key.Alg, key.Public, key.Private, key.State, key.CreatedAt, key.ActivatedAt, key.RetiredAt)
+	return err
+}
+
+func (k *signingKeySQLRepository) Update(ctx context.Context, key *domain.SigningKey) error {
+	cmd := k.db.Rebind(fmt.Sprintf("UPDATE %s SET alg = ?, public = ?, private = ?, state = ?, activated_at = ?, retired_at = ? WHERE id = ?", k.tableName))
+	_, err := k.db.ExecContext(ctx, cmd, key.Alg, key.Public, key.Private, key.State, key.ActivatedAt, key.RetiredAt, key.Id)
+	return err
+}
+
+func (k *signingKeySQLRepository) FindAll(ctx context.Context) ([]*domain.SigningKey, error) {
+	var keys []*domain.SigningKey
+	cmd := fmt.Sprintf("SELECT * FROM %s ORDER BY created_at", k.tableName)
+	if err := sqlx.SelectContext(ctx, k.db, &keys, cmd); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (k *signingKeySQLRepository) Delete(ctx context.Context, id string) error {
+	cmd := k.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", k.tableName))
+	_, err := k.db.ExecContext(ctx, cmd, id)
+	return err
+}
+
 type userAccountSQLRepository struct {
-	db        *sqlx.DB
+	db        sqlx.ExtContext
 	tableName string
 }
 
-func (u *userAccountSQLRepository) FindById(id string) (*domain.UserAccount, error) {
+func (u *userAccountSQLRepository) FindById(ctx context.Context, id string) (*domain.UserAccount, error) {
 	var user domain.UserAccount
 	cmd := u.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE id = ? LIMIT 1", u.tableName))
-	err := u.db.Get(&user, cmd, id)
+	err := sqlx.GetContext(ctx, u.db, &user, cmd, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -125,17 +335,17 @@ func (u *userAccountSQLRepository) FindById(id string) (*domain.UserAccount, err
 }
 
 type userClaimSQLRepository struct {
-	db                   *sqlx.DB
+	db                   sqlx.ExtContext
 	tableNameScopes      string
 	tableNameClaims      string
 	tableNameUsers       string
 	tableNameScopeClaims string
 }
 
-func (u *userClaimSQLRepository) GetUserClaims(userId, scopes string) (map[string]interface{}, error) {
+func (u *userClaimSQLRepository) GetUserClaims(ctx context.Context, userId, scopes string) (map[string]interface{}, error) {
 	userDetails := make(map[string]interface{})
 	userDetailsSql := u.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE id = ? LIMIT 1", u.tableNameUsers))
-	rows, err := u.db.Queryx(userDetailsSql, userId)
+	rows, err := u.db.QueryxContext(ctx, userDetailsSql, userId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return map[string]interface{}{}, nil
@@ -143,8 +353,21 @@ func (u *userClaimSQLRepository) GetUserClaims(userId, scopes string) (map[strin
 		return nil, err
 	}
 
-	for rows.Next() {
-		err = rows.MapScan(userDetails)
+	if !rows.Next() {
+		_ = rows.Close()
+		return map[string]interface{}{}, rows.Err()
+	}
+	err = rows.MapScan(userDetails)
+	// Release the connection before querying the claims.
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Some drivers scan text columns into []byte.
+	for column, value := range userDetails {
+		if b, ok := value.([]byte); ok {
+			userDetails[column] = string(b)
+		}
 	}
 
 	var claims []domain.Claim
@@ -153,7 +376,7 @@ func (u *userClaimSQLRepository) GetUserClaims(userId, scopes string) (map[strin
 	for _, scope := range scopesArr {
 		var scopeId string
 		scopeIdSql := u.db.Rebind(fmt.Sprintf("SELECT id FROM %s WHERE name = ? LIMIT 1", u.tableNameScopes))
-		err = u.db.Get(&scopeId, scopeIdSql, scope)
+		err = sqlx.GetContext(ctx, u.db, &scopeId, scopeIdSql, scope)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				continue
@@ -164,7 +387,7 @@ func (u *userClaimSQLRepository) GetUserClaims(userId, scopes string) (map[strin
 		var tempClaims []domain.Claim
 		claimsSql := u.db.Rebind(fmt.Sprintf("SELECT name FROM %s WHERE id IN (SELECT claim_id FROM %s WHERE scope_id = ?)", u.tableNameClaims, u.tableNameScopeClaims))
 
-		err = u.db.Select(&tempClaims, claimsSql, scopeId)
+		err = sqlx.SelectContext(ctx, u.db, &tempClaims, claimsSql, scopeId)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				continue
@@ -186,13 +409,321 @@ func (u *userClaimSQLRepository) GetUserClaims(userId, scopes string) (map[strin
 	return claimsValues, nil
 }
 
+type userDeviceSQLRepository struct {
+	db        sqlx.ExtContext
+	tableName string
+}
+
+func (u *userDeviceSQLRepository) Create(ctx context.Context, device *domain.UserDevice) error {
+	cmd := u.db.Rebind(fmt.Sprintf("INSERT INTO %s (id, user_id, platform, push_token, display_name, public_key, created_at, last_seen_at, deregistered_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", u.tableName))
+	_, err := u.db.ExecContext(ctx, cmd, device.Id, device.UserId, device.Platform, device.PushToken, device.DisplayName, device.PublicKey, device.CreatedAt, device.LastSeenAt, device.DeregisteredAt)
+	return err
+}
+
+func (u *userDeviceSQLRepository) Update(ctx context.Context, device *domain.UserDevice) error {
+	cmd := u.db.Rebind(fmt.Sprintf("UPDATE %s SET platform = ?, push_token = ?, display_name = ?, public_key = ?, last_seen_at = ?, deregistered_at = ? WHERE id = ?", u.tableName))
+	_, err := u.db.ExecContext(ctx, cmd, device.Platform, device.PushToken, device.DisplayName, device.PublicKey, device.LastSeenAt, device.DeregisteredAt, device.Id)
+	return err
+}
+
+func (u *userDeviceSQLRepository) FindById(ctx context.Context, id string) (*domain.UserDevice, error) {
+	var device domain.UserDevice
+	cmd := u.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE id = ? LIMIT 1", u.tableName))
+	if err := sqlx.GetContext(ctx, u.db, &device, cmd, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (u *userDeviceSQLRepository) FindActiveByUserId(ctx context.Context, userId string) ([]*domain.UserDevice, error) {
+	var devices []*domain.UserDevice
+	cmd := u.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE user_id = ? AND deregistered_at IS NULL ORDER BY last_seen_at DESC", u.tableName))
+	if err := sqlx.SelectContext(ctx, u.db, &devices, cmd, userId); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+type grantSQLRepository struct {
+	db        sqlx.ExtContext
+	tableName string
+}
+
+func (g *grantSQLRepository) Create(ctx context.Context, grant *domain.Grant) error {
+	cmd := g.db.Rebind(fmt.Sprintf("INSERT INTO %s (user_id, client_id, scope, created_at, consented_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?)", g.tableName))
+	_, err := g.db.ExecContext(ctx, cmd, grant.UserId, grant.ClientId, grant.Scope, grant.CreatedAt, grant.ConsentedAt, grant.RevokedAt)
+	return err
+}
+
+func (g *grantSQLRepository) Update(ctx context.Context, grant *domain.Grant) error {
+	cmd := g.db.Rebind(fmt.Sprintf("UPDATE %s SET scope = ?, consented_at = ?, revoked_at = ? WHERE user_id = ? AND client_id = ?", g.tableName))
+	_, err := g.db.ExecContext(ctx, cmd, grant.Scope, grant.ConsentedAt, grant.RevokedAt, grant.UserId, grant.ClientId)
+	return err
+}
+
+func (g *grantSQLRepository) FindByUserIdAndClientId(ctx context.Context, userId, clientId string) (*domain.Grant, error) {
+	var grant domain.Grant
+	cmd := g.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE user_id = ? AND client_id = ? LIMIT 1", g.tableName))
+	if err := sqlx.GetContext(ctx, g.db, &grant, cmd, userId, clientId); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func (g *grantSQLRepository) FindActiveByUserId(ctx context.Context, userId string) ([]*domain.Grant, error) {
+	var grants []*domain.Grant
+	cmd := g.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE user_id = ? AND revoked_at IS NULL ORDER BY consented_at DESC", g.tableName))
+	if err := sqlx.SelectContext(ctx, g.db, &grants, cmd, userId); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+type scopeSQLRepository struct {
+	db                   sqlx.ExtContext
+	tableNameScopes      string
+	tableNameClaims      string
+	tableNameScopeClaims string
+}
+
+// A row of the scopes table, localizations are stored as JSON.
+type scopeSQLRow struct {
+	Id               string `db:"id"`
+	Name             string `db:"name"`
+	DisplayName      string `db:"display_name"`
+	Description      string `db:"description"`
+	Localizations    string `db:"localizations"`
+	RequiresUserCode bool   `db:"requires_user_code"`
+}
+
+func marshalScopeLocalizations(scope *domain.Scope) (string, error) {
+	if len(scope.Localizations) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(scope.Localizations)
+	return string(b), err
+}
+
+func (s *scopeSQLRepository) CreateScope(ctx context.Context, scope *domain.Scope) error {
+	localizations, err := marshalScopeLocalizations(scope)
+	if err != nil {
+		return err
+	}
+	id := util.GenerateUuid()
+	cmd := s.db.Rebind(fmt.Sprintf("INSERT INTO %s (id, name, display_name, description, localizations, requires_user_code) VALUES (?, ?, ?, ?, ?, ?)", s.tableNameScopes))
+	if _, err := s.db.ExecContext(ctx, cmd, id, scope.Name, scope.DisplayName, scope.Description, localizations, scope.RequiresUserCode); err != nil {
+		return err
+	}
+	return s.setScopeClaims(ctx, id, scope.Claims)
+}
+
+func (s *scopeSQLRepository) UpdateScope(ctx context.Context, scope *domain.Scope) error {
+	localizations, err := marshalScopeLocalizations(scope)
+	if err != nil {
+		return err
+	}
+	cmd := s.db.Rebind(fmt.Sprintf("UPDATE %s SET display_name = ?, description = ?, localizations = ?, requires_user_code = ? WHERE name = ?", s.tableNameScopes))
+	if _, err := s.db.ExecContext(ctx, cmd, scope.DisplayName, scope.Description, localizations, scope.RequiresUserCode, scope.Name); err != nil {
+		return err
+	}
+	id, err := s.findId(ctx, s.tableNameScopes, scope.Name)
+	if err != nil || id == "" {
+		return err
+	}
+	return s.setScopeClaims(ctx, id, scope.Claims)
+}
+
+// Replaces the claims the scope grants, creating those that don't exist yet.
+func (s *scopeSQLRepository) setScopeClaims(ctx context.Context, scopeId string, claims []string) error {
+	cmd := s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE scope_id = ?", s.tableNameScopeClaims))
+	if _, err := s.db.ExecContext(ctx, cmd, scopeId); err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		claimId, err := s.findId(ctx, s.tableNameClaims, claim)
+		if err != nil {
+			return err
+		}
+		if claimId == "" {
+			claimId = util.GenerateUuid()
+			cmd := s.db.Rebind(fmt.Sprintf("INSERT INTO %s (id, name, description) VALUES (?, ?, ?)", s.tableNameClaims))
+			if _, err := s.db.ExecContext(ctx, cmd, claimId, claim, ""); err != nil {
+				return err
+			}
+		}
+		cmd := s.db.Rebind(fmt.Sprintf("INSERT INTO %s (scope_id, claim_id) VALUES (?, ?)", s.tableNameScopeClaims))
+		if _, err := s.db.ExecContext(ctx, cmd, scopeId, claimId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the id of the scope or claim with the given name, empty when there's none.
+func (s *scopeSQLRepository) findId(ctx context.Context, tableName, name string) (string, error) {
+	var id string
+	cmd := s.db.Rebind(fmt.Sprintf("SELECT id FROM %s WHERE name = ? LIMIT 1", tableName))
+	if err := sqlx.GetContext(ctx, s.db, &id, cmd, name); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *scopeSQLRepository) DeleteScope(ctx context.Context, name string) error {
+	id, err := s.findId(ctx, s.tableNameScopes, name)
+	if err != nil || id == "" {
+		return err
+	}
+	cmd := s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE scope_id = ?", s.tableNameScopeClaims))
+	if _, err := s.db.ExecContext(ctx, cmd, id); err != nil {
+		return err
+	}
+	cmd = s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.tableNameScopes))
+	_, err = s.db.ExecContext(ctx, cmd, id)
+	return err
+}
+
+func (s *scopeSQLRepository) selectScopes(ctx context.Context, where string, args ...interface{}) ([]*domain.Scope, error) {
+	var rows []*scopeSQLRow
+	cmd := s.db.Rebind(fmt.Sprintf("SELECT id, name, COALESCE(display_name, '') AS display_name, COALESCE(description, '') AS description, COALESCE(localizations, '') AS localizations, requires_user_code FROM %s %s", s.tableNameScopes, where))
+	if err := sqlx.SelectContext(ctx, s.db, &rows, cmd, args...); err != nil {
+		return nil, err
+	}
+	scopes := make([]*domain.Scope, 0, len(rows))
+	for _, row := range rows {
+		scope := &domain.Scope{
+			Name:             row.Name,
+			DisplayName:      row.DisplayName,
+			Description:      row.Description,
+			RequiresUserCode: row.RequiresUserCode,
+		}
+		if row.Localizations != "" {
+			if err := json.Unmarshal([]byte(row.Localizations), &scope.Localizations); err != nil {
+				return nil, err
+			}
+		}
+		claimsCmd := s.db.Rebind(fmt.Sprintf("SELECT name FROM %s WHERE id IN (SELECT claim_id FROM %s WHERE scope_id = ?) ORDER BY name", s.tableNameClaims, s.tableNameScopeClaims))
+		if err := sqlx.SelectContext(ctx, s.db, &scope.Claims, claimsCmd, row.Id); err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+func (s *scopeSQLRepository) FindScopeByName(ctx context.Context, name string) (*domain.Scope, error) {
+	scopes, err := s.selectScopes(ctx, "WHERE name = ?", name)
+	if err != nil || len(scopes) == 0 {
+		return nil, err
+	}
+	return scopes[0], nil
+}
+
+func (s *scopeSQLRepository) FindAllScopes(ctx context.Context) ([]*domain.Scope, error) {
+	return s.selectScopes(ctx, "ORDER BY name")
+}
+
+func (s *scopeSQLRepository) CreateClaim(ctx context.Context, claim *domain.Claim) error {
+	cmd := s.db.Rebind(fmt.Sprintf("INSERT INTO %s (id, name, description) VALUES (?, ?, ?)", s.tableNameClaims))
+	_, err := s.db.ExecContext(ctx, cmd, util.GenerateUuid(), claim.Name, claim.Description)
+	return err
+}
+
+func (s *scopeSQLRepository) UpdateClaim(ctx context.Context, claim *domain.Claim) error {
+	cmd := s.db.Rebind(fmt.Sprintf("UPDATE %s SET description = ? WHERE name = ?", s.tableNameClaims))
+	_, err := s.db.ExecContext(ctx, cmd, claim.Description, claim.Name)
+	return err
+}
+
+func (s *scopeSQLRepository) DeleteClaim(ctx context.Context, name string) error {
+	id, err := s.findId(ctx, s.tableNameClaims, name)
+	if err != nil || id == "" {
+		return err
+	}
+	cmd := s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE claim_id = ?", s.tableNameScopeClaims))
+	if _, err := s.db.ExecContext(ctx, cmd, id); err != nil {
+		return err
+	}
+	cmd = s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.tableNameClaims))
+	_, err = s.db.ExecContext(ctx, cmd, id)
+	return err
+}
+
+func (s *scopeSQLRepository) FindAllClaims(ctx context.Context) ([]*domain.Claim, error) {
+	var claims []*domain.Claim
+	cmd := fmt.Sprintf("SELECT name, COALESCE(description, '') AS description FROM %s ORDER BY name", s.tableNameClaims)
+	if err := sqlx.SelectContext(ctx, s.db, &claims, cmd); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+type sqlLocker struct {
+	db        *sqlx.DB
+	tableName string
+	owner     string
+}
+
+// NewSQLLocker creates a locker backed by the locks table.
+func NewSQLLocker(defaultDb *sql.DB, driverName, prefix string) *sqlLocker {
+	return &sqlLocker{
+		db:        sqlx.NewDb(defaultDb, driverName),
+		tableName: buildTableName(prefix, "locks"),
+		owner:     util.GenerateUuid(),
+	}
+}
+
+func (l *sqlLocker) TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+
+	// Locks that are past their expiry are abandoned e.g. the holder crashed.
+	deleteCmd := l.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE name = ? AND expires_at < ?", l.tableName))
+	if _, err := l.db.ExecContext(ctx, deleteCmd, name, now); err != nil {
+		return false, err
+	}
+
+	insertCmd := l.db.Rebind(fmt.Sprintf("INSERT INTO %s (name, owner, expires_at) VALUES (?, ?, ?)", l.tableName))
+	_, insertErr := l.db.ExecContext(ctx, insertCmd, name, l.owner, now.Add(ttl))
+	if insertErr == nil {
+		return true, nil
+	}
+
+	// The insert fails on the primary key when the lock is held, anything else is a real error.
+	var count int
+	countCmd := l.db.Rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE name = ?", l.tableName))
+	if err := l.db.GetContext(ctx, &count, countCmd, name); err != nil || count == 0 {
+		return false, insertErr
+	}
+	return false, nil
+}
+
+func (l *sqlLocker) Unlock(ctx context.Context, name string) error {
+	cmd := l.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE name = ? AND owner = ?", l.tableName))
+	_, err := l.db.ExecContext(ctx, cmd, name, l.owner)
+	return err
+}
+
 type SQLDataStore struct {
+	// Nil when the data store is bound to a transaction.
+	db     *sqlx.DB
+	prefix string
+
 	accessTokenRepo       *accessTokenSQLRepository
 	cibaSessionRepo       *cibaSessionSQLRepository
 	clientApplicationRepo *clientApplicationSQLRepository
 	keyRepositoryRepo     *keySQLRepository
+	signingKeyRepo        *signingKeySQLRepository
 	userAccountRepo       *userAccountSQLRepository
 	userClaimRepo         *userClaimSQLRepository
+	userDeviceRepo        *userDeviceSQLRepository
+	grantRepo             *grantSQLRepository
+	scopeRepo             *scopeSQLRepository
 }
 
 func buildTableName(prefix, tableName string) string {
@@ -204,14 +735,23 @@ func buildTableName(prefix, tableName string) string {
 
 func NewSQLDataStore(defaultDb *sql.DB, driverName, prefix string) *SQLDataStore {
 	db := sqlx.NewDb(defaultDb, driverName)
+	ds := newSQLDataStore(db, prefix)
+	ds.db = db
+	return ds
+}
+
+// Creates the repositories running their queries on db, which is either a database or a transaction.
+func newSQLDataStore(db sqlx.ExtContext, prefix string) *SQLDataStore {
 	return &SQLDataStore{
+		prefix: prefix,
 		accessTokenRepo: &accessTokenSQLRepository{
 			db:        db,
 			tableName: buildTableName(prefix, "access_tokens"),
 		},
 		cibaSessionRepo: &cibaSessionSQLRepository{
-			db:        db,
-			tableName: buildTableName(prefix, "ciba_sessions"),
+			db:                   db,
+			tableName:            buildTableName(prefix, "ciba_sessions"),
+			tableNameTransitions: buildTableName(prefix, "ciba_session_transitions"),
 		},
 		clientApplicationRepo: &clientApplicationSQLRepository{
 			db:        db,
@@ -221,6 +761,10 @@ func NewSQLDataStore(defaultDb *sql.DB, driverName, prefix string) *SQLDataStore
 			db:        db,
 			tableName: buildTableName(prefix, "keys"),
 		},
+		signingKeyRepo: &signingKeySQLRepository{
+			db:        db,
+			tableName: buildTableName(prefix, "signing_keys"),
+		},
 		userAccountRepo: &userAccountSQLRepository{
 			db:        db,
 			tableName: buildTableName(prefix, "user_accounts"),
@@ -232,9 +776,55 @@ func NewSQLDataStore(defaultDb *sql.DB, driverName, prefix string) *SQLDataStore
 			tableNameUsers:       buildTableName(prefix, "user_accounts"),
 			tableNameScopeClaims: buildTableName(prefix, "scope_claims"),
 		},
+		userDeviceRepo: &userDeviceSQLRepository{
+			db:        db,
+			tableName: buildTableName(prefix, "user_devices"),
+		},
+		grantRepo: &grantSQLRepository{
+			db:        db,
+			tableName: buildTableName(prefix, "grants"),
+		},
+		scopeRepo: &scopeSQLRepository{
+			db:                   db,
+			tableNameScopes:      buildTableName(prefix, "scopes"),
+			tableNameClaims:      buildTableName(prefix, "claims"),
+			tableNameScopeClaims: buildTableName(prefix, "scope_claims"),
+		},
 	}
 }
 
+func (s *SQLDataStore) HaveTransactionSupport() bool {
+	return true
+}
+
+// Runs fn with a data store whose repositories share one transaction, which is committed if fn returns
+// no error and rolled back otherwise. Calling it on a data store that is already bound to a
+// transaction runs fn within that transaction.
+func (s *SQLDataStore) WithinTransaction(ctx context.Context, fn func(tx DataStoreInterface) error) error {
+	if s.db == nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(newSQLDataStore(tx, s.prefix)); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Printf("[go-ciba][sqldatastore] failed rolling back transaction %s\n", rollbackErr.Error())
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *SQLDataStore) GetAccessTokenRepository() AccessTokenRepositoryInterface {
 	return s.accessTokenRepo
 }
@@ -251,6 +841,10 @@ func (s *SQLDataStore) GetKeyRepository() KeyRepositoryInterface {
 	return s.keyRepositoryRepo
 }
 
+func (s *SQLDataStore) GetSigningKeyRepository() SigningKeyRepositoryInterface {
+	return s.signingKeyRepo
+}
+
 func (s *SQLDataStore) GetUserAccountRepository() UserAccountRepositoryInterface {
 	return s.userAccountRepo
 }
@@ -258,3 +852,15 @@ func (s *SQLDataStore) GetUserAccountRepository() UserAccountRepositoryInterface
 func (s *SQLDataStore) GetUserClaimRepository() UserClaimRepositoryInterface {
 	return s.userClaimRepo
 }
+
+func (s *SQLDataStore) GetUserDeviceRepository() UserDeviceRepositoryInterface {
+	return s.userDeviceRepo
+}
+
+func (s *SQLDataStore) GetGrantRepository() GrantRepositoryInterface {
+	return s.grantRepo
+}
+
+func (s *SQLDataStore) GetScopeRepository() ScopeRepositoryInterface {
+	return s.scopeRepo
+}
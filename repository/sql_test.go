@@ -1,13 +1,17 @@
 package repository
 
 import (
+	"context"
 	"database/sql/driver"
+	"errors"
 	"regexp"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/adisazhar123/go-ciba/domain"
 	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/adisazhar123/go-ciba/util"
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 )
@@ -19,6 +23,14 @@ func (a anyTime) Match(v driver.Value) bool {
 	return ok
 }
 
+// Matches the hash of a client secret.
+type hashOf string
+
+func (h hashOf) Match(v driver.Value) bool {
+	hashed, ok := v.(string)
+	return ok && util.IsHashedSecret(hashed) && util.CompareSecret(hashed, string(h))
+}
+
 func TestClientApplicationSQLRepository_Register(t *testing.T) {
 	clientApp := test_data.ClientAppPing
 	mockDb, mock, _ := sqlmock.New()
@@ -28,9 +40,9 @@ func TestClientApplicationSQLRepository_Register(t *testing.T) {
 		tableName: "client_applications",
 	}
 
-	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO client_applications (id, secret, name, scope, token_mode, client_notification_endpoint, authentication_request_signing_alg, user_code_parameter_supported, redirect_uri, token_endpoint_auth_method, token_endpoint_auth_signing_alg, grant_types, public_key_uri) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")).WithArgs(clientApp.Id, clientApp.Secret, clientApp.Name, clientApp.Scope, clientApp.TokenMode, clientApp.ClientNotificationEndpoint, clientApp.AuthenticationRequestSigningAlg, clientApp.UserCodeParameterSupported, clientApp.RedirectUri, clientApp.TokenEndpointAuthMethod, clientApp.TokenEndpointAuthSigningAlg, clientApp.GrantTypes, clientApp.PublicKeyUri).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO client_applications (id, secret, name, scope, token_mode, client_notification_endpoint, authentication_request_signing_alg, user_code_parameter_supported, redirect_uri, token_endpoint_auth_method, token_endpoint_auth_signing_alg, grant_types, public_key_uri) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")).WithArgs(clientApp.Id, hashOf(clientApp.Secret), clientApp.Name, clientApp.Scope, clientApp.TokenMode, clientApp.ClientNotificationEndpoint, clientApp.AuthenticationRequestSigningAlg, clientApp.UserCodeParameterSupported, clientApp.RedirectUri, clientApp.TokenEndpointAuthMethod, clientApp.TokenEndpointAuthSigningAlg, clientApp.GrantTypes, clientApp.PublicKeyUri).WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := repo.Register(&clientApp)
+	err := repo.Register(context.Background(), &clientApp)
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
@@ -51,7 +63,7 @@ func TestClientApplicationSQLRepository_FindById(t *testing.T) {
 		WithArgs(clientApp.Id).
 		WillReturnRows(rows)
 
-	ca, err := repo.FindById(clientApp.Id)
+	ca, err := repo.FindById(context.Background(), clientApp.Id)
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
@@ -71,7 +83,7 @@ func TestAccessTokenSQLRepository_Create(t *testing.T) {
 		WithArgs(accesToken.Value, accesToken.ClientId, accesToken.Expires, accesToken.UserId, accesToken.Scope).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := repo.Create(&accesToken)
+	err := repo.Create(context.Background(), &accesToken)
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
@@ -93,7 +105,7 @@ func TestAccessTokenSQLRepository_Find(t *testing.T) {
 	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM access_tokens WHERE access_token = ?")).
 		WithArgs(accessToken.Value).WillReturnRows(rows)
 
-	at, err := repo.Find(accessToken.Value)
+	at, err := repo.Find(context.Background(), accessToken.Value)
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
@@ -101,20 +113,46 @@ func TestAccessTokenSQLRepository_Find(t *testing.T) {
 	assert.NotNil(t, at)
 }
 
+func TestAccessTokenSQLRepository_Find_ShouldReturnError_WhenContextIsCancelled(t *testing.T) {
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	repo := &accessTokenSQLRepository{
+		db:        sqlx.NewDb(mockDb, ""),
+		tableName: "access_tokens",
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM access_tokens WHERE access_token = ?")).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"access_token"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	at, err := repo.Find(ctx, test_data.AccessTokenValid.Value)
+
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Nil(t, at)
+}
+
 func TestCibaSessionSQLRepository_Create(t *testing.T) {
 	cibaSession := test_data.CibaSession6
+	cibaSession.History = []domain.CibaSessionTransition{
+		{Seq: 1, To: domain.StatusPending, Actor: domain.ActorClient, CreatedAt: time.Now().UTC()},
+	}
 	mockDb, mock, _ := sqlmock.New()
 	defer mockDb.Close()
 	repo := &cibaSessionSQLRepository{
-		db:        sqlx.NewDb(mockDb, ""),
-		tableName: "ciba_sessions",
+		db:                   sqlx.NewDb(mockDb, ""),
+		tableName:            "ciba_sessions",
+		tableNameTransitions: "ciba_session_transitions",
 	}
 
-	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ciba_sessions (auth_req_id, client_id, user_id, hint, binding_message, client_notification_token, expires_in, interval, valid, id_token, consented, scope, latest_token_requested_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")).
-		WithArgs(cibaSession.AuthReqId, cibaSession.ClientId, cibaSession.UserId, cibaSession.Hint, cibaSession.BindingMessage, cibaSession.ClientNotificationToken, cibaSession.ExpiresIn, cibaSession.Interval, cibaSession.Valid, cibaSession.IdToken, cibaSession.Consented, cibaSession.Scope, cibaSession.LatestTokenRequestedAt, cibaSession.CreatedAt.Format(time.RFC3339)).
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ciba_sessions (auth_req_id, client_id, user_id, hint, binding_message, client_notification_token, expires_in, interval, valid, id_token, consented, scope, latest_token_requested_at, created_at, status, expires_at, consent_device_id, consent_signature, consent_signed_at, granted_scope) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")).
+		WithArgs(cibaSession.AuthReqId, cibaSession.ClientId, cibaSession.UserId, cibaSession.Hint, cibaSession.BindingMessage, cibaSession.ClientNotificationToken, cibaSession.ExpiresIn, cibaSession.Interval, cibaSession.Valid, cibaSession.IdToken, cibaSession.Consented, cibaSession.Scope, cibaSession.LatestTokenRequestedAt, cibaSession.CreatedAt.Format(time.RFC3339), cibaSession.Status, cibaSession.GetExpiresAt(), cibaSession.ConsentDeviceId, cibaSession.ConsentSignature, cibaSession.ConsentSignedAt, cibaSession.GrantedScope).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ciba_session_transitions (auth_req_id, seq, from_status, to_status, actor, created_at) VALUES (?, ?, ?, ?, ?, ?)")).
+		WithArgs(cibaSession.AuthReqId, 1, "", domain.StatusPending, domain.ActorClient, anyTime{}).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := repo.Create(&cibaSession)
+	err := repo.Create(context.Background(), &cibaSession)
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
@@ -126,36 +164,190 @@ func TestCibaSessionSQLRepository_FindById(t *testing.T) {
 	mockDb, mock, _ := sqlmock.New()
 	defer mockDb.Close()
 	repo := &cibaSessionSQLRepository{
-		db:        sqlx.NewDb(mockDb, ""),
-		tableName: "ciba_sessions",
+		db:                   sqlx.NewDb(mockDb, ""),
+		tableName:            "ciba_sessions",
+		tableNameTransitions: "ciba_session_transitions",
 	}
-	rows := sqlmock.NewRows([]string{"auth_req_id", "client_id", "user_id", "hint", "binding_message", "client_notification_token", "expires_in", "interval", "valid", "id_token", "consented", "scope", "latest_token_requested_at", "created_at"}).
-		AddRow(cibaSession.AuthReqId, cibaSession.ClientId, cibaSession.UserId, cibaSession.Hint, cibaSession.BindingMessage, cibaSession.ClientNotificationToken, cibaSession.ExpiresIn, cibaSession.Interval, cibaSession.Valid, cibaSession.IdToken, cibaSession.Consented, cibaSession.Scope, cibaSession.LatestTokenRequestedAt, cibaSession.CreatedAt)
+	rows := sqlmock.NewRows([]string{"auth_req_id", "client_id", "user_id", "hint", "binding_message", "client_notification_token", "expires_in", "interval", "valid", "id_token", "consented", "scope", "latest_token_requested_at", "created_at", "status"}).
+		AddRow(cibaSession.AuthReqId, cibaSession.ClientId, cibaSession.UserId, cibaSession.Hint, cibaSession.BindingMessage, cibaSession.ClientNotificationToken, cibaSession.ExpiresIn, cibaSession.Interval, cibaSession.Valid, cibaSession.IdToken, cibaSession.Consented, cibaSession.Scope, cibaSession.LatestTokenRequestedAt, cibaSession.CreatedAt, cibaSession.Status)
 	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM ciba_sessions WHERE auth_req_id = ?")).
 		WillReturnRows(rows)
+	historyRows := sqlmock.NewRows([]string{"auth_req_id", "seq", "from_status", "to_status", "actor", "created_at"}).
+		AddRow(cibaSession.AuthReqId, 1, "", domain.StatusPending, domain.ActorClient, cibaSession.CreatedAt)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM ciba_session_transitions WHERE auth_req_id = ? ORDER BY seq")).
+		WithArgs(cibaSession.AuthReqId).
+		WillReturnRows(historyRows)
 
-	cs, err := repo.FindById(cibaSession.AuthReqId)
+	cs, err := repo.FindById(context.Background(), cibaSession.AuthReqId)
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
 	assert.NoError(t, mockErr)
 	assert.NotNil(t, cs)
+	assert.Len(t, cs.History, 1)
+	assert.Equal(t, domain.StatusPending, cs.History[0].To)
 }
 
 func TestCibaSessionSQLRepository_Update(t *testing.T) {
 	cibaSession := test_data.CibaSession6
+	cibaSession.History = []domain.CibaSessionTransition{
+		{Seq: 1, To: domain.StatusPending, Actor: domain.ActorClient, CreatedAt: time.Now().UTC()},
+		{Seq: 2, From: domain.StatusPending, To: domain.StatusApproved, Actor: domain.ActorUser, CreatedAt: time.Now().UTC()},
+	}
+	cibaSession.Status = domain.StatusApproved
 	mockDb, mock, _ := sqlmock.New()
 	defer mockDb.Close()
 	repo := &cibaSessionSQLRepository{
+		db:                   sqlx.NewDb(mockDb, ""),
+		tableName:            "ciba_sessions",
+		tableNameTransitions: "ciba_session_transitions",
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(seq), 0) FROM ciba_session_transitions WHERE auth_req_id = ?")).
+		WithArgs(cibaSession.AuthReqId).
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE ciba_sessions SET client_id = ?, user_id = ?, hint = ?, binding_message = ?, client_notification_token = ?, expires_in = ?, interval = ?, valid = ?, id_token = ?, consented = ?, scope = ?, latest_token_requested_at = ?, status = ?, expires_at = ?, consent_device_id = ?, consent_signature = ?, consent_signed_at = ?, granted_scope = ? WHERE auth_req_id = ? AND status = ?")).
+		WithArgs(cibaSession.ClientId, cibaSession.UserId, cibaSession.Hint, cibaSession.BindingMessage, cibaSession.ClientNotificationToken, cibaSession.ExpiresIn, cibaSession.Interval, cibaSession.Valid, cibaSession.IdToken, cibaSession.Consented, cibaSession.Scope, cibaSession.LatestTokenRequestedAt, cibaSession.Status, cibaSession.GetExpiresAt(), cibaSession.ConsentDeviceId, cibaSession.ConsentSignature, cibaSession.ConsentSignedAt, cibaSession.GrantedScope, cibaSession.AuthReqId, domain.StatusPending).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ciba_session_transitions (auth_req_id, seq, from_status, to_status, actor, created_at) VALUES (?, ?, ?, ?, ?, ?)")).
+		WithArgs(cibaSession.AuthReqId, 2, domain.StatusPending, domain.StatusApproved, domain.ActorUser, anyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := repo.Update(context.Background(), &cibaSession)
+	mockErr := mock.ExpectationsWereMet()
+
+	assert.NoError(t, err)
+	assert.NoError(t, mockErr)
+}
+
+func TestCibaSessionSQLRepository_FindExpired(t *testing.T) {
+	cibaSession := test_data.CibaSession6
+	before := time.Now().UTC()
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	repo := &cibaSessionSQLRepository{
+		db:                   sqlx.NewDb(mockDb, ""),
+		tableName:            "ciba_sessions",
+		tableNameTransitions: "ciba_session_transitions",
+	}
+	rows := sqlmock.NewRows([]string{"auth_req_id", "client_id", "status"}).
+		AddRow(cibaSession.AuthReqId, cibaSession.ClientId, domain.StatusPending)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM ciba_sessions WHERE status IN (?, ?) AND expires_at < ? ORDER BY expires_at LIMIT ?")).
+		WithArgs(domain.StatusPending, domain.StatusApproved, before, 10).
+		WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM ciba_session_transitions WHERE auth_req_id = ? ORDER BY seq")).
+		WithArgs(cibaSession.AuthReqId).
+		WillReturnRows(sqlmock.NewRows([]string{"auth_req_id", "seq", "from_status", "to_status", "actor", "created_at"}))
+
+	cibaSessions, err := repo.FindExpired(context.Background(), before, 10)
+	mockErr := mock.ExpectationsWereMet()
+
+	assert.NoError(t, err)
+	assert.NoError(t, mockErr)
+	assert.Len(t, cibaSessions, 1)
+	assert.Equal(t, cibaSession.AuthReqId, cibaSessions[0].AuthReqId)
+}
+
+func TestCibaSessionSQLRepository_DeleteExpiredBefore(t *testing.T) {
+	before := time.Now().UTC()
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	repo := &cibaSessionSQLRepository{
+		db:                   sqlx.NewDb(mockDb, ""),
+		tableName:            "ciba_sessions",
+		tableNameTransitions: "ciba_session_transitions",
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT auth_req_id FROM ciba_sessions WHERE expires_at < ? ORDER BY expires_at LIMIT ?")).
+		WithArgs(before, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"auth_req_id"}).AddRow("1").AddRow("2"))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM ciba_session_transitions WHERE auth_req_id IN (?, ?)")).
+		WithArgs("1", "2").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM ciba_sessions WHERE auth_req_id IN (?, ?)")).
+		WithArgs("1", "2").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	deleted, err := repo.DeleteExpiredBefore(context.Background(), before, 10)
+	mockErr := mock.ExpectationsWereMet()
+
+	assert.NoError(t, err)
+	assert.NoError(t, mockErr)
+	assert.Equal(t, 2, deleted)
+}
+
+func TestAccessTokenSQLRepository_DeleteExpiredBefore(t *testing.T) {
+	before := time.Now().UTC()
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	repo := &accessTokenSQLRepository{
 		db:        sqlx.NewDb(mockDb, ""),
-		tableName: "ciba_sessions",
+		tableName: "access_tokens",
 	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT access_token FROM access_tokens WHERE expires < ? ORDER BY expires LIMIT ?")).
+		WithArgs(before, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"access_token"}).AddRow("token-1"))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM access_tokens WHERE access_token IN (?)")).
+		WithArgs("token-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	deleted, err := repo.DeleteExpiredBefore(context.Background(), before, 10)
+	mockErr := mock.ExpectationsWereMet()
 
-	mock.ExpectExec(regexp.QuoteMeta("UPDATE ciba_sessions SET client_id = ?, user_id = ?, hint = ?, binding_message = ?, client_notification_token = ?, expires_in = ?, interval = ?, valid = ?, id_token = ?, consented = ?, scope = ?, latest_token_requested_at = ? WHERE auth_req_id = ?")).
-		WithArgs(cibaSession.ClientId, cibaSession.UserId, cibaSession.Hint, cibaSession.BindingMessage, cibaSession.ClientNotificationToken, cibaSession.ExpiresIn, cibaSession.Interval, cibaSession.Valid, cibaSession.IdToken, cibaSession.Consented, cibaSession.Scope, cibaSession.LatestTokenRequestedAt, cibaSession.AuthReqId).
+	assert.NoError(t, err)
+	assert.NoError(t, mockErr)
+	assert.Equal(t, 1, deleted)
+}
+
+func TestSQLLocker_TryLock_ShouldAcquire_WhenFree(t *testing.T) {
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	locker := &sqlLocker{db: sqlx.NewDb(mockDb, ""), tableName: "locks", owner: "owner-1"}
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM locks WHERE name = ? AND expires_at < ?")).
+		WithArgs("sweeper", anyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO locks (name, owner, expires_at) VALUES (?, ?, ?)")).
+		WithArgs("sweeper", "owner-1", anyTime{}).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := repo.Update(&cibaSession)
+	acquired, err := locker.TryLock(context.Background(), "sweeper", time.Minute)
+	mockErr := mock.ExpectationsWereMet()
+
+	assert.NoError(t, err)
+	assert.NoError(t, mockErr)
+	assert.True(t, acquired)
+}
+
+func TestSQLLocker_TryLock_ShouldNotAcquire_WhenHeld(t *testing.T) {
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	locker := &sqlLocker{db: sqlx.NewDb(mockDb, ""), tableName: "locks", owner: "owner-1"}
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM locks WHERE name = ? AND expires_at < ?")).
+		WithArgs("sweeper", anyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO locks (name, owner, expires_at) VALUES (?, ?, ?)")).
+		WithArgs("sweeper", "owner-1", anyTime{}).
+		WillReturnError(errors.New("duplicate key"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM locks WHERE name = ?")).
+		WithArgs("sweeper").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	acquired, err := locker.TryLock(context.Background(), "sweeper", time.Minute)
+	mockErr := mock.ExpectationsWereMet()
+
+	assert.NoError(t, err)
+	assert.NoError(t, mockErr)
+	assert.False(t, acquired)
+}
+
+func TestSQLLocker_Unlock(t *testing.T) {
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	locker := &sqlLocker{db: sqlx.NewDb(mockDb, ""), tableName: "locks", owner: "owner-1"}
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM locks WHERE name = ? AND owner = ?")).
+		WithArgs("sweeper", "owner-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := locker.Unlock(context.Background(), "sweeper")
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
@@ -177,7 +369,7 @@ func TestKeySQLRepository_FindPrivateKeyByClientId(t *testing.T) {
 		WithArgs(key.ClientId).
 		WillReturnRows(rows)
 
-	keyRes, err := repo.FindPrivateKeyByClientId(key.ClientId)
+	keyRes, err := repo.FindPrivateKeyByClientId(context.Background(), key.ClientId)
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
@@ -199,7 +391,7 @@ func TestUserAccountSQLRepository_FindById(t *testing.T) {
 		WithArgs(userAccount.Id).
 		WillReturnRows(rows)
 
-	user, err := repo.FindById(userAccount.Id)
+	user, err := repo.FindById(context.Background(), userAccount.Id)
 	mockErr := mock.ExpectationsWereMet()
 
 	assert.NoError(t, err)
@@ -238,7 +430,7 @@ func TestUserClaimSQLRepository_GetUserClaims(t *testing.T) {
 		WithArgs("id.timestamp.read").
 		WillReturnRows(claimsRows)
 
-	claims, err := repo.GetUserClaims(userAccount.Id, "timestamp.read")
+	claims, err := repo.GetUserClaims(context.Background(), userAccount.Id, "timestamp.read")
 	mockErr := mock.ExpectationsWereMet()
 
 	for _, c := range []string{"created_at", "updated_at"} {
@@ -257,3 +449,64 @@ func TestBuildTableName(t *testing.T) {
 	res = buildTableName("go_ciba", "mytable")
 	assert.Equal(t, "go_ciba_mytable", res)
 }
+
+func TestSQLDataStore_WithinTransaction_ShouldCommit(t *testing.T) {
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	ds := NewSQLDataStore(mockDb, "", "")
+	accessToken := domain.NewAccessToken("token-1", "client-1", "user-1", "openid", time.Now().UTC())
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO access_tokens (access_token, client_id, expires, user_id, scope) VALUES (?, ?, ?, ?, ?)")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := ds.WithinTransaction(context.Background(), func(tx DataStoreInterface) error {
+		return tx.GetAccessTokenRepository().Create(context.Background(), accessToken)
+	})
+	mockErr := mock.ExpectationsWereMet()
+
+	assert.NoError(t, err)
+	assert.NoError(t, mockErr)
+}
+
+func TestSQLDataStore_WithinTransaction_ShouldRollback_WhenFnFails(t *testing.T) {
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	ds := NewSQLDataStore(mockDb, "", "")
+	accessToken := domain.NewAccessToken("token-1", "client-1", "user-1", "openid", time.Now().UTC())
+	fnErr := errors.New("failed")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO access_tokens (access_token, client_id, expires, user_id, scope) VALUES (?, ?, ?, ?, ?)")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+
+	err := ds.WithinTransaction(context.Background(), func(tx DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(context.Background(), accessToken); err != nil {
+			return err
+		}
+		return fnErr
+	})
+	mockErr := mock.ExpectationsWereMet()
+
+	assert.Equal(t, fnErr, err)
+	assert.NoError(t, mockErr)
+}
+
+func TestSQLDataStore_WithinTransaction_ShouldJoinOuterTransaction(t *testing.T) {
+	mockDb, mock, _ := sqlmock.New()
+	defer mockDb.Close()
+	ds := NewSQLDataStore(mockDb, "", "")
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+
+	err := ds.WithinTransaction(context.Background(), func(tx DataStoreInterface) error {
+		return tx.WithinTransaction(context.Background(), func(inner DataStoreInterface) error {
+			assert.Equal(t, tx, inner)
+			return nil
+		})
+	})
+	mockErr := mock.ExpectationsWereMet()
+
+	assert.NoError(t, err)
+	assert.NoError(t, mockErr)
+}
@@ -1,6 +1,7 @@
 package go_ciba
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -31,7 +32,7 @@ func NewResourceRequest(r *http.Request) *ResourceRequest {
 }
 
 type ResourceServerInterface interface {
-	HandleResourceRequest(r *ResourceRequest) error
+	HandleResourceRequest(ctx context.Context, r *ResourceRequest) error
 }
 
 type resourceServer struct {
@@ -46,8 +47,8 @@ func NewResourceServer(accessTokenRepo repository.AccessTokenRepositoryInterface
 	}
 }
 
-func (rs *resourceServer) HandleResourceRequest(r *ResourceRequest, scope string) *util.OidcError {
-	token, err := rs.accessTokenRepo.Find(r.accessToken)
+func (rs *resourceServer) HandleResourceRequest(ctx context.Context, r *ResourceRequest, scope string) *util.OidcError {
+	token, err := rs.accessTokenRepo.Find(ctx, r.accessToken)
 	if err != nil {
 		return util.ErrGeneral
 	}
@@ -1,6 +1,7 @@
 package go_ciba
 
 import (
+	"context"
 	"testing"
 
 	"github.com/adisazhar123/go-ciba/test_data"
@@ -15,7 +16,7 @@ func TestResourceServer_HandleResourceRequest_ShouldReturnErrInvalidToken(t *tes
 	}
 	invalidToken := "4C6C584A-EB31-4E11-A3E7-EADBBB573E96"
 
-	err := rs.HandleResourceRequest(&ResourceRequest{
+	err := rs.HandleResourceRequest(context.Background(), &ResourceRequest{
 		accessToken: invalidToken,
 	}, "")
 
@@ -30,7 +31,7 @@ func TestResourceServer_HandleResourceRequest_ShouldReturnErrInsufficientScope(t
 	}
 	token := "C59D9FBC-D8E4-4B8B-A95B-14F931EE1AB3"
 
-	err := rs.HandleResourceRequest(&ResourceRequest{accessToken: token}, "payment:write")
+	err := rs.HandleResourceRequest(context.Background(), &ResourceRequest{accessToken: token}, "payment:write")
 
 	assert.NotNil(t, err)
 	assert.EqualError(t, err, util.ErrInsufficientScope.Error())
@@ -43,7 +44,7 @@ func TestResourceServer_HandleResourceRequest_ShouldReturnErrInsufficientScope2(
 	}
 	token := test_data.AccessTokenValid.Value
 
-	err := rs.HandleResourceRequest(&ResourceRequest{accessToken: token}, "openid email profile chat:write payment:write")
+	err := rs.HandleResourceRequest(context.Background(), &ResourceRequest{accessToken: token}, "openid email profile chat:write payment:write")
 
 	assert.NotNil(t, err)
 	assert.EqualError(t, err, util.ErrInsufficientScope.Error())
@@ -56,7 +57,7 @@ func TestResourceServer_HandleResourceRequest_ShouldReturnErrInvalidTokenWhenExp
 	}
 	token := test_data.AccessTokenExpired.Value
 
-	err := rs.HandleResourceRequest(&ResourceRequest{accessToken: token}, "")
+	err := rs.HandleResourceRequest(context.Background(), &ResourceRequest{accessToken: token}, "")
 
 	assert.NotNil(t, err)
 	assert.EqualError(t, err, util.ErrInvalidToken.Error())
@@ -69,7 +70,7 @@ func TestResourceServer_HandleResourceRequest_ShouldSucceedWhenTokenIsValid(t *t
 	}
 	token := test_data.AccessTokenValid.Value
 
-	err := rs.HandleResourceRequest(&ResourceRequest{accessToken: token}, "")
+	err := rs.HandleResourceRequest(context.Background(), &ResourceRequest{accessToken: token}, "")
 
 	assert.Nil(t, err)
 }
@@ -81,7 +82,7 @@ func TestResourceServer_HandleResourceRequest_ShouldSucceedWhenTokenIsValid_Cust
 	}
 	token := test_data.AccessTokenValid.Value
 
-	err := rs.HandleResourceRequest(&ResourceRequest{accessToken: token}, "chat:write")
+	err := rs.HandleResourceRequest(context.Background(), &ResourceRequest{accessToken: token}, "chat:write")
 
 	assert.Nil(t, err)
 }
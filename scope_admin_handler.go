@@ -0,0 +1,185 @@
+package go_ciba
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+// Decides whether a request comes from someone allowed to manage the scope registry.
+type AdminAuthorizer interface {
+	// Returns an error when the request isn't authorized.
+	AuthorizeAdmin(r *http.Request) error
+}
+
+type scopesResponse struct {
+	Scopes []*domain.Scope `json:"scopes"`
+}
+
+type claimView struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type claimsResponse struct {
+	Claims []*claimView `json:"claims"`
+}
+
+// The API administrators manage the scope registry with, relative to where it's mounted:
+// GET /scopes lists the scopes, GET, PUT and DELETE /scopes/{name} find, create or replace, and delete one.
+// /claims and /claims/{name} do the same for claims. It routes on the path of the request, so mount it with
+// Mount, or strip the prefix with http.StripPrefix when registering it elsewhere.
+type scopeAdminHandler struct {
+	scopeService service.ScopeServiceInterface
+	authorizer   AdminAuthorizer
+}
+
+func NewScopeAdminHandler(scopeService service.ScopeServiceInterface, authorizer AdminAuthorizer) *scopeAdminHandler {
+	return &scopeAdminHandler{
+		scopeService: scopeService,
+		authorizer:   authorizer,
+	}
+}
+
+// Registers the handler on mux under the given prefix, e.g. /admin serves /admin/scopes.
+func (h *scopeAdminHandler) Mount(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, h))
+}
+
+func (h *scopeAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.authorizer.AuthorizeAdmin(r); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+	name := ""
+	if len(parts) == 2 {
+		name = parts[1]
+	}
+	switch {
+	case parts[0] == "scopes" && name == "":
+		h.serveScopes(w, r)
+	case parts[0] == "scopes":
+		h.serveScope(w, r, name)
+	case parts[0] == "claims" && name == "":
+		h.serveClaims(w, r)
+	case parts[0] == "claims":
+		h.serveClaim(w, r, name)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (h *scopeAdminHandler) serveScopes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	scopes, oidcErr := h.scopeService.FindScopes(r.Context())
+	if oidcErr != nil {
+		h.writeJson(w, oidcErr.Code, oidcErr)
+		return
+	}
+	if scopes == nil {
+		scopes = []*domain.Scope{}
+	}
+	h.writeJson(w, http.StatusOK, &scopesResponse{Scopes: scopes})
+}
+
+func (h *scopeAdminHandler) serveScope(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		scope, oidcErr := h.scopeService.FindScope(r.Context(), name)
+		if oidcErr != nil {
+			h.writeJson(w, oidcErr.Code, oidcErr)
+			return
+		}
+		if scope == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h.writeJson(w, http.StatusOK, scope)
+	case http.MethodPut:
+		scope := &domain.Scope{}
+		if err := json.NewDecoder(r.Body).Decode(scope); err != nil || (scope.Name != "" && scope.Name != name) {
+			h.writeJson(w, util.ErrInvalidRequest.Code, util.ErrInvalidRequest)
+			return
+		}
+		scope.Name = name
+		if oidcErr := h.scopeService.SaveScope(r.Context(), scope); oidcErr != nil {
+			h.writeJson(w, oidcErr.Code, oidcErr)
+			return
+		}
+		h.writeJson(w, http.StatusOK, scope)
+	case http.MethodDelete:
+		if oidcErr := h.scopeService.DeleteScope(r.Context(), name); oidcErr != nil {
+			h.writeJson(w, oidcErr.Code, oidcErr)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *scopeAdminHandler) serveClaims(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, oidcErr := h.scopeService.FindClaims(r.Context())
+	if oidcErr != nil {
+		h.writeJson(w, oidcErr.Code, oidcErr)
+		return
+	}
+	res := &claimsResponse{Claims: []*claimView{}}
+	for _, claim := range claims {
+		res.Claims = append(res.Claims, &claimView{Name: claim.Name, Description: claim.Description})
+	}
+	h.writeJson(w, http.StatusOK, res)
+}
+
+func (h *scopeAdminHandler) serveClaim(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodPut:
+		claim := &claimView{}
+		if err := json.NewDecoder(r.Body).Decode(claim); err != nil || (claim.Name != "" && claim.Name != name) {
+			h.writeJson(w, util.ErrInvalidRequest.Code, util.ErrInvalidRequest)
+			return
+		}
+		claim.Name = name
+		if oidcErr := h.scopeService.SaveClaim(r.Context(), &domain.Claim{Name: claim.Name, Description: claim.Description}); oidcErr != nil {
+			h.writeJson(w, oidcErr.Code, oidcErr)
+			return
+		}
+		h.writeJson(w, http.StatusOK, claim)
+	case http.MethodDelete:
+		if oidcErr := h.scopeService.DeleteClaim(r.Context(), name); oidcErr != nil {
+			h.writeJson(w, oidcErr.Code, oidcErr)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *scopeAdminHandler) writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[go-ciba][scopeadminhandler] failed writing response. %s\n", err.Error())
+	}
+}
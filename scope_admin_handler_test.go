@@ -0,0 +1,118 @@
+package go_ciba
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/stretchr/testify/assert"
+)
+
+type tokenAdminAuthorizer struct{}
+
+func (tokenAdminAuthorizer) AuthorizeAdmin(r *http.Request) error {
+	if r.Header.Get("Authorization") != "Bearer admin" {
+		return errors.New("not an administrator")
+	}
+	return nil
+}
+
+func newTestScopeAdminHandler() (http.Handler, *memory.DataStore) {
+	ds := memory.NewDataStore()
+	ds.AddScope("profile", "name")
+	return http.StripPrefix("/admin", NewScopeAdminHandler(service.NewScopeService(ds), &tokenAdminAuthorizer{})), ds
+}
+
+func serveScopeAdmin(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set("Authorization", "Bearer admin")
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func TestScopeAdminHandler_Scopes(t *testing.T) {
+	h, ds := newTestScopeAdminHandler()
+
+	putRes := serveScopeAdmin(h, http.MethodPut, "/admin/scopes/email", `{"display_name":"Email","localizations":{"fr":{"display_name":"E-mail"}},"requires_user_code":true,"claims":["email"]}`)
+	mismatchRes := serveScopeAdmin(h, http.MethodPut, "/admin/scopes/email", `{"name":"other"}`)
+	listRes := serveScopeAdmin(h, http.MethodGet, "/admin/scopes", "")
+	getRes := serveScopeAdmin(h, http.MethodGet, "/admin/scopes/email", "")
+	deleteRes := serveScopeAdmin(h, http.MethodDelete, "/admin/scopes/profile", "")
+	unknownRes := serveScopeAdmin(h, http.MethodGet, "/admin/scopes/profile", "")
+	list := &scopesResponse{}
+	_ = json.NewDecoder(listRes.Body).Decode(list)
+	stored, _ := ds.GetScopeRepository().FindScopeByName(context.Background(), "email")
+
+	assert.Equal(t, http.StatusOK, putRes.Code)
+	assert.Equal(t, http.StatusBadRequest, mismatchRes.Code)
+	assert.Equal(t, http.StatusOK, listRes.Code)
+	if assert.Len(t, list.Scopes, 2) {
+		assert.Equal(t, "email", list.Scopes[0].Name)
+		assert.Equal(t, "profile", list.Scopes[1].Name)
+	}
+	assert.Equal(t, http.StatusOK, getRes.Code)
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, "E-mail", stored.Localizations["fr"].DisplayName)
+		assert.True(t, stored.RequiresUserCode)
+		assert.Equal(t, []string{"email"}, stored.Claims)
+	}
+	assert.Equal(t, http.StatusNoContent, deleteRes.Code)
+	assert.Equal(t, http.StatusNotFound, unknownRes.Code)
+}
+
+func TestScopeAdminHandler_Claims(t *testing.T) {
+	h, ds := newTestScopeAdminHandler()
+
+	putRes := serveScopeAdmin(h, http.MethodPut, "/admin/claims/name", `{"description":"Your full name"}`)
+	listRes := serveScopeAdmin(h, http.MethodGet, "/admin/claims", "")
+	listBody := listRes.Body.String()
+	deleteRes := serveScopeAdmin(h, http.MethodDelete, "/admin/claims/name", "")
+	unknownRes := serveScopeAdmin(h, http.MethodDelete, "/admin/claims/name", "")
+	profile, _ := ds.GetScopeRepository().FindScopeByName(context.Background(), "profile")
+
+	assert.Equal(t, http.StatusOK, putRes.Code)
+	assert.JSONEq(t, `{"claims":[{"name":"name","description":"Your full name"}]}`, listBody)
+	assert.Equal(t, http.StatusNoContent, deleteRes.Code)
+	assert.Equal(t, http.StatusBadRequest, unknownRes.Code)
+	assert.Empty(t, profile.Claims)
+}
+
+func TestScopeAdminHandler_ShouldRejectUnauthorizedAndUnknownRequests(t *testing.T) {
+	h, _ := newTestScopeAdminHandler()
+	req := httptest.NewRequest(http.MethodGet, "/admin/scopes", nil)
+	unauthorizedRes := httptest.NewRecorder()
+	h.ServeHTTP(unauthorizedRes, req)
+
+	unknownRes := serveScopeAdmin(h, http.MethodGet, "/admin/users", "")
+	methodRes := serveScopeAdmin(h, http.MethodPost, "/admin/scopes", "")
+
+	assert.Equal(t, http.StatusUnauthorized, unauthorizedRes.Code)
+	assert.Equal(t, http.StatusNotFound, unknownRes.Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, methodRes.Code)
+}
+
+func TestScopeAdminHandler_Mount_ShouldServeUnderPrefix(t *testing.T) {
+	ds := memory.NewDataStore()
+	ds.AddScope("profile", "name")
+	mux := http.NewServeMux()
+	NewScopeAdminHandler(service.NewScopeService(ds), &tokenAdminAuthorizer{}).Mount(mux, "/admin/")
+
+	res := serveScopeAdmin(mux, http.MethodGet, "/admin/scopes/profile", "")
+	outsideRes := serveScopeAdmin(mux, http.MethodGet, "/scopes/profile", "")
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"name":"profile"`)
+	assert.Equal(t, http.StatusNotFound, outsideRes.Code)
+}
@@ -1,10 +1,15 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/adisazhar123/go-ciba/domain"
 	"github.com/adisazhar123/go-ciba/grant"
@@ -12,6 +17,7 @@ import (
 	"github.com/adisazhar123/go-ciba/service/http_auth"
 	"github.com/adisazhar123/go-ciba/service/transport"
 	"github.com/adisazhar123/go-ciba/util"
+	"gopkg.in/square/go-jose.v2"
 )
 
 const (
@@ -101,8 +107,16 @@ func makeSuccessfulAuthenticationResponse(authReqId string, expiresIn int64, int
 type ConsentRequest struct {
 	AuthReqId string
 	Consented *bool
+	// ID of the authenticated user giving the consent, it's refused unless the request is theirs.
+	// Only HandleTrustedConsentRequest takes consents without it.
+	UserId string
+	// The compact JWS a registered device of the user signed the decision with, see ConsentSignatureClaims.
+	Signature string
+	// The requested scopes the user approved, nil when they approved all of them. openid is always granted.
+	ApprovedScopes []string
 }
 
+// Creates a consent request without a user, for HandleTrustedConsentRequest.
 func NewConsentRequest(authReqId string, consented *bool) *ConsentRequest {
 	return &ConsentRequest{
 		AuthReqId: authReqId,
@@ -110,17 +124,60 @@ func NewConsentRequest(authReqId string, consented *bool) *ConsentRequest {
 	}
 }
 
+// Creates the consent request of an authenticated user, e.g. from their authentication device.
+func NewUserConsentRequest(userId, authReqId string, consented *bool) *ConsentRequest {
+	return &ConsentRequest{
+		AuthReqId: authReqId,
+		Consented: consented,
+		UserId:    userId,
+	}
+}
+
+// Asks for a pending authentication request to be cancelled by the client that made it.
+type CancellationRequest struct {
+	AuthReqId    string
+	ClientId     string
+	ClientSecret string
+
+	r *http.Request
+}
+
+func NewCancellationRequest(r *http.Request) *CancellationRequest {
+	_ = r.ParseForm()
+	cancellationRequest := &CancellationRequest{
+		AuthReqId: r.Form.Get("auth_req_id"),
+		r:         r,
+	}
+	http_auth.PopulateClientCredentials(r, &cancellationRequest.ClientId, &cancellationRequest.ClientSecret)
+	return cancellationRequest
+}
+
+// A request waiting for the consent of the user, as shown on their authentication device.
+type PendingConsentRequest struct {
+	AuthReqId      string    `json:"auth_req_id"`
+	ClientId       string    `json:"client_id"`
+	ClientName     string    `json:"client_name"`
+	BindingMessage string    `json:"binding_message,omitempty"`
+	Scopes         []string  `json:"scopes"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
 type CibaServiceInterface interface {
 	GrantServiceInterface
-	ConsentServiceInterface
+	UserConsentServiceInterface
+	CancellationServiceInterface
 }
 
 type cibaService struct {
+	dataStore       repository.DataStoreInterface
 	clientAppRepo   repository.ClientApplicationRepositoryInterface
 	userAccountRepo repository.UserAccountRepositoryInterface
 	cibaSessionRepo repository.CibaSessionRepositoryInterface
 	keyRepo         repository.KeyRepositoryInterface
 	userClaimRepo   repository.UserClaimRepositoryInterface
+	userDeviceRepo  repository.UserDeviceRepositoryInterface
+	grantRepo       repository.GrantRepositoryInterface
+	scopeRepo       repository.ScopeRepositoryInterface
 
 	scopeUtil             util.ScopeUtil
 	authenticationContext *http_auth.ClientAuthenticationContext
@@ -128,9 +185,9 @@ type cibaService struct {
 	clientApp *domain.ClientApplication
 	grant     *grant.CibaGrant
 
-	notificationClient transport.NotificationInterface
+	notificationClient transport.UserNotifier
 
-	clientAppNotification transport.NotificationInterface
+	clientAppNotification transport.ClientNotifier
 
 	validateClientNotificationToken func(token string) bool
 
@@ -138,21 +195,21 @@ type cibaService struct {
 }
 
 func NewCibaService(
-	clientAppRepo repository.ClientApplicationRepositoryInterface,
-	userAccountRepo repository.UserAccountRepositoryInterface,
-	cibaSessionRepo repository.CibaSessionRepositoryInterface,
-	keyRepo repository.KeyRepositoryInterface,
-	userClaimRepo repository.UserClaimRepositoryInterface,
-	notificationClient transport.NotificationInterface,
+	dataStore repository.DataStoreInterface,
+	notificationClient transport.UserNotifier,
 	cibaGrant *grant.CibaGrant,
 	validateClientNotificationToken func(token string) bool,
 ) *cibaService {
 	return &cibaService{
-		clientAppRepo:                   clientAppRepo,
-		userAccountRepo:                 userAccountRepo,
-		cibaSessionRepo:                 cibaSessionRepo,
-		keyRepo:                         keyRepo,
-		userClaimRepo:                   userClaimRepo,
+		dataStore:                       dataStore,
+		clientAppRepo:                   dataStore.GetClientApplicationRepository(),
+		userAccountRepo:                 dataStore.GetUserAccountRepository(),
+		cibaSessionRepo:                 dataStore.GetCibaSessionRepository(),
+		keyRepo:                         newSigningKeyResolver(dataStore),
+		userClaimRepo:                   dataStore.GetUserClaimRepository(),
+		userDeviceRepo:                  dataStore.GetUserDeviceRepository(),
+		grantRepo:                       dataStore.GetGrantRepository(),
+		scopeRepo:                       dataStore.GetScopeRepository(),
 		scopeUtil:                       util.ScopeUtil{},
 		grant:                           cibaGrant,
 		notificationClient:              notificationClient,
@@ -167,8 +224,8 @@ func defaultValidateClientNotificationToken(token string) bool {
 	return token != ""
 }
 
-func (cs *cibaService) HandleAuthenticationRequest(request *AuthenticationRequest) (*AuthenticationResponse, *util.OidcError) {
-	err := cs.ValidateAuthenticationRequestParameters(request)
+func (cs *cibaService) HandleAuthenticationRequest(ctx context.Context, request *AuthenticationRequest) (*AuthenticationResponse, *util.OidcError) {
+	err := cs.ValidateAuthenticationRequestParameters(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -180,15 +237,29 @@ func (cs *cibaService) HandleAuthenticationRequest(request *AuthenticationReques
 
 	// Create new ciba session
 	ciba := domain.NewCibaSession(cs.clientApp, request.LoginHint, request.BindingMessage, request.ClientNotificationToken, request.Scope, authReqIdExpiry, cs.grant.Config.PollingIntervalInSeconds)
-	if err := cs.cibaSessionRepo.Create(ciba); err != nil {
+	if err := cs.cibaSessionRepo.Create(ctx, ciba); err != nil {
 		log.Println("An error occurred", err)
 		return nil, util.ErrGeneral
 	}
 
-	if err := cs.notificationClient.Send(map[string]interface{}{
-		"to":               ciba.Hint,
-		"data.auth_req_id": ciba.AuthReqId,
-	}); err != nil {
+	remembered, rememberErr := cs.isConsentRemembered(ctx, ciba, time.Now().UTC())
+	if rememberErr != nil {
+		log.Printf("[go-ciba][cibaservice] failed finding grant of ciba session %s. %s\n", ciba.AuthReqId, rememberErr.Error())
+		return nil, util.ErrGeneral
+	}
+	if remembered {
+		if err := ciba.Approve(domain.ActorSystem); err != nil {
+			log.Println(err)
+			return nil, util.ErrGeneral
+		}
+		ciba.SetGrantedScope(ciba.Scope)
+		if oidcErr := cs.completeConsent(ctx, cs.clientApp, ciba, nil); oidcErr != nil {
+			return nil, oidcErr
+		}
+		return makeSuccessfulAuthenticationResponse(ciba.AuthReqId, ciba.ExpiresIn, ciba.Interval), nil
+	}
+
+	if err := cs.promptUser(ctx, ciba); err != nil {
 		log.Printf("[go-ciba][cibaservice] an error occured sending consent to user %s", err.Error())
 		return nil, util.ErrGeneral
 	}
@@ -196,9 +267,41 @@ func (cs *cibaService) HandleAuthenticationRequest(request *AuthenticationReques
 	return makeSuccessfulAuthenticationResponse(ciba.AuthReqId, ciba.ExpiresIn, ciba.Interval), nil
 }
 
-func (cs *cibaService) ValidateAuthenticationRequestParameters(request *AuthenticationRequest) *util.OidcError {
+// Sends the consent prompt to every active device of the user. It succeeds if at least one device was reached.
+// Users without registered devices get a single prompt the transport routes on its own, e.g. by hint,
+// and so do users whose devices none of the transports reach, e.g. when prompts are only emailed.
+func (cs *cibaService) promptUser(ctx context.Context, ciba *domain.CibaSession) error {
+	devices, err := cs.userDeviceRepo.FindActiveByUserId(ctx, ciba.UserId)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	delivered := 0
+	for _, device := range devices {
+		err := cs.notificationClient.NotifyUser(ctx, transport.NewUserConsentPrompt(ciba, device))
+		if errors.Is(err, transport.ErrDevicePrompt) {
+			continue
+		}
+		if err != nil {
+			log.Printf("[go-ciba][cibaservice] failed sending consent prompt to device %s. %s\n", device.Id, err.Error())
+			lastErr = err
+			continue
+		}
+		delivered++
+	}
+	if delivered > 0 {
+		return nil
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return cs.notificationClient.NotifyUser(ctx, transport.NewUserConsentPrompt(ciba, nil))
+}
+
+func (cs *cibaService) ValidateAuthenticationRequestParameters(ctx context.Context, request *AuthenticationRequest) *util.OidcError {
 	// Make sure client application exists
-	clientApp, err := cs.clientAppRepo.FindById(request.ClientId)
+	clientApp, err := cs.clientAppRepo.FindById(ctx, request.ClientId)
 	if err != nil {
 		return util.ErrGeneral
 	}
@@ -238,7 +341,7 @@ func (cs *cibaService) ValidateAuthenticationRequestParameters(request *Authenti
 	}
 
 	// Make sure hint is valid, it must correspond to a valid user
-	user, err := cs.userAccountRepo.FindById(request.LoginHint)
+	user, err := cs.userAccountRepo.FindById(ctx, request.LoginHint)
 	if err != nil {
 		return util.ErrGeneral
 	}
@@ -251,6 +354,23 @@ func (cs *cibaService) ValidateAuthenticationRequestParameters(request *Authenti
 		return util.ErrInvalidScope
 	}
 
+	// Make sure every scope is registered
+	requiresUserCode := false
+	for _, name := range strings.Split(request.Scope, " ") {
+		if name == "" || name == domain.ScopeOpenId {
+			continue
+		}
+		scope, err := cs.scopeRepo.FindScopeByName(ctx, name)
+		if err != nil {
+			log.Printf("%s failed finding scope %s\n", logTag, err.Error())
+			return util.ErrGeneral
+		}
+		if scope == nil {
+			return util.ErrInvalidScope
+		}
+		requiresUserCode = requiresUserCode || scope.RequiresUserCode
+	}
+
 	// Client registered using ping or push must provide client_notification_token
 	if (clientApp.GetTokenMode() == domain.ModePing || clientApp.GetTokenMode() == domain.ModePush) && !cs.validateClientNotificationToken(request.ClientNotificationToken) {
 		log.Printf("%s client notification is missing or not well formed\n", logTag)
@@ -261,22 +381,37 @@ func (cs *cibaService) ValidateAuthenticationRequestParameters(request *Authenti
 		return util.ErrInvalidBindingMessage
 	}
 
-	// Client registered using user code must supply user_code
-	if clientApp.IsUserCodeSupported() && request.UserCode == "" {
+	// Client registered using user code, or requesting a scope that requires it, must supply user_code
+	requiresUserCode = requiresUserCode || clientApp.IsUserCodeSupported()
+	if requiresUserCode && request.UserCode == "" {
 		return util.ErrMissingUserCode
 	}
 
 	// Check if user code is correct
-	if clientApp.IsUserCodeSupported() && !request.ValidateUserCode(user.GetUseCode(), request.UserCode) {
+	if requiresUserCode && !request.ValidateUserCode(user.GetUseCode(), request.UserCode) {
 		return util.ErrInvalidUserCode
 	}
 
 	return nil
 }
 
-//
-func (cs *cibaService) HandleConsentRequest(request *ConsentRequest) *util.OidcError {
-	cibaSession, err := cs.cibaSessionRepo.FindById(request.AuthReqId)
+// Takes the consent of the authenticated user the request is for, consents without a user are refused.
+func (cs *cibaService) HandleConsentRequest(ctx context.Context, request *ConsentRequest) *util.OidcError {
+	if request.UserId == "" {
+		log.Printf("[go-ciba][cibaservice] refused consent to ciba session %s without an authenticated user\n", request.AuthReqId)
+		return util.ErrInvalidRequest
+	}
+	return cs.handleConsentRequest(ctx, request)
+}
+
+// Takes a consent the caller already proved comes from the user, the user of the request is checked when it's set.
+// Never pass it requests whose auth_req_id alone was submitted.
+func (cs *cibaService) HandleTrustedConsentRequest(ctx context.Context, request *ConsentRequest) *util.OidcError {
+	return cs.handleConsentRequest(ctx, request)
+}
+
+func (cs *cibaService) handleConsentRequest(ctx context.Context, request *ConsentRequest) *util.OidcError {
+	cibaSession, err := cs.cibaSessionRepo.FindById(ctx, request.AuthReqId)
 
 	if err != nil {
 		log.Println(err)
@@ -286,8 +421,13 @@ func (cs *cibaService) HandleConsentRequest(request *ConsentRequest) *util.OidcE
 		log.Println("ciba session not found")
 		return util.ErrTransactionFailed
 	}
+	// Answered like an unknown request, so users can't tell which requests of others exist.
+	if request.UserId != "" && request.UserId != cibaSession.UserId {
+		log.Printf("[go-ciba][cibaservice] user %s tried giving consent to ciba session %s of another user\n", request.UserId, cibaSession.AuthReqId)
+		return util.ErrTransactionFailed
+	}
 
-	clientApp, err := cs.clientAppRepo.FindById(cibaSession.ClientId)
+	clientApp, err := cs.clientAppRepo.FindById(ctx, cibaSession.ClientId)
 	if err != nil {
 		log.Println(err)
 		return util.ErrGeneral
@@ -296,31 +436,106 @@ func (cs *cibaService) HandleConsentRequest(request *ConsentRequest) *util.OidcE
 		return util.ErrInvalidClient
 	}
 
-	if !cibaSession.Valid || cibaSession.Consented != nil || cibaSession.IsTimeExpired() {
+	if request.Consented == nil {
+		return util.ErrInvalidRequest
+	}
+
+	if cibaSession.ExpireIfElapsed() {
+		if err := cs.cibaSessionRepo.Update(ctx, cibaSession); err != nil {
+			log.Println(err)
+			return util.ErrGeneral
+		}
+	}
+
+	if !cibaSession.IsAuthorizationPending() {
 		// not valid
-		log.Printf("[go-ciba][cibaservice] ciba session %s isn't valid\n", cibaSession.AuthReqId)
+		log.Printf("[go-ciba][cibaservice] ciba session %s is %s\n", cibaSession.AuthReqId, cibaSession.GetStatus())
 		if clientApp.TokenMode == domain.ModePush {
-			_ = cs.clientAppNotification.Send(map[string]interface{}{
-				"token_method":              domain.ModePush,
-				"success":                   false,
-				"oidc_error":                util.ErrExpiredToken,
-				"endpoint":                  clientApp.ClientNotificationEndpoint,
-				"client_notification_token": cibaSession.ClientNotificationToken,
+			_ = cs.clientAppNotification.NotifyClient(ctx, &transport.ClientPushError{
+				Endpoint:                clientApp.ClientNotificationEndpoint,
+				ClientNotificationToken: cibaSession.ClientNotificationToken,
+				AuthReqId:               cibaSession.AuthReqId,
+				Error:                   util.ErrExpiredToken,
 			})
 		}
 		return util.ErrExpiredToken
 	}
-	cibaSession.Consented = request.Consented
-	if err := cs.cibaSessionRepo.Update(cibaSession); err != nil {
+
+	grantedScope, ok := grantScope(cibaSession.Scope, request.ApprovedScopes)
+	if !ok {
+		log.Printf("[go-ciba][cibaservice] approved scopes of ciba session %s weren't requested\n", cibaSession.AuthReqId)
+		return util.ErrInvalidScope
+	}
+	// Approving none of the requested scopes grants nothing, the user has to deny the request instead.
+	if *request.Consented && grantedScope == "" {
+		log.Printf("[go-ciba][cibaservice] none of the requested scopes of ciba session %s were approved\n", cibaSession.AuthReqId)
+		return util.ErrInvalidScope
+	}
+
+	if request.Signature != "" {
+		device, signedAt, err := cs.verifyConsentSignature(ctx, cibaSession, request.Signature, *request.Consented, grantedScope, time.Now().UTC())
+		if err != nil {
+			log.Printf("[go-ciba][cibaservice] refused consent signature of ciba session %s. %s\n", cibaSession.AuthReqId, err.Error())
+			return util.ErrInvalidRequest
+		}
+		cibaSession.AttachConsentSignature(device.Id, request.Signature, signedAt)
+	} else if cs.grant.Config.RequireSignedConsent {
+		log.Printf("[go-ciba][cibaservice] refused unsigned consent of ciba session %s\n", cibaSession.AuthReqId)
+		return util.ErrInvalidRequest
+	}
+
+	if *request.Consented {
+		err = cibaSession.Approve(domain.ActorUser)
+		cibaSession.SetGrantedScope(grantedScope)
+	} else {
+		err = cibaSession.Deny(domain.ActorUser)
+	}
+	if err != nil {
 		log.Println(err)
-		return util.ErrGeneral
+		return util.ErrExpiredToken
 	}
 
-	if request.Consented != nil && *request.Consented && clientApp.TokenMode == domain.ModePush {
+	var consent *grantConsent
+	if cibaSession.IsConsented() {
+		consent, err = cs.addGrantConsent(ctx, cibaSession, time.Now().UTC())
+		if err != nil {
+			log.Println(err)
+			return util.ErrGeneral
+		}
+	}
+
+	return cs.completeConsent(ctx, clientApp, cibaSession, consent)
+}
+
+// Stores the consent given to the ciba session, along with the grant of the user when consent isn't nil,
+// and lets the client know.
+func (cs *cibaService) completeConsent(ctx context.Context, clientApp *domain.ClientApplication, cibaSession *domain.CibaSession, consent *grantConsent) *util.OidcError {
+	// Push clients are given their tokens right away, the consent is stored along with them.
+	pushTokens := cibaSession.IsConsented() && clientApp.TokenMode == domain.ModePush
+	if !pushTokens {
+		var err error
+		if consent != nil {
+			// The grant and the approved CIBA session are stored all together or not at all.
+			err = cs.dataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+				if err := consent.save(ctx, tx.GetGrantRepository()); err != nil {
+					return err
+				}
+				return tx.GetCibaSessionRepository().Update(ctx, cibaSession)
+			})
+		} else {
+			err = cs.cibaSessionRepo.Update(ctx, cibaSession)
+		}
+		if err != nil {
+			log.Println(err)
+			return util.ErrGeneral
+		}
+	}
+
+	if pushTokens {
 		extraClaims := make(map[string]interface{})
 		now := util.NowInt()
 
-		key, err := cs.keyRepo.FindPrivateKeyByClientId(cibaSession.ClientId)
+		key, err := cs.keyRepo.FindPrivateKeyByClientId(ctx, cibaSession.ClientId)
 
 		if err != nil {
 			log.Println(err)
@@ -333,7 +548,7 @@ func (cs *cibaService) HandleConsentRequest(request *ConsentRequest) *util.OidcE
 		}
 
 		extraClaims["urn:openid:params:jwt:claim:auth_req_id"] = cibaSession.AuthReqId
-		claims, err := cs.userClaimRepo.GetUserClaims(cibaSession.UserId, cibaSession.Scope)
+		claims, err := cs.userClaimRepo.GetUserClaims(ctx, cibaSession.UserId, cibaSession.GetGrantedScope())
 		if err != nil {
 			log.Println(err)
 			return util.ErrGeneral
@@ -341,6 +556,7 @@ func (cs *cibaService) HandleConsentRequest(request *ConsentRequest) *util.OidcE
 		for k, v := range claims {
 			extraClaims[k] = v
 		}
+		extraClaims = addConsentSignatureClaims(extraClaims, cibaSession, cs.grant.Config)
 
 		tokens := cs.grant.CreateAccessTokenAndIdToken(domain.DefaultCibaIdTokenClaims{
 			DefaultIdTokenClaims: domain.DefaultIdTokenClaims{
@@ -354,59 +570,223 @@ func (cs *cibaService) HandleConsentRequest(request *ConsentRequest) *util.OidcE
 			AuthReqId: cibaSession.AuthReqId,
 		}, extraClaims, key.Private, key.Alg, key.Id)
 
-		cibaSession.Expire()
+		if err := cibaSession.Redeem(domain.ActorSystem); err != nil {
+			log.Println(err)
+			return util.ErrGeneral
+		}
 		cibaSession.IdToken = tokens.IdToken.Value
-
-		if err := cs.cibaSessionRepo.Update(cibaSession); err != nil {
-			log.Printf("[go-ciba][pushtoken] failed updating CIBA session. %s", err.Error())
+		accessToken := domain.NewAccessToken(tokens.AccessToken.Value, cibaSession.ClientId, cibaSession.UserId, cibaSession.GetGrantedScope(), time.Unix(now+tokens.AccessToken.ExpiresIn, 0))
+
+		// The consent, the access token and the redeemed CIBA session are stored all together or not at all.
+		err = cs.dataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+			if consent != nil {
+				if err := consent.save(ctx, tx.GetGrantRepository()); err != nil {
+					return err
+				}
+			}
+			if err := tx.GetAccessTokenRepository().Create(ctx, accessToken); err != nil {
+				return err
+			}
+			return tx.GetCibaSessionRepository().Update(ctx, cibaSession)
+		})
+		if err != nil {
+			log.Printf("[go-ciba][pushtoken] failed storing access token and CIBA session. %s", err.Error())
 			return util.ErrGeneral
 		}
 
-		_ = cs.clientAppNotification.Send(map[string]interface{}{
-			"token_method":              domain.ModePush,
-			"success":                   true,
-			"auth_req_id":               cibaSession.AuthReqId,
-			"access_token":              tokens.AccessToken.Value,
-			"token_type":                tokens.AccessToken.TokenType,
-			"expires_in":                tokens.AccessToken.ExpiresIn,
-			"id_token":                  tokens.IdToken.Value,
-			"client_notification_token": cibaSession.ClientNotificationToken,
-			"endpoint":                  clientApp.ClientNotificationEndpoint,
+		_ = cs.clientAppNotification.NotifyClient(ctx, &transport.ClientPushSuccess{
+			Endpoint:                clientApp.ClientNotificationEndpoint,
+			ClientNotificationToken: cibaSession.ClientNotificationToken,
+			AuthReqId:               cibaSession.AuthReqId,
+			AccessToken:             tokens.AccessToken.Value,
+			TokenType:               tokens.AccessToken.TokenType,
+			ExpiresIn:               tokens.AccessToken.ExpiresIn,
+			IdToken:                 tokens.IdToken.Value,
+			Scope:                   cibaSession.GetGrantedScope(),
+		})
+	} else if clientApp.TokenMode == domain.ModePush {
+		_ = cs.clientAppNotification.NotifyClient(ctx, &transport.ClientPushError{
+			Endpoint:                clientApp.ClientNotificationEndpoint,
+			ClientNotificationToken: cibaSession.ClientNotificationToken,
+			AuthReqId:               cibaSession.AuthReqId,
+			Error:                   util.ErrAccessDenied,
+		})
+	} else if clientApp.TokenMode == domain.ModePing {
+		_ = cs.clientAppNotification.NotifyClient(ctx, &transport.ClientPingCallback{
+			Endpoint:                clientApp.ClientNotificationEndpoint,
+			ClientNotificationToken: cibaSession.ClientNotificationToken,
+			AuthReqId:               cibaSession.AuthReqId,
 		})
-	} else if request.Consented != nil && !*request.Consented && clientApp.TokenMode == domain.ModePush {
-		cibaSession.Consented = request.Consented
+	}
 
-		if err := cs.cibaSessionRepo.Update(cibaSession); err != nil {
-			log.Printf("[go-ciba][pushtoken] failed updating CIBA session. %s", err.Error())
-			return util.ErrGeneral
+	return nil
+}
+
+// Returns the part of the requested scope the user approved, in the requested order. openid is kept
+// as the request is an OpenID Connect one. It fails when a scope that wasn't requested is approved.
+func grantScope(requestedScope string, approvedScopes []string) (string, bool) {
+	if approvedScopes == nil {
+		return requestedScope, true
+	}
+	requested := strings.Fields(requestedScope)
+	approved := make(map[string]bool)
+	for _, scope := range approvedScopes {
+		approved[scope] = true
+	}
+	var granted []string
+	for _, scope := range requested {
+		if scope == "openid" || approved[scope] {
+			granted = append(granted, scope)
 		}
+		delete(approved, scope)
+	}
+	return strings.Join(granted, " "), len(approved) == 0
+}
 
-		_ = cs.clientAppNotification.Send(map[string]interface{}{
-			"token_method":              domain.ModePush,
-			"success":                   false,
-			"oidc_error":                util.ErrAccessDenied,
-			"client_notification_token": cibaSession.ClientNotificationToken,
-			"endpoint":                  clientApp.ClientNotificationEndpoint,
+// Returns the requests of the user waiting for their consent, oldest first.
+func (cs *cibaService) FindPendingConsentRequests(ctx context.Context, userId string) ([]*PendingConsentRequest, *util.OidcError) {
+	cibaSessions, err := cs.cibaSessionRepo.FindPendingByUserId(ctx, userId, time.Now().UTC())
+	if err != nil {
+		log.Printf("[go-ciba][cibaservice] failed finding pending ciba sessions of user %s. %s\n", userId, err.Error())
+		return nil, util.ErrGeneral
+	}
+
+	clientApps := make(map[string]*domain.ClientApplication)
+	requests := make([]*PendingConsentRequest, 0, len(cibaSessions))
+	for _, cibaSession := range cibaSessions {
+		clientApp, found := clientApps[cibaSession.ClientId]
+		if !found {
+			clientApp, err = cs.clientAppRepo.FindById(ctx, cibaSession.ClientId)
+			if err != nil {
+				log.Printf("[go-ciba][cibaservice] failed finding client application %s. %s\n", cibaSession.ClientId, err.Error())
+				return nil, util.ErrGeneral
+			}
+			clientApps[cibaSession.ClientId] = clientApp
+		}
+		// Requests of removed client applications can't be given consent anymore.
+		if clientApp == nil {
+			continue
+		}
+		requests = append(requests, &PendingConsentRequest{
+			AuthReqId:      cibaSession.AuthReqId,
+			ClientId:       clientApp.Id,
+			ClientName:     clientApp.Name,
+			BindingMessage: cibaSession.BindingMessage,
+			Scopes:         strings.Fields(cibaSession.Scope),
+			ExpiresAt:      cibaSession.GetExpiresAt(),
 		})
-	} else if request.Consented != nil && clientApp.TokenMode == domain.ModePing {
-		cibaSession.Consented = request.Consented
+	}
+	return requests, nil
+}
 
-		if err := cs.cibaSessionRepo.Update(cibaSession); err != nil {
-			log.Printf("[go-ciba][pushtoken] failed updating CIBA session. %s", err.Error())
+// Returns the signed consent of the request for audit, or nil when its consent wasn't signed.
+func (cs *cibaService) FindConsentEvidence(ctx context.Context, authReqId string) (*ConsentEvidence, *util.OidcError) {
+	cibaSession, err := cs.cibaSessionRepo.FindById(ctx, authReqId)
+	if err != nil {
+		log.Printf("[go-ciba][cibaservice] failed finding ciba session %s. %s\n", authReqId, err.Error())
+		return nil, util.ErrGeneral
+	}
+	if cibaSession == nil {
+		return nil, util.ErrTransactionFailed
+	}
+	if !cibaSession.IsConsentSigned() {
+		return nil, nil
+	}
+	claims := &ConsentSignatureClaims{}
+	// The signature was verified when the consent was given.
+	if jws, err := jose.ParseSigned(cibaSession.ConsentSignature); err == nil {
+		_ = json.Unmarshal(jws.UnsafePayloadWithoutVerification(), claims)
+	}
+	return &ConsentEvidence{
+		AuthReqId: cibaSession.AuthReqId,
+		UserId:    cibaSession.UserId,
+		DeviceId:  cibaSession.ConsentDeviceId,
+		Signature: cibaSession.ConsentSignature,
+		SignedAt:  *cibaSession.ConsentSignedAt,
+		Claims:    claims,
+	}, nil
+}
+
+// Cancels a pending request of the authenticated client, and withdraws its prompt from the devices
+// of the user. Tokens of a cancelled request are refused with expired_token. Cancelling a cancelled
+// request succeeds, so clients can retry.
+func (cs *cibaService) HandleCancellationRequest(ctx context.Context, request *CancellationRequest) *util.OidcError {
+	clientApp, err := cs.clientAppRepo.FindById(ctx, request.ClientId)
+	if err != nil {
+		log.Printf("[go-ciba][cibaservice] failed finding client application %s. %s\n", request.ClientId, err.Error())
+		return util.ErrGeneral
+	}
+	if clientApp == nil || !cs.authenticationContext.AuthenticateClient(request.r, clientApp) {
+		return util.ErrInvalidClient
+	}
+	if request.AuthReqId == "" {
+		return util.ErrInvalidRequest
+	}
+
+	cibaSession, err := cs.cibaSessionRepo.FindById(ctx, request.AuthReqId)
+	if err != nil {
+		log.Printf("[go-ciba][cibaservice] failed finding ciba session %s. %s\n", request.AuthReqId, err.Error())
+		return util.ErrGeneral
+	}
+	// Answered like an unknown request, so clients can't tell which requests of others exist.
+	if cibaSession == nil || cibaSession.ClientId != clientApp.Id {
+		return util.ErrInvalidGrant
+	}
+
+	if cibaSession.ExpireIfElapsed() {
+		if err := cs.cibaSessionRepo.Update(ctx, cibaSession); err != nil {
+			log.Printf("[go-ciba][cibaservice] failed expiring ciba session %s. %s\n", cibaSession.AuthReqId, err.Error())
 			return util.ErrGeneral
 		}
-
-		_ = cs.clientAppNotification.Send(map[string]interface{}{
-			"token_method":              domain.ModePing,
-			"client_notification_token": cibaSession.ClientNotificationToken,
-			"endpoint":                  clientApp.ClientNotificationEndpoint,
-			"auth_req_id":               cibaSession.AuthReqId,
-		})
+	}
+	if cibaSession.GetStatus() == domain.StatusCancelled {
+		return nil
+	}
+	if err := cibaSession.Cancel(domain.ActorClient); err != nil {
+		log.Printf("[go-ciba][cibaservice] can't cancel ciba session %s, it's %s\n", cibaSession.AuthReqId, cibaSession.GetStatus())
+		return util.ErrExpiredToken
+	}
+	if err := cs.cibaSessionRepo.Update(ctx, cibaSession); err != nil {
+		log.Printf("[go-ciba][cibaservice] failed cancelling ciba session %s. %s\n", cibaSession.AuthReqId, err.Error())
+		return util.ErrGeneral
 	}
 
+	cs.withdrawPrompt(ctx, cibaSession)
 	return nil
 }
 
+// Tells the devices the prompt was sent to it's withdrawn, when the notifier can. Failures are only
+// logged, a withdrawn prompt the user still answers is refused anyway.
+func (cs *cibaService) withdrawPrompt(ctx context.Context, ciba *domain.CibaSession) {
+	notifier, ok := cs.notificationClient.(transport.WithdrawalNotifier)
+	if !ok {
+		return
+	}
+	devices, err := cs.userDeviceRepo.FindActiveByUserId(ctx, ciba.UserId)
+	if err != nil {
+		log.Printf("[go-ciba][cibaservice] failed finding devices of user %s. %s\n", ciba.UserId, err.Error())
+		return
+	}
+	inCharge := false
+	for _, device := range devices {
+		err := notifier.NotifyWithdrawal(ctx, transport.NewUserConsentWithdrawal(ciba, device))
+		if errors.Is(err, transport.ErrDevicePrompt) {
+			continue
+		}
+		inCharge = true
+		if err != nil {
+			log.Printf("[go-ciba][cibaservice] failed withdrawing consent prompt of ciba session %s. %s\n", ciba.AuthReqId, err.Error())
+		}
+	}
+	if inCharge {
+		return
+	}
+	// The prompt went out without a device, so does its withdrawal.
+	if err := notifier.NotifyWithdrawal(ctx, transport.NewUserConsentWithdrawal(ciba, nil)); err != nil {
+		log.Printf("[go-ciba][cibaservice] failed withdrawing consent prompt of ciba session %s. %s\n", ciba.AuthReqId, err.Error())
+	}
+}
+
 func (cs *cibaService) GetGrantIdentifier() string {
 	return cs.grant.GetIdentifier()
 }
@@ -1,20 +1,27 @@
 package service
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/adisazhar123/go-ciba/domain"
 	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/memory"
 	"github.com/adisazhar123/go-ciba/service/http_auth"
+	"github.com/adisazhar123/go-ciba/service/transport"
 	"github.com/adisazhar123/go-ciba/test_data"
 	"github.com/adisazhar123/go-ciba/util"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
 )
 
 type UserAccountVolatileRepository struct {
@@ -32,7 +39,7 @@ func newUserAccountVolatileRepository() *UserAccountVolatileRepository {
 	}
 }
 
-func (u UserAccountVolatileRepository) FindById(id string) (*domain.UserAccount, error) {
+func (u UserAccountVolatileRepository) FindById(ctx context.Context, id string) (*domain.UserAccount, error) {
 	key := fmt.Sprintf("user_account:%s", id)
 	user, exist := u.data[key]
 	if !exist {
@@ -46,17 +53,104 @@ func newAuthenticationContext() *http_auth.ClientAuthenticationContext {
 	return &http_auth.ClientAuthenticationContext{}
 }
 
+// In memory mock of DataStoreInterface, its transactions run fn on the data store itself.
+type dataStoreMock struct {
+	accessTokenRepo repository.AccessTokenRepositoryInterface
+	cibaSessionRepo repository.CibaSessionRepositoryInterface
+	clientAppRepo   repository.ClientApplicationRepositoryInterface
+	keyRepo         repository.KeyRepositoryInterface
+	signingKeyRepo  repository.SigningKeyRepositoryInterface
+	userAccountRepo repository.UserAccountRepositoryInterface
+	userClaimRepo   repository.UserClaimRepositoryInterface
+	userDeviceRepo  repository.UserDeviceRepositoryInterface
+	grantRepo       repository.GrantRepositoryInterface
+	scopeRepo       repository.ScopeRepositoryInterface
+	transactions    int
+}
+
+func (d *dataStoreMock) HaveTransactionSupport() bool {
+	return false
+}
+
+func (d *dataStoreMock) WithinTransaction(ctx context.Context, fn func(tx repository.DataStoreInterface) error) error {
+	d.transactions++
+	return fn(d)
+}
+
+func (d *dataStoreMock) GetAccessTokenRepository() repository.AccessTokenRepositoryInterface {
+	return d.accessTokenRepo
+}
+
+func (d *dataStoreMock) GetCibaSessionRepository() repository.CibaSessionRepositoryInterface {
+	return d.cibaSessionRepo
+}
+
+func (d *dataStoreMock) GetClientApplicationRepository() repository.ClientApplicationRepositoryInterface {
+	return d.clientAppRepo
+}
+
+func (d *dataStoreMock) GetKeyRepository() repository.KeyRepositoryInterface {
+	return d.keyRepo
+}
+
+func (d *dataStoreMock) GetSigningKeyRepository() repository.SigningKeyRepositoryInterface {
+	return d.signingKeyRepo
+}
+
+func (d *dataStoreMock) GetUserAccountRepository() repository.UserAccountRepositoryInterface {
+	return d.userAccountRepo
+}
+
+func (d *dataStoreMock) GetUserClaimRepository() repository.UserClaimRepositoryInterface {
+	return d.userClaimRepo
+}
+
+func (d *dataStoreMock) GetUserDeviceRepository() repository.UserDeviceRepositoryInterface {
+	return d.userDeviceRepo
+}
+
+func (d *dataStoreMock) GetGrantRepository() repository.GrantRepositoryInterface {
+	return d.grantRepo
+}
+
+func (d *dataStoreMock) GetScopeRepository() repository.ScopeRepositoryInterface {
+	return d.scopeRepo
+}
+
 type notificationClientMock struct{}
 
-func (n notificationClientMock) Send(data map[string]interface{}) error {
+func (n notificationClientMock) NotifyUser(ctx context.Context, prompt *transport.UserConsentPrompt) error {
 	return nil
 }
 
+// Returns a scope repository holding the scopes of the test client applications.
+func newScopeRepository() repository.ScopeRepositoryInterface {
+	ds := memory.NewDataStore()
+	ds.AddScope("email", "email")
+	ds.AddScope("profile", "name")
+	return ds.GetScopeRepository()
+}
+
 func newCibaService() *cibaService {
+	dataStore := &dataStoreMock{
+		accessTokenRepo: test_data.NewAccessTokenVolatileRepository(),
+		cibaSessionRepo: test_data.NewCibaSessionVolatileRepository(),
+		clientAppRepo:   test_data.NewClientApplicationVolatileRepository(),
+		keyRepo:         test_data.NewKeyVolatileRepository(),
+		userAccountRepo: newUserAccountVolatileRepository(),
+		userClaimRepo:   test_data.NewUserClaimVolatileRepository(),
+		userDeviceRepo:  memory.NewDataStore().GetUserDeviceRepository(),
+		grantRepo:       memory.NewDataStore().GetGrantRepository(),
+		scopeRepo:       newScopeRepository(),
+	}
 	return &cibaService{
-		clientAppRepo:                   test_data.NewClientApplicationVolatileRepository(),
-		userAccountRepo:                 newUserAccountVolatileRepository(),
-		cibaSessionRepo:                 test_data.NewCibaSessionVolatileRepository(),
+		dataStore:                       dataStore,
+		clientAppRepo:                   dataStore.clientAppRepo,
+		userAccountRepo:                 dataStore.userAccountRepo,
+		cibaSessionRepo:                 dataStore.cibaSessionRepo,
+		userDeviceRepo:                  dataStore.userDeviceRepo,
+		grantRepo:                       dataStore.grantRepo,
+		scopeRepo:                       dataStore.scopeRepo,
 		scopeUtil:                       util.ScopeUtil{},
 		authenticationContext:           newAuthenticationContext(),
 		grant:                           grant.NewCibaGrant(),
@@ -98,7 +192,7 @@ func TestCibaService_HandleAuthenticationRequest_Valid_Ping(t *testing.T) {
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	authRes, err := cs.HandleAuthenticationRequest(authReq)
+	authRes, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Empty(t, err)
 	assert.Empty(t, authRes.Interval)
@@ -106,6 +200,144 @@ func TestCibaService_HandleAuthenticationRequest_Valid_Ping(t *testing.T) {
 	assert.NotEmpty(t, authRes.AuthReqId)
 }
 
+type recordingUserNotifierMock struct {
+	prompts     []*transport.UserConsentPrompt
+	withdrawals []*transport.UserConsentWithdrawal
+	// Push tokens of the devices that can't be reached.
+	unreachable map[string]bool
+}
+
+func (n *recordingUserNotifierMock) NotifyUser(ctx context.Context, prompt *transport.UserConsentPrompt) error {
+	if prompt.Device != nil && n.unreachable[prompt.Device.PushToken] {
+		return fmt.Errorf("device %s is unreachable", prompt.Device.Id)
+	}
+	n.prompts = append(n.prompts, prompt)
+	return nil
+}
+
+func (n *recordingUserNotifierMock) NotifyWithdrawal(ctx context.Context, withdrawal *transport.UserConsentWithdrawal) error {
+	n.withdrawals = append(n.withdrawals, withdrawal)
+	return nil
+}
+
+func newPingAuthenticationRequest() *AuthenticationRequest {
+	auth := createAuthorizationHeaderBasic(test_data.ClientAppPing.Id, test_data.ClientAppPing.Secret)
+	form := url.Values{}
+	form.Set("scope", test_data.ClientAppPing.Scope)
+	form.Set("client_notification_token", util.GenerateRandomString())
+	form.Set("login_hint", test_data.User1.Id)
+	form.Set("binding_message", "aa-123")
+	request, _ := http.NewRequest(http.MethodPost, "ciba.example.com/bc-authorize", strings.NewReader(form.Encode()))
+	request.Header.Add("Authorization", fmt.Sprintf("Basic %s", auth))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return NewAuthenticationRequest(request)
+}
+
+func TestCibaService_HandleAuthenticationRequest_ShouldPromptEveryActiveDevice(t *testing.T) {
+	cs := newCibaService()
+	notifier := &recordingUserNotifierMock{}
+	cs.notificationClient = notifier
+	phone := domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformAndroid, "phone", "Phone", "")
+	tablet := domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformIos, "tablet", "Tablet", "")
+	tablet.Touch(tablet.LastSeenAt.Add(time.Minute))
+	old := domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformWeb, "old", "Old", "")
+	old.Deregister(old.CreatedAt)
+	for _, device := range []*domain.UserDevice{phone, tablet, old} {
+		_ = cs.userDeviceRepo.Create(context.Background(), device)
+	}
+
+	authRes, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+	assert.Nil(t, err)
+	assert.Len(t, notifier.prompts, 2)
+	assert.Equal(t, tablet.Id, notifier.prompts[0].Device.Id)
+	assert.Equal(t, phone.Id, notifier.prompts[1].Device.Id)
+	assert.Equal(t, authRes.AuthReqId, notifier.prompts[0].AuthReqId)
+	assert.Equal(t, test_data.User1.Id, notifier.prompts[0].UserId)
+}
+
+func TestCibaService_HandleAuthenticationRequest_ShouldPromptWithoutDevice_WhenUserHasNone(t *testing.T) {
+	cs := newCibaService()
+	notifier := &recordingUserNotifierMock{}
+	cs.notificationClient = notifier
+
+	_, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+	assert.Nil(t, err)
+	assert.Len(t, notifier.prompts, 1)
+	assert.Nil(t, notifier.prompts[0].Device)
+	assert.Equal(t, test_data.User1.Id, notifier.prompts[0].Hint)
+}
+
+func TestCibaService_HandleAuthenticationRequest_ShouldSucceed_WhenOneDeviceIsReached(t *testing.T) {
+	cs := newCibaService()
+	notifier := &recordingUserNotifierMock{unreachable: map[string]bool{"phone": true}}
+	cs.notificationClient = notifier
+	_ = cs.userDeviceRepo.Create(context.Background(), domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformAndroid, "phone", "Phone", ""))
+	_ = cs.userDeviceRepo.Create(context.Background(), domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformIos, "tablet", "Tablet", ""))
+
+	_, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+	assert.Nil(t, err)
+	assert.Len(t, notifier.prompts, 1)
+	assert.Equal(t, "tablet", notifier.prompts[0].Device.PushToken)
+}
+
+func TestCibaService_HandleAuthenticationRequest_ShouldFail_WhenNoDeviceIsReached(t *testing.T) {
+	cs := newCibaService()
+	cs.notificationClient = &recordingUserNotifierMock{unreachable: map[string]bool{"phone": true}}
+	_ = cs.userDeviceRepo.Create(context.Background(), domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformAndroid, "phone", "Phone", ""))
+
+	authRes, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+	assert.Nil(t, authRes)
+	assert.Equal(t, util.ErrGeneral, err)
+}
+
+// Notifier standing in for a transport that only delivers prompts without a device, like the email one.
+type deviceLessNotifierMock struct {
+	prompts []*transport.UserConsentPrompt
+}
+
+func (n *deviceLessNotifierMock) NotifyUser(ctx context.Context, prompt *transport.UserConsentPrompt) error {
+	if prompt.Device != nil {
+		return transport.ErrDevicePrompt
+	}
+	n.prompts = append(n.prompts, prompt)
+	return nil
+}
+
+func TestCibaService_HandleAuthenticationRequest_ShouldPromptWithoutDevice_WhenNoTransportReachesDevices(t *testing.T) {
+	cs := newCibaService()
+	email := &deviceLessNotifierMock{}
+	cs.notificationClient = email
+	_ = cs.userDeviceRepo.Create(context.Background(), domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformAndroid, "phone", "Phone", ""))
+
+	_, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+	assert.Nil(t, err)
+	if assert.Len(t, email.prompts, 1) {
+		assert.Nil(t, email.prompts[0].Device)
+	}
+}
+
+func TestCibaService_HandleAuthenticationRequest_ShouldPromptDevices_ThroughMultiNotifier(t *testing.T) {
+	cs := newCibaService()
+	email := &deviceLessNotifierMock{}
+	mobile := &recordingUserNotifierMock{}
+	cs.notificationClient = transport.NewMultiNotifier(email, mobile)
+	phone := domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformAndroid, "phone", "Phone", "")
+	_ = cs.userDeviceRepo.Create(context.Background(), phone)
+
+	_, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+	assert.Nil(t, err)
+	assert.Empty(t, email.prompts)
+	if assert.Len(t, mobile.prompts, 1) {
+		assert.Equal(t, phone.Id, mobile.prompts[0].Device.Id)
+	}
+}
+
 // Tests a Ciba request with client application registered as ping mode and also requires a user code
 // user code parameter is given
 // expected to succeed/ no error.
@@ -127,7 +359,7 @@ func TestCibaService_HandleAuthenticationRequest_Valid_WithUserCode_Ping(t *test
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	authRes, err := cs.HandleAuthenticationRequest(authReq)
+	authRes, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Empty(t, err)
 	assert.Empty(t, authRes.Interval)
@@ -157,7 +389,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_ClientId_ClientCredenti
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrUnauthorizedClient.Error())
 	assert.Nil(t, res)
@@ -183,7 +415,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_Password_ClientCredenti
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrInvalidClient.Error())
@@ -211,7 +443,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_MultipleHints_Ping(t *t
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrInvalidRequest.Error())
@@ -237,7 +469,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_UnregisteredScope_Ping(
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrInvalidScope.Error())
@@ -262,7 +494,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_ClientAppNotRegisteredT
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrUnauthorizedClient.Error())
@@ -288,7 +520,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_ClientAppPingWithoutNot
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrInvalidRequest.Error())
@@ -314,7 +546,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_ClientAppPushWithoutNot
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrInvalidRequest.Error())
@@ -341,7 +573,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_BindingMessageTooLong(t
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrInvalidBindingMessage.Error())
@@ -364,7 +596,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_UserCodeNotGiven(t *tes
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrMissingUserCode.Error())
@@ -388,7 +620,7 @@ func TestCibaService_HandleAuthenticationRequest_Invalid_WrongUserCode(t *testin
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	res, err := cs.HandleAuthenticationRequest(authReq)
+	res, err := cs.HandleAuthenticationRequest(context.Background(), authReq)
 
 	assert.Nil(t, res)
 	assert.EqualError(t, err, util.ErrInvalidUserCode.Error())
@@ -412,7 +644,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_InvalidClientApp(t
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrUnauthorizedClient.Error())
 }
@@ -435,7 +667,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_IncorrectClientAppC
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrInvalidClient.Error())
 }
@@ -458,7 +690,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_NotRegisteredToUseC
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrUnauthorizedClient.Error())
 }
@@ -482,7 +714,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_MultipleLoginHint(t
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrInvalidRequest.Error())
 }
@@ -504,7 +736,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_UserNotFound(t *tes
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrUnknownUserId.Error())
 }
@@ -526,11 +758,53 @@ func TestCibaService_ValidateAuthenticationRequestParameters_InvalidScope(t *tes
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrInvalidScope.Error())
 }
 
+func newPingValidationRequest(userCode string) *AuthenticationRequest {
+	auth := createAuthorizationHeaderBasic(test_data.ClientAppPing.Id, test_data.ClientAppPing.Secret)
+
+	form := url.Values{}
+	form.Set("scope", test_data.ClientAppPing.Scope)
+	form.Set("login_hint", test_data.User3.Id)
+	form.Set("binding_message", "aa-123")
+	form.Set("requested_expiry", "120")
+	form.Set("client_notification_token", "41217fd5-10dc-46e8-8151-27b7edf372fa")
+	if userCode != "" {
+		form.Set("user_code", userCode)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, "ciba.example.com/bc-authorize", strings.NewReader(form.Encode()))
+	request.Header.Add("Authorization", fmt.Sprintf("Basic %s", auth))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	return NewAuthenticationRequest(request)
+}
+
+func TestCibaService_ValidateAuthenticationRequestParameters_ScopeIsNotRegistered(t *testing.T) {
+	cs := newCibaService()
+	_ = cs.scopeRepo.DeleteScope(context.Background(), "profile")
+
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), newPingValidationRequest(""))
+
+	assert.EqualError(t, err, util.ErrInvalidScope.Error())
+}
+
+func TestCibaService_ValidateAuthenticationRequestParameters_ScopeRequiresUserCode(t *testing.T) {
+	cs := newCibaService()
+	_ = cs.scopeRepo.UpdateScope(context.Background(), &domain.Scope{Name: "email", Claims: []string{"email"}, RequiresUserCode: true})
+
+	missingErr := cs.ValidateAuthenticationRequestParameters(context.Background(), newPingValidationRequest(""))
+	invalidErr := cs.ValidateAuthenticationRequestParameters(context.Background(), newPingValidationRequest("wrong"))
+	validErr := cs.ValidateAuthenticationRequestParameters(context.Background(), newPingValidationRequest(test_data.User3.UserCode))
+
+	assert.EqualError(t, missingErr, util.ErrMissingUserCode.Error())
+	assert.EqualError(t, invalidErr, util.ErrInvalidUserCode.Error())
+	assert.Nil(t, validErr)
+}
+
 func TestCibaService_ValidateAuthenticationRequestParameters_ClientNotificationTokenIsMissingWhenClientAppIsPing(t *testing.T) {
 	cs := newCibaService()
 	auth := createAuthorizationHeaderBasic(test_data.ClientAppPing.Id, test_data.ClientAppPing.Secret)
@@ -547,7 +821,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_ClientNotificationT
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrInvalidRequest.Error())
 }
@@ -568,7 +842,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_ClientNotificationT
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrInvalidRequest.Error())
 }
@@ -590,7 +864,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_BindingMessageTooLo
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrInvalidBindingMessage.Error())
 }
@@ -612,7 +886,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_UserCodeIsMissing(t
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrMissingUserCode.Error())
 }
@@ -635,7 +909,7 @@ func TestCibaService_ValidateAuthenticationRequestParameters_UserCodeIsInvalid(t
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
 
 	assert.EqualError(t, err, util.ErrInvalidUserCode.Error())
 }
@@ -658,7 +932,389 @@ func TestCibaService_ValidateAuthenticationRequestParameters_ShouldSucceed(t *te
 	request.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
 	authReq := NewAuthenticationRequest(request)
-	err := cs.ValidateAuthenticationRequestParameters(authReq)
+	err := cs.ValidateAuthenticationRequestParameters(context.Background(), authReq)
+
+	assert.Nil(t, err)
+}
+
+type keyRepositoryMock struct {
+	key *domain.Key
+}
+
+func (k *keyRepositoryMock) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
+	return k.key, nil
+}
+
+func TestCibaService_HandleConsentRequest_ShouldStoreAccessTokenAndRedeemSession_WhenPushClientIsGivenConsent(t *testing.T) {
+	cs := newCibaService()
+	dataStore := cs.dataStore.(*dataStoreMock)
+	cs.keyRepo = &keyRepositoryMock{key: &test_data.Key1}
+	cs.userClaimRepo = dataStore.userClaimRepo
+	notification := &recordingNotificationMock{}
+	cs.clientAppNotification = notification
+	interval := int64(5)
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPush, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, &interval)
+	cibaSession.UserId = test_data.User1.Id
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := true
+
+	err := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(cibaSession.UserId, cibaSession.AuthReqId, &consented))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dataStore.transactions)
+	assert.Equal(t, domain.StatusRedeemed, cibaSession.GetStatus())
+	assert.Len(t, notification.sent, 1)
+	accessToken, _ := dataStore.accessTokenRepo.Find(context.Background(), notification.sent[0].(*transport.ClientPushSuccess).AccessToken)
+	assert.NotNil(t, accessToken)
+	assert.Equal(t, cibaSession.UserId, accessToken.UserId)
+}
+
+func TestCibaService_HandleConsentRequest_ShouldNotifyPushClientOfDenial(t *testing.T) {
+	cs := newCibaService()
+	notification := &recordingNotificationMock{}
+	cs.clientAppNotification = notification
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPush, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := false
+
+	err := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(cibaSession.UserId, cibaSession.AuthReqId, &consented))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []transport.ClientMessage{&transport.ClientPushError{
+		Endpoint:                test_data.ClientAppPush.ClientNotificationEndpoint,
+		ClientNotificationToken: cibaSession.ClientNotificationToken,
+		AuthReqId:               cibaSession.AuthReqId,
+		Error:                   util.ErrAccessDenied,
+	}}, notification.sent)
+}
+
+func TestCibaService_HandleConsentRequest_ShouldOnlyUpdateSession_WhenPingClientIsGivenConsent(t *testing.T) {
+	cs := newCibaService()
+	dataStore := cs.dataStore.(*dataStoreMock)
+	cs.clientAppNotification = &recordingNotificationMock{}
+	interval := int64(5)
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, &interval)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := true
+
+	err := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(cibaSession.UserId, cibaSession.AuthReqId, &consented))
+
+	assert.Nil(t, err)
+	// The one storing the grant along with the session, no tokens are issued.
+	assert.Equal(t, 1, dataStore.transactions)
+	assert.Equal(t, domain.StatusApproved, cibaSession.GetStatus())
+}
+
+func TestCibaService_HandleConsentRequest_ShouldLetPingClientRedeemTokens_WithMemoryDataStore(t *testing.T) {
+	ds := memory.NewDataStore()
+	key := test_data.Key1
+	key.ClientId = test_data.ClientAppPing.Id
+	ds.AddKey(&key)
+	ds.AddUserAccount(&test_data.User1)
+	ds.AddScope("email", "email")
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPing)
+	cs := NewCibaService(ds, &notificationClientMock{}, grant.NewCibaGrant(), defaultValidateClientNotificationToken)
+	cs.clientAppNotification = &recordingNotificationMock{}
+	ts := NewTokenService(ds, grant.NewCibaGrant())
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid email", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+	consented := true
+
+	consentErr := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(cibaSession.UserId, cibaSession.AuthReqId, &consented))
+	tokens, tokenErr := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  test_data.ClientAppPing.Id,
+		authReqId: cibaSession.AuthReqId,
+	})
+	_, replayErr := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  test_data.ClientAppPing.Id,
+		authReqId: cibaSession.AuthReqId,
+	})
+
+	assert.Nil(t, consentErr)
+	assert.Nil(t, tokenErr)
+	accessToken, _ := ds.GetAccessTokenRepository().Find(context.Background(), tokens.AccessToken.Value)
+	assert.NotNil(t, accessToken)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+	assert.Equal(t, domain.StatusRedeemed, stored.GetStatus())
+	assert.EqualError(t, replayErr, util.ErrExpiredToken.Error())
+}
+
+func TestCibaService_HandleConsentRequest_ShouldRefuseConsent_WhenRequestIsOfAnotherUser(t *testing.T) {
+	cs := newCibaService()
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := true
+
+	err := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(test_data.User2.Id, cibaSession.AuthReqId, &consented))
+
+	assert.Equal(t, util.ErrTransactionFailed, err)
+	assert.Equal(t, domain.StatusPending, cibaSession.GetStatus())
+}
+
+func TestCibaService_HandleConsentRequest_ShouldTakeConsent_WhenRequestIsOfTheUser(t *testing.T) {
+	cs := newCibaService()
+	cs.clientAppNotification = &recordingNotificationMock{}
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := false
+
+	err := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(test_data.User1.Id, cibaSession.AuthReqId, &consented))
+
+	assert.Nil(t, err)
+	assert.Equal(t, domain.StatusDenied, cibaSession.GetStatus())
+}
+
+func TestCibaService_HandleConsentRequest_ShouldRefuseAnonymousConsent(t *testing.T) {
+	cs := newCibaService()
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := true
+
+	err := cs.HandleConsentRequest(context.Background(), NewConsentRequest(cibaSession.AuthReqId, &consented))
+
+	assert.Equal(t, util.ErrInvalidRequest, err)
+	assert.Equal(t, domain.StatusPending, cibaSession.GetStatus())
+}
+
+func TestCibaService_HandleTrustedConsentRequest_ShouldTakeConsentWithoutUser(t *testing.T) {
+	cs := newCibaService()
+	cs.clientAppNotification = &recordingNotificationMock{}
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := false
+
+	err := cs.HandleTrustedConsentRequest(context.Background(), NewConsentRequest(cibaSession.AuthReqId, &consented))
+
+	assert.Nil(t, err)
+	assert.Equal(t, domain.StatusDenied, cibaSession.GetStatus())
+}
+
+func TestCibaService_FindPendingConsentRequests_ShouldReturnPendingRequestsOfUser(t *testing.T) {
+	ds := memory.NewDataStore()
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPing)
+	cs := NewCibaService(ds, &notificationClientMock{}, grant.NewCibaGrant(), defaultValidateClientNotificationToken)
+	pending := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "W4SCT", "client-notification-token", "openid email", 3600, nil)
+	denied := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = denied.Deny(domain.ActorUser)
+	ofOtherUser := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User2.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	for _, cibaSession := range []*domain.CibaSession{pending, denied, ofOtherUser} {
+		_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+	}
+
+	requests, err := cs.FindPendingConsentRequests(context.Background(), test_data.User1.Id)
+
+	assert.Nil(t, err)
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, pending.AuthReqId, requests[0].AuthReqId)
+		assert.Equal(t, test_data.ClientAppPing.Id, requests[0].ClientId)
+		assert.Equal(t, test_data.ClientAppPing.Name, requests[0].ClientName)
+		assert.Equal(t, "W4SCT", requests[0].BindingMessage)
+		assert.Equal(t, []string{"openid", "email"}, requests[0].Scopes)
+		assert.Equal(t, pending.GetExpiresAt(), requests[0].ExpiresAt)
+	}
+}
+
+func TestGrantScope(t *testing.T) {
+	tests := []struct {
+		approved []string
+		granted  string
+		ok       bool
+	}{
+		{nil, "openid email profile", true},
+		{[]string{"profile"}, "openid profile", true},
+		{[]string{"profile", "openid", "email"}, "openid email profile", true},
+		{[]string{}, "openid", true},
+		{[]string{"address"}, "", false},
+	}
+	for _, test := range tests {
+		granted, ok := grantScope("openid email profile", test.approved)
+
+		assert.Equal(t, test.ok, ok, test.approved)
+		if test.ok {
+			assert.Equal(t, test.granted, granted, test.approved)
+		}
+	}
+}
+
+func TestCibaService_HandleConsentRequest_ShouldIssueTokensForApprovedScopesOnly(t *testing.T) {
+	ds := memory.NewDataStore()
+	key := test_data.Key1
+	key.ClientId = test_data.ClientAppPing.Id
+	ds.AddKey(&key)
+	ds.AddUserAccount(&test_data.User1)
+	ds.AddScope("email", "email")
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPing)
+	cs := NewCibaService(ds, &notificationClientMock{}, grant.NewCibaGrant(), defaultValidateClientNotificationToken)
+	cs.clientAppNotification = &recordingNotificationMock{}
+	ts := NewTokenService(ds, grant.NewCibaGrant())
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid email", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+	consented := true
+	request := NewUserConsentRequest(test_data.User1.Id, cibaSession.AuthReqId, &consented)
+	request.ApprovedScopes = []string{}
+
+	consentErr := cs.HandleConsentRequest(context.Background(), request)
+	tokens, tokenErr := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  test_data.ClientAppPing.Id,
+		authReqId: cibaSession.AuthReqId,
+	})
+
+	assert.Nil(t, consentErr)
+	assert.Nil(t, tokenErr)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+	assert.Equal(t, "openid email", stored.Scope)
+	assert.Equal(t, "openid", stored.GetGrantedScope())
+	accessToken, _ := ds.GetAccessTokenRepository().Find(context.Background(), tokens.AccessToken.Value)
+	assert.Equal(t, "openid", accessToken.Scope)
+	assert.Equal(t, "openid", makeSuccessfulTokenResponse(tokens).Scope)
+	idToken, _ := jose.ParseSigned(tokens.IdToken.Value)
+	claims := make(map[string]interface{})
+	_ = json.Unmarshal(idToken.UnsafePayloadWithoutVerification(), &claims)
+	assert.NotContains(t, claims, "email")
+}
+
+func TestCibaService_HandleConsentRequest_ShouldReturnInvalidScope_WhenApprovedScopeWasNotRequested(t *testing.T) {
+	cs := newCibaService()
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := true
+	request := NewUserConsentRequest(test_data.User1.Id, cibaSession.AuthReqId, &consented)
+	request.ApprovedScopes = []string{"email"}
+
+	err := cs.HandleConsentRequest(context.Background(), request)
+
+	assert.Equal(t, util.ErrInvalidScope, err)
+	assert.Equal(t, domain.StatusPending, cibaSession.GetStatus())
+}
+
+func TestCibaService_HandleConsentRequest_ShouldReturnInvalidScope_WhenNoRequestedScopeIsApproved(t *testing.T) {
+	cs := newCibaService()
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "email profile", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	consented := true
+	request := NewUserConsentRequest(test_data.User1.Id, cibaSession.AuthReqId, &consented)
+	request.ApprovedScopes = []string{}
+
+	err := cs.HandleConsentRequest(context.Background(), request)
+
+	assert.Equal(t, util.ErrInvalidScope, err)
+	assert.Equal(t, domain.StatusPending, cibaSession.GetStatus())
+	assert.Nil(t, cibaSession.GrantedScope)
+}
+
+func newCancellationRequest(clientApp domain.ClientApplication, authReqId string) *CancellationRequest {
+	form := url.Values{}
+	form.Set("auth_req_id", authReqId)
+	request, _ := http.NewRequest(http.MethodPost, "ciba.example.com/bc-cancel", strings.NewReader(form.Encode()))
+	request.Header.Add("Authorization", fmt.Sprintf("Basic %s", createAuthorizationHeaderBasic(clientApp.Id, clientApp.Secret)))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return NewCancellationRequest(request)
+}
+
+func TestCibaService_HandleCancellationRequest_ShouldCancelAndWithdrawPrompts(t *testing.T) {
+	ds := memory.NewDataStore()
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPing)
+	notifier := &recordingUserNotifierMock{}
+	cs := NewCibaService(ds, notifier, grant.NewCibaGrant(), defaultValidateClientNotificationToken)
+	ts := NewTokenService(ds, grant.NewCibaGrant())
+	phone := domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformAndroid, "phone", "Phone", "")
+	_ = ds.GetUserDeviceRepository().Create(context.Background(), phone)
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+
+	err := cs.HandleCancellationRequest(context.Background(), newCancellationRequest(test_data.ClientAppPing, cibaSession.AuthReqId))
+	retryErr := cs.HandleCancellationRequest(context.Background(), newCancellationRequest(test_data.ClientAppPing, cibaSession.AuthReqId))
+	_, tokenErr := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  test_data.ClientAppPing.Id,
+		authReqId: cibaSession.AuthReqId,
+	})
+	consented := true
+	consentErr := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(cibaSession.UserId, cibaSession.AuthReqId, &consented))
 
 	assert.Nil(t, err)
+	assert.Nil(t, retryErr)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+	assert.Equal(t, domain.StatusCancelled, stored.GetStatus())
+	assert.Equal(t, util.ErrExpiredToken, tokenErr)
+	assert.Equal(t, util.ErrExpiredToken, consentErr)
+	assert.Len(t, notifier.withdrawals, 1)
+	assert.Equal(t, cibaSession.AuthReqId, notifier.withdrawals[0].AuthReqId)
+	assert.Equal(t, phone.Id, notifier.withdrawals[0].Device.Id)
+}
+
+func receivePromptEvent(t *testing.T, subscription *transport.PromptSubscription) *transport.PromptEvent {
+	select {
+	case event := <-subscription.C:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no prompt event delivered")
+		return nil
+	}
+}
+
+func TestCibaService_ShouldPromptAndWithdrawThroughHub_WhenUserOnlyHasMobileDevices(t *testing.T) {
+	cs := newCibaService()
+	hub := transport.NewPromptHub()
+	cs.notificationClient = hub
+	_ = cs.userDeviceRepo.Create(context.Background(), domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformAndroid, "phone", "Phone", ""))
+	subscription := hub.Subscribe(test_data.User1.Id)
+	defer subscription.Close()
+
+	res, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+	assert.Nil(t, err)
+	prompted := receivePromptEvent(t, subscription)
+	if assert.NotNil(t, prompted.Prompt) {
+		assert.Equal(t, res.AuthReqId, prompted.Prompt.AuthReqId)
+		assert.Nil(t, prompted.Prompt.Device)
+	}
+
+	cancelErr := cs.HandleCancellationRequest(context.Background(), newCancellationRequest(test_data.ClientAppPing, res.AuthReqId))
+
+	assert.Nil(t, cancelErr)
+	withdrawn := receivePromptEvent(t, subscription)
+	if assert.NotNil(t, withdrawn.Withdrawal) {
+		assert.Equal(t, res.AuthReqId, withdrawn.Withdrawal.AuthReqId)
+	}
+}
+
+func TestCibaService_HandleCancellationRequest_ShouldRefuse_WhenRequestIsOfAnotherClient(t *testing.T) {
+	cs := newCibaService()
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+
+	err := cs.HandleCancellationRequest(context.Background(), newCancellationRequest(test_data.ClientAppPoll, cibaSession.AuthReqId))
+	unknownErr := cs.HandleCancellationRequest(context.Background(), newCancellationRequest(test_data.ClientAppPoll, "unknown"))
+
+	assert.Equal(t, util.ErrInvalidGrant, err)
+	assert.Equal(t, util.ErrInvalidGrant, unknownErr)
+	assert.Equal(t, domain.StatusPending, cibaSession.GetStatus())
+}
+
+func TestCibaService_HandleCancellationRequest_ShouldRefuse_WhenClientIsNotAuthenticated(t *testing.T) {
+	cs := newCibaService()
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+	clientApp := test_data.ClientAppPing
+	clientApp.Secret = "wrong-secret"
+
+	err := cs.HandleCancellationRequest(context.Background(), newCancellationRequest(clientApp, cibaSession.AuthReqId))
+
+	assert.Equal(t, util.ErrInvalidClient, err)
+	assert.Equal(t, domain.StatusPending, cibaSession.GetStatus())
+}
+
+func TestCibaService_HandleCancellationRequest_ShouldRefuse_WhenRequestWasAnswered(t *testing.T) {
+	cs := newCibaService()
+	notifier := &recordingUserNotifierMock{}
+	cs.notificationClient = notifier
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cibaSession.Approve(domain.ActorUser)
+	_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+
+	err := cs.HandleCancellationRequest(context.Background(), newCancellationRequest(test_data.ClientAppPing, cibaSession.AuthReqId))
+
+	assert.Equal(t, util.ErrExpiredToken, err)
+	assert.Equal(t, domain.StatusApproved, cibaSession.GetStatus())
+	assert.Empty(t, notifier.withdrawals)
 }
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	ConsentDecisionApprove = "approve"
+	ConsentDecisionDeny    = "deny"
+	// The amr of ID tokens issued for consent signed by a device, proof of possession of its key.
+	AmrProofOfPossession = "pop"
+	// How far ahead of the server the clock of a device may be.
+	consentSignatureLeeway = 30 * time.Second
+)
+
+var consentSignatureAlgs = map[string]bool{
+	string(jose.RS256): true,
+	string(jose.PS256): true,
+	string(jose.ES256): true,
+	string(jose.ES384): true,
+	string(jose.EdDSA): true,
+}
+
+// The payload a device signs its consent decision with, as a JWS with the device ID as kid.
+type ConsentSignatureClaims struct {
+	AuthReqId string `json:"auth_req_id"`
+	// ConsentDecisionApprove or ConsentDecisionDeny.
+	Decision string `json:"decision"`
+	// The binding message of the request, so the user is known to have seen it.
+	BindingMessage string `json:"binding_message"`
+	// The approved scopes, absent when all the requested scopes were approved.
+	Scopes []string `json:"scopes,omitempty"`
+	Iat    int64    `json:"iat"`
+}
+
+// The signed consent of a request, for audit. The signature can be verified again with the public key of the device.
+type ConsentEvidence struct {
+	AuthReqId string                  `json:"auth_req_id"`
+	UserId    string                  `json:"user_id"`
+	DeviceId  string                  `json:"device_id"`
+	Signature string                  `json:"signature"`
+	SignedAt  time.Time               `json:"signed_at"`
+	Claims    *ConsentSignatureClaims `json:"claims"`
+}
+
+// Parses the PEM encoded public key of a device, only keys consent can be signed with are accepted.
+func parseDevicePublicKey(publicKey string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, errors.New("public key isn't PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("public key of type %T isn't supported", key)
+}
+
+func consentSignatureMaxAge(config *grant.GrantConfig) time.Duration {
+	if config.ConsentSignatureMaxAgeInSeconds > 0 {
+		return time.Duration(config.ConsentSignatureMaxAgeInSeconds) * time.Second
+	}
+	return time.Duration(grant.DefaultConsentSignatureMaxAgeInSeconds) * time.Second
+}
+
+// Verifies the consent decision, and the scope it grants when it's an approval, was signed by an
+// active device of the user of the session, and returns the device and when it was signed.
+// Signatures are bound to the request and a request can only be given consent once, so they
+// can't be replayed; those older than the max age are refused.
+func (cs *cibaService) verifyConsentSignature(ctx context.Context, cibaSession *domain.CibaSession, signature string, consented bool, grantedScope string, now time.Time) (*domain.UserDevice, time.Time, error) {
+	jws, err := jose.ParseSigned(signature)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, time.Time{}, errors.New("consent must have exactly one signature")
+	}
+	header := jws.Signatures[0].Header
+	if !consentSignatureAlgs[header.Algorithm] {
+		return nil, time.Time{}, fmt.Errorf("consent signature algorithm %s isn't allowed", header.Algorithm)
+	}
+
+	device, err := cs.userDeviceRepo.FindById(ctx, header.KeyID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if device == nil || !device.IsActive() || device.UserId != cibaSession.UserId {
+		return nil, time.Time{}, fmt.Errorf("device %s isn't an active device of user %s", header.KeyID, cibaSession.UserId)
+	}
+	key, err := parseDevicePublicKey(device.PublicKey)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("device %s has no usable public key. %s", device.Id, err.Error())
+	}
+	payload, err := jws.Verify(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	claims := &ConsentSignatureClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, time.Time{}, err
+	}
+	decision := ConsentDecisionDeny
+	if consented {
+		decision = ConsentDecisionApprove
+	}
+	if claims.AuthReqId != cibaSession.AuthReqId || claims.Decision != decision || claims.BindingMessage != cibaSession.BindingMessage {
+		return nil, time.Time{}, errors.New("signed consent doesn't match the request")
+	}
+	if signedScope, ok := grantScope(cibaSession.Scope, claims.Scopes); consented && (!ok || signedScope != grantedScope) {
+		return nil, time.Time{}, errors.New("signed scopes don't match the approved scopes")
+	}
+	signedAt := time.Unix(claims.Iat, 0).UTC()
+	if signedAt.After(now.Add(consentSignatureLeeway)) || now.Sub(signedAt) > consentSignatureMaxAge(cs.grant.Config) {
+		return nil, time.Time{}, errors.New("consent signature is too old or signed in the future")
+	}
+	return device, signedAt, nil
+}
+
+// Adds what the signed consent tells about the authentication of the user to the claims of its ID token.
+func addConsentSignatureClaims(claims map[string]interface{}, cibaSession *domain.CibaSession, config *grant.GrantConfig) map[string]interface{} {
+	if !cibaSession.IsConsentSigned() {
+		return claims
+	}
+	if claims == nil {
+		claims = make(map[string]interface{})
+	}
+	claims["amr"] = []string{AmrProofOfPossession}
+	if config.SignedConsentAcr != "" {
+		claims["acr"] = config.SignedConsentAcr
+	}
+	return claims
+}
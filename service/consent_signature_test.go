@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Returns the private key of a device and its PEM encoded public key.
+func newDeviceKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+}
+
+func signConsent(t *testing.T, key *ecdsa.PrivateKey, deviceId string, claims *ConsentSignatureClaims) string {
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", deviceId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := sig.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, _ := jws.CompactSerialize()
+	return signature
+}
+
+type signedConsentFixture struct {
+	ds          *memory.DataStore
+	cs          *cibaService
+	notifier    *recordingNotificationMock
+	key         *ecdsa.PrivateKey
+	device      *domain.UserDevice
+	cibaSession *domain.CibaSession
+}
+
+func newSignedConsentFixture(t *testing.T, clientApp *domain.ClientApplication) *signedConsentFixture {
+	ds := memory.NewDataStore()
+	ds.AddUserAccount(&test_data.User1)
+	signingKey := test_data.Key1
+	signingKey.ClientId = clientApp.Id
+	ds.AddKey(&signingKey)
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), clientApp)
+	key, publicKey := newDeviceKey(t)
+	device, _ := NewDeviceService(ds).RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformAndroid, "push-token", "Pixel", publicKey))
+	cibaSession := domain.NewCibaSession(clientApp, test_data.User1.Id, "W4SCT", "client-notification-token", "openid", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+	cs := NewCibaService(ds, &notificationClientMock{}, grant.NewCibaGrant(), defaultValidateClientNotificationToken)
+	notifier := &recordingNotificationMock{}
+	cs.clientAppNotification = notifier
+	return &signedConsentFixture{ds: ds, cs: cs, notifier: notifier, key: key, device: device, cibaSession: cibaSession}
+}
+
+func (f *signedConsentFixture) claims(decision string) *ConsentSignatureClaims {
+	return &ConsentSignatureClaims{
+		AuthReqId:      f.cibaSession.AuthReqId,
+		Decision:       decision,
+		BindingMessage: f.cibaSession.BindingMessage,
+		Iat:            time.Now().Unix(),
+	}
+}
+
+func (f *signedConsentFixture) submit(signature string, consented bool) *util.OidcError {
+	request := NewUserConsentRequest(test_data.User1.Id, f.cibaSession.AuthReqId, &consented)
+	request.Signature = signature
+	return f.cs.HandleConsentRequest(context.Background(), request)
+}
+
+func (f *signedConsentFixture) stored() *domain.CibaSession {
+	stored, _ := f.ds.GetCibaSessionRepository().FindById(context.Background(), f.cibaSession.AuthReqId)
+	return stored
+}
+
+func TestCibaService_HandleConsentRequest_ShouldStoreEvidence_WhenConsentIsSigned(t *testing.T) {
+	f := newSignedConsentFixture(t, &test_data.ClientAppPoll)
+	signature := signConsent(t, f.key, f.device.Id, f.claims(ConsentDecisionApprove))
+
+	err := f.submit(signature, true)
+	evidence, evidenceErr := f.cs.FindConsentEvidence(context.Background(), f.cibaSession.AuthReqId)
+
+	assert.Nil(t, err)
+	assert.Equal(t, domain.StatusApproved, f.stored().GetStatus())
+	assert.Nil(t, evidenceErr)
+	if assert.NotNil(t, evidence) {
+		assert.Equal(t, f.device.Id, evidence.DeviceId)
+		assert.Equal(t, signature, evidence.Signature)
+		assert.Equal(t, ConsentDecisionApprove, evidence.Claims.Decision)
+		assert.Equal(t, "W4SCT", evidence.Claims.BindingMessage)
+	}
+}
+
+func TestCibaService_HandleConsentRequest_ShouldRefuseSignature_WhenItDoesNotMatchTheRequest(t *testing.T) {
+	f := newSignedConsentFixture(t, &test_data.ClientAppPoll)
+	stale := f.claims(ConsentDecisionApprove)
+	stale.Iat = time.Now().Add(-10 * time.Minute).Unix()
+	otherBindingMessage := f.claims(ConsentDecisionApprove)
+	otherBindingMessage.BindingMessage = "OTHER"
+	otherKey, _ := newDeviceKey(t)
+
+	staleErr := f.submit(signConsent(t, f.key, f.device.Id, stale), true)
+	decisionErr := f.submit(signConsent(t, f.key, f.device.Id, f.claims(ConsentDecisionDeny)), true)
+	bindingMessageErr := f.submit(signConsent(t, f.key, f.device.Id, otherBindingMessage), true)
+	otherKeyErr := f.submit(signConsent(t, otherKey, f.device.Id, f.claims(ConsentDecisionApprove)), true)
+	unknownDeviceErr := f.submit(signConsent(t, f.key, "unknown", f.claims(ConsentDecisionApprove)), true)
+
+	assert.Equal(t, util.ErrInvalidRequest, staleErr)
+	assert.Equal(t, util.ErrInvalidRequest, decisionErr)
+	assert.Equal(t, util.ErrInvalidRequest, bindingMessageErr)
+	assert.Equal(t, util.ErrInvalidRequest, otherKeyErr)
+	assert.Equal(t, util.ErrInvalidRequest, unknownDeviceErr)
+	assert.Equal(t, domain.StatusPending, f.stored().GetStatus())
+}
+
+func TestCibaService_HandleConsentRequest_ShouldRefuseReplayedSignature(t *testing.T) {
+	f := newSignedConsentFixture(t, &test_data.ClientAppPoll)
+	signature := signConsent(t, f.key, f.device.Id, f.claims(ConsentDecisionApprove))
+	_ = f.submit(signature, true)
+
+	err := f.submit(signature, true)
+
+	assert.Equal(t, util.ErrExpiredToken, err)
+}
+
+func TestCibaService_HandleConsentRequest_ShouldRefuseUnsignedConsent_WhenSignedConsentIsRequired(t *testing.T) {
+	f := newSignedConsentFixture(t, &test_data.ClientAppPoll)
+	f.cs.grant.Config.RequireSignedConsent = true
+
+	err := f.submit("", true)
+
+	assert.Equal(t, util.ErrInvalidRequest, err)
+	assert.Equal(t, domain.StatusPending, f.stored().GetStatus())
+}
+
+func TestCibaService_HandleConsentRequest_ShouldAddAmrAndAcr_WhenConsentIsSigned(t *testing.T) {
+	f := newSignedConsentFixture(t, &test_data.ClientAppPush)
+	f.cs.grant.Config.SignedConsentAcr = "urn:example:acr:signed-consent"
+
+	err := f.submit(signConsent(t, f.key, f.device.Id, f.claims(ConsentDecisionApprove)), true)
+
+	assert.Nil(t, err)
+	if assert.Len(t, f.notifier.sent, 1) {
+		idToken, _ := jose.ParseSigned(f.notifier.sent[0].(*transport.ClientPushSuccess).IdToken)
+		claims := make(map[string]interface{})
+		_ = json.Unmarshal(idToken.UnsafePayloadWithoutVerification(), &claims)
+		assert.Equal(t, []interface{}{AmrProofOfPossession}, claims["amr"])
+		assert.Equal(t, "urn:example:acr:signed-consent", claims["acr"])
+	}
+}
+
+func TestCibaService_HandleConsentRequest_ShouldRefuseSignature_WhenSignedScopesDifferFromApprovedScopes(t *testing.T) {
+	f := newSignedConsentFixture(t, &test_data.ClientAppPoll)
+	f.cibaSession.Scope = "openid email"
+	_ = f.ds.GetCibaSessionRepository().Update(context.Background(), f.cibaSession)
+	consented := true
+	request := NewUserConsentRequest(test_data.User1.Id, f.cibaSession.AuthReqId, &consented)
+	request.ApprovedScopes = []string{}
+	request.Signature = signConsent(t, f.key, f.device.Id, f.claims(ConsentDecisionApprove))
+
+	err := f.cs.HandleConsentRequest(context.Background(), request)
+
+	assert.Equal(t, util.ErrInvalidRequest, err)
+	assert.Equal(t, domain.StatusPending, f.stored().GetStatus())
+}
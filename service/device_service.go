@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+type RegisterDeviceRequest struct {
+	UserId      string
+	Platform    string
+	PushToken   string
+	DisplayName string
+	PublicKey   string
+}
+
+func NewRegisterDeviceRequest(userId, platform, pushToken, displayName, publicKey string) *RegisterDeviceRequest {
+	return &RegisterDeviceRequest{
+		UserId:      userId,
+		Platform:    platform,
+		PushToken:   pushToken,
+		DisplayName: displayName,
+		PublicKey:   publicKey,
+	}
+}
+
+// Keeps track of the authentication devices of users. It's the device registry the consent prompts
+// are routed with, the server authenticates users before calling it on their behalf.
+type deviceService struct {
+	userAccountRepo repository.UserAccountRepositoryInterface
+	userDeviceRepo  repository.UserDeviceRepositoryInterface
+
+	now func() time.Time
+}
+
+func NewDeviceService(dataStore repository.DataStoreInterface) *deviceService {
+	return &deviceService{
+		userAccountRepo: dataStore.GetUserAccountRepository(),
+		userDeviceRepo:  dataStore.GetUserDeviceRepository(),
+		now: func() time.Time {
+			return time.Now().UTC()
+		},
+	}
+}
+
+// Registers a device of the user. A device registering a push token the user already has is
+// the same device registering again, e.g. after an app update, so it's refreshed instead. Its public key
+// is never replaced though, as that would let whoever registers the token sign consent in its name;
+// a push token registered with another key is registered as a new device.
+func (d *deviceService) RegisterDevice(ctx context.Context, request *RegisterDeviceRequest) (*domain.UserDevice, *util.OidcError) {
+	if !domain.IsValidDevicePlatform(request.Platform) || request.PushToken == "" {
+		return nil, util.ErrInvalidRequest
+	}
+	// The key is only used to verify signed consent, it's checked now so devices learn it's unusable.
+	if request.PublicKey != "" {
+		if _, err := parseDevicePublicKey(request.PublicKey); err != nil {
+			log.Printf("[go-ciba][deviceservice] refused public key of device of user %s. %s\n", request.UserId, err.Error())
+			return nil, util.ErrInvalidRequest
+		}
+	}
+	user, err := d.userAccountRepo.FindById(ctx, request.UserId)
+	if err != nil {
+		log.Printf("[go-ciba][deviceservice] failed finding user %s. %s\n", request.UserId, err.Error())
+		return nil, util.ErrGeneral
+	}
+	if user == nil {
+		return nil, util.ErrUnknownUserId
+	}
+
+	devices, err := d.userDeviceRepo.FindActiveByUserId(ctx, request.UserId)
+	if err != nil {
+		log.Printf("[go-ciba][deviceservice] failed finding devices of user %s. %s\n", request.UserId, err.Error())
+		return nil, util.ErrGeneral
+	}
+	for _, device := range devices {
+		if device.PushToken != request.PushToken {
+			continue
+		}
+		if request.PublicKey != "" && request.PublicKey != device.PublicKey {
+			continue
+		}
+		device.Platform = request.Platform
+		device.DisplayName = request.DisplayName
+		device.Touch(d.now())
+		if err := d.userDeviceRepo.Update(ctx, device); err != nil {
+			log.Printf("[go-ciba][deviceservice] failed updating device %s. %s\n", device.Id, err.Error())
+			return nil, util.ErrGeneral
+		}
+		return device, nil
+	}
+
+	device := domain.NewUserDevice(request.UserId, request.Platform, request.PushToken, request.DisplayName, request.PublicKey)
+	if err := d.userDeviceRepo.Create(ctx, device); err != nil {
+		log.Printf("[go-ciba][deviceservice] failed creating device of user %s. %s\n", request.UserId, err.Error())
+		return nil, util.ErrGeneral
+	}
+	return device, nil
+}
+
+// Deregisters a device of the user, consent prompts are no longer sent to it.
+func (d *deviceService) DeregisterDevice(ctx context.Context, userId, deviceId string) *util.OidcError {
+	device, err := d.userDeviceRepo.FindById(ctx, deviceId)
+	if err != nil {
+		log.Printf("[go-ciba][deviceservice] failed finding device %s. %s\n", deviceId, err.Error())
+		return util.ErrGeneral
+	}
+	// Devices of other users are treated as unknown ones.
+	if device == nil || device.UserId != userId || !device.IsActive() {
+		return util.ErrInvalidRequest
+	}
+	device.Deregister(d.now())
+	if err := d.userDeviceRepo.Update(ctx, device); err != nil {
+		log.Printf("[go-ciba][deviceservice] failed deregistering device %s. %s\n", deviceId, err.Error())
+		return util.ErrGeneral
+	}
+	return nil
+}
+
+// Returns the active devices of the user, most recently seen first.
+func (d *deviceService) FindDevices(ctx context.Context, userId string) ([]*domain.UserDevice, *util.OidcError) {
+	devices, err := d.userDeviceRepo.FindActiveByUserId(ctx, userId)
+	if err != nil {
+		log.Printf("[go-ciba][deviceservice] failed finding devices of user %s. %s\n", userId, err.Error())
+		return nil, util.ErrGeneral
+	}
+	return devices, nil
+}
+
+// Records that the device was seen, e.g. when it answers a consent prompt.
+func (d *deviceService) TouchDevice(ctx context.Context, deviceId string) *util.OidcError {
+	device, err := d.userDeviceRepo.FindById(ctx, deviceId)
+	if err != nil {
+		log.Printf("[go-ciba][deviceservice] failed finding device %s. %s\n", deviceId, err.Error())
+		return util.ErrGeneral
+	}
+	if device == nil || !device.IsActive() {
+		return util.ErrInvalidRequest
+	}
+	device.Touch(d.now())
+	if err := d.userDeviceRepo.Update(ctx, device); err != nil {
+		log.Printf("[go-ciba][deviceservice] failed updating device %s. %s\n", deviceId, err.Error())
+		return util.ErrGeneral
+	}
+	return nil
+}
+
+func (d *deviceService) FindPushTokens(ctx context.Context, userId string) ([]string, error) {
+	devices, err := d.userDeviceRepo.FindActiveByUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	pushTokens := make([]string, 0, len(devices))
+	for _, device := range devices {
+		pushTokens = append(pushTokens, device.PushToken)
+	}
+	return pushTokens, nil
+}
+
+// Deregisters the devices of the user with the given push token.
+func (d *deviceService) RemovePushToken(ctx context.Context, userId, pushToken string) error {
+	devices, err := d.userDeviceRepo.FindActiveByUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if device.PushToken != pushToken {
+			continue
+		}
+		device.Deregister(d.now())
+		if err := d.userDeviceRepo.Update(ctx, device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
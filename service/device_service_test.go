@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDeviceService() *deviceService {
+	ds := memory.NewDataStore()
+	ds.AddUserAccount(&test_data.User1)
+	return NewDeviceService(ds)
+}
+
+func TestDeviceService_RegisterDevice(t *testing.T) {
+	ds := newDeviceService()
+	_, publicKey := newDeviceKey(t)
+
+	device, err := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformAndroid, "push-token", "Pixel", publicKey))
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, device.Id)
+	devices, _ := ds.FindDevices(context.Background(), test_data.User1.Id)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "Pixel", devices[0].DisplayName)
+	assert.Equal(t, publicKey, devices[0].PublicKey)
+}
+
+func TestDeviceService_RegisterDevice_ShouldRefreshDevice_WhenPushTokenIsRegistered(t *testing.T) {
+	ds := newDeviceService()
+	first, _ := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformAndroid, "push-token", "Pixel", ""))
+
+	second, err := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformAndroid, "push-token", "Pixel 2", ""))
+
+	assert.Nil(t, err)
+	assert.Equal(t, first.Id, second.Id)
+	devices, _ := ds.FindDevices(context.Background(), test_data.User1.Id)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "Pixel 2", devices[0].DisplayName)
+}
+
+func TestDeviceService_RegisterDevice_ShouldKeepPublicKey_WhenPushTokenIsRegisteredAgain(t *testing.T) {
+	ds := newDeviceService()
+	_, publicKey := newDeviceKey(t)
+	_, otherPublicKey := newDeviceKey(t)
+	first, _ := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformAndroid, "push-token", "Pixel", publicKey))
+
+	refreshed, refreshErr := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformAndroid, "push-token", "Pixel 2", ""))
+	other, otherErr := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformAndroid, "push-token", "Pixel 3", otherPublicKey))
+
+	assert.Nil(t, refreshErr)
+	assert.Nil(t, otherErr)
+	assert.Equal(t, first.Id, refreshed.Id)
+	assert.NotEqual(t, first.Id, other.Id)
+	stored, _ := ds.userDeviceRepo.FindById(context.Background(), first.Id)
+	assert.Equal(t, publicKey, stored.PublicKey)
+	assert.Equal(t, "Pixel 2", stored.DisplayName)
+	assert.Equal(t, otherPublicKey, other.PublicKey)
+}
+
+func TestDeviceService_RegisterDevice_ShouldFail_WhenRequestIsInvalid(t *testing.T) {
+	ds := newDeviceService()
+
+	_, unknownUserErr := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest("unknown", domain.DevicePlatformAndroid, "push-token", "", ""))
+	_, platformErr := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, "symbian", "push-token", "", ""))
+	_, pushTokenErr := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformIos, "", "", ""))
+	_, publicKeyErr := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformIos, "push-token", "", "public-key"))
+
+	assert.Equal(t, util.ErrUnknownUserId, unknownUserErr)
+	assert.Equal(t, util.ErrInvalidRequest, platformErr)
+	assert.Equal(t, util.ErrInvalidRequest, pushTokenErr)
+	assert.Equal(t, util.ErrInvalidRequest, publicKeyErr)
+}
+
+func TestDeviceService_DeregisterDevice(t *testing.T) {
+	ds := newDeviceService()
+	device, _ := ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformWeb, "push-token", "", ""))
+
+	otherUserErr := ds.DeregisterDevice(context.Background(), "someone-else", device.Id)
+	err := ds.DeregisterDevice(context.Background(), test_data.User1.Id, device.Id)
+	againErr := ds.DeregisterDevice(context.Background(), test_data.User1.Id, device.Id)
+
+	assert.Equal(t, util.ErrInvalidRequest, otherUserErr)
+	assert.Nil(t, err)
+	assert.Equal(t, util.ErrInvalidRequest, againErr)
+	devices, _ := ds.FindDevices(context.Background(), test_data.User1.Id)
+	assert.Empty(t, devices)
+}
+
+func TestDeviceService_RemovePushToken(t *testing.T) {
+	ds := newDeviceService()
+	_, _ = ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformAndroid, "uninstalled", "", ""))
+	_, _ = ds.RegisterDevice(context.Background(), NewRegisterDeviceRequest(test_data.User1.Id, domain.DevicePlatformIos, "phone", "", ""))
+
+	err := ds.RemovePushToken(context.Background(), test_data.User1.Id, "uninstalled")
+	pushTokens, _ := ds.FindPushTokens(context.Background(), test_data.User1.Id)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"phone"}, pushTokens)
+}
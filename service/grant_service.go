@@ -1,14 +1,52 @@
 package service
 
-import "github.com/adisazhar123/go-ciba/util"
+import (
+	"context"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/util"
+)
 
 type GrantServiceInterface interface {
-	ValidateAuthenticationRequestParameters(request *AuthenticationRequest) *util.OidcError
-	HandleAuthenticationRequest(request *AuthenticationRequest) (*AuthenticationResponse, *util.OidcError)
+	ValidateAuthenticationRequestParameters(ctx context.Context, request *AuthenticationRequest) *util.OidcError
+	HandleAuthenticationRequest(ctx context.Context, request *AuthenticationRequest) (*AuthenticationResponse, *util.OidcError)
 
 	GetGrantIdentifier() string
 }
 
 type ConsentServiceInterface interface {
-	HandleConsentRequest(request *ConsentRequest) *util.OidcError
+	HandleConsentRequest(ctx context.Context, request *ConsentRequest) *util.OidcError
+}
+
+// Takes consents the caller already proved come from the user without them being signed in, e.g. with a signed link.
+type TrustedConsentServiceInterface interface {
+	HandleTrustedConsentRequest(ctx context.Context, request *ConsentRequest) *util.OidcError
+}
+
+// Gives authenticated users the requests waiting for their consent, and takes their decisions.
+type UserConsentServiceInterface interface {
+	ConsentServiceInterface
+	FindPendingConsentRequests(ctx context.Context, userId string) ([]*PendingConsentRequest, *util.OidcError)
+}
+
+// Lets clients cancel their pending authentication requests.
+type CancellationServiceInterface interface {
+	HandleCancellationRequest(ctx context.Context, request *CancellationRequest) *util.OidcError
+}
+
+// Lets authenticated users manage the scopes they granted to client applications.
+type UserGrantServiceInterface interface {
+	FindGrants(ctx context.Context, userId string) ([]*domain.Grant, *util.OidcError)
+	RevokeGrant(ctx context.Context, userId, clientId string) *util.OidcError
+}
+
+// Manages the registry of the scopes clients can request and the claims they grant.
+type ScopeServiceInterface interface {
+	FindScopes(ctx context.Context) ([]*domain.Scope, *util.OidcError)
+	FindScope(ctx context.Context, name string) (*domain.Scope, *util.OidcError)
+	SaveScope(ctx context.Context, scope *domain.Scope) *util.OidcError
+	DeleteScope(ctx context.Context, name string) *util.OidcError
+	FindClaims(ctx context.Context) ([]*domain.Claim, *util.OidcError)
+	SaveClaim(ctx context.Context, claim *domain.Claim) *util.OidcError
+	DeleteClaim(ctx context.Context, name string) *util.OidcError
 }
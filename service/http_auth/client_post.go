@@ -24,5 +24,5 @@ func (c *clientPost) ValidateRequest(r *http.Request, ca *domain.ClientApplicati
 	clientId := form.Get("client_id")
 	clientSecret := form.Get("client_secret")
 
-	return ca != nil && ca.Id == clientId && ca.Secret == clientSecret
+	return ca != nil && ca.Id == clientId && ca.VerifySecret(clientSecret)
 }
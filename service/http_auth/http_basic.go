@@ -22,7 +22,7 @@ func (hb *httpBasic) GetClientCredentials(r *http.Request, clientId, clientSecre
 
 func (hb *httpBasic) ValidateRequest(r *http.Request, ca *domain.ClientApplication) bool {
 	clientCred := hb.getClientCredentials(r)
-	return clientCred != nil && ca != nil && ca.GetId() == clientCred.clientId && ca.GetSecret() == clientCred.clientSecret
+	return clientCred != nil && ca != nil && ca.GetId() == clientCred.clientId && ca.VerifySecret(clientCred.clientSecret)
 }
 
 func (hb *httpBasic) getClientCredentials(r *http.Request) *httpClientCredentials {
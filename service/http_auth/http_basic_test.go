@@ -26,6 +26,24 @@ func TestHttpBasic_ValidateRequest_CorrectClientCredentials(t *testing.T) {
 	assert.Equal(t, true, res)
 }
 
+func TestHttpBasic_ValidateRequest_CorrectClientCredentials_WhenSecretIsHashed(t *testing.T) {
+	httpBasic := &httpBasic{}
+	method := "POST"
+	uri := "ciba.example.com/bc-authorize"
+
+	clientApp, _ := (&domain.ClientApplication{
+		Id:     "123456",
+		Secret: "secret",
+	}).WithHashedSecret()
+	auth := base64.StdEncoding.EncodeToString([]byte(clientApp.Id + ":secret"))
+	req, _ := http.NewRequest(method, uri, nil)
+	req.Header.Add("Authorization", "Basic "+auth)
+
+	res := httpBasic.ValidateRequest(req, clientApp)
+
+	assert.Equal(t, true, res)
+}
+
 func TestHttpBasic_ValidateRequest_IncorrectClientCredentials(t *testing.T) {
 	httpBasic := &httpBasic{}
 	method := "POST"
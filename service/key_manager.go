@@ -0,0 +1,389 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/util"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const keyManagerLockName = "go-ciba:key-manager"
+
+// How long the token and Ciba services keep the signing keys before reading them again,
+// which is how late they may pick up a rotation done by the key manager.
+var SigningKeyRefreshInterval = 1 * time.Minute
+
+type KeyManagerConfig struct {
+	// Algorithm of the generated keys, one of RS256, RS384, RS512, PS256, PS384 or PS512.
+	Alg string
+	// Size in bits of the generated RSA keys.
+	KeySize int
+	// How long a key signs tokens before it's retired. The next key is published for as long beforehand.
+	RotationPeriod time.Duration
+	// How long a retired key stays published. It's never shorter than TokenLifetime plus SigningKeyRefreshInterval,
+	// so that tokens signed right before the services noticed the rotation can still be verified.
+	RetentionPeriod time.Duration
+	// Longest lifetime of the tokens signed with the keys.
+	TokenLifetime time.Duration
+	// How often the key manager checks whether the active key is due for rotation.
+	Interval time.Duration
+	// How long the key manager lock is held before another instance may take it over.
+	LockTtl time.Duration
+}
+
+func NewKeyManagerConfig() *KeyManagerConfig {
+	return &KeyManagerConfig{
+		Alg:             "RS256",
+		KeySize:         2048,
+		RotationPeriod:  30 * 24 * time.Hour,
+		RetentionPeriod: 24 * time.Hour,
+		TokenLifetime:   time.Duration(grant.DefaultIdTokenLifeTimeInSeconds) * time.Second,
+		Interval:        1 * time.Hour,
+		LockTtl:         5 * time.Minute,
+	}
+}
+
+type keyManager struct {
+	dataStore      repository.DataStoreInterface
+	signingKeyRepo repository.SigningKeyRepositoryInterface
+	locker         repository.LockerInterface
+	// The published keys, kept until they're due to change.
+	keySet *signingKeySet
+
+	config *KeyManagerConfig
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Creates a key manager that generates the server signing keys, used by client applications without
+// a key of their own, and rotates them. A nil locker means the key manager assumes it's the only instance running.
+func NewKeyManager(dataStore repository.DataStoreInterface, locker repository.LockerInterface, config *KeyManagerConfig) *keyManager {
+	k := &keyManager{
+		dataStore:      dataStore,
+		signingKeyRepo: dataStore.GetSigningKeyRepository(),
+		locker:         locker,
+		config:         config,
+	}
+	k.keySet = newSigningKeySet(k.signingKeyRepo, k.nextChange)
+	return k
+}
+
+// Runs Rotate right away, so that there's an active key, then every configured interval until Stop is called.
+func (k *keyManager) Start() error {
+	if err := k.Rotate(context.Background()); err != nil {
+		return err
+	}
+	k.stop = make(chan struct{})
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		ticker := time.NewTicker(k.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := k.Rotate(context.Background()); err != nil {
+					log.Printf("[go-ciba][keymanager] an error occured rotating keys %s\n", err.Error())
+				}
+			case <-k.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stops the key manager and waits for the running rotation, if any, to finish.
+func (k *keyManager) Stop() {
+	close(k.stop)
+	k.wg.Wait()
+}
+
+// Makes sure there's an active and a next key. The active key is retired once its rotation period is over,
+// the next key taking its place, and retired keys are deleted once their retention period is over.
+func (k *keyManager) Rotate(ctx context.Context) error {
+	if k.locker != nil {
+		acquired, err := k.locker.TryLock(ctx, keyManagerLockName, k.config.LockTtl)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			return nil
+		}
+		defer func() {
+			if err := k.locker.Unlock(ctx, keyManagerLockName); err != nil {
+				log.Printf("[go-ciba][keymanager] failed releasing lock %s\n", err.Error())
+			}
+		}()
+	}
+	return k.rotate(ctx, time.Now().UTC())
+}
+
+func (k *keyManager) rotate(ctx context.Context, now time.Time) error {
+	keys, err := k.signingKeyRepo.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	var active, next *domain.SigningKey
+	var retired []*domain.SigningKey
+	for _, key := range keys {
+		switch key.State {
+		case domain.SigningKeyStateActive:
+			active = key
+		case domain.SigningKeyStateNext:
+			next = key
+		case domain.SigningKeyStateRetired:
+			retired = append(retired, key)
+		}
+	}
+
+	// The cached keys are read again even if the rotation failed, it may have been partly applied.
+	defer k.keySet.invalidate()
+	return k.dataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		repo := tx.GetSigningKeyRepository()
+		if active != nil && now.Sub(*active.ActivatedAt) >= k.config.RotationPeriod {
+			active.Retire(now)
+			if err := repo.Update(ctx, active); err != nil {
+				return err
+			}
+			log.Printf("[go-ciba][keymanager] retired signing key %s\n", active.Id)
+			active = nil
+		}
+		if active == nil {
+			if next == nil {
+				// There was no key at all, the first one is used right away.
+				key, err := k.generate(now)
+				if err != nil {
+					return err
+				}
+				key.Activate(now)
+				if err := repo.Create(ctx, key); err != nil {
+					return err
+				}
+			} else {
+				next.Activate(now)
+				if err := repo.Update(ctx, next); err != nil {
+					return err
+				}
+				next = nil
+			}
+		}
+		if next == nil {
+			key, err := k.generate(now)
+			if err != nil {
+				return err
+			}
+			if err := repo.Create(ctx, key); err != nil {
+				return err
+			}
+		}
+		for _, key := range retired {
+			if !k.isPublished(key, now) {
+				if err := repo.Delete(ctx, key.Id); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (k *keyManager) isPublished(key *domain.SigningKey, now time.Time) bool {
+	return key.State != domain.SigningKeyStateRetired || now.Before(key.RetiredAt.Add(k.retentionPeriod()))
+}
+
+func (k *keyManager) retentionPeriod() time.Duration {
+	if minimum := k.config.TokenLifetime + SigningKeyRefreshInterval; k.config.RetentionPeriod < minimum {
+		return minimum
+	}
+	return k.config.RetentionPeriod
+}
+
+// Returns when the given keys are next due to change: the active key being retired or a retired key being
+// deleted. Rotations done by another instance are picked up within the configured interval.
+func (k *keyManager) nextChange(keys []*domain.SigningKey, now time.Time) time.Time {
+	next := now.Add(k.config.Interval)
+	for _, key := range keys {
+		var change time.Time
+		switch key.State {
+		case domain.SigningKeyStateActive:
+			change = key.ActivatedAt.Add(k.config.RotationPeriod)
+		case domain.SigningKeyStateRetired:
+			change = key.RetiredAt.Add(k.retentionPeriod())
+		default:
+			continue
+		}
+		if change.After(now) && change.Before(next) {
+			next = change
+		}
+	}
+	return next
+}
+
+func (k *keyManager) generate(now time.Time) (*domain.SigningKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, k.config.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.SigningKey{
+		Id:        util.GenerateUuid(),
+		Alg:       k.config.Alg,
+		Public:    string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+		Private:   string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})),
+		State:     domain.SigningKeyStateNext,
+		CreatedAt: now,
+	}, nil
+}
+
+// Returns the public keys relying parties verify id tokens with: the next and active keys,
+// and the retired keys until their retention period is over.
+func (k *keyManager) Jwks(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	now := time.Now().UTC()
+	keys, err := k.keySet.find(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	jwks := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+	for _, key := range keys {
+		if !k.isPublished(key, now) {
+			continue
+		}
+		jwk, err := publicJwk(key)
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+// Serves the JWKS, meant to be mounted at the jwks_uri of the server.
+func (k *keyManager) JwksHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		jwks, err := k.Jwks(r.Context())
+		if err != nil {
+			log.Printf("[go-ciba][keymanager] failed finding signing keys %s\n", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(jwks); err != nil {
+			log.Printf("[go-ciba][keymanager] failed writing jwks %s\n", err.Error())
+		}
+	})
+}
+
+// Signing keys read from the repository, kept until expiry says they may have changed.
+type signingKeySet struct {
+	repo   repository.SigningKeyRepositoryInterface
+	expiry func(keys []*domain.SigningKey, now time.Time) time.Time
+
+	mutex     sync.Mutex
+	keys      []*domain.SigningKey
+	expiresAt time.Time
+}
+
+func newSigningKeySet(repo repository.SigningKeyRepositoryInterface, expiry func(keys []*domain.SigningKey, now time.Time) time.Time) *signingKeySet {
+	return &signingKeySet{
+		repo:   repo,
+		expiry: expiry,
+	}
+}
+
+func (s *signingKeySet) find(ctx context.Context, now time.Time) ([]*domain.SigningKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Before(s.expiresAt) {
+		return s.keys, nil
+	}
+	keys, err := s.repo.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+	s.expiresAt = s.expiry(keys, now)
+	return keys, nil
+}
+
+func (s *signingKeySet) invalidate() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expiresAt = time.Time{}
+}
+
+func publicJwk(key *domain.SigningKey) (jose.JSONWebKey, error) {
+	block, _ := pem.Decode([]byte(key.Public))
+	if block == nil {
+		return jose.JSONWebKey{}, fmt.Errorf("signing key %s has no PEM encoded public key", key.Id)
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	return jose.JSONWebKey{
+		Key:       public,
+		KeyID:     key.Id,
+		Algorithm: key.Alg,
+		Use:       "sig",
+	}, nil
+}
+
+// Finds the key signing the tokens of a client application: its own key if it has one,
+// the active server signing key otherwise.
+type signingKeyResolver struct {
+	keyRepo repository.KeyRepositoryInterface
+	keySet  *signingKeySet
+}
+
+func newSigningKeyResolver(dataStore repository.DataStoreInterface) *signingKeyResolver {
+	return &signingKeyResolver{
+		keyRepo: dataStore.GetKeyRepository(),
+		keySet: newSigningKeySet(dataStore.GetSigningKeyRepository(), func(keys []*domain.SigningKey, now time.Time) time.Time {
+			return now.Add(SigningKeyRefreshInterval)
+		}),
+	}
+}
+
+func (s *signingKeyResolver) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
+	key, err := s.keyRepo.FindPrivateKeyByClientId(ctx, clientId)
+	if err != nil || key != nil {
+		return key, err
+	}
+	keys, err := s.keySet.find(ctx, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	var active *domain.SigningKey
+	for _, k := range keys {
+		if k.State == domain.SigningKeyStateActive && (active == nil || k.ActivatedAt.After(*active.ActivatedAt)) {
+			active = k
+		}
+	}
+	if active == nil {
+		return nil, nil
+	}
+	return active.ToKey(clientId), nil
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func newTestKeyManager(ds *memory.DataStore) *keyManager {
+	config := NewKeyManagerConfig()
+	// Small keys keep the tests fast.
+	config.KeySize = 1024
+	return NewKeyManager(ds, nil, config)
+}
+
+func signingKeysByState(t *testing.T, ds *memory.DataStore) map[string][]*domain.SigningKey {
+	keys, err := ds.GetSigningKeyRepository().FindAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	byState := make(map[string][]*domain.SigningKey)
+	for _, key := range keys {
+		byState[key.State] = append(byState[key.State], key)
+	}
+	return byState
+}
+
+func TestKeyManager_Rotate_ShouldGenerateActiveAndNextKeys_WhenThereAreNone(t *testing.T) {
+	ds := memory.NewDataStore()
+	km := newTestKeyManager(ds)
+
+	err := km.Rotate(context.Background())
+	keys := signingKeysByState(t, ds)
+
+	assert.NoError(t, err)
+	assert.Len(t, keys[domain.SigningKeyStateActive], 1)
+	assert.Len(t, keys[domain.SigningKeyStateNext], 1)
+	assert.Len(t, keys[domain.SigningKeyStateRetired], 0)
+}
+
+func TestKeyManager_Rotate_ShouldKeepKeys_WhenRotationPeriodIsNotOver(t *testing.T) {
+	ds := memory.NewDataStore()
+	km := newTestKeyManager(ds)
+	_ = km.Rotate(context.Background())
+	before := signingKeysByState(t, ds)
+
+	err := km.Rotate(context.Background())
+	after := signingKeysByState(t, ds)
+
+	assert.NoError(t, err)
+	assert.Equal(t, before[domain.SigningKeyStateActive][0].Id, after[domain.SigningKeyStateActive][0].Id)
+	assert.Equal(t, before[domain.SigningKeyStateNext][0].Id, after[domain.SigningKeyStateNext][0].Id)
+}
+
+func TestKeyManager_Rotate_ShouldPromoteNextKey_WhenRotationPeriodIsOver(t *testing.T) {
+	ds := memory.NewDataStore()
+	km := newTestKeyManager(ds)
+	now := time.Now().UTC()
+	_ = km.rotate(context.Background(), now)
+	before := signingKeysByState(t, ds)
+
+	err := km.rotate(context.Background(), now.Add(km.config.RotationPeriod))
+	after := signingKeysByState(t, ds)
+
+	assert.NoError(t, err)
+	assert.Equal(t, before[domain.SigningKeyStateActive][0].Id, after[domain.SigningKeyStateRetired][0].Id)
+	assert.Equal(t, before[domain.SigningKeyStateNext][0].Id, after[domain.SigningKeyStateActive][0].Id)
+	assert.Len(t, after[domain.SigningKeyStateNext], 1)
+	assert.NotEqual(t, before[domain.SigningKeyStateNext][0].Id, after[domain.SigningKeyStateNext][0].Id)
+}
+
+func TestKeyManager_Jwks_ShouldPublishRetiredKeys_UntilRetentionPeriodIsOver(t *testing.T) {
+	ds := memory.NewDataStore()
+	km := newTestKeyManager(ds)
+	now := time.Now().UTC()
+	_ = km.rotate(context.Background(), now.Add(-km.config.RotationPeriod))
+	first := signingKeysByState(t, ds)[domain.SigningKeyStateActive][0]
+	_ = km.rotate(context.Background(), now)
+
+	jwks, err := km.Jwks(context.Background())
+	deleteErr := km.rotate(context.Background(), now.Add(km.config.RetentionPeriod))
+	jwksAfterRetention, _ := km.Jwks(context.Background())
+
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 3)
+	assert.Len(t, jwks.Key(first.Id), 1)
+	assert.True(t, jwks.Keys[0].IsPublic())
+	assert.Equal(t, "sig", jwks.Keys[0].Use)
+	assert.NoError(t, deleteErr)
+	assert.Len(t, jwksAfterRetention.Keys, 2)
+	assert.Len(t, jwksAfterRetention.Key(first.Id), 0)
+}
+
+type countingSigningKeyRepository struct {
+	repository.SigningKeyRepositoryInterface
+	reads int
+}
+
+func (c *countingSigningKeyRepository) FindAll(ctx context.Context) ([]*domain.SigningKey, error) {
+	c.reads++
+	return c.SigningKeyRepositoryInterface.FindAll(ctx)
+}
+
+func TestKeyManager_Jwks_ShouldReadKeysOnce_UntilTheyRotate(t *testing.T) {
+	ds := memory.NewDataStore()
+	km := newTestKeyManager(ds)
+	repo := &countingSigningKeyRepository{SigningKeyRepositoryInterface: km.signingKeyRepo}
+	km.signingKeyRepo = repo
+	km.keySet = newSigningKeySet(repo, km.nextChange)
+	now := time.Now().UTC()
+	_ = km.rotate(context.Background(), now)
+
+	_, _ = km.Jwks(context.Background())
+	jwks, err := km.Jwks(context.Background())
+	readsBeforeRotation := repo.reads
+	_ = km.rotate(context.Background(), now.Add(km.config.RotationPeriod))
+	rotated, _ := km.Jwks(context.Background())
+
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 2)
+	// One read by the first rotation, one by the first Jwks.
+	assert.Equal(t, 2, readsBeforeRotation)
+	assert.Len(t, rotated.Keys, 3)
+}
+
+func TestKeyManager_Jwks_ShouldKeepRetiredKeys_AtLeastAsLongAsTheTokensTheySigned(t *testing.T) {
+	ds := memory.NewDataStore()
+	km := newTestKeyManager(ds)
+	km.config.RetentionPeriod = time.Minute
+	now := time.Now().UTC()
+	_ = km.rotate(context.Background(), now.Add(-km.config.RotationPeriod))
+	first := signingKeysByState(t, ds)[domain.SigningKeyStateActive][0]
+	_ = km.rotate(context.Background(), now)
+
+	_ = km.rotate(context.Background(), now.Add(km.config.TokenLifetime))
+	retained := signingKeysByState(t, ds)[domain.SigningKeyStateRetired]
+	_ = km.rotate(context.Background(), now.Add(km.config.TokenLifetime+SigningKeyRefreshInterval))
+	deleted := signingKeysByState(t, ds)[domain.SigningKeyStateRetired]
+
+	assert.Len(t, retained, 1)
+	assert.Equal(t, first.Id, retained[0].Id)
+	assert.Len(t, deleted, 0)
+}
+
+func TestKeyManager_JwksHandler_ShouldServePublishedKeys(t *testing.T) {
+	km := newTestKeyManager(memory.NewDataStore())
+	_ = km.Rotate(context.Background())
+	w := httptest.NewRecorder()
+
+	km.JwksHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jwks", nil))
+	jwks := &jose.JSONWebKeySet{}
+	err := json.Unmarshal(w.Body.Bytes(), jwks)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 2)
+	assert.True(t, jwks.Keys[0].IsPublic())
+}
+
+func TestKeyManager_JwksHandler_ShouldOnlyAllowGet(t *testing.T) {
+	km := newTestKeyManager(memory.NewDataStore())
+	w := httptest.NewRecorder()
+
+	km.JwksHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/jwks", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+}
+
+func TestSigningKeyResolver_ShouldPreferClientKey_OverActiveSigningKey(t *testing.T) {
+	ds := memory.NewDataStore()
+	ds.AddKey(&test_data.Key1)
+	_ = newTestKeyManager(ds).Rotate(context.Background())
+	active := signingKeysByState(t, ds)[domain.SigningKeyStateActive][0]
+	resolver := newSigningKeyResolver(ds)
+
+	clientKey, err := resolver.FindPrivateKeyByClientId(context.Background(), test_data.Key1.ClientId)
+	serverKey, serverErr := resolver.FindPrivateKeyByClientId(context.Background(), "client-without-key")
+
+	assert.NoError(t, err)
+	assert.Equal(t, test_data.Key1.Id, clientKey.Id)
+	assert.NoError(t, serverErr)
+	assert.Equal(t, active.Id, serverKey.Id)
+	assert.Equal(t, "client-without-key", serverKey.ClientId)
+}
+
+func TestSigningKeyResolver_ShouldReturnNil_WhenThereIsNoKey(t *testing.T) {
+	resolver := newSigningKeyResolver(memory.NewDataStore())
+
+	key, err := resolver.FindPrivateKeyByClientId(context.Background(), "client-without-key")
+
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+}
+
+func TestTokenService_GrantAccessToken_ShouldSignIdTokenWithActiveSigningKey_WhenClientHasNoKey(t *testing.T) {
+	ds := memory.NewDataStore()
+	ds.AddUserAccount(&test_data.User1)
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPing)
+	km := newTestKeyManager(ds)
+	_ = km.Rotate(context.Background())
+	ts := NewTokenService(ds, grant.NewCibaGrant())
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = cibaSession.Approve(domain.ActorUser)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+
+	tokens, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  test_data.ClientAppPing.Id,
+		authReqId: cibaSession.AuthReqId,
+	})
+	jwks, _ := km.Jwks(context.Background())
+
+	assert.Nil(t, err)
+	idToken, parseErr := jwt.ParseSigned(tokens.IdToken.Value)
+	assert.NoError(t, parseErr)
+	claims := make(map[string]interface{})
+	verifyErr := idToken.Claims(jwks.Key(idToken.Headers[0].KeyID)[0].Key, &claims)
+	assert.NoError(t, verifyErr)
+	assert.Equal(t, cibaSession.AuthReqId, claims["auth_req_id"])
+}
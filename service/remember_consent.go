@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+// The grant of a user with the consent they just gave added to it.
+type grantConsent struct {
+	grant *domain.Grant
+	// Whether the user had no grant for the client yet.
+	created bool
+}
+
+func (g *grantConsent) save(ctx context.Context, grantRepo repository.GrantRepositoryInterface) error {
+	if g.created {
+		return grantRepo.Create(ctx, g.grant)
+	}
+	return grantRepo.Update(ctx, g.grant)
+}
+
+// Adds the scope granted to the ciba session to the grant of its user for its client.
+func (cs *cibaService) addGrantConsent(ctx context.Context, cibaSession *domain.CibaSession, now time.Time) (*grantConsent, error) {
+	grant, err := cs.grantRepo.FindByUserIdAndClientId(ctx, cibaSession.UserId, cibaSession.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	if grant == nil {
+		grant = domain.NewGrant(cibaSession.UserId, cibaSession.ClientId, cibaSession.GetGrantedScope(), now)
+		return &grantConsent{grant: grant, created: true}, nil
+	}
+	grant.AddConsent(cibaSession.GetGrantedScope(), now)
+	return &grantConsent{grant: grant}, nil
+}
+
+// Reports whether the ciba session can be approved without prompting the user. It can when its client
+// has a remember consent policy, the active grant of the user covers every requested scope, none of
+// them must always be asked for, and the user gave their consent recently enough.
+func (cs *cibaService) isConsentRemembered(ctx context.Context, cibaSession *domain.CibaSession, now time.Time) (bool, error) {
+	policy := cs.grant.Config.RememberConsent[cibaSession.ClientId]
+	if policy == nil || cs.grant.Config.RequireSignedConsent {
+		return false, nil
+	}
+	for _, scope := range strings.Fields(cibaSession.Scope) {
+		if util.SliceStringContains(policy.AlwaysAskScopes, scope) {
+			return false, nil
+		}
+	}
+	grant, err := cs.grantRepo.FindByUserIdAndClientId(ctx, cibaSession.UserId, cibaSession.ClientId)
+	if err != nil || grant == nil {
+		return false, err
+	}
+	if policy.MaxAgeInSeconds > 0 && now.Sub(grant.ConsentedAt) > time.Duration(policy.MaxAgeInSeconds)*time.Second {
+		return false, nil
+	}
+	return grant.Covers(cibaSession.Scope), nil
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCibaService_HandleConsentRequest_ShouldAddApprovedScopesToGrant(t *testing.T) {
+	cs := newCibaService()
+	cs.clientAppNotification = &recordingNotificationMock{}
+	consented := true
+	for _, scope := range []string{"openid email", "openid profile"} {
+		cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", scope, 3600, nil)
+		_ = cs.cibaSessionRepo.Create(context.Background(), cibaSession)
+		assert.Nil(t, cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(cibaSession.UserId, cibaSession.AuthReqId, &consented)))
+	}
+	denied := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid chat:write", 3600, nil)
+	_ = cs.cibaSessionRepo.Create(context.Background(), denied)
+	consented = false
+
+	err := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(denied.UserId, denied.AuthReqId, &consented))
+	userGrant, _ := cs.grantRepo.FindByUserIdAndClientId(context.Background(), test_data.User1.Id, test_data.ClientAppPing.Id)
+
+	assert.Nil(t, err)
+	if assert.NotNil(t, userGrant) {
+		assert.Equal(t, "openid email profile", userGrant.Scope)
+		assert.True(t, userGrant.IsActive())
+	}
+}
+
+// Memory datastore whose transactions fail updating Ciba sessions, as if they were updated concurrently.
+type conflictingTxDataStore struct {
+	*memory.DataStore
+}
+
+func (c *conflictingTxDataStore) WithinTransaction(ctx context.Context, fn func(tx repository.DataStoreInterface) error) error {
+	return c.DataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		return fn(&conflictingTx{DataStoreInterface: tx})
+	})
+}
+
+type conflictingTx struct {
+	repository.DataStoreInterface
+}
+
+func (c *conflictingTx) GetCibaSessionRepository() repository.CibaSessionRepositoryInterface {
+	return &conflictingCibaSessionRepository{CibaSessionRepositoryInterface: c.DataStoreInterface.GetCibaSessionRepository()}
+}
+
+type conflictingCibaSessionRepository struct {
+	repository.CibaSessionRepositoryInterface
+}
+
+func (c *conflictingCibaSessionRepository) Update(ctx context.Context, cibaSession *domain.CibaSession) error {
+	return repository.ErrConcurrentUpdate
+}
+
+func TestCibaService_HandleConsentRequest_ShouldNotStoreGrant_WhenSessionUpdateFails(t *testing.T) {
+	ds := memory.NewDataStore()
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPing)
+	cs := NewCibaService(&conflictingTxDataStore{DataStore: ds}, &notificationClientMock{}, grant.NewCibaGrant(), defaultValidateClientNotificationToken)
+	notification := &recordingNotificationMock{}
+	cs.clientAppNotification = notification
+	cibaSession := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, nil)
+	_ = ds.GetCibaSessionRepository().Create(context.Background(), cibaSession)
+	consented := true
+
+	err := cs.HandleConsentRequest(context.Background(), NewUserConsentRequest(cibaSession.UserId, cibaSession.AuthReqId, &consented))
+	userGrant, _ := ds.GetGrantRepository().FindByUserIdAndClientId(context.Background(), test_data.User1.Id, test_data.ClientAppPing.Id)
+	stored, _ := ds.GetCibaSessionRepository().FindById(context.Background(), cibaSession.AuthReqId)
+
+	assert.Equal(t, util.ErrGeneral, err)
+	assert.Nil(t, userGrant)
+	assert.Equal(t, domain.StatusPending, stored.GetStatus())
+	assert.Empty(t, notification.sent)
+}
+
+func TestCibaService_HandleAuthenticationRequest_ShouldApproveWithoutPrompting_WhenConsentIsRemembered(t *testing.T) {
+	cs := newCibaService()
+	notifier := &recordingUserNotifierMock{}
+	cs.notificationClient = notifier
+	notification := &recordingNotificationMock{}
+	cs.clientAppNotification = notification
+	cs.grant.Config.RememberConsent = map[string]*grant.RememberConsentPolicy{
+		test_data.ClientAppPing.Id: {MaxAgeInSeconds: 3600},
+	}
+	_ = cs.grantRepo.Create(context.Background(), domain.NewGrant(test_data.User1.Id, test_data.ClientAppPing.Id, test_data.ClientAppPing.Scope, time.Now().UTC().Add(-time.Minute)))
+
+	authRes, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+	assert.Nil(t, err)
+	assert.Empty(t, notifier.prompts)
+	cibaSession, _ := cs.cibaSessionRepo.FindById(context.Background(), authRes.AuthReqId)
+	assert.Equal(t, domain.StatusApproved, cibaSession.GetStatus())
+	assert.Equal(t, domain.ActorSystem, cibaSession.History[len(cibaSession.History)-1].Actor)
+	assert.Equal(t, test_data.ClientAppPing.Scope, cibaSession.GetGrantedScope())
+	if assert.Len(t, notification.sent, 1) {
+		assert.Equal(t, authRes.AuthReqId, notification.sent[0].(*transport.ClientPingCallback).AuthReqId)
+	}
+}
+
+func TestCibaService_HandleAuthenticationRequest_ShouldPromptUser_WhenConsentIsNotRemembered(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name                 string
+		policy               *grant.RememberConsentPolicy
+		scope                string
+		consentedAt          time.Time
+		revoked              bool
+		requireSignedConsent bool
+	}{
+		{name: "no policy", scope: test_data.ClientAppPing.Scope, consentedAt: now},
+		{name: "scope not granted", policy: &grant.RememberConsentPolicy{}, scope: "openid email", consentedAt: now},
+		{name: "scope always asked", policy: &grant.RememberConsentPolicy{AlwaysAskScopes: []string{"profile"}}, scope: test_data.ClientAppPing.Scope, consentedAt: now},
+		{name: "consent too old", policy: &grant.RememberConsentPolicy{MaxAgeInSeconds: 3600}, scope: test_data.ClientAppPing.Scope, consentedAt: now.Add(-2 * time.Hour)},
+		{name: "grant revoked", policy: &grant.RememberConsentPolicy{}, scope: test_data.ClientAppPing.Scope, consentedAt: now, revoked: true},
+		{name: "signed consent required", policy: &grant.RememberConsentPolicy{}, scope: test_data.ClientAppPing.Scope, consentedAt: now, requireSignedConsent: true},
+	}
+	for _, test := range tests {
+		cs := newCibaService()
+		notifier := &recordingUserNotifierMock{}
+		cs.notificationClient = notifier
+		cs.grant.Config.RequireSignedConsent = test.requireSignedConsent
+		if test.policy != nil {
+			cs.grant.Config.RememberConsent = map[string]*grant.RememberConsentPolicy{test_data.ClientAppPing.Id: test.policy}
+		}
+		userGrant := domain.NewGrant(test_data.User1.Id, test_data.ClientAppPing.Id, test.scope, test.consentedAt)
+		if test.revoked {
+			userGrant.Revoke(now)
+		}
+		_ = cs.grantRepo.Create(context.Background(), userGrant)
+
+		authRes, err := cs.HandleAuthenticationRequest(context.Background(), newPingAuthenticationRequest())
+
+		assert.Nil(t, err, test.name)
+		assert.Len(t, notifier.prompts, 1, test.name)
+		cibaSession, _ := cs.cibaSessionRepo.FindById(context.Background(), authRes.AuthReqId)
+		assert.Equal(t, domain.StatusPending, cibaSession.GetStatus(), test.name)
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+// Manages the registry of scopes and claims, the server authorizes administrators before calling it.
+type scopeService struct {
+	dataStore repository.DataStoreInterface
+	scopeRepo repository.ScopeRepositoryInterface
+}
+
+func NewScopeService(dataStore repository.DataStoreInterface) *scopeService {
+	return &scopeService{
+		dataStore: dataStore,
+		scopeRepo: dataStore.GetScopeRepository(),
+	}
+}
+
+// Scope and claim names are sent space separated, so they can't be empty or contain spaces.
+func isValidScopeName(name string) bool {
+	return name != "" && strings.IndexFunc(name, unicode.IsSpace) == -1
+}
+
+// Returns every scope ordered by name.
+func (s *scopeService) FindScopes(ctx context.Context) ([]*domain.Scope, *util.OidcError) {
+	scopes, err := s.scopeRepo.FindAllScopes(ctx)
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed finding scopes. %s\n", err.Error())
+		return nil, util.ErrGeneral
+	}
+	return scopes, nil
+}
+
+// Returns the scope with the given name, or nil when there's none.
+func (s *scopeService) FindScope(ctx context.Context, name string) (*domain.Scope, *util.OidcError) {
+	scope, err := s.scopeRepo.FindScopeByName(ctx, name)
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed finding scope %s. %s\n", name, err.Error())
+		return nil, util.ErrGeneral
+	}
+	return scope, nil
+}
+
+// Creates the scope, or replaces the one with the same name. The claims it grants that don't exist yet are created.
+func (s *scopeService) SaveScope(ctx context.Context, scope *domain.Scope) *util.OidcError {
+	if !isValidScopeName(scope.Name) {
+		return util.ErrInvalidRequest
+	}
+	for _, claim := range scope.Claims {
+		if !isValidScopeName(claim) {
+			return util.ErrInvalidRequest
+		}
+	}
+	err := s.dataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		existing, err := tx.GetScopeRepository().FindScopeByName(ctx, scope.Name)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return tx.GetScopeRepository().CreateScope(ctx, scope)
+		}
+		return tx.GetScopeRepository().UpdateScope(ctx, scope)
+	})
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed saving scope %s. %s\n", scope.Name, err.Error())
+		return util.ErrGeneral
+	}
+	return nil
+}
+
+// Deletes the scope, clients can no longer request it. The claims it granted are kept.
+func (s *scopeService) DeleteScope(ctx context.Context, name string) *util.OidcError {
+	scope, oidcErr := s.FindScope(ctx, name)
+	if oidcErr != nil {
+		return oidcErr
+	}
+	if scope == nil {
+		return util.ErrInvalidRequest
+	}
+	err := s.dataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		return tx.GetScopeRepository().DeleteScope(ctx, name)
+	})
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed deleting scope %s. %s\n", name, err.Error())
+		return util.ErrGeneral
+	}
+	return nil
+}
+
+// Returns every claim ordered by name.
+func (s *scopeService) FindClaims(ctx context.Context) ([]*domain.Claim, *util.OidcError) {
+	claims, err := s.scopeRepo.FindAllClaims(ctx)
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed finding claims. %s\n", err.Error())
+		return nil, util.ErrGeneral
+	}
+	return claims, nil
+}
+
+// Returns the claim with the given name, or nil when there's none.
+func (s *scopeService) findClaim(ctx context.Context, name string) (*domain.Claim, error) {
+	claims, err := s.scopeRepo.FindAllClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, claim := range claims {
+		if claim.Name == name {
+			return claim, nil
+		}
+	}
+	return nil, nil
+}
+
+// Creates the claim, or replaces the one with the same name.
+func (s *scopeService) SaveClaim(ctx context.Context, claim *domain.Claim) *util.OidcError {
+	if !isValidScopeName(claim.Name) {
+		return util.ErrInvalidRequest
+	}
+	existing, err := s.findClaim(ctx, claim.Name)
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed finding claim %s. %s\n", claim.Name, err.Error())
+		return util.ErrGeneral
+	}
+	if existing == nil {
+		err = s.scopeRepo.CreateClaim(ctx, claim)
+	} else {
+		err = s.scopeRepo.UpdateClaim(ctx, claim)
+	}
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed saving claim %s. %s\n", claim.Name, err.Error())
+		return util.ErrGeneral
+	}
+	return nil
+}
+
+// Deletes the claim, the scopes granting it no longer do.
+func (s *scopeService) DeleteClaim(ctx context.Context, name string) *util.OidcError {
+	existing, err := s.findClaim(ctx, name)
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed finding claim %s. %s\n", name, err.Error())
+		return util.ErrGeneral
+	}
+	if existing == nil {
+		return util.ErrInvalidRequest
+	}
+	err = s.dataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		return tx.GetScopeRepository().DeleteClaim(ctx, name)
+	})
+	if err != nil {
+		log.Printf("[go-ciba][scopeservice] failed deleting claim %s. %s\n", name, err.Error())
+		return util.ErrGeneral
+	}
+	return nil
+}
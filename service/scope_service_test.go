@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newScopeService() (*scopeService, *memory.DataStore) {
+	ds := memory.NewDataStore()
+	ds.AddScope("profile", "name")
+	return NewScopeService(ds), ds
+}
+
+func TestScopeService_SaveScope_ShouldCreateThenReplaceScope(t *testing.T) {
+	ss, _ := newScopeService()
+	email := &domain.Scope{Name: "email", Description: "Your email", Claims: []string{"email"}}
+
+	createErr := ss.SaveScope(context.Background(), email)
+	email.Description = "Your email address"
+	email.RequiresUserCode = true
+	updateErr := ss.SaveScope(context.Background(), email)
+	found, findErr := ss.FindScope(context.Background(), "email")
+	scopes, _ := ss.FindScopes(context.Background())
+	claims, _ := ss.FindClaims(context.Background())
+
+	assert.Nil(t, createErr)
+	assert.Nil(t, updateErr)
+	assert.Nil(t, findErr)
+	if assert.NotNil(t, found) {
+		assert.Equal(t, "Your email address", found.Description)
+		assert.True(t, found.RequiresUserCode)
+	}
+	assert.Len(t, scopes, 2)
+	assert.Len(t, claims, 2)
+}
+
+func TestScopeService_SaveScope_ShouldRejectInvalidNames(t *testing.T) {
+	ss, _ := newScopeService()
+
+	emptyErr := ss.SaveScope(context.Background(), &domain.Scope{})
+	spaceErr := ss.SaveScope(context.Background(), &domain.Scope{Name: "email profile"})
+	claimErr := ss.SaveScope(context.Background(), &domain.Scope{Name: "email", Claims: []string{"email address"}})
+
+	assert.Equal(t, util.ErrInvalidRequest, emptyErr)
+	assert.Equal(t, util.ErrInvalidRequest, spaceErr)
+	assert.Equal(t, util.ErrInvalidRequest, claimErr)
+}
+
+func TestScopeService_DeleteScope(t *testing.T) {
+	ss, _ := newScopeService()
+
+	err := ss.DeleteScope(context.Background(), "profile")
+	unknownErr := ss.DeleteScope(context.Background(), "profile")
+	found, _ := ss.FindScope(context.Background(), "profile")
+
+	assert.Nil(t, err)
+	assert.Equal(t, util.ErrInvalidRequest, unknownErr)
+	assert.Nil(t, found)
+}
+
+func TestScopeService_SaveClaimThenDeleteClaim(t *testing.T) {
+	ss, _ := newScopeService()
+
+	saveErr := ss.SaveClaim(context.Background(), &domain.Claim{Name: "name", Description: "Your full name"})
+	claims, _ := ss.FindClaims(context.Background())
+	deleteErr := ss.DeleteClaim(context.Background(), "name")
+	unknownErr := ss.DeleteClaim(context.Background(), "name")
+	profile, _ := ss.FindScope(context.Background(), "profile")
+
+	assert.Nil(t, saveErr)
+	if assert.Len(t, claims, 1) {
+		assert.Equal(t, "Your full name", claims[0].Description)
+	}
+	assert.Nil(t, deleteErr)
+	assert.Equal(t, util.ErrInvalidRequest, unknownErr)
+	assert.Empty(t, profile.Claims)
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+const sessionSweeperLockName = "go-ciba:session-sweeper"
+
+type SweeperConfig struct {
+	// How often the sweeper runs.
+	Interval time.Duration
+	// How long expired Ciba sessions and access tokens are kept before being deleted.
+	Retention time.Duration
+	// The maximum number of rows handled per query.
+	BatchSize int
+	// How long the sweeper lock is held before another instance may take it over.
+	// A sweep stops once nine tenths of it have passed, the rest is left to the next one.
+	LockTtl time.Duration
+}
+
+func NewSweeperConfig() *SweeperConfig {
+	return &SweeperConfig{
+		Interval:  1 * time.Minute,
+		Retention: 24 * time.Hour,
+		BatchSize: 100,
+		LockTtl:   5 * time.Minute,
+	}
+}
+
+type sessionSweeper struct {
+	cibaSessionRepo repository.CibaSessionRepositoryInterface
+	accessTokenRepo repository.AccessTokenRepositoryInterface
+	clientAppRepo   repository.ClientApplicationRepositoryInterface
+	locker          repository.LockerInterface
+
+	clientAppNotification transport.ClientNotifier
+
+	config *SweeperConfig
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Creates a sweeper that expires Ciba sessions whose lifetime has passed and purges them,
+// along with expired access tokens, once the retention period is over.
+// A nil locker means the sweeper assumes it's the only instance running.
+func NewSessionSweeper(
+	cibaSessionRepo repository.CibaSessionRepositoryInterface,
+	accessTokenRepo repository.AccessTokenRepositoryInterface,
+	clientAppRepo repository.ClientApplicationRepositoryInterface,
+	locker repository.LockerInterface,
+	config *SweeperConfig,
+) *sessionSweeper {
+	return &sessionSweeper{
+		cibaSessionRepo:       cibaSessionRepo,
+		accessTokenRepo:       accessTokenRepo,
+		clientAppRepo:         clientAppRepo,
+		locker:                locker,
+		clientAppNotification: transport.NewClientAppNotificationClient(),
+		config:                config,
+		stop:                  make(chan struct{}),
+	}
+}
+
+// Runs Sweep every configured interval until Stop is called, a stopped sweeper doesn't start again.
+func (s *sessionSweeper) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Sweep(context.Background()); err != nil {
+					log.Printf("[go-ciba][sweeper] an error occured sweeping %s\n", err.Error())
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the sweeper and waits for the running sweep, if any, to finish. It can be called
+// more than once, and before Start.
+func (s *sessionSweeper) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.wg.Wait()
+}
+
+// Expires every Ciba session whose lifetime has passed, notifying push clients,
+// then deletes the Ciba sessions and access tokens that expired before the retention period.
+func (s *sessionSweeper) Sweep(ctx context.Context) error {
+	if s.locker != nil {
+		acquired, err := s.locker.TryLock(ctx, sessionSweeperLockName, s.config.LockTtl)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			log.Println("[go-ciba][sweeper] another instance is sweeping, skipping")
+			return nil
+		}
+		defer func() {
+			if err := s.locker.Unlock(ctx, sessionSweeperLockName); err != nil {
+				log.Printf("[go-ciba][sweeper] failed releasing lock %s\n", err.Error())
+			}
+		}()
+		// The lock isn't renewed, so the sweep must be done before it expires and another instance takes it.
+		// The lock is released with ctx, which outlives the sweep.
+		sweepCtx, cancel := context.WithTimeout(ctx, s.config.LockTtl-s.config.LockTtl/10)
+		defer cancel()
+		return s.sweep(sweepCtx)
+	}
+	return s.sweep(ctx)
+}
+
+func (s *sessionSweeper) sweep(ctx context.Context) error {
+	now := time.Now().UTC()
+	if err := s.expireSessions(ctx, now); err != nil {
+		return err
+	}
+	return s.purge(ctx, now.Add(-s.config.Retention))
+}
+
+func (s *sessionSweeper) expireSessions(ctx context.Context, now time.Time) error {
+	clientApps := make(map[string]*domain.ClientApplication)
+	for {
+		cibaSessions, err := s.cibaSessionRepo.FindExpired(ctx, now, s.config.BatchSize)
+		if err != nil {
+			return err
+		}
+		expired := 0
+		for _, cibaSession := range cibaSessions {
+			if !cibaSession.ExpireIfElapsed() {
+				continue
+			}
+			if err := s.cibaSessionRepo.Update(ctx, cibaSession); errors.Is(err, repository.ErrConcurrentUpdate) {
+				// e.g. it was approved meanwhile, the next sweep expires it if it's still due.
+				log.Printf("[go-ciba][sweeper] ciba session %s was updated concurrently, skipping\n", cibaSession.AuthReqId)
+				continue
+			} else if err != nil {
+				return err
+			}
+			expired++
+			log.Printf("[go-ciba][sweeper] ciba session %s has expired\n", cibaSession.AuthReqId)
+
+			clientApp, ok := clientApps[cibaSession.ClientId]
+			if !ok {
+				if clientApp, err = s.clientAppRepo.FindById(ctx, cibaSession.ClientId); err != nil {
+					return err
+				}
+				clientApps[cibaSession.ClientId] = clientApp
+			}
+			if clientApp != nil && clientApp.TokenMode == domain.ModePush {
+				s.notifyExpired(ctx, clientApp, cibaSession)
+			}
+		}
+		// Skipped sessions are found again, a batch of them only would be found forever.
+		if len(cibaSessions) < s.config.BatchSize || expired == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *sessionSweeper) notifyExpired(ctx context.Context, clientApp *domain.ClientApplication, cibaSession *domain.CibaSession) {
+	err := s.clientAppNotification.NotifyClient(ctx, &transport.ClientPushError{
+		Endpoint:                clientApp.ClientNotificationEndpoint,
+		ClientNotificationToken: cibaSession.ClientNotificationToken,
+		AuthReqId:               cibaSession.AuthReqId,
+		Error:                   util.ErrExpiredToken,
+	})
+	if err != nil {
+		log.Printf("[go-ciba][sweeper] failed notifying client %s of expired ciba session %s. %s\n", clientApp.Id, cibaSession.AuthReqId, err.Error())
+	}
+}
+
+func (s *sessionSweeper) purge(ctx context.Context, before time.Time) error {
+	for {
+		deleted, err := s.cibaSessionRepo.DeleteExpiredBefore(ctx, before, s.config.BatchSize)
+		if err != nil {
+			return err
+		}
+		if deleted < s.config.BatchSize {
+			break
+		}
+	}
+	for {
+		deleted, err := s.accessTokenRepo.DeleteExpiredBefore(ctx, before, s.config.BatchSize)
+		if err != nil {
+			return err
+		}
+		if deleted < s.config.BatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/service/transport"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/stretchr/testify/assert"
+)
+
+type sweeperCibaSessionRepository struct {
+	data map[string]*domain.CibaSession
+	// Ciba sessions updated elsewhere since they were read, updating them fails.
+	conflicts map[string]bool
+}
+
+// In memory mock of CibaSessionRepositoryInterface holding only the given Ciba sessions.
+func newSweeperCibaSessionRepository(cibaSessions ...*domain.CibaSession) *sweeperCibaSessionRepository {
+	repo := &sweeperCibaSessionRepository{data: map[string]*domain.CibaSession{}, conflicts: map[string]bool{}}
+	for _, cs := range cibaSessions {
+		repo.data[cs.AuthReqId] = cs
+	}
+	return repo
+}
+
+func (s *sweeperCibaSessionRepository) Create(ctx context.Context, cibaSession *domain.CibaSession) error {
+	s.data[cibaSession.AuthReqId] = cibaSession
+	return nil
+}
+
+func (s *sweeperCibaSessionRepository) FindById(ctx context.Context, id string) (*domain.CibaSession, error) {
+	return s.data[id], nil
+}
+
+func (s *sweeperCibaSessionRepository) Update(ctx context.Context, cibaSession *domain.CibaSession) error {
+	if s.conflicts[cibaSession.AuthReqId] {
+		return repository.ErrConcurrentUpdate
+	}
+	s.data[cibaSession.AuthReqId] = cibaSession
+	return nil
+}
+
+func (s *sweeperCibaSessionRepository) FindExpired(ctx context.Context, before time.Time, limit int) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range s.data {
+		if len(cibaSessions) < limit && !cs.IsFinal() && cs.GetExpiresAt().Before(before) {
+			cibaSessions = append(cibaSessions, cs)
+		}
+	}
+	return cibaSessions, nil
+}
+
+func (s *sweeperCibaSessionRepository) FindPendingByUserId(ctx context.Context, userId string, after time.Time) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range s.data {
+		if cs.UserId == userId && cs.IsAuthorizationPending() && cs.GetExpiresAt().After(after) {
+			cibaSessions = append(cibaSessions, cs)
+		}
+	}
+	return cibaSessions, nil
+}
+
+func (s *sweeperCibaSessionRepository) FindActiveByUserIdAndClientId(ctx context.Context, userId, clientId string) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range s.data {
+		if cs.UserId == userId && cs.ClientId == clientId && !cs.IsFinal() {
+			cibaSessions = append(cibaSessions, cs)
+		}
+	}
+	return cibaSessions, nil
+}
+
+func (s *sweeperCibaSessionRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	deleted := 0
+	for id, cs := range s.data {
+		if deleted < limit && cs.GetExpiresAt().Before(before) {
+			delete(s.data, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+type lockerMock struct {
+	held     bool
+	unlocked bool
+}
+
+func (l *lockerMock) TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return !l.held, nil
+}
+
+func (l *lockerMock) Unlock(ctx context.Context, name string) error {
+	l.unlocked = true
+	return nil
+}
+
+type recordingNotificationMock struct {
+	sent []transport.ClientMessage
+}
+
+func (r *recordingNotificationMock) NotifyClient(ctx context.Context, message transport.ClientMessage) error {
+	r.sent = append(r.sent, message)
+	return nil
+}
+
+func newExpiredCibaSession(clientApp *domain.ClientApplication, age time.Duration) *domain.CibaSession {
+	interval := int64(5)
+	cs := domain.NewCibaSession(clientApp, "hint", "binding", "client-notification-token", "openid", 60, &interval)
+	cs.CreatedAt = cs.CreatedAt.Add(-age)
+	cs.ExpiresAt = cs.ExpiresAt.Add(-age)
+	return cs
+}
+
+func newTestSessionSweeper(cibaSessionRepo *sweeperCibaSessionRepository, locker repository.LockerInterface) (*sessionSweeper, *recordingNotificationMock) {
+	notification := &recordingNotificationMock{}
+	config := NewSweeperConfig()
+	config.BatchSize = 1
+	sweeper := NewSessionSweeper(cibaSessionRepo, &AccessTokenVolatileRepository{}, test_data.NewClientApplicationVolatileRepository(), locker, config)
+	sweeper.clientAppNotification = notification
+	return sweeper, notification
+}
+
+func TestSessionSweeper_Sweep_ShouldExpireSessionsAndNotifyPushClients(t *testing.T) {
+	push := newExpiredCibaSession(&test_data.ClientAppPush, 5*time.Minute)
+	poll := newExpiredCibaSession(&test_data.ClientAppPoll, 5*time.Minute)
+	active := newExpiredCibaSession(&test_data.ClientAppPush, 0)
+	repo := newSweeperCibaSessionRepository(push, poll, active)
+	sweeper, notification := newTestSessionSweeper(repo, nil)
+
+	err := sweeper.Sweep(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, domain.StatusExpired, push.GetStatus())
+	assert.Equal(t, domain.StatusExpired, poll.GetStatus())
+	assert.Equal(t, domain.StatusPending, active.GetStatus())
+	assert.Len(t, notification.sent, 1)
+	assert.Equal(t, &transport.ClientPushError{
+		Endpoint:                test_data.ClientAppPush.ClientNotificationEndpoint,
+		ClientNotificationToken: push.ClientNotificationToken,
+		AuthReqId:               push.AuthReqId,
+		Error:                   util.ErrExpiredToken,
+	}, notification.sent[0])
+}
+
+func TestSessionSweeper_Sweep_ShouldDeleteSessionsPastRetention(t *testing.T) {
+	stale := newExpiredCibaSession(&test_data.ClientAppPoll, 48*time.Hour)
+	recent := newExpiredCibaSession(&test_data.ClientAppPoll, 5*time.Minute)
+	repo := newSweeperCibaSessionRepository(stale, recent)
+	sweeper, _ := newTestSessionSweeper(repo, nil)
+
+	err := sweeper.Sweep(context.Background())
+
+	assert.NoError(t, err)
+	assert.NotContains(t, repo.data, stale.AuthReqId)
+	assert.Contains(t, repo.data, recent.AuthReqId)
+	assert.Equal(t, domain.StatusExpired, recent.GetStatus())
+}
+
+func TestSessionSweeper_Sweep_ShouldSkip_WhenLockIsHeldElsewhere(t *testing.T) {
+	cs := newExpiredCibaSession(&test_data.ClientAppPush, 5*time.Minute)
+	locker := &lockerMock{held: true}
+	sweeper, notification := newTestSessionSweeper(newSweeperCibaSessionRepository(cs), locker)
+
+	err := sweeper.Sweep(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, domain.StatusPending, cs.GetStatus())
+	assert.Empty(t, notification.sent)
+	assert.False(t, locker.unlocked)
+}
+
+func TestSessionSweeper_Sweep_ShouldReleaseLock(t *testing.T) {
+	cs := newExpiredCibaSession(&test_data.ClientAppPoll, 5*time.Minute)
+	locker := &lockerMock{}
+	sweeper, _ := newTestSessionSweeper(newSweeperCibaSessionRepository(cs), locker)
+
+	err := sweeper.Sweep(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, domain.StatusExpired, cs.GetStatus())
+	assert.True(t, locker.unlocked)
+}
+
+func TestSessionSweeper_Sweep_ShouldSkipSession_WhenUpdatedConcurrently(t *testing.T) {
+	approved := newExpiredCibaSession(&test_data.ClientAppPush, 5*time.Minute)
+	expired := newExpiredCibaSession(&test_data.ClientAppPoll, 5*time.Minute)
+	repo := newSweeperCibaSessionRepository(approved, expired)
+	repo.conflicts[approved.AuthReqId] = true
+	sweeper, notification := newTestSessionSweeper(repo, nil)
+	sweeper.config.BatchSize = 10
+
+	err := sweeper.Sweep(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, domain.StatusExpired, expired.GetStatus())
+	assert.Empty(t, notification.sent)
+}
+
+func TestSessionSweeper_Stop_ShouldNotPanic_WhenNotStartedOrStoppedTwice(t *testing.T) {
+	notStarted, _ := newTestSessionSweeper(newSweeperCibaSessionRepository(), nil)
+	started, _ := newTestSessionSweeper(newSweeperCibaSessionRepository(), nil)
+	started.Start()
+
+	assert.NotPanics(t, notStarted.Stop)
+	assert.NotPanics(t, started.Stop)
+	assert.NotPanics(t, started.Stop)
+}
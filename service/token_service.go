@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"time"
@@ -43,9 +45,9 @@ func NewTokenRequest(r *http.Request) *TokenRequest {
 }
 
 type TokenServiceInterface interface {
-	HandleTokenRequest(request *TokenRequest) (*TokenResponse, *util.OidcError)
-	GrantAccessToken(request *TokenRequest) (*domain.Tokens, *util.OidcError)
-	ValidateTokenRequest(request *TokenRequest) *util.OidcError
+	HandleTokenRequest(ctx context.Context, request *TokenRequest) (*TokenResponse, *util.OidcError)
+	GrantAccessToken(ctx context.Context, request *TokenRequest) (*domain.Tokens, *util.OidcError)
+	ValidateTokenRequest(ctx context.Context, request *TokenRequest) *util.OidcError
 }
 
 type TokenResponse struct {
@@ -54,9 +56,12 @@ type TokenResponse struct {
 	RefreshToken *string `json:"refresh_token"`
 	ExpiresIn    int64   `json:"expires_in"`
 	IdToken      string  `json:"id_token"`
+	// The granted scope, it's less than the requested one when the user approved only part of it.
+	Scope string `json:"scope,omitempty"`
 }
 
 type tokenService struct {
+	dataStore       repository.DataStoreInterface
 	accessTokenRepo repository.AccessTokenRepositoryInterface
 	clientAppRepo   repository.ClientApplicationRepositoryInterface
 	cibaSessionRepo repository.CibaSessionRepositoryInterface
@@ -67,13 +72,14 @@ type tokenService struct {
 	authenticationContext *http_auth.ClientAuthenticationContext
 }
 
-func NewTokenService(accessTokenRepo repository.AccessTokenRepositoryInterface, clientAppRepo repository.ClientApplicationRepositoryInterface, cibaSessionRepo repository.CibaSessionRepositoryInterface, keyRepo repository.KeyRepositoryInterface, userClaimRepo repository.UserClaimRepositoryInterface, grant *grant.CibaGrant) *tokenService {
+func NewTokenService(dataStore repository.DataStoreInterface, grant *grant.CibaGrant) *tokenService {
 	return &tokenService{
-		accessTokenRepo:       accessTokenRepo,
-		clientAppRepo:         clientAppRepo,
-		cibaSessionRepo:       cibaSessionRepo,
-		keyRepo:               keyRepo,
-		userClaimRepo:         userClaimRepo,
+		dataStore:             dataStore,
+		accessTokenRepo:       dataStore.GetAccessTokenRepository(),
+		clientAppRepo:         dataStore.GetClientApplicationRepository(),
+		cibaSessionRepo:       dataStore.GetCibaSessionRepository(),
+		keyRepo:               newSigningKeyResolver(dataStore),
+		userClaimRepo:         dataStore.GetUserClaimRepository(),
 		grant:                 grant,
 		authenticationContext: http_auth.NewClientAuthenticationContext(grant.Config),
 	}
@@ -86,15 +92,16 @@ func makeSuccessfulTokenResponse(tokens *domain.Tokens) *TokenResponse {
 		RefreshToken: nil,
 		ExpiresIn:    tokens.AccessToken.ExpiresIn,
 		IdToken:      tokens.IdToken.Value,
+		Scope:        tokens.AccessToken.Scope,
 	}
 }
 
 // This performs authentication on the client app
-func (t *tokenService) ValidateTokenRequest(request *TokenRequest) *util.OidcError {
+func (t *tokenService) ValidateTokenRequest(ctx context.Context, request *TokenRequest) *util.OidcError {
 	if request.grantType != grant.IdentifierCiba {
 		return util.ErrUnsupportedGrantType
 	}
-	ca, err := t.clientAppRepo.FindById(request.clientId)
+	ca, err := t.clientAppRepo.FindById(ctx, request.clientId)
 	if err != nil {
 		log.Println(err)
 		return util.ErrGeneral
@@ -109,11 +116,11 @@ func (t *tokenService) ValidateTokenRequest(request *TokenRequest) *util.OidcErr
 	return nil
 }
 
-func (t *tokenService) HandleTokenRequest(request *TokenRequest) (*TokenResponse, *util.OidcError) {
-	if err := t.ValidateTokenRequest(request); err != nil {
+func (t *tokenService) HandleTokenRequest(ctx context.Context, request *TokenRequest) (*TokenResponse, *util.OidcError) {
+	if err := t.ValidateTokenRequest(ctx, request); err != nil {
 		return nil, err
 	}
-	tokens, err := t.GrantAccessToken(request)
+	tokens, err := t.GrantAccessToken(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -121,25 +128,33 @@ func (t *tokenService) HandleTokenRequest(request *TokenRequest) (*TokenResponse
 }
 
 func (t *tokenService) validate(cs *domain.CibaSession) *util.OidcError {
-	if !cs.IsValid() || cs.IsTimeExpired() {
+	if cs.IsTimeExpired() {
 		return util.ErrExpiredToken
-	} else if cs.IsAuthorizationPending() {
+	}
+	switch cs.GetStatus() {
+	case domain.StatusPending:
 		return util.ErrAuthorizationPending
-	} else if !cs.IsConsented() {
+	case domain.StatusApproved:
+		return nil
+	case domain.StatusDenied, domain.StatusRevoked:
 		return util.ErrAccessDenied
+	default:
+		// expired, cancelled or already redeemed
+		return util.ErrExpiredToken
 	}
-	return nil
 }
 
 type UserConsentResponse struct {
-	err    *util.OidcError
-	status bool
+	err         *util.OidcError
+	status      bool
+	cibaSession *domain.CibaSession
 }
 
-func waitForUserConsent(response chan UserConsentResponse, authReqId string, cibaSessionRepo repository.CibaSessionRepositoryInterface) {
+// Polls the CIBA session until the user has given or denied consent, it times out, or ctx is done.
+func waitForUserConsent(ctx context.Context, response chan UserConsentResponse, authReqId string, cibaSessionRepo repository.CibaSessionRepositoryInterface) {
 	start := util.NowInt()
 	for true {
-		cs, err := cibaSessionRepo.FindById(authReqId)
+		cs, err := cibaSessionRepo.FindById(ctx, authReqId)
 		if err != nil {
 			log.Println(err)
 			response <- UserConsentResponse{
@@ -148,6 +163,23 @@ func waitForUserConsent(response chan UserConsentResponse, authReqId string, cib
 			}
 			break
 		}
+		// Denied and revoked are final statuses too, they must be reported as such rather than as expired.
+		if cs != nil && (cs.GetStatus() == domain.StatusDenied || cs.GetStatus() == domain.StatusRevoked) {
+			log.Printf("%s user didn't give consent\n", LogTag)
+			response <- UserConsentResponse{
+				err:    util.ErrAccessDenied,
+				status: false,
+			}
+			break
+		}
+		if cs == nil || cs.IsTimeExpired() || cs.IsFinal() {
+			log.Printf("%s ciba session is no longer valid while waiting for user consent\n", LogTag)
+			response <- UserConsentResponse{
+				err:    util.ErrExpiredToken,
+				status: false,
+			}
+			break
+		}
 		if cs.IsAuthorizationPending() {
 			now := util.NowInt()
 			timeTakenInSeconds := now - start
@@ -159,30 +191,32 @@ func waitForUserConsent(response chan UserConsentResponse, authReqId string, cib
 				}
 				break
 			}
-			time.Sleep(1 * time.Second)
-			continue
-		} else if cs.IsConsented() {
-			log.Printf("%s user has consented\n", LogTag)
-			response <- UserConsentResponse{
-				err:    nil,
-				status: true,
-			}
-			break
-		} else {
-			log.Printf("%s user didn't give consent\n", LogTag)
-			response <- UserConsentResponse{
-				err:    util.ErrAccessDenied,
-				status: false,
+			select {
+			case <-ctx.Done():
+				log.Printf("%s stopped waiting for user consent. %s\n", LogTag, ctx.Err().Error())
+				response <- UserConsentResponse{
+					err:    util.ErrAuthorizationPending,
+					status: false,
+				}
+				return
+			case <-time.After(1 * time.Second):
 			}
-			break
+			continue
+		}
+		log.Printf("%s user has consented\n", LogTag)
+		response <- UserConsentResponse{
+			err:         nil,
+			status:      true,
+			cibaSession: cs,
 		}
+		break
 	}
 }
 
-func (t *tokenService) GrantAccessToken(request *TokenRequest) (*domain.Tokens, *util.OidcError) {
+func (t *tokenService) GrantAccessToken(ctx context.Context, request *TokenRequest) (*domain.Tokens, *util.OidcError) {
 	// Do some validation
 	// Check if auth_req_id exists
-	cs, err := t.cibaSessionRepo.FindById(request.authReqId)
+	cs, err := t.cibaSessionRepo.FindById(ctx, request.authReqId)
 	if err != nil {
 		log.Println(err)
 		return nil, util.ErrGeneral
@@ -190,8 +224,15 @@ func (t *tokenService) GrantAccessToken(request *TokenRequest) (*domain.Tokens,
 		return nil, util.ErrInvalidGrant
 	}
 
+	if cs.ExpireIfElapsed() {
+		if err := t.cibaSessionRepo.Update(ctx, cs); err != nil {
+			log.Printf("%s failed updating CIBA session. %s", LogTag, err.Error())
+			return nil, util.ErrGeneral
+		}
+	}
+
 	// Check if client_id that is attached to auth_req_id is registered to use CIBA
-	ca, err := t.clientAppRepo.FindById(cs.ClientId)
+	ca, err := t.clientAppRepo.FindById(ctx, cs.ClientId)
 	if err != nil {
 		log.Println(err)
 		return nil, util.ErrGeneral
@@ -220,18 +261,34 @@ func (t *tokenService) GrantAccessToken(request *TokenRequest) (*domain.Tokens,
 		}
 
 		cs.LatestTokenRequestedAt = &now
-		if err := t.cibaSessionRepo.Update(cs); err != nil {
+		if err := t.cibaSessionRepo.Update(ctx, cs); errors.Is(err, repository.ErrConcurrentUpdate) {
+			// The status has changed since the session was read, e.g. the user answered, so it's validated again.
+			// The time of the request doesn't matter anymore as the session is no longer pending.
+			cs, err = t.cibaSessionRepo.FindById(ctx, request.authReqId)
+			if err != nil {
+				log.Printf("%s failed finding CIBA session. %s", LogTag, err.Error())
+				return nil, util.ErrGeneral
+			}
+			if cs == nil {
+				return nil, util.ErrExpiredToken
+			}
+			if err := t.validate(cs); err != nil && err != util.ErrAuthorizationPending {
+				return nil, err
+			}
+		} else if err != nil {
 			log.Printf("%s failed updating CIBA session.", LogTag)
 			return nil, util.ErrGeneral
 		}
 
 		ucrChan := make(chan UserConsentResponse)
-		go waitForUserConsent(ucrChan, request.authReqId, t.cibaSessionRepo)
+		go waitForUserConsent(ctx, ucrChan, request.authReqId, t.cibaSessionRepo)
 		resp := <-ucrChan
 		if resp.err != nil {
 			log.Printf("%s failed waiting for user consent. %s", LogTag, resp.err.Error())
 			return nil, resp.err
 		}
+		// The session has changed status while waiting
+		cs = resp.cibaSession
 	} else if ca.TokenMode == domain.ModePing {
 		err := t.validate(cs)
 		if err != nil {
@@ -241,7 +298,7 @@ func (t *tokenService) GrantAccessToken(request *TokenRequest) (*domain.Tokens,
 		return nil, util.ErrUnauthorizedClient
 	}
 
-	key, err := t.keyRepo.FindPrivateKeyByClientId(request.clientId)
+	key, err := t.keyRepo.FindPrivateKeyByClientId(ctx, request.clientId)
 	if err != nil {
 		return nil, util.ErrGeneral
 	}
@@ -251,10 +308,11 @@ func (t *tokenService) GrantAccessToken(request *TokenRequest) (*domain.Tokens,
 		return nil, util.ErrInvalidGrant
 	}
 
-	extraClaims, err := t.userClaimRepo.GetUserClaims(cs.UserId, cs.Scope)
+	extraClaims, err := t.userClaimRepo.GetUserClaims(ctx, cs.UserId, cs.GetGrantedScope())
 	if err != nil {
 		return nil, util.ErrGeneral
 	}
+	extraClaims = addConsentSignatureClaims(extraClaims, cs, t.grant.Config)
 	now := util.NowInt()
 	// TODO: support other grant types as well, not just CIBA.
 	tokens := t.grant.CreateAccessTokenAndIdToken(domain.DefaultCibaIdTokenClaims{
@@ -269,16 +327,23 @@ func (t *tokenService) GrantAccessToken(request *TokenRequest) (*domain.Tokens,
 		AuthReqId: request.authReqId,
 	}, extraClaims, key.Private, key.Alg, key.Id)
 
-	accessToken := domain.NewAccessToken(tokens.AccessToken.Value, request.clientId, cs.Hint, cs.Scope, time.Unix(now+tokens.AccessToken.ExpiresIn, 0))
-	if err := t.accessTokenRepo.Create(accessToken); err != nil {
-		log.Printf("%s cannot create access token. %s", LogTag, err.Error())
-		return nil, util.ErrGeneral
+	accessToken := domain.NewAccessToken(tokens.AccessToken.Value, request.clientId, cs.Hint, cs.GetGrantedScope(), time.Unix(now+tokens.AccessToken.ExpiresIn, 0))
+	if err := cs.Redeem(domain.ActorSystem); err != nil {
+		log.Printf("%s cannot redeem CIBA session. %s", LogTag, err.Error())
+		return nil, util.ErrExpiredToken
 	}
-
-	cs.Expire()
 	cs.IdToken = tokens.IdToken.Value
-	if err := t.cibaSessionRepo.Update(cs); err != nil {
-		log.Printf("%s failed updating CIBA session. %s", LogTag, err.Error())
+	tokens.AccessToken.Scope = cs.GetGrantedScope()
+
+	// Either the access token is stored and the CIBA session is redeemed, or neither is.
+	err = t.dataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		if err := tx.GetAccessTokenRepository().Create(ctx, accessToken); err != nil {
+			return err
+		}
+		return tx.GetCibaSessionRepository().Update(ctx, cs)
+	})
+	if err != nil {
+		log.Printf("%s failed storing access token and CIBA session. %s", LogTag, err.Error())
 		return nil, util.ErrGeneral
 	}
 
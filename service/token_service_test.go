@@ -1,14 +1,19 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/adisazhar123/go-ciba/domain"
 	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/repository/memory"
 	"github.com/adisazhar123/go-ciba/test_data"
 	"github.com/adisazhar123/go-ciba/util"
 	"github.com/stretchr/testify/assert"
@@ -22,22 +27,38 @@ func newAccessTokenVolatileRepository() *AccessTokenVolatileRepository {
 	return &AccessTokenVolatileRepository{data: map[string]*domain.AccessToken{}}
 }
 
-func (a *AccessTokenVolatileRepository) Create(accessToken *domain.AccessToken) error {
+func (a *AccessTokenVolatileRepository) Create(ctx context.Context, accessToken *domain.AccessToken) error {
 	a.data[accessToken.Value] = accessToken
 	return nil
 }
 
-func (a *AccessTokenVolatileRepository) Find(accessToken string) (*domain.AccessToken, error) {
+func (a *AccessTokenVolatileRepository) Find(ctx context.Context, accessToken string) (*domain.AccessToken, error) {
 	return nil, nil
 }
 
+func (a *AccessTokenVolatileRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	return 0, nil
+}
+
+func (a *AccessTokenVolatileRepository) DeleteByUserIdAndClientId(ctx context.Context, userId, clientId string) (int, error) {
+	return 0, nil
+}
+
 func newTokenService() *tokenService {
-	return &tokenService{
+	dataStore := &dataStoreMock{
 		accessTokenRepo: newAccessTokenVolatileRepository(),
 		clientAppRepo:   test_data.NewClientApplicationVolatileRepository(),
 		cibaSessionRepo: test_data.NewCibaSessionVolatileRepository(),
 		userClaimRepo:   test_data.NewUserClaimVolatileRepository(),
 		keyRepo:         test_data.NewKeyVolatileRepository(),
+	}
+	return &tokenService{
+		dataStore:       dataStore,
+		accessTokenRepo: dataStore.accessTokenRepo,
+		clientAppRepo:   dataStore.clientAppRepo,
+		cibaSessionRepo: dataStore.cibaSessionRepo,
+		userClaimRepo:   dataStore.userClaimRepo,
+		keyRepo:         dataStore.keyRepo,
 		grant:           grant.NewCibaGrant(),
 	}
 }
@@ -45,7 +66,7 @@ func newTokenService() *tokenService {
 func TestTokenService_GrantAccessToken_ShouldReturnErrorInvalidGrant_WhenAuthReqIdDoesntExist(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		authReqId: "unknown-auth-req-id",
 	})
 
@@ -55,7 +76,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorInvalidGrant_WhenAuthReq
 func TestTokenService_GrantAccessToken_ShouldReturnErrorInvalidGrant_WhenAuthReqIdIsIssuedToAnotherClient(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  "different-client-id",
 		authReqId: test_data.CibaSession1.AuthReqId,
 	})
@@ -66,7 +87,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorInvalidGrant_WhenAuthReq
 func TestTokenService_GrantAccessToken_ShouldReturnErrorInvalidClient_WhenAuthReqIdIsntAttachedToClientApplication(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession2.ClientId,
 		authReqId: test_data.CibaSession2.AuthReqId,
 	})
@@ -77,7 +98,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorInvalidClient_WhenAuthRe
 func TestTokenService_GrantAccessToken_ShouldReturnErrorUnauthorizedClient_WhenClientIsntRegisteredToUseCiba(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.ClientAppNotRegisteredToUseCiba.Id,
 		authReqId: test_data.CibaSession3.AuthReqId,
 	})
@@ -88,7 +109,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorUnauthorizedClient_WhenC
 func TestTokenService_GrantAccessToken_ShouldReturnErrorUnauthorizedClient_WhenClientIsRegisteredToUsePushTokenMode(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession4.ClientId,
 		authReqId: test_data.CibaSession4.AuthReqId,
 	})
@@ -99,7 +120,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorUnauthorizedClient_WhenC
 func TestTokenService_GrantAccessToken_ShouldReturnErrorExpiredToken_WhenTokenIsExpired(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession5.ClientId,
 		authReqId: test_data.CibaSession5.AuthReqId,
 	})
@@ -110,7 +131,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorExpiredToken_WhenTokenIs
 func TestTokenService_GrantAccessToken_ShouldReturnErrorAuthorizationPending_WhenUserHasntGivenConsent(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession6.ClientId,
 		authReqId: test_data.CibaSession6.AuthReqId,
 	})
@@ -121,7 +142,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorAuthorizationPending_Whe
 func TestTokenService_GrantAccessToken_ShouldReturnErrorAccessDenied_WhenUserDidntGiveConsent(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession7.ClientId,
 		authReqId: test_data.CibaSession7.AuthReqId,
 	})
@@ -135,7 +156,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnError_WhenKeyIsntFoundForClie
 		clientId:  test_data.CibaSession8.ClientId,
 		authReqId: test_data.CibaSession8.AuthReqId,
 	}
-	_, err := ts.GrantAccessToken(req)
+	_, err := ts.GrantAccessToken(context.Background(), req)
 
 	assert.EqualError(t, err, util.ErrInvalidGrant.Error())
 }
@@ -143,7 +164,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnError_WhenKeyIsntFoundForClie
 func TestTokenService_GrantAccessToken_ShouldReturnTokens_WhenClientAppPingIsValid(t *testing.T) {
 	ts := newTokenService()
 
-	res, err := ts.GrantAccessToken(&TokenRequest{
+	res, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession9.ClientId,
 		authReqId: test_data.CibaSession9.AuthReqId,
 	})
@@ -157,7 +178,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnTokens_WhenClientAppPingIsVal
 func TestTokenService_GrantAccessToken_ShouldReturnTokens_WhenClientAppPollIsValid_Already_Consented(t *testing.T) {
 	ts := newTokenService()
 
-	res, err := ts.GrantAccessToken(&TokenRequest{
+	res, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession10.ClientId,
 		authReqId: test_data.CibaSession10.AuthReqId,
 	})
@@ -171,7 +192,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnTokens_WhenClientAppPollIsVal
 func TestTokenService_GrantAccessToken_ShouldNotReturnErrorSlowDown_WhenClientAppPollIsPollingTooFast(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession11.ClientId,
 		authReqId: test_data.CibaSession11.AuthReqId,
 	})
@@ -182,7 +203,7 @@ func TestTokenService_GrantAccessToken_ShouldNotReturnErrorSlowDown_WhenClientAp
 func TestTokenService_GrantAccessToken_ShouldReturnErrorAuthorizationPending_WhenClientAppPollIsntBeingGivenAuthorizationByUser(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession12.ClientId,
 		authReqId: test_data.CibaSession12.AuthReqId,
 	})
@@ -193,7 +214,7 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorAuthorizationPending_Whe
 func TestTokenService_GrantAccessToken_ShouldReturnErrorAccessDenied_WhenClientAppIsDeniedAuthorizationByUser(t *testing.T) {
 	ts := newTokenService()
 
-	_, err := ts.GrantAccessToken(&TokenRequest{
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
 		clientId:  test_data.CibaSession13.ClientId,
 		authReqId: test_data.CibaSession13.AuthReqId,
 	})
@@ -201,6 +222,44 @@ func TestTokenService_GrantAccessToken_ShouldReturnErrorAccessDenied_WhenClientA
 	assert.EqualError(t, err, util.ErrAccessDenied.Error())
 }
 
+func TestTokenService_GrantAccessToken_ShouldStopWaitingForUserConsent_WhenContextIsCancelled(t *testing.T) {
+	ts := newTokenService()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+
+	_, err := ts.GrantAccessToken(ctx, &TokenRequest{
+		clientId:  test_data.CibaSession12.ClientId,
+		authReqId: test_data.CibaSession12.AuthReqId,
+	})
+
+	assert.EqualError(t, err, util.ErrAuthorizationPending.Error())
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestTokenService_GrantAccessToken_ShouldReturnErrorAccessDenied_WhenUserDeniesWhileWaiting(t *testing.T) {
+	ts := newTokenService()
+	ts.cibaSessionRepo = memory.NewDataStore().GetCibaSessionRepository()
+	cs := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "", "", "openid", 120, nil)
+	cs.UserId = test_data.User1.Id
+	_ = ts.cibaSessionRepo.Create(context.Background(), cs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		stored, _ := ts.cibaSessionRepo.FindById(context.Background(), cs.AuthReqId)
+		_ = stored.Deny(domain.ActorUser)
+		_ = ts.cibaSessionRepo.Update(context.Background(), stored)
+	}()
+
+	_, err := ts.GrantAccessToken(ctx, &TokenRequest{
+		clientId:  cs.ClientId,
+		authReqId: cs.AuthReqId,
+	})
+
+	assert.EqualError(t, err, util.ErrAccessDenied.Error())
+}
+
 func TestNewTokenRequest_ShouldPopulateIdAndSecretGivenHttpBasicAuthentication(t *testing.T) {
 	clientId := "id"
 	clientSecret := "secret"
@@ -256,3 +315,83 @@ func TestNewTokenRequest_ShouldNotPopulateGivenUnknownClientAuthentication(t *te
 	assert.Empty(t, tokenRequest.clientId)
 	assert.Empty(t, tokenRequest.clientSecret)
 }
+
+// Has the user deny the Ciba session right after it's first read, as if they answered while the token was requested.
+type answeringCibaSessionRepository struct {
+	repository.CibaSessionRepositoryInterface
+	answered bool
+}
+
+func (a *answeringCibaSessionRepository) FindById(ctx context.Context, id string) (*domain.CibaSession, error) {
+	cs, err := a.CibaSessionRepositoryInterface.FindById(ctx, id)
+	if err != nil || cs == nil || a.answered {
+		return cs, err
+	}
+	a.answered = true
+	answered, _ := a.CibaSessionRepositoryInterface.FindById(ctx, id)
+	_ = answered.Deny(domain.ActorUser)
+	return cs, a.CibaSessionRepositoryInterface.Update(ctx, answered)
+}
+
+func TestTokenService_GrantAccessToken_ShouldValidateAgain_WhenUserAnswersWhilePolling(t *testing.T) {
+	ts := newTokenService()
+	ts.cibaSessionRepo = &answeringCibaSessionRepository{CibaSessionRepositoryInterface: memory.NewDataStore().GetCibaSessionRepository()}
+	cs := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "", "", "openid", 120, nil)
+	_ = ts.cibaSessionRepo.Create(context.Background(), cs)
+
+	_, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  cs.ClientId,
+		authReqId: cs.AuthReqId,
+	})
+
+	assert.EqualError(t, err, util.ErrAccessDenied.Error())
+}
+
+type failingAccessTokenRepository struct {
+	AccessTokenVolatileRepository
+}
+
+func (f *failingAccessTokenRepository) Create(ctx context.Context, accessToken *domain.AccessToken) error {
+	return errors.New("failed creating access token")
+}
+
+func newApprovedCibaSession(clientApp *domain.ClientApplication) *domain.CibaSession {
+	interval := int64(5)
+	cs := domain.NewCibaSession(clientApp, test_data.User1.Id, "binding", "client-notification-token", "openid", 3600, &interval)
+	cs.UserId = test_data.User1.Id
+	_ = cs.Approve(domain.ActorUser)
+	return cs
+}
+
+func TestTokenService_GrantAccessToken_ShouldStoreAccessTokenAndRedeemSession_WithinOneTransaction(t *testing.T) {
+	ts := newTokenService()
+	dataStore := ts.dataStore.(*dataStoreMock)
+	cs := newApprovedCibaSession(&test_data.ClientAppPingUserCodeSupported)
+	_ = ts.cibaSessionRepo.Create(context.Background(), cs)
+
+	res, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  cs.ClientId,
+		authReqId: cs.AuthReqId,
+	})
+
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.Equal(t, 1, dataStore.transactions)
+	assert.Contains(t, dataStore.accessTokenRepo.(*AccessTokenVolatileRepository).data, res.AccessToken.Value)
+	assert.Equal(t, domain.StatusRedeemed, cs.GetStatus())
+}
+
+func TestTokenService_GrantAccessToken_ShouldReturnErrorGeneral_WhenStoringAccessTokenFails(t *testing.T) {
+	ts := newTokenService()
+	ts.dataStore.(*dataStoreMock).accessTokenRepo = &failingAccessTokenRepository{}
+	cs := newApprovedCibaSession(&test_data.ClientAppPingUserCodeSupported)
+	_ = ts.cibaSessionRepo.Create(context.Background(), cs)
+
+	res, err := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  cs.ClientId,
+		authReqId: cs.AuthReqId,
+	})
+
+	assert.Nil(t, res)
+	assert.EqualError(t, err, util.ErrGeneral.Error())
+}
@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"errors"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/util"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var ErrInvalidConsentLink = errors.New("consent link is invalid or has expired")
+
+// What following a consent link does, approving or denying a Ciba authentication request.
+type ConsentLink struct {
+	Id        string
+	AuthReqId string
+	Consented bool
+	ExpiresAt time.Time
+}
+
+type consentLinkClaims struct {
+	Consented bool `json:"consented"`
+}
+
+// Signs and verifies the tokens of consent links with HMAC SHA-256.
+// The links are single use as the consent of a Ciba authentication request can only be given once.
+type ConsentLinkSigner struct {
+	key []byte
+	now func() time.Time
+}
+
+// Creates a signer with a key of at least 32 bytes, the key is shared by every server following the links.
+func NewConsentLinkSigner(key []byte) (*ConsentLinkSigner, error) {
+	if len(key) < 32 {
+		return nil, errors.New("consent link key must be at least 32 bytes")
+	}
+	return &ConsentLinkSigner{
+		key: key,
+		now: time.Now,
+	}, nil
+}
+
+// Returns the token of a link approving or denying the Ciba authentication request, valid for lifetime.
+func (s *ConsentLinkSigner) Sign(authReqId string, consented bool, lifetime time.Duration) (string, error) {
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: s.key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	now := s.now()
+	return jwt.Signed(sig).Claims(jwt.Claims{
+		ID:       util.GenerateUuid(),
+		Subject:  authReqId,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(lifetime)),
+	}).Claims(consentLinkClaims{
+		Consented: consented,
+	}).CompactSerialize()
+}
+
+// Returns the consent link of token, or ErrInvalidConsentLink when it isn't signed with the key or has expired.
+func (s *ConsentLinkSigner) Verify(token string) (*ConsentLink, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, ErrInvalidConsentLink
+	}
+	// Only HS256 is accepted, whatever the header says.
+	if len(parsed.Headers) != 1 || parsed.Headers[0].Algorithm != string(jose.HS256) {
+		return nil, ErrInvalidConsentLink
+	}
+	claims := jwt.Claims{}
+	custom := consentLinkClaims{}
+	if err := parsed.Claims(s.key, &claims, &custom); err != nil {
+		return nil, ErrInvalidConsentLink
+	}
+	if claims.Subject == "" || claims.Expiry == nil || claims.ValidateWithLeeway(jwt.Expected{Time: s.now()}, 0) != nil {
+		return nil, ErrInvalidConsentLink
+	}
+	return &ConsentLink{
+		Id:        claims.ID,
+		AuthReqId: claims.Subject,
+		Consented: custom.Consented,
+		ExpiresAt: claims.Expiry.Time(),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var consentLinkKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestConsentLinkSigner_SignThenVerify(t *testing.T) {
+	signer, _ := NewConsentLinkSigner(consentLinkKey)
+
+	approve, _ := signer.Sign(authReqId, true, time.Minute)
+	deny, _ := signer.Sign(authReqId, false, time.Minute)
+	approveLink, approveErr := signer.Verify(approve)
+	denyLink, denyErr := signer.Verify(deny)
+
+	assert.NoError(t, approveErr)
+	assert.NoError(t, denyErr)
+	assert.Equal(t, authReqId, approveLink.AuthReqId)
+	assert.True(t, approveLink.Consented)
+	assert.False(t, denyLink.Consented)
+	assert.NotEqual(t, approveLink.Id, denyLink.Id)
+}
+
+func TestConsentLinkSigner_Verify_ShouldFail_WhenLinkExpired(t *testing.T) {
+	signer, _ := NewConsentLinkSigner(consentLinkKey)
+	now := time.Now()
+	signer.now = func() time.Time { return now }
+	token, _ := signer.Sign(authReqId, true, time.Minute)
+	now = now.Add(2 * time.Minute)
+
+	link, err := signer.Verify(token)
+
+	assert.Nil(t, link)
+	assert.Equal(t, ErrInvalidConsentLink, err)
+}
+
+func TestConsentLinkSigner_Verify_ShouldFail_WhenSignedWithAnotherKey(t *testing.T) {
+	signer, _ := NewConsentLinkSigner(consentLinkKey)
+	other, _ := NewConsentLinkSigner([]byte(strings.Repeat("x", 32)))
+	token, _ := other.Sign(authReqId, true, time.Minute)
+
+	_, err := signer.Verify(token)
+	_, garbageErr := signer.Verify("not-a-token")
+
+	assert.Equal(t, ErrInvalidConsentLink, err)
+	assert.Equal(t, ErrInvalidConsentLink, garbageErr)
+}
+
+func TestNewConsentLinkSigner_ShouldFail_WhenKeyIsShort(t *testing.T) {
+	signer, err := NewConsentLinkSigner([]byte("short"))
+
+	assert.Nil(t, signer)
+	assert.Error(t, err)
+}
@@ -0,0 +1,286 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/repository"
+)
+
+var ErrNoEmail = errors.New("user has no email address")
+
+const defaultEmailTextTemplate = `{{.ClientName}} is asking you to sign in.
+{{if .BindingMessage}}
+Make sure the code below is the one shown by {{.ClientName}}:
+
+    {{.BindingMessage}}
+{{end}}
+It will be able to access: {{range $i, $s := .Scopes}}{{if $i}}, {{end}}{{$s}}{{end}}
+
+Approve: {{.ApproveUrl}}
+
+Deny: {{.DenyUrl}}
+
+The links expire at {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}. If you didn't try to sign in, deny the request.
+`
+
+const defaultEmailHtmlTemplate = `<!DOCTYPE html>
+<html>
+<body>
+<p><strong>{{.ClientName}}</strong> is asking you to sign in.</p>
+{{if .BindingMessage}}<p>Make sure the code below is the one shown by {{.ClientName}}:</p>
+<p style="font-size:24px;font-family:monospace">{{.BindingMessage}}</p>
+{{end}}<p>It will be able to access:</p>
+<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{end}}</ul>
+<p><a href="{{.ApproveUrl}}">Approve</a> &nbsp; <a href="{{.DenyUrl}}">Deny</a></p>
+<p>The links expire at {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}. If you didn't try to sign in, deny the request.</p>
+</body>
+</html>
+`
+
+// The SMTP server sending the emails.
+type SmtpServer struct {
+	// The host:port of the server.
+	Addr string
+	// Nil when the server doesn't require authentication.
+	Auth smtp.Auth
+	// The address the emails are sent from.
+	From string
+}
+
+type EmailConfig struct {
+	Subject      string
+	LinkLifetime time.Duration
+	Timeout      time.Duration
+	// Used when the server supports STARTTLS, the server name is taken from Addr when nil.
+	TlsConfig    *tls.Config
+	TextTemplate *texttemplate.Template
+	HtmlTemplate *htmltemplate.Template
+}
+
+func NewEmailConfig() *EmailConfig {
+	return &EmailConfig{
+		Subject:      "Sign-in request",
+		LinkLifetime: 10 * time.Minute,
+		Timeout:      10 * time.Second,
+		TextTemplate: texttemplate.Must(texttemplate.New("text").Parse(defaultEmailTextTemplate)),
+		HtmlTemplate: htmltemplate.Must(htmltemplate.New("html").Parse(defaultEmailHtmlTemplate)),
+	}
+}
+
+// What the email templates are executed with.
+type EmailConsentPrompt struct {
+	UserName       string
+	ClientName     string
+	Scopes         []string
+	BindingMessage string
+	ApproveUrl     string
+	DenyUrl        string
+	ExpiresAt      time.Time
+}
+
+// Emails consent prompts to users, with links approving and denying the request. The links are
+// followed through the consent link handler served at consentUrl.
+type emailNotification struct {
+	server          *SmtpServer
+	userAccountRepo repository.UserAccountRepositoryInterface
+	clientAppRepo   repository.ClientApplicationRepositoryInterface
+	links           *ConsentLinkSigner
+	consentUrl      string
+	config          *EmailConfig
+}
+
+func NewEmailNotification(server *SmtpServer, dataStore repository.DataStoreInterface, links *ConsentLinkSigner, consentUrl string) *emailNotification {
+	return NewCustomEmailNotification(server, dataStore, links, consentUrl, NewEmailConfig())
+}
+
+func NewCustomEmailNotification(server *SmtpServer, dataStore repository.DataStoreInterface, links *ConsentLinkSigner, consentUrl string, config *EmailConfig) *emailNotification {
+	return &emailNotification{
+		server:          server,
+		userAccountRepo: dataStore.GetUserAccountRepository(),
+		clientAppRepo:   dataStore.GetClientApplicationRepository(),
+		links:           links,
+		consentUrl:      consentUrl,
+		config:          config,
+	}
+}
+
+// Emails the prompt to the address of the user account. Only prompts without a device are sent,
+// the users who registered a device are prompted on it.
+func (e *emailNotification) NotifyUser(ctx context.Context, prompt *UserConsentPrompt) error {
+	if prompt.Device != nil {
+		return ErrDevicePrompt
+	}
+	user, err := e.userAccountRepo.FindById(ctx, prompt.UserId)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Email == "" {
+		return ErrNoEmail
+	}
+	to, err := mail.ParseAddress(user.Email)
+	if err != nil {
+		return err
+	}
+	clientApp, err := e.clientAppRepo.FindById(ctx, prompt.ClientId)
+	if err != nil {
+		return err
+	}
+	if clientApp == nil {
+		return fmt.Errorf("client application %s not found", prompt.ClientId)
+	}
+
+	approveUrl, err := e.linkUrl(prompt.AuthReqId, true)
+	if err != nil {
+		return err
+	}
+	denyUrl, err := e.linkUrl(prompt.AuthReqId, false)
+	if err != nil {
+		return err
+	}
+	msg, err := e.buildMessage(to.Address, &EmailConsentPrompt{
+		UserName:       user.Name,
+		ClientName:     clientApp.Name,
+		Scopes:         strings.Fields(prompt.Scope),
+		BindingMessage: prompt.BindingMessage,
+		ApproveUrl:     approveUrl,
+		DenyUrl:        denyUrl,
+		ExpiresAt:      time.Now().Add(e.config.LinkLifetime).UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.send(ctx, to.Address, msg); err != nil {
+		log.Printf("[go-ciba][emailnotification] failed sending consent prompt %s. %s\n", prompt.AuthReqId, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (e *emailNotification) linkUrl(authReqId string, consented bool) (string, error) {
+	token, err := e.links.Sign(authReqId, consented, e.config.LinkLifetime)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(e.consentUrl)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Builds a multipart/alternative message with the text and HTML templates.
+func (e *emailNotification) buildMessage(to string, data *EmailConsentPrompt) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		execute     func(buf *bytes.Buffer) error
+	}{
+		{"text/plain; charset=UTF-8", func(buf *bytes.Buffer) error { return e.config.TextTemplate.Execute(buf, data) }},
+		{"text/html; charset=UTF-8", func(buf *bytes.Buffer) error { return e.config.HtmlTemplate.Execute(buf, data) }},
+	}
+	for _, p := range parts {
+		var content bytes.Buffer
+		if err := p.execute(&content); err != nil {
+			return nil, err
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", p.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(content.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.server.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", e.config.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// Sends the message, upgrading the connection with STARTTLS when the server supports it.
+func (e *emailNotification) send(ctx context.Context, to string, msg []byte) error {
+	dialer := &net.Dialer{Timeout: e.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", e.server.Addr)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(e.config.Timeout))
+	host, _, _ := net.SplitHostPort(e.server.Addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		tlsConfig := e.config.TlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: host}
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if e.server.Auth != nil {
+		if err := client.Auth(e.server.Auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(e.server.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,230 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	texttemplate "text/template"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+)
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// Stands in for an SMTP server, it accepts every message without authentication.
+type smtpStandIn struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages []smtpMessage
+}
+
+func newSmtpStandIn(t *testing.T) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *smtpStandIn) Close() {
+	_ = s.listener.Close()
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ESMTP")
+	msg := smtpMessage{}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 localhost")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(line[5:], "FROM:"), "<>")
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(line[5:], "TO:"), "<>"))
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.mutex.Lock()
+			s.messages = append(s.messages, msg)
+			s.mutex.Unlock()
+			msg = smtpMessage{}
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+// Returns the parts of the email by content type.
+func readEmailParts(t *testing.T, data string) (*mail.Message, map[string]string) {
+	message, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, _ := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	parts := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(part)
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[mediaType] = string(content)
+	}
+	return message, parts
+}
+
+func newTestEmailNotification(t *testing.T) (*emailNotification, *smtpStandIn, *ConsentLinkSigner) {
+	standIn := newSmtpStandIn(t)
+	ds := memory.NewDataStore()
+	ds.AddUserAccount(&test_data.User1)
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPing)
+	links, _ := NewConsentLinkSigner(consentLinkKey)
+	email := NewEmailNotification(&SmtpServer{
+		Addr: standIn.Addr(),
+		From: "ciba@example.com",
+	}, ds, links, "https://ciba.example.com/consent")
+	return email, standIn, links
+}
+
+func TestEmailNotification_NotifyUser(t *testing.T) {
+	email, standIn, links := newTestEmailNotification(t)
+	defer standIn.Close()
+
+	err := email.NotifyUser(context.Background(), &UserConsentPrompt{
+		UserId:         test_data.User1.Id,
+		Hint:           test_data.User1.Id,
+		AuthReqId:      authReqId,
+		ClientId:       test_data.ClientAppPing.Id,
+		Scope:          "openid email",
+		BindingMessage: "W4SCT",
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, standIn.messages, 1)
+	assert.Equal(t, "ciba@example.com", standIn.messages[0].from)
+	assert.Equal(t, []string{test_data.User1.Email}, standIn.messages[0].to)
+	message, parts := readEmailParts(t, standIn.messages[0].data)
+	assert.Equal(t, test_data.User1.Email, message.Header.Get("To"))
+	assert.Len(t, parts, 2)
+	for _, content := range parts {
+		assert.Contains(t, content, "client-app-ping")
+		assert.Contains(t, content, "W4SCT")
+		assert.Contains(t, content, "openid")
+		assert.Contains(t, content, "email")
+	}
+
+	text := parts["text/plain"]
+	approveUrl := strings.TrimSpace(strings.SplitN(strings.SplitN(text, "Approve: ", 2)[1], "\n", 2)[0])
+	denyUrl := strings.TrimSpace(strings.SplitN(strings.SplitN(text, "Deny: ", 2)[1], "\n", 2)[0])
+	assert.True(t, strings.HasPrefix(approveUrl, "https://ciba.example.com/consent?token="))
+	approve, _ := url.Parse(approveUrl)
+	deny, _ := url.Parse(denyUrl)
+	approveLink, approveErr := links.Verify(approve.Query().Get("token"))
+	denyLink, denyErr := links.Verify(deny.Query().Get("token"))
+	assert.NoError(t, approveErr)
+	assert.NoError(t, denyErr)
+	assert.Equal(t, authReqId, approveLink.AuthReqId)
+	assert.True(t, approveLink.Consented)
+	assert.False(t, denyLink.Consented)
+}
+
+func TestEmailNotification_NotifyUser_ShouldUseCustomTemplates(t *testing.T) {
+	email, standIn, _ := newTestEmailNotification(t)
+	defer standIn.Close()
+	email.config.Subject = "Approve {{not a template}}"
+	email.config.TextTemplate = texttemplateMust("Hi {{.UserName}}, {{.ClientName}} says {{.BindingMessage}}")
+
+	err := email.NotifyUser(context.Background(), &UserConsentPrompt{
+		UserId:         test_data.User1.Id,
+		AuthReqId:      authReqId,
+		ClientId:       test_data.ClientAppPing.Id,
+		Scope:          "openid",
+		BindingMessage: "W4SCT",
+	})
+
+	assert.NoError(t, err)
+	message, parts := readEmailParts(t, standIn.messages[0].data)
+	assert.Equal(t, "Approve {{not a template}}", message.Header.Get("Subject"))
+	assert.Equal(t, "Hi user-1, client-app-ping says W4SCT", parts["text/plain"])
+}
+
+func TestEmailNotification_NotifyUser_ShouldSkipDevicePrompts(t *testing.T) {
+	email, standIn, _ := newTestEmailNotification(t)
+	defer standIn.Close()
+
+	err := email.NotifyUser(context.Background(), &UserConsentPrompt{
+		UserId:    test_data.User1.Id,
+		AuthReqId: authReqId,
+		ClientId:  test_data.ClientAppPing.Id,
+		Device:    domain.NewUserDevice(test_data.User1.Id, domain.DevicePlatformAndroid, "phone", "", ""),
+	})
+
+	assert.Equal(t, ErrDevicePrompt, err)
+	assert.Empty(t, standIn.messages)
+}
+
+func TestEmailNotification_NotifyUser_ShouldFail_WhenUserIsUnknown(t *testing.T) {
+	email, standIn, _ := newTestEmailNotification(t)
+	defer standIn.Close()
+
+	err := email.NotifyUser(context.Background(), &UserConsentPrompt{
+		UserId:    "unknown",
+		AuthReqId: authReqId,
+		ClientId:  test_data.ClientAppPing.Id,
+	})
+
+	assert.Equal(t, ErrNoEmail, err)
+}
+
+func texttemplateMust(text string) *texttemplate.Template {
+	return texttemplate.Must(texttemplate.New("text").Parse(text))
+}
@@ -0,0 +1,332 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	DefaultFcmBaseUrl  = "https://fcm.googleapis.com"
+	DefaultFcmTokenUrl = "https://oauth2.googleapis.com/token"
+	fcmScope           = "https://www.googleapis.com/auth/firebase.messaging"
+	// How long before they expire OAuth2 tokens are renewed.
+	fcmTokenExpiryLeeway = time.Minute
+	// The type of the data messages withdrawing a prompt, prompts have no type.
+	FcmMessageTypeWithdrawal = "consent_withdrawn"
+)
+
+var ErrNoDevice = errors.New("user has no device registered")
+
+// Where the push tokens of the users' authentication devices are looked up.
+type DeviceRegistry interface {
+	FindPushTokens(ctx context.Context, userId string) ([]string, error)
+	// Called when FCM reports that the push token is no longer valid, e.g. the app was uninstalled.
+	RemovePushToken(ctx context.Context, userId, pushToken string) error
+}
+
+// The Google service account sending the messages, as found in its JSON key file.
+type FcmServiceAccount struct {
+	ProjectId    string `json:"project_id"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenUri     string `json:"token_uri"`
+}
+
+// Reads a service account from its JSON key file.
+func LoadFcmServiceAccount(path string) (*FcmServiceAccount, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	serviceAccount := &FcmServiceAccount{}
+	if err := json.Unmarshal(data, serviceAccount); err != nil {
+		return nil, err
+	}
+	return serviceAccount, nil
+}
+
+type FcmConfig struct {
+	// Where the FCM HTTP v1 API is, it's only changed to test against a local stand-in.
+	BaseUrl string
+	// Where OAuth2 tokens are requested when the service account doesn't say.
+	TokenUrl string
+	Timeout  time.Duration
+}
+
+func NewFcmConfig() *FcmConfig {
+	return &FcmConfig{
+		BaseUrl:  DefaultFcmBaseUrl,
+		TokenUrl: DefaultFcmTokenUrl,
+		Timeout:  5 * time.Second,
+	}
+}
+
+// Sends consent prompts to every device registered by the user through the FCM HTTP v1 API.
+type firebaseCloudMessagingV1 struct {
+	client         *http.Client
+	serviceAccount *FcmServiceAccount
+	privateKey     *rsa.PrivateKey
+	devices        DeviceRegistry
+	config         *FcmConfig
+
+	mutex       sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+	now         func() time.Time
+}
+
+func NewFirebaseCloudMessagingV1(serviceAccount *FcmServiceAccount, devices DeviceRegistry) (*firebaseCloudMessagingV1, error) {
+	return NewCustomFirebaseCloudMessagingV1(serviceAccount, devices, NewFcmConfig())
+}
+
+func NewCustomFirebaseCloudMessagingV1(serviceAccount *FcmServiceAccount, devices DeviceRegistry, config *FcmConfig) (*firebaseCloudMessagingV1, error) {
+	privateKey, err := parseRsaPrivateKey(serviceAccount.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &firebaseCloudMessagingV1{
+		client: &http.Client{
+			Timeout: config.Timeout,
+		},
+		serviceAccount: serviceAccount,
+		privateKey:     privateKey,
+		devices:        devices,
+		config:         config,
+		now:            time.Now,
+	}, nil
+}
+
+// Service account keys are PKCS8 encoded, PKCS1 is accepted as well.
+func parseRsaPrivateKey(private string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(private))
+	if block == nil {
+		return nil, errors.New("service account private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func (f *firebaseCloudMessagingV1) tokenUrl() string {
+	if f.serviceAccount.TokenUri != "" {
+		return f.serviceAccount.TokenUri
+	}
+	return f.config.TokenUrl
+}
+
+type fcmTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Returns an OAuth2 access token, obtained with a JWT signed by the service account and cached until it expires.
+func (f *firebaseCloudMessagingV1) token(ctx context.Context) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.now()
+	if f.accessToken != "" && now.Before(f.expiresAt) {
+		return f.accessToken, nil
+	}
+
+	assertion, err := f.assertion(now)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, f.tokenUrl(), strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get fcm access token %s", string(resBody))
+	}
+
+	tokenResponse := &fcmTokenResponse{}
+	if err := json.Unmarshal(resBody, tokenResponse); err != nil {
+		return "", err
+	}
+	f.accessToken = tokenResponse.AccessToken
+	f.expiresAt = now.Add(time.Duration(tokenResponse.ExpiresIn)*time.Second - fcmTokenExpiryLeeway)
+	return f.accessToken, nil
+}
+
+func (f *firebaseCloudMessagingV1) assertion(now time.Time) (string, error) {
+	opt := (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", f.serviceAccount.PrivateKeyId)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: f.privateKey}, opt)
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(sig).Claims(map[string]interface{}{
+		"iss":   f.serviceAccount.ClientEmail,
+		"scope": fcmScope,
+		"aud":   f.tokenUrl(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).CompactSerialize()
+}
+
+type fcmV1Message struct {
+	Token string            `json:"token"`
+	Data  map[string]string `json:"data"`
+}
+
+type fcmV1SendRequest struct {
+	Message *fcmV1Message `json:"message"`
+}
+
+type fcmV1ErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// Reports whether FCM rejected the message because the push token is no longer valid.
+func (e *fcmV1ErrorResponse) isUnregistered() bool {
+	for _, detail := range e.Error.Details {
+		if detail.ErrorCode == "UNREGISTERED" {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends the prompt to every device of the user. It succeeds if at least one device was reached.
+// Devices whose push token FCM no longer knows are removed from the registry.
+// Prompts addressed to a device are only sent to that device.
+func (f *firebaseCloudMessagingV1) NotifyUser(ctx context.Context, prompt *UserConsentPrompt) error {
+	data := map[string]string{
+		"auth_req_id": prompt.AuthReqId,
+		"client_id":   prompt.ClientId,
+		"scope":       prompt.Scope,
+	}
+	if prompt.BindingMessage != "" {
+		data["binding_message"] = prompt.BindingMessage
+	}
+	return f.deliver(ctx, prompt.UserId, prompt.Device, prompt.AuthReqId, data)
+}
+
+// Tells the devices of the user to stop showing the prompt, with a data message of type consent_withdrawn.
+func (f *firebaseCloudMessagingV1) NotifyWithdrawal(ctx context.Context, withdrawal *UserConsentWithdrawal) error {
+	return f.deliver(ctx, withdrawal.UserId, withdrawal.Device, withdrawal.AuthReqId, map[string]string{
+		"type":        FcmMessageTypeWithdrawal,
+		"auth_req_id": withdrawal.AuthReqId,
+		"client_id":   withdrawal.ClientId,
+	})
+}
+
+// Sends the data message to device, or to every device of the user when it's nil.
+func (f *firebaseCloudMessagingV1) deliver(ctx context.Context, userId string, device *domain.UserDevice, authReqId string, data map[string]string) error {
+	var pushTokens []string
+	if device != nil {
+		pushTokens = []string{device.PushToken}
+	} else {
+		var err error
+		if pushTokens, err = f.devices.FindPushTokens(ctx, userId); err != nil {
+			return err
+		}
+	}
+	if len(pushTokens) == 0 {
+		return ErrNoDevice
+	}
+
+	var lastErr error
+	delivered := 0
+	for _, pushToken := range pushTokens {
+		if err := f.send(ctx, userId, pushToken, data); err != nil {
+			log.Printf("[go-ciba][firebasecloudmessaging] failed sending message of %s. %s\n", authReqId, err.Error())
+			lastErr = err
+			continue
+		}
+		delivered++
+	}
+	if delivered == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+func (f *firebaseCloudMessagingV1) send(ctx context.Context, userId, pushToken string, data map[string]string) error {
+	accessToken, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+	jsonBody, _ := json.Marshal(&fcmV1SendRequest{
+		Message: &fcmV1Message{
+			Token: pushToken,
+			Data:  data,
+		},
+	})
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/messages:send", strings.TrimSuffix(f.config.BaseUrl, "/"), f.serviceAccount.ProjectId)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(jsonBody))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	errorResponse := &fcmV1ErrorResponse{}
+	_ = json.Unmarshal(resBody, errorResponse)
+	if res.StatusCode == http.StatusUnauthorized {
+		f.forgetToken()
+	}
+	if errorResponse.isUnregistered() {
+		if err := f.devices.RemovePushToken(ctx, userId, pushToken); err != nil {
+			log.Printf("[go-ciba][firebasecloudmessaging] failed removing unregistered device of user %s. %s\n", userId, err.Error())
+		}
+	}
+	return fmt.Errorf("failed to send notification message %s", string(resBody))
+}
+
+// Makes the next message get a new access token.
+func (f *firebaseCloudMessagingV1) forgetToken() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.accessToken = ""
+}
@@ -0,0 +1,245 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type deviceRegistryMock struct {
+	mutex      sync.Mutex
+	pushTokens map[string][]string
+}
+
+func (d *deviceRegistryMock) FindPushTokens(ctx context.Context, userId string) ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.pushTokens[userId]...), nil
+}
+
+func (d *deviceRegistryMock) RemovePushToken(ctx context.Context, userId, pushToken string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var kept []string
+	for _, t := range d.pushTokens[userId] {
+		if t != pushToken {
+			kept = append(kept, t)
+		}
+	}
+	d.pushTokens[userId] = kept
+	return nil
+}
+
+// Stands in for the Google token endpoint and the FCM HTTP v1 API.
+type fcmStandIn struct {
+	*httptest.Server
+	t             *testing.T
+	publicKey     *rsa.PublicKey
+	mutex         sync.Mutex
+	tokenRequests int
+	messages      []fcmV1Message
+	unregistered  map[string]bool
+}
+
+func newFcmStandIn(t *testing.T, publicKey *rsa.PublicKey) *fcmStandIn {
+	s := &fcmStandIn{t: t, publicKey: publicKey, unregistered: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc("/v1/projects/go-ciba-test/messages:send", s.handleSend)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *fcmStandIn) handleToken(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	assertion, err := jwt.ParseSigned(r.PostForm.Get("assertion"))
+	claims := make(map[string]interface{})
+	if err != nil || assertion.Claims(s.publicKey, &claims) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	assert.Equal(s.t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+	assert.Equal(s.t, "ciba@go-ciba-test.iam.gserviceaccount.com", claims["iss"])
+	assert.Equal(s.t, fcmScope, claims["scope"])
+	assert.Equal(s.t, s.URL+"/token", claims["aud"])
+	s.mutex.Lock()
+	s.tokenRequests++
+	s.mutex.Unlock()
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "oauth2-access-token",
+		"expires_in":   3600,
+		"token_type":   "Bearer",
+	})
+}
+
+func (s *fcmStandIn) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer oauth2-access-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body := &fcmV1SendRequest{}
+	_ = json.NewDecoder(r.Body).Decode(body)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.unregistered[body.Message.Token] {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`))
+		return
+	}
+	s.messages = append(s.messages, *body.Message)
+	_, _ = w.Write([]byte(`{"name":"projects/go-ciba-test/messages/1"}`))
+}
+
+func newTestFcm(t *testing.T, devices DeviceRegistry) (*firebaseCloudMessagingV1, *fcmStandIn) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	standIn := newFcmStandIn(t, &key.PublicKey)
+	config := NewFcmConfig()
+	config.BaseUrl = standIn.URL
+	fcm, err := NewCustomFirebaseCloudMessagingV1(&FcmServiceAccount{
+		ProjectId:    "go-ciba-test",
+		PrivateKeyId: "key-id",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		ClientEmail:  "ciba@go-ciba-test.iam.gserviceaccount.com",
+		TokenUri:     standIn.URL + "/token",
+	}, devices, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fcm, standIn
+}
+
+func newPrompt() *UserConsentPrompt {
+	return &UserConsentPrompt{
+		UserId:         userId,
+		Hint:           userId,
+		AuthReqId:      authReqId,
+		ClientId:       "client-id",
+		Scope:          "openid",
+		BindingMessage: "W4SCT",
+	}
+}
+
+func TestFirebaseCloudMessagingV1_NotifyUser_ShouldSendToEveryDevice(t *testing.T) {
+	devices := &deviceRegistryMock{pushTokens: map[string][]string{userId: {"phone", "tablet"}}}
+	fcm, standIn := newTestFcm(t, devices)
+	defer standIn.Close()
+
+	err := fcm.NotifyUser(context.Background(), newPrompt())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, standIn.tokenRequests)
+	assert.Len(t, standIn.messages, 2)
+	assert.Equal(t, "phone", standIn.messages[0].Token)
+	assert.Equal(t, "tablet", standIn.messages[1].Token)
+	assert.Equal(t, map[string]string{
+		"auth_req_id":     authReqId,
+		"client_id":       "client-id",
+		"scope":           "openid",
+		"binding_message": "W4SCT",
+	}, standIn.messages[0].Data)
+}
+
+func TestFirebaseCloudMessagingV1_NotifyWithdrawal_ShouldSendWithdrawalToEveryDevice(t *testing.T) {
+	devices := &deviceRegistryMock{pushTokens: map[string][]string{userId: {"phone", "tablet"}}}
+	fcm, standIn := newTestFcm(t, devices)
+	defer standIn.Close()
+
+	err := fcm.NotifyWithdrawal(context.Background(), newWithdrawal())
+
+	assert.NoError(t, err)
+	assert.Len(t, standIn.messages, 2)
+	assert.Equal(t, map[string]string{
+		"type":        FcmMessageTypeWithdrawal,
+		"auth_req_id": authReqId,
+		"client_id":   "client-id",
+	}, standIn.messages[1].Data)
+}
+
+func TestFirebaseCloudMessagingV1_NotifyUser_ShouldCacheAccessTokenUntilItExpires(t *testing.T) {
+	devices := &deviceRegistryMock{pushTokens: map[string][]string{userId: {"phone"}}}
+	fcm, standIn := newTestFcm(t, devices)
+	defer standIn.Close()
+	now := time.Now()
+	fcm.now = func() time.Time { return now }
+
+	_ = fcm.NotifyUser(context.Background(), newPrompt())
+	_ = fcm.NotifyUser(context.Background(), newPrompt())
+	cachedRequests := standIn.tokenRequests
+	now = now.Add(time.Hour)
+	_ = fcm.NotifyUser(context.Background(), newPrompt())
+
+	assert.Equal(t, 1, cachedRequests)
+	assert.Equal(t, 2, standIn.tokenRequests)
+	assert.Len(t, standIn.messages, 3)
+}
+
+func TestFirebaseCloudMessagingV1_NotifyUser_ShouldRemoveUnregisteredDevice(t *testing.T) {
+	devices := &deviceRegistryMock{pushTokens: map[string][]string{userId: {"uninstalled", "phone"}}}
+	fcm, standIn := newTestFcm(t, devices)
+	defer standIn.Close()
+	standIn.unregistered["uninstalled"] = true
+
+	err := fcm.NotifyUser(context.Background(), newPrompt())
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"phone"}, devices.pushTokens[userId])
+	assert.Len(t, standIn.messages, 1)
+}
+
+func TestFirebaseCloudMessagingV1_NotifyUser_ShouldFail_WhenNoDeviceIsReached(t *testing.T) {
+	devices := &deviceRegistryMock{pushTokens: map[string][]string{userId: {"uninstalled"}}}
+	fcm, standIn := newTestFcm(t, devices)
+	defer standIn.Close()
+	standIn.unregistered["uninstalled"] = true
+
+	err := fcm.NotifyUser(context.Background(), newPrompt())
+
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "UNREGISTERED"))
+	assert.Empty(t, devices.pushTokens[userId])
+}
+
+func TestFirebaseCloudMessagingV1_NotifyUser_ShouldFail_WhenUserHasNoDevice(t *testing.T) {
+	fcm, standIn := newTestFcm(t, &deviceRegistryMock{pushTokens: map[string][]string{}})
+	defer standIn.Close()
+
+	err := fcm.NotifyUser(context.Background(), newPrompt())
+
+	assert.Equal(t, ErrNoDevice, err)
+	assert.Equal(t, 0, standIn.tokenRequests)
+}
+
+func TestNewFirebaseCloudMessagingV1_ShouldFail_WhenPrivateKeyIsNotPem(t *testing.T) {
+	fcm, err := NewFirebaseCloudMessagingV1(&FcmServiceAccount{PrivateKey: "not-a-key"}, &deviceRegistryMock{})
+
+	assert.Nil(t, fcm)
+	assert.EqualError(t, err, "service account private key is not PEM encoded")
+}
+
+func TestFirebaseCloudMessagingV1_NotifyUser_ShouldOnlySendToPromptDevice(t *testing.T) {
+	devices := &deviceRegistryMock{pushTokens: map[string][]string{userId: {"phone", "tablet"}}}
+	fcm, standIn := newTestFcm(t, devices)
+	defer standIn.Close()
+	prompt := newPrompt()
+	prompt.Device = domain.NewUserDevice(userId, domain.DevicePlatformIos, "tablet", "Tablet", "")
+
+	err := fcm.NotifyUser(context.Background(), prompt)
+
+	assert.NoError(t, err)
+	assert.Len(t, standIn.messages, 1)
+	assert.Equal(t, "tablet", standIn.messages[0].Token)
+}
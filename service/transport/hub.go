@@ -0,0 +1,250 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DefaultPromptChannel = "ciba:consent_prompts"
+	// How many prompts a subscriber can fall behind before new ones are dropped.
+	subscriptionBufferSize = 16
+	// How many delivered events a subscription remembers to skip duplicates.
+	subscriptionSeenSize = 64
+)
+
+// A prompt, or the withdrawal of one, sent to the subscribers of a user. Only one of them is set.
+type PromptEvent struct {
+	Prompt     *UserConsentPrompt     `json:"prompt,omitempty"`
+	Withdrawal *UserConsentWithdrawal `json:"withdrawal,omitempty"`
+}
+
+func (e *PromptEvent) userId() string {
+	if e.Withdrawal != nil {
+		return e.Withdrawal.UserId
+	}
+	return e.Prompt.UserId
+}
+
+// Relays the events published on any server instance to the hubs of every instance.
+type PromptBroker interface {
+	Publish(ctx context.Context, event *PromptEvent) error
+	// Calls deliver with every event published until ctx is done.
+	Receive(ctx context.Context, deliver func(event *PromptEvent)) error
+}
+
+// Where the subscribers of the users are registered.
+type PromptSubscriber interface {
+	Subscribe(userId string) *PromptSubscription
+}
+
+// The prompts sent to a user and their withdrawals, read from C until Close is called.
+type PromptSubscription struct {
+	UserId string
+	C      <-chan *PromptEvent
+
+	events chan *PromptEvent
+	hub    *promptHub
+	// Guarded by the mutex of the hub.
+	seen   map[string]bool
+	order  []string
+	closed bool
+}
+
+// Records that the subscriber got the event, reporting whether it hadn't already. Must be called with the hub mutex held.
+func (s *PromptSubscription) markSeen(key string) bool {
+	if s.seen[key] {
+		return false
+	}
+	s.seen[key] = true
+	s.order = append(s.order, key)
+	if len(s.order) > subscriptionSeenSize {
+		delete(s.seen, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+// Sends the event unless the subscription already got it, must be called with the hub mutex held.
+// A withdrawal also marks its prompt as seen, so a prompt relayed late isn't shown after it.
+func (s *PromptSubscription) deliver(event *PromptEvent) {
+	if s.closed {
+		return
+	}
+	var authReqId string
+	if event.Withdrawal != nil {
+		authReqId = event.Withdrawal.AuthReqId
+		s.markSeen(authReqId)
+		if !s.markSeen("withdrawn:" + authReqId) {
+			return
+		}
+	} else if authReqId = event.Prompt.AuthReqId; !s.markSeen(authReqId) {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		log.Printf("[go-ciba][prompthub] dropped consent prompt event of %s of user %s, the subscriber is too slow\n", authReqId, s.UserId)
+	}
+}
+
+// Reports whether the prompt of the request wasn't delivered yet, it won't be delivered after. It's
+// used when the subscriber is sent the request some other way, e.g. replaying the pending requests.
+func (s *PromptSubscription) Claim(authReqId string) bool {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	return s.markSeen(authReqId)
+}
+
+func (s *PromptSubscription) Close() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(s.hub.subscriptions[s.UserId], s)
+	if len(s.hub.subscriptions[s.UserId]) == 0 {
+		delete(s.hub.subscriptions, s.UserId)
+	}
+	close(s.events)
+}
+
+// Delivers consent prompts in real time to the subscribed sessions of their user, e.g. web apps
+// approving requests that can't receive push notifications. Prompts for a registered device
+// other than a web one are for the device transports.
+type promptHub struct {
+	mutex         sync.Mutex
+	subscriptions map[string]map[*PromptSubscription]struct{}
+	broker        PromptBroker
+}
+
+// Creates a hub delivering the events sent through this server instance only.
+func NewPromptHub() *promptHub {
+	return &promptHub{
+		subscriptions: make(map[string]map[*PromptSubscription]struct{}),
+	}
+}
+
+// Creates a hub publishing the events to broker, and delivering those published by every instance
+// until ctx is done.
+func NewBrokeredPromptHub(ctx context.Context, broker PromptBroker) *promptHub {
+	hub := NewPromptHub()
+	hub.broker = broker
+	go func() {
+		if err := broker.Receive(ctx, hub.deliver); err != nil && ctx.Err() == nil {
+			log.Printf("[go-ciba][prompthub] stopped receiving consent prompts. %s\n", err.Error())
+		}
+	}()
+	return hub
+}
+
+func (h *promptHub) Subscribe(userId string) *PromptSubscription {
+	events := make(chan *PromptEvent, subscriptionBufferSize)
+	s := &PromptSubscription{
+		UserId: userId,
+		C:      events,
+		events: events,
+		hub:    h,
+		seen:   make(map[string]bool),
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.subscriptions[userId] == nil {
+		h.subscriptions[userId] = make(map[*PromptSubscription]struct{})
+	}
+	h.subscriptions[userId][s] = struct{}{}
+	return s
+}
+
+// Delivers the prompt to the subscribers of its user, it succeeds even if nobody is subscribed
+// as the request is replayed when they are.
+func (h *promptHub) NotifyUser(ctx context.Context, prompt *UserConsentPrompt) error {
+	if prompt.Device != nil && prompt.Device.Platform != domain.DevicePlatformWeb {
+		return ErrDevicePrompt
+	}
+	return h.publish(ctx, &PromptEvent{Prompt: prompt})
+}
+
+// Tells the subscribers of the user the prompt was withdrawn.
+func (h *promptHub) NotifyWithdrawal(ctx context.Context, withdrawal *UserConsentWithdrawal) error {
+	if withdrawal.Device != nil && withdrawal.Device.Platform != domain.DevicePlatformWeb {
+		return ErrDevicePrompt
+	}
+	return h.publish(ctx, &PromptEvent{Withdrawal: withdrawal})
+}
+
+func (h *promptHub) publish(ctx context.Context, event *PromptEvent) error {
+	if h.broker != nil {
+		return h.broker.Publish(ctx, event)
+	}
+	h.deliver(event)
+	return nil
+}
+
+func (h *promptHub) deliver(event *PromptEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for s := range h.subscriptions[event.userId()] {
+		s.deliver(event)
+	}
+}
+
+// Relays prompt events through Redis pub/sub.
+type redisPromptBroker struct {
+	client  *redis.Client
+	channel string
+}
+
+func NewRedisPromptBroker(client *redis.Client) *redisPromptBroker {
+	return NewCustomRedisPromptBroker(client, DefaultPromptChannel)
+}
+
+func NewCustomRedisPromptBroker(client *redis.Client, channel string) *redisPromptBroker {
+	return &redisPromptBroker{
+		client:  client,
+		channel: channel,
+	}
+}
+
+func (r *redisPromptBroker) Publish(ctx context.Context, event *PromptEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, r.channel, payload).Err()
+}
+
+func (r *redisPromptBroker) Receive(ctx context.Context, deliver func(event *PromptEvent)) error {
+	pubsub := r.client.Subscribe(ctx, r.channel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			event := &PromptEvent{}
+			if err := json.Unmarshal([]byte(message.Payload), event); err != nil {
+				log.Printf("[go-ciba][redispromptbroker] skipped malformed consent prompt event. %s\n", err.Error())
+				continue
+			}
+			if event.Prompt == nil && event.Withdrawal == nil {
+				log.Printf("[go-ciba][redispromptbroker] skipped empty consent prompt event\n")
+				continue
+			}
+			deliver(event)
+		}
+	}
+}
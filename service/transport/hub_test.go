@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+// Relays prompts between the hubs receiving from it, like Redis pub/sub between server instances.
+type memoryPromptBroker struct {
+	mutex     sync.Mutex
+	receivers []func(event *PromptEvent)
+	ready     sync.WaitGroup
+}
+
+func (m *memoryPromptBroker) Publish(ctx context.Context, event *PromptEvent) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, deliver := range m.receivers {
+		deliver(event)
+	}
+	return nil
+}
+
+func (m *memoryPromptBroker) Receive(ctx context.Context, deliver func(event *PromptEvent)) error {
+	m.mutex.Lock()
+	m.receivers = append(m.receivers, deliver)
+	m.mutex.Unlock()
+	m.ready.Done()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func receiveEvent(t *testing.T, s *PromptSubscription) *PromptEvent {
+	select {
+	case event := <-s.C:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no consent prompt event received")
+		return nil
+	}
+}
+
+func receive(t *testing.T, s *PromptSubscription) *UserConsentPrompt {
+	event := receiveEvent(t, s)
+	if event.Prompt == nil {
+		t.Fatalf("unexpected withdrawal of %s", event.Withdrawal.AuthReqId)
+	}
+	return event.Prompt
+}
+
+func assertNothingReceived(t *testing.T, s *PromptSubscription) {
+	select {
+	case event := <-s.C:
+		t.Fatalf("unexpected consent prompt event %+v", event)
+	default:
+	}
+}
+
+func newWithdrawal() *UserConsentWithdrawal {
+	return &UserConsentWithdrawal{
+		UserId:    userId,
+		AuthReqId: authReqId,
+		ClientId:  "client-id",
+	}
+}
+
+func TestPromptHub_NotifyUser_ShouldDeliverToSubscribersOfUser(t *testing.T) {
+	hub := NewPromptHub()
+	first := hub.Subscribe(userId)
+	second := hub.Subscribe(userId)
+	other := hub.Subscribe("other-user")
+
+	err := hub.NotifyUser(context.Background(), newPrompt())
+
+	assert.NoError(t, err)
+	assert.Equal(t, authReqId, receive(t, first).AuthReqId)
+	assert.Equal(t, authReqId, receive(t, second).AuthReqId)
+	assertNothingReceived(t, other)
+}
+
+func TestPromptHub_NotifyUser_ShouldSkipDuplicatesAndClaimedPrompts(t *testing.T) {
+	hub := NewPromptHub()
+	s := hub.Subscribe(userId)
+	claimed := newPrompt()
+	claimed.AuthReqId = "claimed"
+
+	firstClaim := s.Claim("claimed")
+	secondClaim := s.Claim("claimed")
+	_ = hub.NotifyUser(context.Background(), newPrompt())
+	_ = hub.NotifyUser(context.Background(), newPrompt())
+	_ = hub.NotifyUser(context.Background(), claimed)
+
+	assert.True(t, firstClaim)
+	assert.False(t, secondClaim)
+	assert.Equal(t, authReqId, receive(t, s).AuthReqId)
+	assertNothingReceived(t, s)
+}
+
+func TestPromptHub_NotifyUser_ShouldOnlyAcceptWebDevicePrompts(t *testing.T) {
+	hub := NewPromptHub()
+	s := hub.Subscribe(userId)
+	phone := newPrompt()
+	phone.Device = domain.NewUserDevice(userId, domain.DevicePlatformAndroid, "phone", "", "")
+	portal := newPrompt()
+	portal.Device = domain.NewUserDevice(userId, domain.DevicePlatformWeb, "portal", "", "")
+
+	phoneErr := hub.NotifyUser(context.Background(), phone)
+	portalErr := hub.NotifyUser(context.Background(), portal)
+
+	assert.Equal(t, ErrDevicePrompt, phoneErr)
+	assert.NoError(t, portalErr)
+	assert.Equal(t, authReqId, receive(t, s).AuthReqId)
+}
+
+func TestPromptHub_NotifyWithdrawal_ShouldDeliverOnceAfterThePrompt(t *testing.T) {
+	hub := NewPromptHub()
+	s := hub.Subscribe(userId)
+
+	_ = hub.NotifyUser(context.Background(), newPrompt())
+	err := hub.NotifyWithdrawal(context.Background(), newWithdrawal())
+	_ = hub.NotifyWithdrawal(context.Background(), newWithdrawal())
+
+	assert.NoError(t, err)
+	assert.Equal(t, authReqId, receive(t, s).AuthReqId)
+	withdrawn := receiveEvent(t, s)
+	assert.Nil(t, withdrawn.Prompt)
+	assert.Equal(t, authReqId, withdrawn.Withdrawal.AuthReqId)
+	assertNothingReceived(t, s)
+}
+
+func TestPromptHub_NotifyWithdrawal_ShouldSkipPromptsRelayedAfterIt(t *testing.T) {
+	hub := NewPromptHub()
+	s := hub.Subscribe(userId)
+	phone := newWithdrawal()
+	phone.Device = domain.NewUserDevice(userId, domain.DevicePlatformAndroid, "phone", "", "")
+
+	phoneErr := hub.NotifyWithdrawal(context.Background(), phone)
+	_ = hub.NotifyWithdrawal(context.Background(), newWithdrawal())
+	_ = hub.NotifyUser(context.Background(), newPrompt())
+
+	assert.Equal(t, ErrDevicePrompt, phoneErr)
+	assert.NotNil(t, receiveEvent(t, s).Withdrawal)
+	assertNothingReceived(t, s)
+}
+
+func TestPromptHub_Close_ShouldStopDelivery(t *testing.T) {
+	hub := NewPromptHub()
+	s := hub.Subscribe(userId)
+
+	s.Close()
+	s.Close()
+	err := hub.NotifyUser(context.Background(), newPrompt())
+
+	assert.NoError(t, err)
+	_, open := <-s.C
+	assert.False(t, open)
+	assert.Empty(t, hub.subscriptions)
+}
+
+func TestBrokeredPromptHub_ShouldDeliverPromptsPublishedByOtherInstances(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := &memoryPromptBroker{}
+	broker.ready.Add(2)
+	publishing := NewBrokeredPromptHub(ctx, broker)
+	subscribed := NewBrokeredPromptHub(ctx, broker)
+	broker.ready.Wait()
+	s := subscribed.Subscribe(userId)
+
+	err := publishing.NotifyUser(context.Background(), newPrompt())
+	withdrawalErr := publishing.NotifyWithdrawal(context.Background(), newWithdrawal())
+
+	assert.NoError(t, err)
+	assert.NoError(t, withdrawalErr)
+	assert.Equal(t, authReqId, receive(t, s).AuthReqId)
+	assert.Equal(t, authReqId, receiveEvent(t, s).Withdrawal.AuthReqId)
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+// Asks the user to give their consent to a Ciba authentication request.
+type UserConsentPrompt struct {
+	UserId string
+	// The login hint the client identified the user with.
+	Hint           string
+	AuthReqId      string
+	ClientId       string
+	Scope          string
+	BindingMessage string
+	// The registered device the prompt is sent to, nil when the user has none and the
+	// transport has to find the user on its own.
+	Device *domain.UserDevice
+}
+
+// Returns the prompt asking for the consent of the Ciba session, sent to device unless it's nil.
+func NewUserConsentPrompt(ciba *domain.CibaSession, device *domain.UserDevice) *UserConsentPrompt {
+	return &UserConsentPrompt{
+		UserId:         ciba.UserId,
+		Hint:           ciba.Hint,
+		AuthReqId:      ciba.AuthReqId,
+		ClientId:       ciba.ClientId,
+		Scope:          ciba.Scope,
+		BindingMessage: ciba.BindingMessage,
+		Device:         device,
+	}
+}
+
+// Tells the user a consent prompt was withdrawn, e.g. because the client cancelled the request,
+// so it's no longer shown.
+type UserConsentWithdrawal struct {
+	UserId    string
+	AuthReqId string
+	ClientId  string
+	// The registered device the prompt was sent to, nil when the user has none.
+	Device *domain.UserDevice
+}
+
+// Returns the withdrawal of the prompt of the Ciba session, sent to device unless it's nil.
+func NewUserConsentWithdrawal(ciba *domain.CibaSession, device *domain.UserDevice) *UserConsentWithdrawal {
+	return &UserConsentWithdrawal{
+		UserId:    ciba.UserId,
+		AuthReqId: ciba.AuthReqId,
+		ClientId:  ciba.ClientId,
+		Device:    device,
+	}
+}
+
+// Sent to the client notification endpoint of a client application.
+// It's implemented by ClientPingCallback, ClientPushSuccess and ClientPushError only.
+type ClientMessage interface {
+	callback() *clientCallback
+}
+
+// The request delivering a client message.
+type clientCallback struct {
+	endpoint                string
+	clientNotificationToken string
+	body                    interface{}
+}
+
+// Tells a ping client its tokens can be requested.
+type ClientPingCallback struct {
+	Endpoint                string
+	ClientNotificationToken string
+	AuthReqId               string
+}
+
+func (m *ClientPingCallback) callback() *clientCallback {
+	return &clientCallback{
+		endpoint:                m.Endpoint,
+		clientNotificationToken: m.ClientNotificationToken,
+		body: struct {
+			AuthReqId string `json:"auth_req_id"`
+		}{m.AuthReqId},
+	}
+}
+
+// Delivers the tokens of a push client.
+type ClientPushSuccess struct {
+	Endpoint                string
+	ClientNotificationToken string
+	AuthReqId               string
+	AccessToken             string
+	TokenType               string
+	ExpiresIn               int64
+	IdToken                 string
+	// The granted scope, it's less than the requested one when the user approved only part of it.
+	Scope string
+}
+
+func (m *ClientPushSuccess) callback() *clientCallback {
+	return &clientCallback{
+		endpoint:                m.Endpoint,
+		clientNotificationToken: m.ClientNotificationToken,
+		body: struct {
+			AuthReqId   string `json:"auth_req_id"`
+			AccessToken string `json:"access_token"`
+			TokenType   string `json:"token_type"`
+			ExpiresIn   int64  `json:"expires_in"`
+			IdToken     string `json:"id_token"`
+			Scope       string `json:"scope,omitempty"`
+		}{m.AuthReqId, m.AccessToken, m.TokenType, m.ExpiresIn, m.IdToken, m.Scope},
+	}
+}
+
+// Tells a push client its authentication request failed, because it was denied or it expired.
+type ClientPushError struct {
+	Endpoint                string
+	ClientNotificationToken string
+	AuthReqId               string
+	Error                   *util.OidcError
+}
+
+func (m *ClientPushError) callback() *clientCallback {
+	return &clientCallback{
+		endpoint:                m.Endpoint,
+		clientNotificationToken: m.ClientNotificationToken,
+		body: struct {
+			AuthReqId        string `json:"auth_req_id"`
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description,omitempty"`
+		}{m.AuthReqId, m.Error.ErrorTag, m.Error.ErrorDescription},
+	}
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// Returned by notifiers for prompts and withdrawals they don't deliver, e.g. those addressed to a kind
+// of device they don't reach. It means another channel is in charge of them rather than a failure.
+var ErrDevicePrompt = errors.New("consent prompt is addressed to a device")
+
+// Sends consent prompts and withdrawals through several channels, e.g. FCM for mobile devices and
+// the prompt hub for web ones.
+type multiNotifier struct {
+	notifiers []UserNotifier
+}
+
+func NewMultiNotifier(notifiers ...UserNotifier) *multiNotifier {
+	return &multiNotifier{notifiers: notifiers}
+}
+
+// Sends the prompt through every channel. It succeeds if at least one of them delivered it, and fails
+// with ErrDevicePrompt when none of them is in charge of it.
+func (m *multiNotifier) NotifyUser(ctx context.Context, prompt *UserConsentPrompt) error {
+	var errs []error
+	for _, notifier := range m.notifiers {
+		errs = append(errs, notifier.NotifyUser(ctx, prompt))
+	}
+	return m.result(prompt.AuthReqId, errs)
+}
+
+// Tells every channel that can the prompt was withdrawn, with the same outcome as NotifyUser.
+func (m *multiNotifier) NotifyWithdrawal(ctx context.Context, withdrawal *UserConsentWithdrawal) error {
+	var errs []error
+	for _, notifier := range m.notifiers {
+		if withdrawalNotifier, ok := notifier.(WithdrawalNotifier); ok {
+			errs = append(errs, withdrawalNotifier.NotifyWithdrawal(ctx, withdrawal))
+		}
+	}
+	return m.result(withdrawal.AuthReqId, errs)
+}
+
+func (m *multiNotifier) result(authReqId string, errs []error) error {
+	var lastErr error
+	delivered := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			delivered++
+		case errors.Is(err, ErrDevicePrompt):
+		default:
+			log.Printf("[go-ciba][multinotifier] failed notifying of %s. %s\n", authReqId, err.Error())
+			lastErr = err
+		}
+	}
+	if delivered > 0 {
+		return nil
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return ErrDevicePrompt
+}
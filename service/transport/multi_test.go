@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+type channelNotifierMock struct {
+	err         error
+	prompts     []*UserConsentPrompt
+	withdrawals []*UserConsentWithdrawal
+}
+
+func (c *channelNotifierMock) NotifyUser(ctx context.Context, prompt *UserConsentPrompt) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.prompts = append(c.prompts, prompt)
+	return nil
+}
+
+func (c *channelNotifierMock) NotifyWithdrawal(ctx context.Context, withdrawal *UserConsentWithdrawal) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.withdrawals = append(c.withdrawals, withdrawal)
+	return nil
+}
+
+func newMultiNotifierPrompt() *UserConsentPrompt {
+	cibaSession := domain.NewCibaSession(&domain.ClientApplication{Id: "client"}, userId, "", "", "openid", 60, nil)
+	return NewUserConsentPrompt(cibaSession, domain.NewUserDevice(userId, domain.DevicePlatformAndroid, "phone", "Phone", ""))
+}
+
+func TestMultiNotifier_NotifyUser_ShouldSendThroughEveryChannel(t *testing.T) {
+	notInCharge := &channelNotifierMock{err: ErrDevicePrompt}
+	first := &channelNotifierMock{}
+	second := &channelNotifierMock{}
+
+	err := NewMultiNotifier(notInCharge, first, second).NotifyUser(context.Background(), newMultiNotifierPrompt())
+
+	assert.NoError(t, err)
+	assert.Len(t, first.prompts, 1)
+	assert.Len(t, second.prompts, 1)
+}
+
+func TestMultiNotifier_NotifyUser_ShouldSucceed_WhenOneChannelDelivers(t *testing.T) {
+	failing := &channelNotifierMock{err: errors.New("unreachable")}
+	delivering := &channelNotifierMock{}
+
+	err := NewMultiNotifier(failing, delivering).NotifyUser(context.Background(), newMultiNotifierPrompt())
+
+	assert.NoError(t, err)
+	assert.Len(t, delivering.prompts, 1)
+}
+
+func TestMultiNotifier_NotifyUser_ShouldReturnFailure_OverNotInCharge(t *testing.T) {
+	failure := errors.New("unreachable")
+
+	err := NewMultiNotifier(&channelNotifierMock{err: ErrDevicePrompt}, &channelNotifierMock{err: failure}).NotifyUser(context.Background(), newMultiNotifierPrompt())
+
+	assert.Equal(t, failure, err)
+}
+
+func TestMultiNotifier_NotifyUser_ShouldReturnErrDevicePrompt_WhenNoChannelIsInCharge(t *testing.T) {
+	err := NewMultiNotifier(&channelNotifierMock{err: ErrDevicePrompt}).NotifyUser(context.Background(), newMultiNotifierPrompt())
+
+	assert.Equal(t, ErrDevicePrompt, err)
+}
+
+func TestMultiNotifier_NotifyWithdrawal_ShouldOnlyTellWithdrawalNotifiers(t *testing.T) {
+	withdrawing := &channelNotifierMock{}
+	prompt := newMultiNotifierPrompt()
+
+	err := NewMultiNotifier(&FirebaseCloudMessaging{}, withdrawing).NotifyWithdrawal(context.Background(), &UserConsentWithdrawal{AuthReqId: prompt.AuthReqId, UserId: userId})
+
+	assert.NoError(t, err)
+	assert.Len(t, withdrawing.withdrawals, 1)
+}
@@ -2,23 +2,36 @@ package transport
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
 	"time"
-
-	"github.com/adisazhar123/go-ciba/domain"
-	"github.com/adisazhar123/go-ciba/util"
 )
 
-type NotificationInterface interface {
-	Send(data map[string]interface{}) error
+// Sends consent prompts to the authentication devices of users.
+type UserNotifier interface {
+	NotifyUser(ctx context.Context, prompt *UserConsentPrompt) error
+}
+
+// Tells the authentication devices of users a consent prompt was withdrawn. UserNotifiers
+// implementing it are told of withdrawals, those that don't leave the prompt to fail once answered.
+type WithdrawalNotifier interface {
+	NotifyWithdrawal(ctx context.Context, withdrawal *UserConsentWithdrawal) error
+}
+
+// Sends messages to the client notification endpoints of client applications.
+type ClientNotifier interface {
+	NotifyClient(ctx context.Context, message ClientMessage) error
 }
 
+// Sends consent prompts to the /topics/ciba_consent_<user> topic through the legacy FCM API.
+//
+// Deprecated: Google has shut the legacy API down, and anyone subscribing to the topic sees the prompts.
+// Use NewFirebaseCloudMessagingV1 instead.
 type FirebaseCloudMessaging struct {
 	client    *http.Client
 	serverKey string
@@ -40,26 +53,19 @@ type fcmSendRequest struct {
 	Data map[string]interface{} `json:"data"`
 }
 
-func (f *FirebaseCloudMessaging) Send(data map[string]interface{}) error {
+func (f *FirebaseCloudMessaging) NotifyUser(ctx context.Context, prompt *UserConsentPrompt) error {
 	body := &fcmSendRequest{
-		To:   fmt.Sprintf("/topics/ciba_consent_%s", data["to"].(string)),
-		Data: make(map[string]interface{}),
-	}
-
-	for k, v := range data {
-		if strings.Contains(k, "data.") {
-			key := strings.Split(k, "data.")[1]
-			body.Data[key] = v
-		}
+		To: fmt.Sprintf("/topics/ciba_consent_%s", prompt.Hint),
+		Data: map[string]interface{}{
+			"auth_req_id": prompt.AuthReqId,
+		},
 	}
 
 	jsonBody, _ := json.Marshal(body)
-	req, _ := http.NewRequest(http.MethodPost, f.baseUrl, bytes.NewBuffer(jsonBody))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, f.baseUrl, bytes.NewBuffer(jsonBody))
 	req.Header.Add("Authorization", fmt.Sprintf("key=%s", f.serverKey))
 	req.Header.Add("Content-Type", "application/json")
 
-	fmt.Println(string(jsonBody))
-
 	res, err := f.client.Do(req)
 
 	if err != nil {
@@ -89,61 +95,12 @@ func NewClientAppNotificationClient() *ClientAppNotification {
 	}}
 }
 
-type TokenCallbackRequest struct {
-	AuthReqId               string `json:"auth_req_id,omitempty"`
-	AccessToken             string `json:"access_token,omitempty"`
-	TokenType               string `json:"token_type,omitempty"`
-	ExpiresIn               int    `json:"expires_in,omitempty"`
-	IdToken                 string `json:"id_token,omitempty"`
-	endpoint                string
-	clientNotificationToken string
-
-	util.OidcError
-}
-
-func (c *ClientAppNotification) buildRequest(data map[string]interface{}) *TokenCallbackRequest {
-	var body *TokenCallbackRequest = nil
-
-	tokenMethod := data["token_method"].(string)
-
-	if tokenMethod == domain.ModePush {
-		success := data["success"].(bool)
-		if success {
-			body = &TokenCallbackRequest{
-				AuthReqId:               data["auth_req_id"].(string),
-				AccessToken:             data["access_token"].(string),
-				TokenType:               data["token_type"].(string),
-				ExpiresIn:               data["expires_in"].(int),
-				IdToken:                 data["id_token"].(string),
-				clientNotificationToken: data["client_notification_token"].(string),
-				endpoint:                data["endpoint"].(string),
-			}
-		} else {
-			body = &TokenCallbackRequest{
-				OidcError:               data["oidc_error"].(util.OidcError),
-				clientNotificationToken: data["client_notification_token"].(string),
-				endpoint:                data["endpoint"].(string),
-			}
-		}
-	} else if tokenMethod == domain.ModePing {
-		body = &TokenCallbackRequest{
-			AuthReqId:               data["auth_req_id"].(string),
-			clientNotificationToken: data["client_notification_token"].(string),
-			endpoint:                data["endpoint"].(string),
-		}
-	}
-
-	return body
-}
-
-func (c *ClientAppNotification) Send(data map[string]interface{}) error {
-	body := c.buildRequest(data)
-	jsonBody, _ := json.Marshal(body)
-
-	fmt.Println(string(jsonBody))
+func (c *ClientAppNotification) NotifyClient(ctx context.Context, message ClientMessage) error {
+	callback := message.callback()
+	jsonBody, _ := json.Marshal(callback.body)
 
-	req, _ := http.NewRequest(http.MethodPost, body.endpoint, bytes.NewBuffer(jsonBody))
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", body.clientNotificationToken))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, callback.endpoint, bytes.NewBuffer(jsonBody))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", callback.clientNotificationToken))
 	req.Header.Add("Content-Type", "application/json")
 
 	res, err := c.client.Do(req)
@@ -1,11 +1,11 @@
 package transport
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"testing"
 
-	"github.com/adisazhar123/go-ciba/domain"
 	"github.com/adisazhar123/go-ciba/util"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/h2non/gock.v1"
@@ -24,7 +24,7 @@ const (
 	userId                  = "123"
 )
 
-func TestFirebaseCloudMessaging_Send(t *testing.T) {
+func TestFirebaseCloudMessaging_NotifyUser(t *testing.T) {
 	defer gock.Off()
 	body := &fcmSendRequest{
 		To:   fmt.Sprintf("/topics/ciba_consent_%s", userId),
@@ -39,15 +39,15 @@ func TestFirebaseCloudMessaging_Send(t *testing.T) {
 		Reply(200)
 	client := NewFirebaseCloudMessaging(firebaseServerKey)
 
-	err := client.Send(map[string]interface{}{
-		"to":               userId,
-		"data.auth_req_id": authReqId,
+	err := client.NotifyUser(context.Background(), &UserConsentPrompt{
+		Hint:      userId,
+		AuthReqId: authReqId,
 	})
 
 	assert.NoError(t, err)
 }
 
-func TestFirebaseCloudMessaging_Send_ShouldReturnError(t *testing.T) {
+func TestFirebaseCloudMessaging_NotifyUser_ShouldReturnError(t *testing.T) {
 	defer gock.Off()
 	body := &fcmSendRequest{
 		To:   fmt.Sprintf("/topics/ciba_consent_%s", userId),
@@ -63,27 +63,16 @@ func TestFirebaseCloudMessaging_Send_ShouldReturnError(t *testing.T) {
 		JSON(map[string]string{"message": "validation error"})
 	client := NewFirebaseCloudMessaging(firebaseServerKey)
 
-	err := client.Send(map[string]interface{}{
-		"to":               userId,
-		"data.auth_req_id": authReqId,
+	err := client.NotifyUser(context.Background(), &UserConsentPrompt{
+		Hint:      userId,
+		AuthReqId: authReqId,
 	})
 
 	assert.Error(t, err)
 }
 
-func TestClientAppNotification_Send_SuccessfulPush(t *testing.T) {
+func TestClientAppNotification_NotifyClient_SuccessfulPush(t *testing.T) {
 	defer gock.Off()
-	requestBody := map[string]interface{}{
-		"token_method":              domain.ModePush,
-		"success":                   true,
-		"auth_req_id":               authReqId,
-		"access_token":              accessToken,
-		"token_type":                tokenType,
-		"expires_in":                expiresIn,
-		"id_token":                  idToken,
-		"client_notification_token": clientNotificationToken,
-		"endpoint":                  endpoint,
-	}
 	jsonBody, _ := json.Marshal(map[string]interface{}{
 		"auth_req_id":  authReqId,
 		"access_token": accessToken,
@@ -98,21 +87,26 @@ func TestClientAppNotification_Send_SuccessfulPush(t *testing.T) {
 		Reply(200)
 	client := NewClientAppNotificationClient()
 
-	err := client.Send(requestBody)
+	err := client.NotifyClient(context.Background(), &ClientPushSuccess{
+		Endpoint:                endpoint,
+		ClientNotificationToken: clientNotificationToken,
+		AuthReqId:               authReqId,
+		AccessToken:             accessToken,
+		TokenType:               tokenType,
+		ExpiresIn:               expiresIn,
+		IdToken:                 idToken,
+	})
 
 	assert.NoError(t, err)
 }
 
-func TestClientAppNotification_Send_PushOidcError(t *testing.T) {
+func TestClientAppNotification_NotifyClient_PushOidcError(t *testing.T) {
 	defer gock.Off()
-	requestBody := map[string]interface{}{
-		"oidc_error":                *util.ErrAccessDenied,
-		"client_notification_token": clientNotificationToken,
-		"endpoint":                  endpoint,
-		"success":                   false,
-		"token_method":              domain.ModePush,
-	}
-	jsonBody, _ := json.Marshal(util.ErrAccessDenied)
+	jsonBody, _ := json.Marshal(map[string]interface{}{
+		"auth_req_id":       authReqId,
+		"error":             util.ErrAccessDenied.ErrorTag,
+		"error_description": util.ErrAccessDenied.ErrorDescription,
+	})
 	gock.New(endpoint).
 		Post("").
 		MatchHeader("Authorization", "Bearer "+clientNotificationToken).
@@ -120,20 +114,18 @@ func TestClientAppNotification_Send_PushOidcError(t *testing.T) {
 		Reply(200)
 	client := NewClientAppNotificationClient()
 
-	err := client.Send(requestBody)
+	err := client.NotifyClient(context.Background(), &ClientPushError{
+		Endpoint:                endpoint,
+		ClientNotificationToken: clientNotificationToken,
+		AuthReqId:               authReqId,
+		Error:                   util.ErrAccessDenied,
+	})
 
 	assert.NoError(t, err)
 }
 
-func TestClientAppNotification_Send_SuccessfulPing(t *testing.T) {
+func TestClientAppNotification_NotifyClient_SuccessfulPing(t *testing.T) {
 	defer gock.Off()
-	requestBody := map[string]interface{}{
-		"client_notification_token": clientNotificationToken,
-		"endpoint":                  endpoint,
-		"success":                   true,
-		"token_method":              domain.ModePing,
-		"auth_req_id":               authReqId,
-	}
 	jsonBody, _ := json.Marshal(map[string]interface{}{
 		"auth_req_id": authReqId,
 	})
@@ -141,10 +133,30 @@ func TestClientAppNotification_Send_SuccessfulPing(t *testing.T) {
 		Post("").
 		MatchHeader("Authorization", "Bearer "+clientNotificationToken).
 		JSON(jsonBody).
-		Reply(200)
+		Reply(204)
 	client := NewClientAppNotificationClient()
 
-	err := client.Send(requestBody)
+	err := client.NotifyClient(context.Background(), &ClientPingCallback{
+		Endpoint:                endpoint,
+		ClientNotificationToken: clientNotificationToken,
+		AuthReqId:               authReqId,
+	})
 
 	assert.NoError(t, err)
 }
+
+func TestClientAppNotification_NotifyClient_ShouldReturnError_WhenEndpointFails(t *testing.T) {
+	defer gock.Off()
+	gock.New(endpoint).
+		Post("").
+		Reply(500)
+	client := NewClientAppNotificationClient()
+
+	err := client.NotifyClient(context.Background(), &ClientPingCallback{
+		Endpoint:                endpoint,
+		ClientNotificationToken: clientNotificationToken,
+		AuthReqId:               authReqId,
+	})
+
+	assert.Error(t, err)
+}
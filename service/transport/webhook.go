@@ -0,0 +1,306 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+const (
+	WebhookEventConsentPrompt = "ciba.consent_prompt"
+	// Sent when a prompt is withdrawn, its data has no login hint nor scope.
+	WebhookEventConsentWithdrawn = "ciba.consent_withdrawn"
+	WebhookSignatureHeader       = "X-Ciba-Signature"
+	WebhookIdempotencyHeader     = "Idempotency-Key"
+)
+
+var ErrInvalidWebhookSignature = errors.New("webhook signature is invalid or too old")
+
+// Where the events are posted and the secret their bodies are signed with.
+type WebhookEndpoint struct {
+	Url    string
+	Secret string
+}
+
+type WebhookConfig struct {
+	// Endpoints of client applications by client ID, they are used instead of the global endpoint
+	// for the prompts of those clients.
+	ClientEndpoints map[string]*WebhookEndpoint
+	// Attempts made before giving up, requests are only retried on network errors and 5xx responses.
+	MaxAttempts int
+	// Waited before the first retry, doubled on every retry after.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Timeout        time.Duration
+	// Certificates are always verified, RootCAs can be set to trust a private CA.
+	TlsConfig *tls.Config
+	// Allows http endpoints, they are only meant for local development.
+	AllowHttp bool
+}
+
+func NewWebhookConfig() *WebhookConfig {
+	return &WebhookConfig{
+		ClientEndpoints: make(map[string]*WebhookEndpoint),
+		MaxAttempts:     3,
+		InitialBackoff:  500 * time.Millisecond,
+		MaxBackoff:      5 * time.Second,
+		Timeout:         5 * time.Second,
+	}
+}
+
+// The JSON body posted to webhook endpoints.
+type WebhookEvent struct {
+	// Unique to the event, it's also sent as the Idempotency-Key header and stays the same across retries.
+	Id        string             `json:"id"`
+	Type      string             `json:"type"`
+	CreatedAt int64              `json:"created_at"`
+	Data      *WebhookPromptData `json:"data"`
+}
+
+type WebhookPromptData struct {
+	UserId         string               `json:"user_id"`
+	LoginHint      string               `json:"login_hint"`
+	AuthReqId      string               `json:"auth_req_id"`
+	ClientId       string               `json:"client_id"`
+	Scope          string               `json:"scope"`
+	BindingMessage string               `json:"binding_message,omitempty"`
+	Device         *WebhookPromptDevice `json:"device,omitempty"`
+}
+
+// The registered device the prompt is for, absent when the user has none.
+type WebhookPromptDevice struct {
+	Id        string `json:"id"`
+	Platform  string `json:"platform"`
+	PushToken string `json:"push_token"`
+}
+
+// Posts consent prompts and their withdrawals as events to a webhook, for teams delivering them with their own push infrastructure.
+type webhookNotification struct {
+	client   *http.Client
+	endpoint *WebhookEndpoint
+	config   *WebhookConfig
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+// Creates a webhook notification posting to endpoint, it can be nil when every client has its own endpoint.
+func NewWebhookNotification(endpoint *WebhookEndpoint) (*webhookNotification, error) {
+	return NewCustomWebhookNotification(endpoint, NewWebhookConfig())
+}
+
+func NewCustomWebhookNotification(endpoint *WebhookEndpoint, config *WebhookConfig) (*webhookNotification, error) {
+	endpoints := []*WebhookEndpoint{endpoint}
+	for _, e := range config.ClientEndpoints {
+		endpoints = append(endpoints, e)
+	}
+	for _, e := range endpoints {
+		if e == nil {
+			continue
+		}
+		if err := validateWebhookEndpoint(e, config.AllowHttp); err != nil {
+			return nil, err
+		}
+	}
+
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.TlsConfig != nil {
+		httpTransport.TLSClientConfig = config.TlsConfig.Clone()
+	}
+	if httpTransport.TLSClientConfig != nil && httpTransport.TLSClientConfig.InsecureSkipVerify {
+		return nil, errors.New("webhook certificates must be verified")
+	}
+	return &webhookNotification{
+		client: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: httpTransport,
+		},
+		endpoint: endpoint,
+		config:   config,
+		now:      time.Now,
+		sleep:    sleepContext,
+	}, nil
+}
+
+func validateWebhookEndpoint(endpoint *WebhookEndpoint, allowHttp bool) error {
+	u, err := url.Parse(endpoint.Url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && !(allowHttp && u.Scheme == "http") {
+		return fmt.Errorf("webhook endpoint %s must use https", endpoint.Url)
+	}
+	if endpoint.Secret == "" {
+		return fmt.Errorf("webhook endpoint %s has no secret", endpoint.Url)
+	}
+	return nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (w *webhookNotification) endpointOf(clientId string) *WebhookEndpoint {
+	if endpoint, ok := w.config.ClientEndpoints[clientId]; ok {
+		return endpoint
+	}
+	return w.endpoint
+}
+
+func (w *webhookNotification) NotifyUser(ctx context.Context, prompt *UserConsentPrompt) error {
+	return w.deliver(ctx, WebhookEventConsentPrompt, &WebhookPromptData{
+		UserId:         prompt.UserId,
+		LoginHint:      prompt.Hint,
+		AuthReqId:      prompt.AuthReqId,
+		ClientId:       prompt.ClientId,
+		Scope:          prompt.Scope,
+		BindingMessage: prompt.BindingMessage,
+		Device:         newWebhookPromptDevice(prompt.Device),
+	})
+}
+
+func (w *webhookNotification) NotifyWithdrawal(ctx context.Context, withdrawal *UserConsentWithdrawal) error {
+	return w.deliver(ctx, WebhookEventConsentWithdrawn, &WebhookPromptData{
+		UserId:    withdrawal.UserId,
+		AuthReqId: withdrawal.AuthReqId,
+		ClientId:  withdrawal.ClientId,
+		Device:    newWebhookPromptDevice(withdrawal.Device),
+	})
+}
+
+func newWebhookPromptDevice(device *domain.UserDevice) *WebhookPromptDevice {
+	if device == nil {
+		return nil
+	}
+	return &WebhookPromptDevice{
+		Id:        device.Id,
+		Platform:  device.Platform,
+		PushToken: device.PushToken,
+	}
+}
+
+// Posts the event to the endpoint of the client, retrying with backoff.
+func (w *webhookNotification) deliver(ctx context.Context, eventType string, data *WebhookPromptData) error {
+	endpoint := w.endpointOf(data.ClientId)
+	if endpoint == nil {
+		return fmt.Errorf("no webhook endpoint for client application %s", data.ClientId)
+	}
+	event := &WebhookEvent{
+		Id:        util.GenerateUuid(),
+		Type:      eventType,
+		CreatedAt: w.now().Unix(),
+		Data:      data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(ctx, endpoint, event.Id, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.config.MaxAttempts {
+			log.Printf("[go-ciba][webhooknotification] failed sending %s event of %s. %s\n", eventType, data.AuthReqId, err.Error())
+			return err
+		}
+		if err := w.sleep(ctx, backoff); err != nil {
+			return err
+		}
+		if backoff *= 2; backoff > w.config.MaxBackoff {
+			backoff = w.config.MaxBackoff
+		}
+	}
+}
+
+// Posts the event once, reporting whether a failure is worth retrying.
+func (w *webhookNotification) post(ctx context.Context, endpoint *WebhookEndpoint, eventId string, body []byte) (bool, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.Url, bytes.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add(WebhookIdempotencyHeader, eventId)
+	req.Header.Add(WebhookSignatureHeader, SignWebhookBody(endpoint.Secret, w.now(), body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	return res.StatusCode >= http.StatusInternalServerError, fmt.Errorf("webhook responded %d %s", res.StatusCode, string(resBody))
+}
+
+// Returns the X-Ciba-Signature header of body, the HMAC SHA-256 of "<timestamp>.<body>" keyed with secret.
+func SignWebhookBody(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(webhookMac(secret, t, body)))
+}
+
+func webhookMac(secret, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Verifies the X-Ciba-Signature header of a received body, rejecting signatures older than tolerance
+// so captured requests can't be replayed later. It's meant for the services receiving the events.
+func VerifyWebhookSignature(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			if sig, err := hex.DecodeString(kv[1]); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidWebhookSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return ErrInvalidWebhookSignature
+	}
+	expected := webhookMac(secret, timestamp, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidWebhookSignature
+}
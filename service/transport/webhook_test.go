@@ -0,0 +1,219 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+const webhookSecret = "webhook-secret"
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// Stands in for a webhook endpoint, it responds with the queued status codes and 200 after.
+type webhookStandIn struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	statuses []int
+	requests []webhookRequest
+}
+
+func newWebhookStandIn(statuses ...int) *webhookStandIn {
+	s := &webhookStandIn{statuses: statuses}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.requests = append(s.requests, webhookRequest{header: r.Header.Clone(), body: body})
+		if len(s.statuses) > 0 {
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+		}
+	}))
+	return s
+}
+
+func (s *webhookStandIn) trustingConfig() *WebhookConfig {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	config := NewWebhookConfig()
+	config.TlsConfig = &tls.Config{RootCAs: pool}
+	return config
+}
+
+func newTestWebhook(t *testing.T, endpoint *WebhookEndpoint, config *WebhookConfig) (*webhookNotification, *[]time.Duration) {
+	webhook, err := NewCustomWebhookNotification(endpoint, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sleeps []time.Duration
+	webhook.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	return webhook, &sleeps
+}
+
+func TestWebhookNotification_NotifyUser_ShouldPostSignedEvent(t *testing.T) {
+	standIn := newWebhookStandIn()
+	defer standIn.Close()
+	webhook, _ := newTestWebhook(t, &WebhookEndpoint{Url: standIn.URL, Secret: webhookSecret}, standIn.trustingConfig())
+	prompt := newPrompt()
+	prompt.Device = domain.NewUserDevice(userId, domain.DevicePlatformAndroid, "phone", "Phone", "")
+
+	err := webhook.NotifyUser(context.Background(), prompt)
+
+	assert.NoError(t, err)
+	assert.Len(t, standIn.requests, 1)
+	req := standIn.requests[0]
+	assert.NoError(t, VerifyWebhookSignature(webhookSecret, req.header.Get(WebhookSignatureHeader), req.body, time.Now(), time.Minute))
+	event := &WebhookEvent{}
+	_ = json.Unmarshal(req.body, event)
+	assert.Equal(t, event.Id, req.header.Get(WebhookIdempotencyHeader))
+	assert.Equal(t, WebhookEventConsentPrompt, event.Type)
+	assert.Equal(t, &WebhookPromptData{
+		UserId:         userId,
+		LoginHint:      userId,
+		AuthReqId:      authReqId,
+		ClientId:       "client-id",
+		Scope:          "openid",
+		BindingMessage: "W4SCT",
+		Device: &WebhookPromptDevice{
+			Id:        prompt.Device.Id,
+			Platform:  domain.DevicePlatformAndroid,
+			PushToken: "phone",
+		},
+	}, event.Data)
+}
+
+func TestWebhookNotification_NotifyWithdrawal_ShouldPostSignedEvent(t *testing.T) {
+	standIn := newWebhookStandIn()
+	defer standIn.Close()
+	webhook, _ := newTestWebhook(t, &WebhookEndpoint{Url: standIn.URL, Secret: webhookSecret}, standIn.trustingConfig())
+
+	err := webhook.NotifyWithdrawal(context.Background(), newWithdrawal())
+
+	assert.NoError(t, err)
+	assert.Len(t, standIn.requests, 1)
+	req := standIn.requests[0]
+	assert.NoError(t, VerifyWebhookSignature(webhookSecret, req.header.Get(WebhookSignatureHeader), req.body, time.Now(), time.Minute))
+	event := &WebhookEvent{}
+	_ = json.Unmarshal(req.body, event)
+	assert.Equal(t, WebhookEventConsentWithdrawn, event.Type)
+	assert.Equal(t, &WebhookPromptData{
+		UserId:    userId,
+		AuthReqId: authReqId,
+		ClientId:  "client-id",
+	}, event.Data)
+}
+
+func TestWebhookNotification_NotifyUser_ShouldRetryServerErrorsWithBackoff(t *testing.T) {
+	standIn := newWebhookStandIn(http.StatusServiceUnavailable, http.StatusBadGateway)
+	defer standIn.Close()
+	webhook, sleeps := newTestWebhook(t, &WebhookEndpoint{Url: standIn.URL, Secret: webhookSecret}, standIn.trustingConfig())
+
+	err := webhook.NotifyUser(context.Background(), newPrompt())
+
+	assert.NoError(t, err)
+	assert.Len(t, standIn.requests, 3)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, *sleeps)
+	idempotencyKey := standIn.requests[0].header.Get(WebhookIdempotencyHeader)
+	assert.NotEmpty(t, idempotencyKey)
+	for _, req := range standIn.requests {
+		assert.Equal(t, idempotencyKey, req.header.Get(WebhookIdempotencyHeader))
+	}
+}
+
+func TestWebhookNotification_NotifyUser_ShouldGiveUp_AfterMaxAttempts(t *testing.T) {
+	standIn := newWebhookStandIn(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	defer standIn.Close()
+	webhook, _ := newTestWebhook(t, &WebhookEndpoint{Url: standIn.URL, Secret: webhookSecret}, standIn.trustingConfig())
+
+	err := webhook.NotifyUser(context.Background(), newPrompt())
+
+	assert.Error(t, err)
+	assert.Len(t, standIn.requests, 3)
+}
+
+func TestWebhookNotification_NotifyUser_ShouldNotRetryClientErrors(t *testing.T) {
+	standIn := newWebhookStandIn(http.StatusBadRequest)
+	defer standIn.Close()
+	webhook, sleeps := newTestWebhook(t, &WebhookEndpoint{Url: standIn.URL, Secret: webhookSecret}, standIn.trustingConfig())
+
+	err := webhook.NotifyUser(context.Background(), newPrompt())
+
+	assert.Error(t, err)
+	assert.Len(t, standIn.requests, 1)
+	assert.Empty(t, *sleeps)
+}
+
+func TestWebhookNotification_NotifyUser_ShouldUseClientEndpoint(t *testing.T) {
+	global := newWebhookStandIn()
+	defer global.Close()
+	perClient := newWebhookStandIn()
+	defer perClient.Close()
+	config := global.trustingConfig()
+	config.TlsConfig.RootCAs.AddCert(perClient.Certificate())
+	config.ClientEndpoints["client-id"] = &WebhookEndpoint{Url: perClient.URL, Secret: "client-secret"}
+	webhook, _ := newTestWebhook(t, &WebhookEndpoint{Url: global.URL, Secret: webhookSecret}, config)
+	other := newPrompt()
+	other.ClientId = "other-client-id"
+
+	_ = webhook.NotifyUser(context.Background(), newPrompt())
+	_ = webhook.NotifyUser(context.Background(), other)
+
+	assert.Len(t, perClient.requests, 1)
+	assert.Len(t, global.requests, 1)
+	req := perClient.requests[0]
+	assert.NoError(t, VerifyWebhookSignature("client-secret", req.header.Get(WebhookSignatureHeader), req.body, time.Now(), time.Minute))
+}
+
+func TestWebhookNotification_NotifyUser_ShouldFail_WhenCertificateIsUntrusted(t *testing.T) {
+	standIn := newWebhookStandIn()
+	defer standIn.Close()
+	config := NewWebhookConfig()
+	config.MaxAttempts = 1
+	webhook, _ := newTestWebhook(t, &WebhookEndpoint{Url: standIn.URL, Secret: webhookSecret}, config)
+
+	err := webhook.NotifyUser(context.Background(), newPrompt())
+
+	assert.Error(t, err)
+	assert.Empty(t, standIn.requests)
+}
+
+func TestNewWebhookNotification_ShouldRejectInsecureEndpoints(t *testing.T) {
+	_, httpErr := NewWebhookNotification(&WebhookEndpoint{Url: "http://hooks.example.com", Secret: webhookSecret})
+	_, secretErr := NewWebhookNotification(&WebhookEndpoint{Url: "https://hooks.example.com"})
+	config := NewWebhookConfig()
+	config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	_, skipVerifyErr := NewCustomWebhookNotification(&WebhookEndpoint{Url: "https://hooks.example.com", Secret: webhookSecret}, config)
+
+	assert.Error(t, httpErr)
+	assert.Error(t, secretErr)
+	assert.Error(t, skipVerifyErr)
+}
+
+func TestVerifyWebhookSignature_ShouldRejectTamperedAndOldBodies(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	signedAt := time.Now()
+	header := SignWebhookBody(webhookSecret, signedAt, body)
+
+	assert.NoError(t, VerifyWebhookSignature(webhookSecret, header, body, signedAt, time.Minute))
+	assert.Equal(t, ErrInvalidWebhookSignature, VerifyWebhookSignature(webhookSecret, header, []byte(`{"id":"2"}`), signedAt, time.Minute))
+	assert.Equal(t, ErrInvalidWebhookSignature, VerifyWebhookSignature("other-secret", header, body, signedAt, time.Minute))
+	assert.Equal(t, ErrInvalidWebhookSignature, VerifyWebhookSignature(webhookSecret, header, body, signedAt.Add(2*time.Minute), time.Minute))
+	assert.Equal(t, ErrInvalidWebhookSignature, VerifyWebhookSignature(webhookSecret, "garbage", body, signedAt, time.Minute))
+}
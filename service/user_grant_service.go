@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+// Lets users see the client applications they granted scopes to and revoke them, the server
+// authenticates users before calling it on their behalf.
+type userGrantService struct {
+	dataStore repository.DataStoreInterface
+	grantRepo repository.GrantRepositoryInterface
+
+	now func() time.Time
+}
+
+func NewUserGrantService(dataStore repository.DataStoreInterface) *userGrantService {
+	return &userGrantService{
+		dataStore: dataStore,
+		grantRepo: dataStore.GetGrantRepository(),
+		now: func() time.Time {
+			return time.Now().UTC()
+		},
+	}
+}
+
+// Returns the active grants of the user, most recently consented first.
+func (u *userGrantService) FindGrants(ctx context.Context, userId string) ([]*domain.Grant, *util.OidcError) {
+	grants, err := u.grantRepo.FindActiveByUserId(ctx, userId)
+	if err != nil {
+		log.Printf("[go-ciba][usergrantservice] failed finding grants of user %s. %s\n", userId, err.Error())
+		return nil, util.ErrGeneral
+	}
+	return grants, nil
+}
+
+// Revokes the grant of the user for the client along with the access tokens issued to the client
+// for them, so the client has to ask for consent again. Its pending and approved requests are revoked too,
+// so no tokens are issued for them afterwards. No refresh token is ever issued.
+func (u *userGrantService) RevokeGrant(ctx context.Context, userId, clientId string) *util.OidcError {
+	grant, err := u.grantRepo.FindByUserIdAndClientId(ctx, userId, clientId)
+	if err != nil {
+		log.Printf("[go-ciba][usergrantservice] failed finding grant of user %s for client %s. %s\n", userId, clientId, err.Error())
+		return util.ErrGeneral
+	}
+	if grant == nil || !grant.IsActive() {
+		return util.ErrInvalidRequest
+	}
+	grant.Revoke(u.now())
+	err = u.dataStore.WithinTransaction(ctx, func(tx repository.DataStoreInterface) error {
+		if err := tx.GetGrantRepository().Update(ctx, grant); err != nil {
+			return err
+		}
+		if err := revokeCibaSessions(ctx, tx.GetCibaSessionRepository(), userId, clientId); err != nil {
+			return err
+		}
+		_, err := tx.GetAccessTokenRepository().DeleteByUserIdAndClientId(ctx, userId, clientId)
+		return err
+	})
+	if err != nil {
+		log.Printf("[go-ciba][usergrantservice] failed revoking grant of user %s for client %s. %s\n", userId, clientId, err.Error())
+		return util.ErrGeneral
+	}
+	return nil
+}
+
+func revokeCibaSessions(ctx context.Context, cibaSessionRepo repository.CibaSessionRepositoryInterface, userId, clientId string) error {
+	cibaSessions, err := cibaSessionRepo.FindActiveByUserIdAndClientId(ctx, userId, clientId)
+	if err != nil {
+		return err
+	}
+	for _, cs := range cibaSessions {
+		if err := cs.Revoke(domain.ActorUser); err != nil {
+			return err
+		}
+		if err := cibaSessionRepo.Update(ctx, cs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/grant"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/adisazhar123/go-ciba/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newUserGrantService() (*userGrantService, *memory.DataStore) {
+	ds := memory.NewDataStore()
+	now := time.Now().UTC()
+	_ = ds.GetGrantRepository().Create(context.Background(), domain.NewGrant(test_data.User1.Id, test_data.ClientAppPing.Id, "openid email", now.Add(-time.Hour)))
+	_ = ds.GetGrantRepository().Create(context.Background(), domain.NewGrant(test_data.User1.Id, test_data.ClientAppPoll.Id, "openid", now))
+	_ = ds.GetGrantRepository().Create(context.Background(), domain.NewGrant(test_data.User2.Id, test_data.ClientAppPing.Id, "openid", now))
+	return NewUserGrantService(ds), ds
+}
+
+func TestUserGrantService_FindGrants_ShouldReturnActiveGrantsOfUser(t *testing.T) {
+	us, _ := newUserGrantService()
+
+	grants, err := us.FindGrants(context.Background(), test_data.User1.Id)
+
+	assert.Nil(t, err)
+	if assert.Len(t, grants, 2) {
+		assert.Equal(t, test_data.ClientAppPoll.Id, grants[0].ClientId)
+		assert.Equal(t, test_data.ClientAppPing.Id, grants[1].ClientId)
+	}
+}
+
+func TestUserGrantService_RevokeGrant_ShouldRevokeGrantAndItsAccessTokens(t *testing.T) {
+	us, ds := newUserGrantService()
+	expires := time.Now().UTC().Add(time.Hour)
+	revoked := domain.NewAccessToken("revoked-token", test_data.ClientAppPing.Id, test_data.User1.Id, "openid", expires)
+	otherClient := domain.NewAccessToken("other-client-token", test_data.ClientAppPoll.Id, test_data.User1.Id, "openid", expires)
+	otherUser := domain.NewAccessToken("other-user-token", test_data.ClientAppPing.Id, test_data.User2.Id, "openid", expires)
+	for _, at := range []*domain.AccessToken{revoked, otherClient, otherUser} {
+		_ = ds.GetAccessTokenRepository().Create(context.Background(), at)
+	}
+
+	err := us.RevokeGrant(context.Background(), test_data.User1.Id, test_data.ClientAppPing.Id)
+	userGrant, _ := ds.GetGrantRepository().FindByUserIdAndClientId(context.Background(), test_data.User1.Id, test_data.ClientAppPing.Id)
+	grants, _ := us.FindGrants(context.Background(), test_data.User1.Id)
+	foundRevoked, _ := ds.GetAccessTokenRepository().Find(context.Background(), revoked.Value)
+	foundOtherClient, _ := ds.GetAccessTokenRepository().Find(context.Background(), otherClient.Value)
+	foundOtherUser, _ := ds.GetAccessTokenRepository().Find(context.Background(), otherUser.Value)
+
+	assert.Nil(t, err)
+	assert.False(t, userGrant.IsActive())
+	assert.Len(t, grants, 1)
+	assert.Nil(t, foundRevoked)
+	assert.NotNil(t, foundOtherClient)
+	assert.NotNil(t, foundOtherUser)
+}
+
+func TestUserGrantService_RevokeGrant_ShouldRevokeRequestsOfClient(t *testing.T) {
+	us, ds := newUserGrantService()
+	_ = ds.GetClientApplicationRepository().Register(context.Background(), &test_data.ClientAppPing)
+	ts := NewTokenService(ds, grant.NewCibaGrant())
+	approved := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "", "client-notification-token", "openid", 3600, nil)
+	_ = approved.Approve(domain.ActorUser)
+	pending := domain.NewCibaSession(&test_data.ClientAppPing, test_data.User1.Id, "", "client-notification-token", "openid", 3600, nil)
+	otherClient := domain.NewCibaSession(&test_data.ClientAppPoll, test_data.User1.Id, "", "", "openid", 3600, nil)
+	for _, cs := range []*domain.CibaSession{approved, pending, otherClient} {
+		_ = ds.GetCibaSessionRepository().Create(context.Background(), cs)
+	}
+
+	err := us.RevokeGrant(context.Background(), test_data.User1.Id, test_data.ClientAppPing.Id)
+	_, tokenErr := ts.GrantAccessToken(context.Background(), &TokenRequest{
+		clientId:  test_data.ClientAppPing.Id,
+		authReqId: approved.AuthReqId,
+	})
+	foundPending, _ := ds.GetCibaSessionRepository().FindById(context.Background(), pending.AuthReqId)
+	foundOtherClient, _ := ds.GetCibaSessionRepository().FindById(context.Background(), otherClient.AuthReqId)
+
+	assert.Nil(t, err)
+	assert.Equal(t, util.ErrAccessDenied, tokenErr)
+	assert.Equal(t, domain.StatusRevoked, foundPending.GetStatus())
+	assert.Equal(t, domain.StatusPending, foundOtherClient.GetStatus())
+}
+
+func TestUserGrantService_RevokeGrant_ShouldFail_WhenGrantIsUnknownOrRevoked(t *testing.T) {
+	us, _ := newUserGrantService()
+	_ = us.RevokeGrant(context.Background(), test_data.User1.Id, test_data.ClientAppPing.Id)
+
+	unknownErr := us.RevokeGrant(context.Background(), test_data.User2.Id, test_data.ClientAppPoll.Id)
+	revokedErr := us.RevokeGrant(context.Background(), test_data.User1.Id, test_data.ClientAppPing.Id)
+
+	assert.Equal(t, util.ErrInvalidRequest, unknownErr)
+	assert.Equal(t, util.ErrInvalidRequest, revokedErr)
+}
@@ -1,9 +1,11 @@
 package test_data
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/adisazhar123/go-ciba/domain"
@@ -338,13 +340,13 @@ func NewClientApplicationVolatileRepository() *clientApplicationVolatileReposito
 	}
 }
 
-func (c *clientApplicationVolatileRepository) Register(clientApp *domain.ClientApplication) error {
+func (c *clientApplicationVolatileRepository) Register(ctx context.Context, clientApp *domain.ClientApplication) error {
 	key := fmt.Sprintf("client_application:%s", clientApp.Id)
 	c.data[key] = clientApp
 	return nil
 }
 
-func (c *clientApplicationVolatileRepository) FindById(id string) (*domain.ClientApplication, error) {
+func (c *clientApplicationVolatileRepository) FindById(ctx context.Context, id string) (*domain.ClientApplication, error) {
 	key := fmt.Sprintf("client_application:%s", id)
 	clientApp, _ := c.data[key]
 	return clientApp, nil
@@ -373,21 +375,74 @@ func NewCibaSessionVolatileRepository() *cibaSessionVolatileRepository {
 	}}
 }
 
-func (c cibaSessionVolatileRepository) FindById(id string) (*domain.CibaSession, error) {
+func (c cibaSessionVolatileRepository) FindById(ctx context.Context, id string) (*domain.CibaSession, error) {
 	return c.data[id], nil
 }
 
-func (c cibaSessionVolatileRepository) Update(cibaSession *domain.CibaSession) error {
+func (c cibaSessionVolatileRepository) Update(ctx context.Context, cibaSession *domain.CibaSession) error {
 	c.data[cibaSession.AuthReqId] = cibaSession
 	return nil
 }
 
-func (c cibaSessionVolatileRepository) Create(cibaSession *domain.CibaSession) error {
+func (c cibaSessionVolatileRepository) Create(ctx context.Context, cibaSession *domain.CibaSession) error {
 	key := fmt.Sprintf("%s", cibaSession.AuthReqId)
 	c.data[key] = cibaSession
 	return nil
 }
 
+func (c cibaSessionVolatileRepository) FindExpired(ctx context.Context, before time.Time, limit int) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range c.data {
+		if len(cibaSessions) == limit {
+			break
+		}
+		if !cs.IsFinal() && cs.GetExpiresAt().Before(before) {
+			cibaSessions = append(cibaSessions, cs)
+		}
+	}
+	return cibaSessions, nil
+}
+
+func (c cibaSessionVolatileRepository) FindPendingByUserId(ctx context.Context, userId string, after time.Time) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range c.data {
+		if cs.UserId == userId && cs.IsAuthorizationPending() && cs.GetExpiresAt().After(after) {
+			cibaSessions = append(cibaSessions, cs)
+		}
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].CreatedAt.Before(cibaSessions[j].CreatedAt)
+	})
+	return cibaSessions, nil
+}
+
+func (c cibaSessionVolatileRepository) FindActiveByUserIdAndClientId(ctx context.Context, userId, clientId string) ([]*domain.CibaSession, error) {
+	var cibaSessions []*domain.CibaSession
+	for _, cs := range c.data {
+		if cs.UserId == userId && cs.ClientId == clientId && !cs.IsFinal() {
+			cibaSessions = append(cibaSessions, cs)
+		}
+	}
+	sort.Slice(cibaSessions, func(i, j int) bool {
+		return cibaSessions[i].CreatedAt.Before(cibaSessions[j].CreatedAt)
+	})
+	return cibaSessions, nil
+}
+
+func (c cibaSessionVolatileRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	deleted := 0
+	for id, cs := range c.data {
+		if deleted == limit {
+			break
+		}
+		if cs.GetExpiresAt().Before(before) {
+			delete(c.data, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
 type keyVolatileRepository struct {
 	data map[string]*domain.Key
 }
@@ -406,7 +461,7 @@ func NewKeyVolatileRepository() *keyVolatileRepository {
 	}}
 }
 
-func (k keyVolatileRepository) FindPrivateKeyByClientId(clientId string) (*domain.Key, error) {
+func (k keyVolatileRepository) FindPrivateKeyByClientId(ctx context.Context, clientId string) (*domain.Key, error) {
 	for _, v := range k.data {
 		if v.ClientId == clientId {
 			return v, nil
@@ -419,16 +474,41 @@ type accessTokenVolatileRepository struct {
 	data map[string]*domain.AccessToken
 }
 
-func (a *accessTokenVolatileRepository) Create(accessToken *domain.AccessToken) error {
+func (a *accessTokenVolatileRepository) Create(ctx context.Context, accessToken *domain.AccessToken) error {
 	a.data[accessToken.Value] = accessToken
 	return nil
 }
 
-func (a *accessTokenVolatileRepository) Find(accessToken string) (*domain.AccessToken, error) {
+func (a *accessTokenVolatileRepository) Find(ctx context.Context, accessToken string) (*domain.AccessToken, error) {
 	token := a.data[accessToken]
 	return token, nil
 }
 
+func (a *accessTokenVolatileRepository) DeleteExpiredBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	deleted := 0
+	for value, token := range a.data {
+		if deleted == limit {
+			break
+		}
+		if token.Expires.Before(before) {
+			delete(a.data, value)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (a *accessTokenVolatileRepository) DeleteByUserIdAndClientId(ctx context.Context, userId, clientId string) (int, error) {
+	deleted := 0
+	for value, token := range a.data {
+		if token.UserId == userId && token.ClientId == clientId {
+			delete(a.data, value)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
 func NewAccessTokenVolatileRepository() *accessTokenVolatileRepository {
 	return &accessTokenVolatileRepository{
 		data: map[string]*domain.AccessToken{
@@ -441,7 +521,7 @@ func NewAccessTokenVolatileRepository() *accessTokenVolatileRepository {
 type userClaimVolatileRepository struct {
 }
 
-func (u *userClaimVolatileRepository) GetUserClaims(userId, scopes string) (map[string]interface{}, error) {
+func (u *userClaimVolatileRepository) GetUserClaims(ctx context.Context, userId, scopes string) (map[string]interface{}, error) {
 	return map[string]interface{}{}, nil
 }
 
@@ -1,12 +1,13 @@
 package go_ciba
 
 import (
+	"context"
 	"github.com/adisazhar123/go-ciba/service"
 	"github.com/adisazhar123/go-ciba/util"
 )
 
 type TokenServerInterface interface {
-	HandleTokenRequest(request *service.TokenRequest) (*service.TokenResponse, *util.OidcError)
+	HandleTokenRequest(ctx context.Context, request *service.TokenRequest) (*service.TokenResponse, *util.OidcError)
 }
 
 type tokenServer struct {
@@ -17,6 +18,6 @@ func NewTokenServer(service service.TokenServiceInterface) *tokenServer {
 	return &tokenServer{service: service}
 }
 
-func (t *tokenServer) HandleTokenRequest(request *service.TokenRequest) (*service.TokenResponse, *util.OidcError) {
-	return t.service.HandleTokenRequest(request)
+func (t *tokenServer) HandleTokenRequest(ctx context.Context, request *service.TokenRequest) (*service.TokenResponse, *util.OidcError) {
+	return t.service.HandleTokenRequest(ctx, request)
 }
@@ -0,0 +1,77 @@
+package go_ciba
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/util"
+)
+
+type userGrantsResponse struct {
+	Grants []*domain.Grant `json:"grants"`
+}
+
+// The API users manage their grants with. GET lists the active grants of the authenticated user,
+// and DELETE revokes the one of the client_id query parameter along with its access tokens.
+type userGrantHandler struct {
+	grantService  service.UserGrantServiceInterface
+	authenticator UserSessionAuthenticator
+}
+
+func NewUserGrantHandler(grantService service.UserGrantServiceInterface, authenticator UserSessionAuthenticator) *userGrantHandler {
+	return &userGrantHandler{
+		grantService:  grantService,
+		authenticator: authenticator,
+	}
+}
+
+func (h *userGrantHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	userId, err := h.authenticator.AuthenticateUser(r)
+	if err != nil || userId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		grants, oidcErr := h.grantService.FindGrants(r.Context(), userId)
+		if oidcErr != nil {
+			h.writeJson(w, oidcErr.Code, oidcErr)
+			return
+		}
+		if grants == nil {
+			grants = []*domain.Grant{}
+		}
+		h.writeJson(w, http.StatusOK, &userGrantsResponse{Grants: grants})
+		return
+	}
+
+	// Browsers send DELETE across origins only after a preflight, so session cookies can't be
+	// used by other sites to revoke grants.
+	clientId := r.URL.Query().Get("client_id")
+	if clientId == "" {
+		h.writeJson(w, util.ErrInvalidRequest.Code, util.ErrInvalidRequest)
+		return
+	}
+	if oidcErr := h.grantService.RevokeGrant(r.Context(), userId, clientId); oidcErr != nil {
+		h.writeJson(w, oidcErr.Code, oidcErr)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userGrantHandler) writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[go-ciba][usergranthandler] failed writing response. %s\n", err.Error())
+	}
+}
@@ -0,0 +1,70 @@
+package go_ciba
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adisazhar123/go-ciba/domain"
+	"github.com/adisazhar123/go-ciba/repository/memory"
+	"github.com/adisazhar123/go-ciba/service"
+	"github.com/adisazhar123/go-ciba/test_data"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUserGrantHandler() (*userGrantHandler, *memory.DataStore) {
+	ds := memory.NewDataStore()
+	_ = ds.GetGrantRepository().Create(context.Background(), domain.NewGrant(test_data.User1.Id, test_data.ClientAppPoll.Id, "openid email", time.Now().UTC()))
+	return NewUserGrantHandler(service.NewUserGrantService(ds), &headerAuthenticator{}), ds
+}
+
+func serveUserGrants(h http.Handler, method, target, userId string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("X-User", userId)
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func TestUserGrantHandler_Get_ShouldListGrantsOfUser(t *testing.T) {
+	h, _ := newTestUserGrantHandler()
+
+	res := serveUserGrants(h, http.MethodGet, "/grants", test_data.User1.Id)
+	otherRes := serveUserGrants(h, http.MethodGet, "/grants", test_data.User2.Id)
+	body := &userGrantsResponse{}
+	_ = json.NewDecoder(res.Body).Decode(body)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	if assert.Len(t, body.Grants, 1) {
+		assert.Equal(t, test_data.ClientAppPoll.Id, body.Grants[0].ClientId)
+		assert.Equal(t, "openid email", body.Grants[0].Scope)
+	}
+	assert.JSONEq(t, `{"grants":[]}`, otherRes.Body.String())
+}
+
+func TestUserGrantHandler_Delete_ShouldRevokeGrantOfUser(t *testing.T) {
+	h, ds := newTestUserGrantHandler()
+
+	otherRes := serveUserGrants(h, http.MethodDelete, "/grants?client_id="+test_data.ClientAppPoll.Id, test_data.User2.Id)
+	missingRes := serveUserGrants(h, http.MethodDelete, "/grants", test_data.User1.Id)
+	res := serveUserGrants(h, http.MethodDelete, "/grants?client_id="+test_data.ClientAppPoll.Id, test_data.User1.Id)
+	stored, _ := ds.GetGrantRepository().FindByUserIdAndClientId(context.Background(), test_data.User1.Id, test_data.ClientAppPoll.Id)
+
+	assert.Equal(t, http.StatusBadRequest, otherRes.Code)
+	assert.Equal(t, http.StatusBadRequest, missingRes.Code)
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.False(t, stored.IsActive())
+}
+
+func TestUserGrantHandler_ShouldRejectUnauthenticatedRequests(t *testing.T) {
+	h, _ := newTestUserGrantHandler()
+
+	res := serveUserGrants(h, http.MethodGet, "/grants", "")
+	postRes := serveUserGrants(h, http.MethodPost, "/grants", test_data.User1.Id)
+
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, postRes.Code)
+}
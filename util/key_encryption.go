@@ -0,0 +1,119 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Prefix of the private keys sealed by SealPrivateKey, telling them apart from the ones stored in plaintext.
+const sealedPrivateKeyPrefix = "enc:"
+
+// Encrypts private keys before they're stored, and decrypts them once they're read. The additional data
+// is authenticated along with the ciphertext, decrypting fails unless it's the same as when encrypting.
+type KeyEncryptionProvider interface {
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// Encrypts with AES-GCM under a master key held by the server.
+type localKeyEncryptionProvider struct {
+	aead cipher.AEAD
+}
+
+// Creates a provider encrypting with the given master key, which must be 32 bytes long.
+func NewLocalKeyEncryptionProvider(masterKey []byte) (*localKeyEncryptionProvider, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes long, got %d", len(masterKey))
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &localKeyEncryptionProvider{aead: aead}, nil
+}
+
+// Creates a provider encrypting with the base64 encoded master key stored in the given file.
+func NewLocalKeyEncryptionProviderFromFile(path string) (*localKeyEncryptionProvider, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalKeyEncryptionProviderFromBase64(string(encoded))
+}
+
+// Creates a provider encrypting with the base64 encoded master key held by the given environment variable.
+func NewLocalKeyEncryptionProviderFromEnv(name string) (*localKeyEncryptionProvider, error) {
+	encoded, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return newLocalKeyEncryptionProviderFromBase64(encoded)
+}
+
+func newLocalKeyEncryptionProviderFromBase64(encoded string) (*localKeyEncryptionProvider, error) {
+	masterKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	return NewLocalKeyEncryptionProvider(masterKey)
+}
+
+// Returns a random nonce followed by the sealed plaintext.
+func (l *localKeyEncryptionProvider) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, l.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return l.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (l *localKeyEncryptionProvider) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < l.aead.NonceSize() {
+		return nil, errors.New("ciphertext is shorter than the nonce")
+	}
+	nonce, sealed := ciphertext[:l.aead.NonceSize()], ciphertext[l.aead.NonceSize():]
+	return l.aead.Open(nil, nonce, sealed, additionalData)
+}
+
+func IsSealedPrivateKey(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrivateKeyPrefix)
+}
+
+// Encrypts the PEM encoded private key of the key with the given ID with provider, into the form it's stored in.
+// The ID is bound to the ciphertext, so a private key copied over to another key can't be opened.
+func SealPrivateKey(provider KeyEncryptionProvider, keyId, private string) (string, error) {
+	ciphertext, err := provider.Encrypt([]byte(private), []byte(keyId))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrivateKeyPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypts a private key sealed by SealPrivateKey for the key with the given ID. Private keys stored in plaintext
+// are returned as is.
+func OpenPrivateKey(provider KeyEncryptionProvider, keyId, stored string) (string, error) {
+	if !IsSealedPrivateKey(stored) {
+		return stored, nil
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrivateKeyPrefix))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := provider.Decrypt(ciphertext, []byte(keyId))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
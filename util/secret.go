@@ -0,0 +1,30 @@
+package util
+
+import (
+	"crypto/subtle"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Returns the salted bcrypt hash of a client secret.
+func HashSecret(secret string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func IsHashedSecret(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// Reports whether secret matches the stored one, in constant time. Secrets stored before
+// they were hashed are compared as plaintext.
+func CompareSecret(stored, secret string) bool {
+	if IsHashedSecret(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(secret)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(secret)) == 1
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashSecret_ShouldBeSalted(t *testing.T) {
+	first, err := HashSecret("secret")
+	second, _ := HashSecret("secret")
+
+	assert.NoError(t, err)
+	assert.True(t, IsHashedSecret(first))
+	assert.NotEqual(t, first, second)
+}
+
+func TestCompareSecret_ShouldCompareHashedSecret(t *testing.T) {
+	hashed, _ := HashSecret("secret")
+
+	assert.True(t, CompareSecret(hashed, "secret"))
+	assert.False(t, CompareSecret(hashed, "wrong-secret"))
+	assert.False(t, CompareSecret(hashed, hashed))
+}
+
+func TestCompareSecret_ShouldComparePlaintextSecret_WhenSecretIsNotHashed(t *testing.T) {
+	assert.False(t, IsHashedSecret("secret"))
+	assert.True(t, CompareSecret("secret", "secret"))
+	assert.False(t, CompareSecret("secret", "wrong-secret"))
+}